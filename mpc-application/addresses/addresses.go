@@ -0,0 +1,218 @@
+package addresses
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/btcutil/base58"
+	"github.com/btcsuite/btcd/btcutil/bech32"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// Address is the representation of a public key on one chain. Derivation
+// describes how it is computed from the key.
+type Address struct {
+	Chain      string `json:"chain"`
+	Network    string `json:"network,omitempty"`
+	Type       string `json:"type"`
+	Address    string `json:"address"`
+	Derivation string `json:"derivation"`
+}
+
+// Encoder returns the addresses of a compressed secp256k1 public key on one
+// chain.
+type Encoder func(publicKey []byte) ([]Address, error)
+
+var encoders = make(map[string]Encoder)
+var encodersMtx sync.Mutex
+
+func init() {
+	Register("ethereum", encodeEthereum)
+	Register("bitcoin", encodeBitcoin)
+	Register("tron", encodeTron)
+}
+
+// Register adds the encoder of a chain, replacing an encoder of the same
+// name.
+func Register(chain string, encoder Encoder) {
+	encodersMtx.Lock()
+	defer encodersMtx.Unlock()
+	encoders[chain] = encoder
+}
+
+// Derive returns the addresses of the public key on all registered chains,
+// sorted by chain. The key may be compressed or uncompressed.
+func Derive(publicKey []byte) ([]Address, error) {
+	compressed, err := compress(publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	encodersMtx.Lock()
+	names := make([]string, 0, len(encoders))
+	for name := range encoders {
+		names = append(names, name)
+	}
+	encodersMtx.Unlock()
+	sort.Strings(names)
+
+	res := make([]Address, 0)
+	for _, name := range names {
+		encodersMtx.Lock()
+		encoder := encoders[name]
+		encodersMtx.Unlock()
+		addresses, err := encoder(compressed)
+		if err != nil {
+			return nil, errors.New(name + ": " + err.Error())
+		}
+		res = append(res, addresses...)
+	}
+	return res, nil
+}
+
+func compress(publicKey []byte) ([]byte, error) {
+	switch len(publicKey) {
+	case 33:
+		if _, err := crypto.DecompressPubkey(publicKey); err != nil {
+			return nil, err
+		}
+		return publicKey, nil
+	case 65:
+		key, err := crypto.UnmarshalPubkey(publicKey)
+		if err != nil {
+			return nil, err
+		}
+		return crypto.CompressPubkey(key), nil
+	}
+	return nil, errors.New("invalid public key length")
+}
+
+// keccakAddress is the 20-byte account of Ethereum and Tron.
+func keccakAddress(publicKey []byte) ([]byte, error) {
+	key, err := crypto.DecompressPubkey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	return crypto.PubkeyToAddress(*key).Bytes(), nil
+}
+
+func encodeEthereum(publicKey []byte) ([]Address, error) {
+	key, err := crypto.DecompressPubkey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	return []Address{{
+		Chain:      "ethereum",
+		Type:       "eoa",
+		Address:    crypto.PubkeyToAddress(*key).Hex(),
+		Derivation: "keccak256(uncompressed key without 0x04)[12:], EIP-55 checksum",
+	}}, nil
+}
+
+// EVM returns an encoder for an EVM chain with the chain ID, which shares
+// the account of Ethereum.
+func EVM(chain string, chainID uint64) Encoder {
+	return func(publicKey []byte) ([]Address, error) {
+		key, err := crypto.DecompressPubkey(publicKey)
+		if err != nil {
+			return nil, err
+		}
+		return []Address{{
+			Chain:      chain,
+			Network:    strconv.FormatUint(chainID, 10),
+			Type:       "eoa",
+			Address:    crypto.PubkeyToAddress(*key).Hex(),
+			Derivation: "same as ethereum, EVM chain ID " + strconv.FormatUint(chainID, 10),
+		}}, nil
+	}
+}
+
+var bitcoinNetworks = []struct {
+	name   string
+	params *chaincfg.Params
+}{
+	{"mainnet", &chaincfg.MainNetParams},
+	{"testnet", &chaincfg.TestNet3Params},
+	{"regtest", &chaincfg.RegressionNetParams},
+}
+
+func encodeBitcoin(publicKey []byte) ([]Address, error) {
+	res := make([]Address, 0, 2*len(bitcoinNetworks))
+	for _, network := range bitcoinNetworks {
+		p2pkh, err := btcutil.NewAddressPubKeyHash(btcutil.Hash160(publicKey), network.params)
+		if err != nil {
+			return nil, err
+		}
+		p2wpkh, err := btcutil.NewAddressWitnessPubKeyHash(btcutil.Hash160(publicKey), network.params)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, Address{
+			Chain:      "bitcoin",
+			Network:    network.name,
+			Type:       "p2pkh",
+			Address:    p2pkh.EncodeAddress(),
+			Derivation: "base58check(version ‖ ripemd160(sha256(compressed key)))",
+		}, Address{
+			Chain:      "bitcoin",
+			Network:    network.name,
+			Type:       "p2wpkh",
+			Address:    p2wpkh.EncodeAddress(),
+			Derivation: "bech32(" + network.params.Bech32HRPSegwit + ", 0, ripemd160(sha256(compressed key)))",
+		})
+	}
+	return res, nil
+}
+
+// tronVersion prefixes Tron mainnet addresses.
+const tronVersion = 0x41
+
+func encodeTron(publicKey []byte) ([]Address, error) {
+	account, err := keccakAddress(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	return []Address{{
+		Chain:      "tron",
+		Type:       "account",
+		Address:    base58.CheckEncode(account, tronVersion),
+		Derivation: "base58check(0x41 ‖ keccak256(uncompressed key without 0x04)[12:])",
+	}}, nil
+}
+
+// Cosmos returns an encoder for a Cosmos SDK chain with the bech32 prefix
+// hrp, e.g. cosmos or osmo.
+func Cosmos(hrp string) Encoder {
+	return func(publicKey []byte) ([]Address, error) {
+		data, err := bech32.ConvertBits(btcutil.Hash160(publicKey), 8, 5, true)
+		if err != nil {
+			return nil, err
+		}
+		address, err := bech32.Encode(hrp, data)
+		if err != nil {
+			return nil, err
+		}
+		return []Address{{
+			Chain:      "cosmos",
+			Network:    hrp,
+			Type:       "account",
+			Address:    address,
+			Derivation: "bech32(" + hrp + ", ripemd160(sha256(compressed key)))",
+		}}, nil
+	}
+}
+
+// RegisterCosmos registers an encoder for every bech32 prefix in the comma
+// separated list.
+func RegisterCosmos(prefixes string) {
+	for _, hrp := range strings.Split(prefixes, ",") {
+		if hrp = strings.ToLower(strings.TrimSpace(hrp)); hrp != "" {
+			Register("cosmos/"+hrp, Cosmos(hrp))
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package addresses
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+// generator is the compressed public key of private key 1, the key of the
+// BIP-173 P2WPKH example.
+const generator = "0279be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798"
+
+func TestKnownVectors(t *testing.T) {
+	publicKey, _ := hex.DecodeString(generator)
+	Register("cosmos/cosmos", Cosmos("cosmos"))
+	Register("evm/polygon", EVM("polygon", 137))
+	list, err := Derive(publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"ethereum eoa":           "0x7E5F4552091A69125d5DfCb7b8C2659029395Bdf",
+		"polygon 137 eoa":        "0x7E5F4552091A69125d5DfCb7b8C2659029395Bdf",
+		"bitcoin mainnet p2pkh":  "1BgGZ9tcN4rm9KBzDn7KprQz87SZ26SAMH",
+		"bitcoin mainnet p2wpkh": "bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4",
+		"bitcoin testnet p2pkh":  "mrCDrCybB6J1vRfbwM5hemdJz73FwDBC8r",
+		"bitcoin testnet p2wpkh": "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx",
+		"bitcoin regtest p2wpkh": "bcrt1qw508d6qejxtdg4y5r3zarvary0c5xw7kygt080",
+		"tron account":           "TMVQGm1qAQYVdetCeGRRkTWYYrLXuHK2HC",
+		"cosmos cosmos account":  "cosmos1w508d6qejxtdg4y5r3zarvary0c5xw7k6ah60c",
+	}
+	got := make(map[string]string)
+	for _, a := range list {
+		key := a.Chain + " " + a.Type
+		if a.Network != "" {
+			key = a.Chain + " " + a.Network + " " + a.Type
+		}
+		got[key] = a.Address
+	}
+	for key, address := range want {
+		if got[key] != address {
+			t.Errorf("%s: got %q, want %s", key, got[key], address)
+		}
+	}
+}
+
+// An uncompressed key has the same addresses as its compressed form.
+func TestUncompressedKey(t *testing.T) {
+	compressed, _ := hex.DecodeString(generator)
+	uncompressed, _ := hex.DecodeString("0479be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798483ada7726a3c4655da4fbfc0e1108a8fd17b448a68554199c47d08ffb10d4b8")
+	a, err := Derive(compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := Derive(uncompressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(a) != len(b) {
+		t.Fatalf("%d addresses of the compressed key, %d of the uncompressed one", len(a), len(b))
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			t.Errorf("%+v != %+v", a[i], b[i])
+		}
+	}
+	if _, err = Derive(compressed[1:]); err == nil {
+		t.Error("key of invalid length accepted")
+	}
+}
@@ -0,0 +1,276 @@
+package audit
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"mpc_poc/helper"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/joho/godotenv"
+)
+
+// Checkpoint is the event of entries that sign the chain up to them.
+const Checkpoint = "checkpoint"
+
+// Entry is one record of the audit log of a node. Approver is the operator
+// who decided on a request, Result what became of it. Every entry holds the
+// hash of the one before it, checkpoints are signed by the node key.
+type Entry struct {
+	Seq       uint64          `json:"seq"`
+	Time      time.Time       `json:"time"`
+	Node      string          `json:"node"`
+	Event     string          `json:"event"`
+	Protocol  string          `json:"protocol,omitempty"`
+	Address   string          `json:"address,omitempty"`
+	SessionID string          `json:"sessionId,omitempty"`
+	Digest    string          `json:"digest,omitempty"`
+	Summary   string          `json:"summary,omitempty"`
+	Payload   json.RawMessage `json:"payload,omitempty"`
+	Requester string          `json:"requester,omitempty"`
+	Approver  string          `json:"approver,omitempty"`
+	Result    string          `json:"result,omitempty"`
+	Reason    string          `json:"reason,omitempty"`
+	Signer    string          `json:"signer,omitempty"`
+	Signature string          `json:"signature,omitempty"`
+	PrevHash  string          `json:"prevHash"`
+	Hash      string          `json:"hash"`
+}
+
+var node string
+var key *ecdsa.PrivateKey
+var last Entry
+var sinceCheckpoint int
+var fileMtx sync.Mutex
+var loadOnce sync.Once
+
+// Init sets the node whose log is written and loads its key from
+// AUDIT_KEY_FILE, audit-<node>.key by default. The key has to be provisioned
+// like the message key, a log signed by a key created on the fly proves
+// nothing.
+func Init(id string) error {
+	_ = godotenv.Load()
+	node = id
+	nodeKey, err := crypto.LoadECDSA(keyPath())
+	if err != nil {
+		return errors.New("no audit key in " + keyPath() + ": " + err.Error())
+	}
+	fileMtx.Lock()
+	key = nodeKey
+	fileMtx.Unlock()
+	log.Printf("audit: node %s signs checkpoints with %s\n", id, crypto.PubkeyToAddress(nodeKey.PublicKey).Hex())
+	return nil
+}
+
+func path() string {
+	return helper.GetEnv("AUDIT_FILE", "audit-"+node+".log")
+}
+
+func keyPath() string {
+	return helper.GetEnv("AUDIT_KEY_FILE", "audit-"+node+".key")
+}
+
+func checkpointInterval() int {
+	interval, err := strconv.Atoi(helper.GetEnv("AUDIT_CHECKPOINT_INTERVAL", "100"))
+	if err != nil || interval <= 0 {
+		return 100
+	}
+	return interval
+}
+
+// hash is the Keccak-256 hash of the entry without its hash and signature.
+func (e Entry) hash() common.Hash {
+	e.Hash = ""
+	e.Signature = ""
+	data, _ := json.Marshal(e)
+	return crypto.Keccak256Hash(data)
+}
+
+// load continues the chain of the log. A log that was written before signs a
+// checkpoint, so later edits of older entries are detected. fileMtx must be
+// held.
+func load() {
+	loadOnce.Do(func() {
+		if key == nil {
+			log.Printf("audit: no node key, checkpoints are not signed\n")
+		}
+
+		file, err := os.Open(path())
+		if err != nil {
+			return
+		}
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 1024*1024), 16*1024*1024)
+		for scanner.Scan() {
+			var e Entry
+			if json.Unmarshal(scanner.Bytes(), &e) == nil {
+				last = e
+			}
+		}
+		if last.Seq > 0 && last.Event != Checkpoint {
+			write(Entry{Event: Checkpoint, Reason: "restart"})
+		}
+	})
+}
+
+// write chains, hashes and appends the entry. fileMtx must be held.
+func write(entry Entry) {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now().UTC()
+	}
+	entry.Node = node
+	entry.Seq = last.Seq + 1
+	entry.PrevHash = last.Hash
+	if entry.Event == Checkpoint && key != nil {
+		entry.Signer = crypto.PubkeyToAddress(key.PublicKey).Hex()
+	}
+	hash := entry.hash()
+	entry.Hash = hash.Hex()
+	if entry.Event == Checkpoint && key != nil {
+		sig, err := crypto.Sign(hash.Bytes(), key)
+		if err == nil {
+			entry.Signature = hexutil.Encode(sig)
+		}
+	}
+	data, _ := json.Marshal(entry)
+
+	file, err := os.OpenFile(path(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Printf("audit: failed to open %s: %v\n", path(), err)
+		return
+	}
+	defer file.Close()
+	if _, err = file.Write(append(data, '\n')); err != nil {
+		log.Printf("audit: failed to write %s: %v\n", path(), err)
+		return
+	}
+	last = entry
+	if entry.Event == Checkpoint {
+		sinceCheckpoint = 0
+	} else {
+		sinceCheckpoint++
+	}
+}
+
+// Append writes the entry as a JSON line to AUDIT_FILE, audit-<node>.log by
+// default, and a checkpoint every AUDIT_CHECKPOINT_INTERVAL entries.
+func Append(entry Entry) {
+	fileMtx.Lock()
+	defer fileMtx.Unlock()
+	load()
+	write(entry)
+	if sinceCheckpoint >= checkpointInterval() {
+		write(Entry{Event: Checkpoint})
+	}
+}
+
+// Export returns the log with a checkpoint of its current end, so an export
+// can be verified completely.
+func Export() ([]Entry, error) {
+	fileMtx.Lock()
+	defer fileMtx.Unlock()
+	load()
+	if last.Seq > 0 && last.Event != Checkpoint {
+		write(Entry{Event: Checkpoint, Reason: "export"})
+	}
+	file, err := os.Open(path())
+	if errors.Is(err, os.ErrNotExist) {
+		return make([]Entry, 0), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return Read(file)
+}
+
+// Read parses a log of JSON lines.
+func Read(r io.Reader) ([]Entry, error) {
+	res := make([]Entry, 0)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 1024*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var e Entry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, errors.New("line " + strconv.Itoa(line) + ": " + err.Error())
+		}
+		res = append(res, e)
+	}
+	return res, scanner.Err()
+}
+
+// Report is the result of verifying a log. Unsigned counts the entries after
+// the last checkpoint, which could be removed without being detected.
+type Report struct {
+	Entries        int    `json:"entries"`
+	Checkpoints    int    `json:"checkpoints"`
+	LastCheckpoint uint64 `json:"lastCheckpoint"`
+	Unsigned       int    `json:"unsigned"`
+	Signer         string `json:"signer,omitempty"`
+}
+
+// Verify checks that the entries start at the beginning of the log, follow
+// each other without gaps, are unchanged and that every checkpoint is signed
+// by the same key, signer if given. The first problem is returned as error.
+func Verify(entries []Entry, signer string) (Report, error) {
+	report := Report{Entries: len(entries)}
+	if signer != "" {
+		if !common.IsHexAddress(signer) {
+			return report, errors.New("invalid signer: " + signer)
+		}
+		report.Signer = common.HexToAddress(signer).Hex()
+	}
+	prev := Entry{}
+	for i, e := range entries {
+		at := "entry " + strconv.FormatUint(e.Seq, 10)
+		if e.Seq != prev.Seq+1 {
+			return report, errors.New(at + " follows entry " + strconv.FormatUint(prev.Seq, 10) + ", entries are missing or reordered")
+		}
+		if e.PrevHash != prev.Hash {
+			return report, errors.New(at + " doesn't chain to the entry before it, entries were removed or changed")
+		}
+		hash := e.hash()
+		if e.Hash != hash.Hex() {
+			return report, errors.New(at + " was changed, its hash is " + hash.Hex() + " instead of " + e.Hash)
+		}
+		if i > 0 && e.Node != prev.Node {
+			return report, errors.New(at + " is of node " + e.Node + " instead of " + prev.Node)
+		}
+		if e.Event == Checkpoint {
+			sig, err := hexutil.Decode(e.Signature)
+			if err != nil || len(sig) != crypto.SignatureLength {
+				return report, errors.New(at + " is an unsigned checkpoint")
+			}
+			publicKey, err := crypto.SigToPub(hash.Bytes(), sig)
+			if err != nil || crypto.PubkeyToAddress(*publicKey) != common.HexToAddress(e.Signer) {
+				return report, errors.New(at + " is a checkpoint with an invalid signature")
+			}
+			if report.Signer == "" {
+				report.Signer = common.HexToAddress(e.Signer).Hex()
+			} else if common.HexToAddress(e.Signer).Hex() != report.Signer {
+				return report, errors.New(at + " is a checkpoint signed by " + e.Signer + " instead of " + report.Signer)
+			}
+			report.Checkpoints++
+			report.LastCheckpoint = e.Seq
+			report.Unsigned = 0
+		} else {
+			report.Unsigned++
+		}
+		prev = e
+	}
+	return report, nil
+}
@@ -0,0 +1,50 @@
+package audit
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// The node key is provisioned, Init doesn't create one.
+func TestInitNeedsProvisionedKey(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("AUDIT_FILE", filepath.Join(dir, "audit-a.log"))
+	t.Setenv("AUDIT_KEY_FILE", filepath.Join(dir, "audit-a.key"))
+	if err := Init("a"); err == nil {
+		t.Fatal("Init succeeded without a key")
+	}
+	if _, err := crypto.LoadECDSA(filepath.Join(dir, "audit-a.key")); err == nil {
+		t.Fatal("Init created a key")
+	}
+
+	nodeKey, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = crypto.SaveECDSA(filepath.Join(dir, "audit-a.key"), nodeKey); err != nil {
+		t.Fatal(err)
+	}
+	if err = Init("a"); err != nil {
+		t.Fatal(err)
+	}
+	Append(Entry{Event: "sign", Result: "signed"})
+	entries, err := Export()
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer := crypto.PubkeyToAddress(nodeKey.PublicKey).Hex()
+	report, err := Verify(entries, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Checkpoints != 1 || report.Signer != signer {
+		t.Errorf("%d checkpoints signed by %s, want 1 by %s", report.Checkpoints, report.Signer, signer)
+	}
+
+	other, _ := crypto.GenerateKey()
+	if _, err = Verify(entries, crypto.PubkeyToAddress(other.PublicKey).Hex()); err == nil {
+		t.Error("checkpoint accepted for another signer")
+	}
+}
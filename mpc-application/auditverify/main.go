@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io"
+	"log"
+	"os"
+
+	"mpc_poc/audit"
+)
+
+// read parses an audit log file or an export of GET /audit, - is stdin.
+func read(file string) ([]audit.Entry, error) {
+	var data []byte
+	var err error
+	if file == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(file)
+	}
+	if err != nil {
+		return nil, err
+	}
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		var entries []audit.Entry
+		err = json.Unmarshal(trimmed, &entries)
+		return entries, err
+	}
+	return audit.Read(bytes.NewReader(data))
+}
+
+func main() {
+	log.SetFlags(0)
+	signer := flag.String("signer", "", "address of the node key that must have signed the checkpoints, required")
+	flag.Usage = func() {
+		log.Printf("usage: %s -signer address <audit log or export, - for stdin>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	// trusting the key of the first checkpoint would accept a log rewritten
+	// and signed with another key
+	if flag.NArg() != 1 || *signer == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	entries, err := read(flag.Arg(0))
+	if err != nil {
+		log.Fatalf("failed to read %s: %v\n", flag.Arg(0), err)
+	}
+	report, err := audit.Verify(entries, *signer)
+	if err != nil {
+		log.Printf("invalid: %v\n", err)
+		os.Exit(1)
+	}
+	if report.Checkpoints == 0 {
+		log.Printf("valid chain of %d entries without checkpoints, it could have been rewritten as a whole\n", report.Entries)
+		return
+	}
+	log.Printf("valid: %d entries, %d checkpoints signed by %s\n", report.Entries, report.Checkpoints, report.Signer)
+	if report.Unsigned > 0 {
+		log.Printf("warning: the last %d entries follow checkpoint %d, removing them wouldn't be detected\n", report.Unsigned, report.LastCheckpoint)
+	}
+}
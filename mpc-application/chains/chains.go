@@ -0,0 +1,254 @@
+package chains
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"math/big"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"mpc_poc/helper"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/joho/godotenv"
+)
+
+// Backend is what the service needs from a chain. Both *ethclient.Client and
+// the go-ethereum simulated backend implement it.
+type Backend interface {
+	ethereum.ContractCaller
+	ethereum.GasEstimator
+	ethereum.GasPricer
+	ethereum.TransactionReader
+	ethereum.TransactionSender
+	HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error)
+	BalanceAt(ctx context.Context, account common.Address, blockNumber *big.Int) (*big.Int, error)
+	NonceAt(ctx context.Context, account common.Address, blockNumber *big.Int) (uint64, error)
+	PendingCodeAt(ctx context.Context, account common.Address) ([]byte, error)
+	PendingNonceAt(ctx context.Context, account common.Address) (uint64, error)
+	SuggestGasTipCap(ctx context.Context) (*big.Int, error)
+}
+
+type NativeCurrency struct {
+	Name     string `json:"name"`
+	Symbol   string `json:"symbol"`
+	Decimals uint8  `json:"decimals"`
+}
+
+// Explorer holds URL templates, {hash} and {address} are replaced.
+type Explorer struct {
+	Tx      string `json:"tx"`
+	Address string `json:"address"`
+}
+
+type Chain struct {
+	Name           string         `json:"name"`
+	ChainID        uint64         `json:"chainId"`
+	RPCURLs        []string       `json:"rpcUrls"`
+	NativeCurrency NativeCurrency `json:"nativeCurrency"`
+	Explorer       Explorer       `json:"explorer"`
+	MaxFeePerGas   string         `json:"maxFeePerGas,omitempty"`
+	Confirmations  uint64         `json:"confirmations,omitempty"`
+	BundlerURL     string         `json:"bundlerUrl,omitempty"`
+
+	backend Backend
+	client  *ethclient.Client
+}
+
+// ChainInfo is the public part of a chain, the RPC URLs may contain API keys.
+type ChainInfo struct {
+	Name           string         `json:"name"`
+	ChainID        uint64         `json:"chainId"`
+	NativeCurrency NativeCurrency `json:"nativeCurrency"`
+	Explorer       Explorer       `json:"explorer"`
+	MaxFeePerGas   string         `json:"maxFeePerGas,omitempty"`
+	Confirmations  uint64         `json:"confirmations"`
+	Default        bool           `json:"default"`
+}
+
+type Config struct {
+	Default string   `json:"default"`
+	Chains  []*Chain `json:"chains"`
+}
+
+// defaultConfirmations is how many blocks a transaction needs to be
+// considered final on chains that don't configure it.
+const defaultConfirmations = 12
+
+var config Config
+var configErr error
+var configOnce sync.Once
+var mtx sync.Mutex
+
+// load reads the registry from CHAINS_CONFIG, chains.json by default.
+// Environment variables in the RPC URLs are expanded, so keys can be kept
+// out of the file.
+func load() error {
+	configOnce.Do(func() {
+		_ = godotenv.Load()
+		path := helper.GetEnv("CHAINS_CONFIG", "chains.json")
+		data, err := os.ReadFile(path)
+		if err != nil {
+			configErr = err
+			log.Printf("chains: failed to load %s: %v\n", path, err)
+			return
+		}
+		if err = json.Unmarshal(data, &config); err != nil {
+			configErr = err
+			log.Printf("chains: failed to parse %s: %v\n", path, err)
+			return
+		}
+		for _, chain := range config.Chains {
+			if chain.Name == "" || chain.ChainID == 0 || len(chain.RPCURLs) == 0 {
+				configErr = errors.New("chain " + chain.Name + " needs a name, a chain ID and RPC URLs")
+				return
+			}
+			for i, url := range chain.RPCURLs {
+				chain.RPCURLs[i] = os.ExpandEnv(url)
+			}
+			chain.BundlerURL = os.ExpandEnv(chain.BundlerURL)
+			if chain.Confirmations == 0 {
+				chain.Confirmations = defaultConfirmations
+			}
+		}
+		if config.Default == "" && len(config.Chains) > 0 {
+			config.Default = config.Chains[0].Name
+		}
+	})
+	return configErr
+}
+
+// Get returns the chain by name or chain ID, an empty name selects the
+// default chain.
+func Get(name string) (*Chain, error) {
+	if err := load(); err != nil {
+		return nil, err
+	}
+	if name == "" {
+		name = config.Default
+	}
+	for _, chain := range config.Chains {
+		if strings.EqualFold(chain.Name, name) || strconv.FormatUint(chain.ChainID, 10) == name {
+			return chain, nil
+		}
+	}
+	return nil, errors.New("unknown chain: " + name)
+}
+
+func List() ([]ChainInfo, error) {
+	if err := load(); err != nil {
+		return nil, err
+	}
+	res := make([]ChainInfo, 0, len(config.Chains))
+	for _, chain := range config.Chains {
+		res = append(res, ChainInfo{
+			Name:           chain.Name,
+			ChainID:        chain.ChainID,
+			NativeCurrency: chain.NativeCurrency,
+			Explorer:       chain.Explorer,
+			MaxFeePerGas:   chain.MaxFeePerGas,
+			Confirmations:  chain.Confirmations,
+			Default:        chain.Name == config.Default,
+		})
+	}
+	return res, nil
+}
+
+// SetBackend makes the chain use the given backend instead of its RPC URLs,
+// e.g. a simulated backend.
+func (c *Chain) SetBackend(backend Backend) {
+	mtx.Lock()
+	defer mtx.Unlock()
+	c.backend = backend
+}
+
+func (c *Chain) ID() *big.Int {
+	return new(big.Int).SetUint64(c.ChainID)
+}
+
+// Backend returns the client of the chain. The RPC URLs are dialed in order
+// on first use and the first one that answers with the configured chain ID
+// is kept for all later calls.
+func (c *Chain) Backend(ctx context.Context) (Backend, error) {
+	mtx.Lock()
+	if c.backend != nil {
+		defer mtx.Unlock()
+		return c.backend, nil
+	}
+	if c.client != nil {
+		defer mtx.Unlock()
+		return c.client, nil
+	}
+	mtx.Unlock()
+
+	client, err := c.Dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	mtx.Lock()
+	defer mtx.Unlock()
+	if c.client != nil {
+		// dialed concurrently, keep the first client
+		client.Close()
+		return c.client, nil
+	}
+	c.client = ethclient.NewClient(client)
+	return c.client, nil
+}
+
+// Close closes the client of the chain, the next call of Backend dials
+// again.
+func (c *Chain) Close() {
+	mtx.Lock()
+	defer mtx.Unlock()
+	if c.client != nil {
+		c.client.Close()
+		c.client = nil
+	}
+}
+
+// Dial returns a raw RPC client of the first URL that answers with the
+// configured chain ID. URLs are logged by index as they may contain API keys.
+func (c *Chain) Dial(ctx context.Context) (*rpc.Client, error) {
+	err := errors.New("no RPC URLs configured for " + c.Name)
+	for i, url := range c.RPCURLs {
+		var client *rpc.Client
+		client, err = rpc.DialContext(ctx, url)
+		if err != nil {
+			log.Printf("chains: failed to dial %s RPC %d: %v\n", c.Name, i, err)
+			continue
+		}
+		var chainID hexutil.Big
+		err = client.CallContext(ctx, &chainID, "eth_chainId")
+		if err != nil {
+			client.Close()
+			log.Printf("chains: %s RPC %d is not available: %v\n", c.Name, i, err)
+			continue
+		}
+		if chainID.ToInt().Uint64() != c.ChainID {
+			client.Close()
+			err = errors.New("RPC of " + c.Name + " returned chain ID " + chainID.ToInt().String())
+			log.Printf("chains: %v\n", err)
+			continue
+		}
+		return client, nil
+	}
+	return nil, err
+}
+
+func (c *Chain) TxURL(hash string) string {
+	return strings.ReplaceAll(c.Explorer.Tx, "{hash}", hash)
+}
+
+func (c *Chain) AddressURL(address string) string {
+	return strings.ReplaceAll(c.Explorer.Address, "{address}", address)
+}
@@ -0,0 +1,111 @@
+package chains
+
+import (
+	"context"
+	"math/big"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind/backends"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+var _ Backend = (*backends.SimulatedBackend)(nil)
+
+// devNode answers eth_chainId like a dev node and counts the calls.
+type devNode struct {
+	chainID uint64
+	calls   int32
+}
+
+func (n *devNode) ChainId() hexutil.Big {
+	atomic.AddInt32(&n.calls, 1)
+	return hexutil.Big(*new(big.Int).SetUint64(n.chainID))
+}
+
+func serve(t *testing.T, node *devNode) string {
+	t.Helper()
+	server := rpc.NewServer()
+	if err := server.RegisterName("eth", node); err != nil {
+		t.Fatal(err)
+	}
+	s := httptest.NewServer(server)
+	t.Cleanup(func() {
+		s.Close()
+		server.Stop()
+	})
+	return s.URL
+}
+
+// The client of a chain is dialed once and shared by all callers.
+func TestBackendIsCached(t *testing.T) {
+	node := &devNode{chainID: 1337}
+	chain := &Chain{Name: "dev", ChainID: 1337, RPCURLs: []string{serve(t, node)}}
+	defer chain.Close()
+
+	first, err := chain.Backend(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		backend, err := chain.Backend(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if backend != first {
+			t.Fatal("Backend dialed a new client")
+		}
+	}
+	if calls := atomic.LoadInt32(&node.calls); calls != 1 {
+		t.Errorf("chain ID checked %d times, want 1", calls)
+	}
+
+	chain.Close()
+	if backend, _ := chain.Backend(context.Background()); backend == first {
+		t.Error("closed client reused")
+	}
+}
+
+// URLs of other chains are skipped.
+func TestBackendSkipsOtherChains(t *testing.T) {
+	other := &devNode{chainID: 1}
+	dev := &devNode{chainID: 1337}
+	chain := &Chain{Name: "dev", ChainID: 1337, RPCURLs: []string{serve(t, other), serve(t, dev)}}
+	defer chain.Close()
+
+	if _, err := chain.Backend(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&dev.calls) != 1 {
+		t.Error("the URL of the configured chain wasn't used")
+	}
+
+	wrong := &Chain{Name: "dev", ChainID: 1337, RPCURLs: []string{serve(t, other)}}
+	if _, err := wrong.Backend(context.Background()); err == nil {
+		t.Error("Backend accepted a node of another chain")
+	}
+}
+
+func TestSimulatedBackend(t *testing.T) {
+	account := common.HexToAddress("0x00000000000000000000000000000000000000a1")
+	sim := backends.NewSimulatedBackend(core.GenesisAlloc{account: {Balance: big.NewInt(1e18)}}, 8000000)
+	defer sim.Close()
+	chain := &Chain{Name: "simulated", ChainID: 1337}
+	chain.SetBackend(sim)
+
+	backend, err := chain.Backend(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	balance, err := backend.BalanceAt(context.Background(), account, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance.Cmp(big.NewInt(1e18)) != 0 {
+		t.Errorf("balance %s, want 1e18", balance)
+	}
+}
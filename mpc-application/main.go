@@ -1,16 +1,32 @@
 package main
 
 import (
+	"bytes"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
+	"io"
 	"log"
 	"net/http"
 	"os"
+	"runtime"
+	"strconv"
 
+	"mpc_poc/audit"
 	"mpc_poc/broker"
+	"mpc_poc/chains"
 	"mpc_poc/helper"
+	"mpc_poc/messaging"
 	"mpc_poc/models"
+	"mpc_poc/nonces"
+	"mpc_poc/payload"
 	"mpc_poc/service"
+	"mpc_poc/session"
+	"mpc_poc/signer"
 
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
@@ -20,12 +36,123 @@ import (
 var ids party.IDSlice
 
 type Parameters struct {
-	Threshold int    `json:"threshold"`
-	Message   string `json:"message"`
-	Address   string `json:"address"`
-	To        string `json:"to"`
-	Amount    string `json:"amount"`
-	Online    bool   `json:"online"`
+	Threshold     int                            `json:"threshold"`
+	Message       string                         `json:"message"`
+	Address       string                         `json:"address"`
+	To            string                         `json:"to"`
+	Amount        string                         `json:"amount"`
+	Online        bool                           `json:"online"`
+	Chain         string                         `json:"chain"`
+	Token         string                         `json:"token"`
+	Contract      string                         `json:"contract"`
+	ABI           json.RawMessage                `json:"abi"`
+	Method        string                         `json:"method"`
+	Args          []json.RawMessage              `json:"args"`
+	Bytecode      string                         `json:"bytecode"`
+	Fee           service.FeeOptions             `json:"fee"`
+	TypedData     json.RawMessage                `json:"typedData"`
+	Digest        string                         `json:"digest"`
+	Format        string                         `json:"format"`
+	Signature     string                         `json:"signature"`
+	PublicKey     string                         `json:"publicKey"`
+	PSBT          string                         `json:"psbt"`
+	Network       string                         `json:"network"`
+	UserOperation payload.UserOperation          `json:"userOperation"`
+	EntryPoint    string                         `json:"entryPoint"`
+	ChainID       uint64                         `json:"chainId"`
+	Raw           bool                           `json:"raw"`
+	Submit        bool                           `json:"submit"`
+	Safe          string                         `json:"safe"`
+	Data          string                         `json:"data"`
+	SafeOptions   service.SafeTransactionOptions `json:"safeOptions"`
+	Kind          string                         `json:"kind"`
+	Transaction   string                         `json:"transaction"`
+	Personal      bool                           `json:"personal"`
+	Description   string                         `json:"description"`
+	Requester     string                         `json:"requester"`
+	Approver      string                         `json:"approver"`
+	Reason        string                         `json:"reason"`
+	ID            string                         `json:"id"`
+	Signatures    []models.AdminSignature        `json:"signatures"`
+}
+
+// digest returns the digest given as hex or, without one, the Keccak-256
+// hash of the message.
+func digest(parameters Parameters) (common.Hash, error) {
+	if parameters.Digest == "" {
+		return crypto.Keccak256Hash([]byte(parameters.Message)), nil
+	}
+	b, err := hexutil.Decode(parameters.Digest)
+	if err != nil || len(b) != common.HashLength {
+		return common.Hash{}, errors.New("digest must be 32 bytes of 0x hex")
+	}
+	return common.BytesToHash(b), nil
+}
+
+// errorBody is what failed requests return: the message, or the refusals of
+// the participants if they refused to sign.
+func errorBody(err error) interface{} {
+	var refused *service.RefusedError
+	if errors.As(err, &refused) {
+		return struct {
+			Error    string           `json:"error"`
+			Refusals []models.Refusal `json:"refusals"`
+		}{err.Error(), refused.Refusals}
+	}
+	return err.Error()
+}
+
+// signingPayload is what /sign and /signonline sign: the Keccak-256 hash of
+// the message or a given digest. Participants can check neither, the message
+// may be an encoded transaction.
+func signingPayload(parameters Parameters) (payload.Payload, error) {
+	if parameters.Digest == "" {
+		return payload.NewKeccak([]byte(parameters.Message)), nil
+	}
+	hash, err := digest(parameters)
+	if err != nil {
+		return payload.Payload{}, err
+	}
+	return payload.NewDigest(hash), nil
+}
+
+// requestPayload is what a sign request signs: the typed data, the unsigned
+// transaction for chain, the message as personal_sign or, like /sign, a blind
+// digest. Participants refuse blind payloads unless ALLOW_BLIND_SIGNING=true,
+// so they are refused here as well.
+func requestPayload(parameters Parameters) (payload.Payload, error) {
+	switch {
+	case len(parameters.TypedData) > 0:
+		typedData, err := service.ParseTypedData(parameters.TypedData)
+		if err != nil {
+			return payload.Payload{}, err
+		}
+		return payload.NewTypedData(typedData)
+	case parameters.Transaction != "":
+		chain, err := chains.Get(parameters.Chain)
+		if err != nil {
+			return payload.Payload{}, err
+		}
+		raw, err := hexutil.Decode(parameters.Transaction)
+		if err != nil {
+			return payload.Payload{}, errors.New("transaction must be the 0x hex of an unsigned transaction")
+		}
+		tx := new(types.Transaction)
+		if err = tx.UnmarshalBinary(raw); err != nil {
+			return payload.Payload{}, errors.New("invalid transaction: " + err.Error())
+		}
+		return payload.NewTransaction(chain.ID(), tx)
+	case parameters.Personal:
+		message := []byte(parameters.Message)
+		if data, err := hexutil.Decode(parameters.Message); err == nil {
+			message = data
+		}
+		return payload.NewMessage(message), nil
+	}
+	if helper.GetEnv("ALLOW_BLIND_SIGNING", "false") != "true" {
+		return payload.Payload{}, errors.New("blind sign request, give typedData, a transaction or a personal message, or set ALLOW_BLIND_SIGNING=true")
+	}
+	return signingPayload(parameters)
 }
 
 func GenerateKeys(w http.ResponseWriter, r *http.Request) {
@@ -41,19 +168,418 @@ func RefreshKeys(w http.ResponseWriter, r *http.Request) {
 	var parameters Parameters
 	_ = json.NewDecoder(r.Body).Decode(&parameters)
 
-	res := service.RefreshKeys(ids, parameters.Threshold, parameters.Address)
-	_ = json.NewEncoder(w).Encode(res)
+	res, err := service.RefreshKeys(ids, parameters.Threshold, parameters.Address)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(errorBody(err))
+	} else {
+		_ = json.NewEncoder(w).Encode(res)
+	}
 }
 
+// Sign returns the raw signature as base64 unless a format is requested.
 func Sign(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	var parameters Parameters
 	_ = json.NewDecoder(r.Body).Decode(&parameters)
-	messageHash := crypto.Keccak256Hash([]byte(parameters.Message))
-	res := service.Sign(ids, parameters.Threshold, messageHash, parameters.Address)
+	p, err := signingPayload(parameters)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(errorBody(err))
+		return
+	}
+	if parameters.Format == "" {
+		res, err := service.Sign(ids, parameters.Threshold, p, parameters.Address)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(errorBody(err))
+		} else {
+			_ = json.NewEncoder(w).Encode(res)
+		}
+		return
+	}
+	res, err := service.SignDigest(ids, parameters.Threshold, parameters.Address, p, false, service.SignatureFormat(parameters.Format))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(errorBody(err))
+	} else {
+		_ = json.NewEncoder(w).Encode(res)
+	}
+}
+
+// SignPersonal signs the message as personal_sign. Like wallets do, a message
+// that is valid 0x hex is signed as bytes.
+func SignPersonal(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	var parameters Parameters
+	_ = json.NewDecoder(r.Body).Decode(&parameters)
+	message := []byte(parameters.Message)
+	if data, err := hexutil.Decode(parameters.Message); err == nil {
+		message = data
+	}
+	res, err := service.SignPersonal(ids, parameters.Threshold, parameters.Address, message, parameters.Online)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(errorBody(err))
+	} else {
+		_ = json.NewEncoder(w).Encode(res)
+	}
+}
+
+func SignTyped(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	var parameters Parameters
+	_ = json.NewDecoder(r.Body).Decode(&parameters)
+	typedData, err := service.ParseTypedData(parameters.TypedData)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(errorBody(err))
+		return
+	}
+	res, err := service.SignTypedData(ids, parameters.Threshold, parameters.Address, typedData, parameters.Online)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(errorBody(err))
+	} else {
+		_ = json.NewEncoder(w).Encode(res)
+	}
+}
+
+func SignUserOperation(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	var parameters Parameters
+	_ = json.NewDecoder(r.Body).Decode(&parameters)
+	res, err := service.SignUserOperation(ids, parameters.Threshold, parameters.Address, parameters.UserOperation, parameters.EntryPoint, parameters.Chain, parameters.ChainID, parameters.Raw, parameters.Online, parameters.Submit)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(errorBody(err))
+	} else {
+		_ = json.NewEncoder(w).Encode(res)
+	}
+}
+
+// callData returns the data of a transaction, given as hex or as a method of
+// an ABI with arguments.
+func callData(parameters Parameters) ([]byte, error) {
+	if parameters.Method != "" {
+		data, _, err := service.EncodeCall(parameters.ABI, parameters.Method, parameters.Args)
+		return data, err
+	}
+	if parameters.Data == "" {
+		return []byte{}, nil
+	}
+	return hexutil.Decode(parameters.Data)
+}
+
+func ProposeSafeTransaction(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	var parameters Parameters
+	_ = json.NewDecoder(r.Body).Decode(&parameters)
+	data, err := callData(parameters)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(errorBody(err))
+		return
+	}
+	res, err := service.ProposeSafeTransaction(parameters.Chain, parameters.Safe, parameters.To, parameters.Amount, data, parameters.SafeOptions)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(errorBody(err))
+	} else {
+		_ = json.NewEncoder(w).Encode(res)
+	}
+}
+
+func SignSafeTransaction(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	var parameters Parameters
+	_ = json.NewDecoder(r.Body).Decode(&parameters)
+	res, err := service.SignSafeTransaction(ids, parameters.Threshold, mux.Vars(r)["hash"], parameters.Address, parameters.Online)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(errorBody(err))
+	} else {
+		_ = json.NewEncoder(w).Encode(res)
+	}
+}
+
+func AddSafeSignature(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	var parameters Parameters
+	_ = json.NewDecoder(r.Body).Decode(&parameters)
+	res, err := service.AddSafeSignature(mux.Vars(r)["hash"], parameters.Signature)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(errorBody(err))
+	} else {
+		_ = json.NewEncoder(w).Encode(res)
+	}
+}
+
+func ExecuteSafeTransaction(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	var parameters Parameters
+	_ = json.NewDecoder(r.Body).Decode(&parameters)
+	res, err := service.ExecuteSafeTransaction(ids, parameters.Threshold, mux.Vars(r)["hash"], parameters.Address, parameters.Online, parameters.Fee)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(errorBody(err))
+	} else {
+		_ = json.NewEncoder(w).Encode(res)
+	}
+}
+
+func GetSafeTransactions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(service.GetSafeTransactions(r.URL.Query().Get("safe")))
+}
+
+func GetSafeTransaction(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	res, err := service.GetSafeTransaction(mux.Vars(r)["hash"])
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(errorBody(err))
+	} else {
+		_ = json.NewEncoder(w).Encode(res)
+	}
+}
+
+// CreateRequest stores a transfer, with the parameters of /sendeth, or a
+// signature, see requestPayload, as a draft for the approvers.
+func CreateRequest(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	var parameters Parameters
+	_ = json.NewDecoder(r.Body).Decode(&parameters)
+	operation := service.Operation{
+		Kind:      service.RequestKind(parameters.Kind),
+		Address:   parameters.Address,
+		Threshold: parameters.Threshold,
+		Online:    parameters.Online,
+		Chain:     parameters.Chain,
+		To:        parameters.To,
+		Amount:    parameters.Amount,
+		Fee:       parameters.Fee,
+		Format:    service.SignatureFormat(parameters.Format),
+	}
+	var err error
+	if operation.Kind == service.SignRequest {
+		var p payload.Payload
+		if p, err = requestPayload(parameters); err == nil {
+			operation.Payload = &p
+		}
+	}
+	var res service.ApprovalRequest
+	if err == nil {
+		res, err = service.CreateApprovalRequest(operation, parameters.Description, parameters.Requester)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(errorBody(err))
+	} else {
+		_ = json.NewEncoder(w).Encode(res)
+	}
+}
+
+func SubmitRequest(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	res, err := service.SubmitApprovalRequest(mux.Vars(r)["id"])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(errorBody(err))
+	} else {
+		_ = json.NewEncoder(w).Encode(res)
+	}
+}
+
+// decideRequest handles approvals and rejections, the approver signs
+// "approve <hash>" or "reject <hash>" of the request as personal_sign.
+func decideRequest(approve bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		var parameters Parameters
+		_ = json.NewDecoder(r.Body).Decode(&parameters)
+		res, err := service.DecideApprovalRequest(mux.Vars(r)["id"], approve, parameters.Approver, parameters.Signature, parameters.Reason)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(errorBody(err))
+		} else {
+			_ = json.NewEncoder(w).Encode(res)
+		}
+	}
+}
+
+func ExecuteRequest(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	res, err := service.ExecuteApprovalRequest(ids, mux.Vars(r)["id"])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(errorBody(err))
+	} else {
+		_ = json.NewEncoder(w).Encode(res)
+	}
+}
+
+func GetRequests(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(service.GetApprovalRequests(service.RequestState(r.URL.Query().Get("state"))))
+}
+
+func GetRequest(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	res, err := service.GetApprovalRequest(mux.Vars(r)["id"])
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(errorBody(err))
+	} else {
+		_ = json.NewEncoder(w).Encode(res)
+	}
+}
+
+// adminAuthorized checks the bearer token against ADMIN_TOKEN. Without
+// ADMIN_TOKEN admin calls are refused.
+func adminAuthorized(w http.ResponseWriter, r *http.Request) bool {
+	token := helper.GetEnv("ADMIN_TOKEN", "")
+	if token == "" {
+		w.WriteHeader(http.StatusForbidden)
+		_ = json.NewEncoder(w).Encode("ADMIN_TOKEN is not set")
+		return false
+	}
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+		w.WriteHeader(http.StatusUnauthorized)
+		_ = json.NewEncoder(w).Encode("invalid admin token")
+		return false
+	}
+	return true
+}
+
+// Freeze stops signing with the key of address, or with all keys without
+// an address, on every participant. It needs ADMIN_TOKEN.
+func Freeze(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !adminAuthorized(w, r) {
+		return
+	}
+	var parameters Parameters
+	_ = json.NewDecoder(r.Body).Decode(&parameters)
+	res, err := service.Freeze(ids, parameters.Address, parameters.Reason, parameters.Requester)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(errorBody(err))
+	} else {
+		_ = json.NewEncoder(w).Encode(res)
+	}
+}
+
+func Unfreeze(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	var parameters Parameters
+	_ = json.NewDecoder(r.Body).Decode(&parameters)
+	err := service.Unfreeze(ids, parameters.ID, parameters.Signatures)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(errorBody(err))
+	} else {
+		_ = json.NewEncoder(w).Encode(parameters.ID)
+	}
+}
+
+func GetFreezes(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(service.GetFreezes(ids))
+}
+
+func GetAudit(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	res, err := audit.Export()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		_ = json.NewEncoder(w).Encode(errorBody(err))
+		return
+	}
 	_ = json.NewEncoder(w).Encode(res)
 }
 
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// auditRequests writes every request that changes something to the audit
+// log: who sent it, its body and the resulting status. The requester is the
+// X-Requester header, the requester parameter or the remote address.
+func auditRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" || r.Method == "HEAD" || r.Method == "OPTIONS" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		var parameters Parameters
+		_ = json.Unmarshal(body, &parameters)
+
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+
+		entry := audit.Entry{
+			Event:     "http",
+			Address:   parameters.Address,
+			Digest:    parameters.Digest,
+			Summary:   r.Method + " " + r.URL.Path,
+			Requester: r.Header.Get("X-Requester"),
+			Result:    strconv.Itoa(recorder.status),
+		}
+		if entry.Requester == "" {
+			entry.Requester = parameters.Requester
+		}
+		if entry.Requester == "" {
+			entry.Requester = r.RemoteAddr
+		}
+		if json.Valid(body) {
+			entry.Payload = body
+		}
+		audit.Append(entry)
+	})
+}
+
+func Simulate(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	var parameters Parameters
+	_ = json.NewDecoder(r.Body).Decode(&parameters)
+	var to *common.Address
+	var data []byte
+	var err error
+	if address := parameters.Contract + parameters.To; address != "" {
+		if !common.IsHexAddress(address) {
+			err = errors.New("invalid to: " + address)
+		} else {
+			to = new(common.Address)
+			*to = common.HexToAddress(address)
+			data, err = callData(parameters)
+		}
+	} else if data, err = hexutil.Decode(parameters.Bytecode); err != nil {
+		err = errors.New("invalid bytecode: " + err.Error())
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(errorBody(err))
+		return
+	}
+	res, err := service.Simulate(parameters.Chain, parameters.Address, to, parameters.Amount, data, parameters.ABI)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(errorBody(err))
+	} else {
+		_ = json.NewEncoder(w).Encode(res)
+	}
+}
+
 func PreSign(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	var parameters Parameters
@@ -66,24 +592,201 @@ func SignOnline(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	var parameters Parameters
 	_ = json.NewDecoder(r.Body).Decode(&parameters)
-	messageHash := crypto.Keccak256Hash([]byte(parameters.Message))
-	res := service.SignOnline(ids, messageHash, parameters.Address)
-	_ = json.NewEncoder(w).Encode(res)
+	p, err := signingPayload(parameters)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(errorBody(err))
+		return
+	}
+	if parameters.Format == "" {
+		res, err := service.SignOnline(ids, p, parameters.Address)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(errorBody(err))
+		} else {
+			_ = json.NewEncoder(w).Encode(res)
+		}
+		return
+	}
+	res, err := service.SignDigest(ids, parameters.Threshold, parameters.Address, p, true, service.SignatureFormat(parameters.Format))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(errorBody(err))
+	} else {
+		_ = json.NewEncoder(w).Encode(res)
+	}
+}
+
+func Verify(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	var parameters Parameters
+	_ = json.NewDecoder(r.Body).Decode(&parameters)
+	messageHash, err := digest(parameters)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(errorBody(err))
+		return
+	}
+	signature, err := hexutil.Decode(parameters.Signature)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode("invalid signature: " + err.Error())
+		return
+	}
+	res, err := service.Verify(messageHash, signature, parameters.Address, parameters.PublicKey)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(errorBody(err))
+	} else {
+		_ = json.NewEncoder(w).Encode(res)
+	}
 }
 
 func SendEth(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	var parameters Parameters
 	_ = json.NewDecoder(r.Body).Decode(&parameters)
-	txHash, err := service.SendEth(ids, parameters.Threshold, parameters.Address, parameters.To, parameters.Amount, parameters.Online)
+	res, err := service.SendEth(ids, parameters.Threshold, parameters.Chain, parameters.Address, parameters.To, parameters.Amount, parameters.Online, parameters.Fee)
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
-		_ = json.NewEncoder(w).Encode(err)
+		_ = json.NewEncoder(w).Encode(errorBody(err))
 	} else {
-		_ = json.NewEncoder(w).Encode(txHash)
+		_ = json.NewEncoder(w).Encode(res)
 	}
 }
 
+func TransferToken(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	var parameters Parameters
+	_ = json.NewDecoder(r.Body).Decode(&parameters)
+	res, err := service.TransferToken(ids, parameters.Threshold, parameters.Chain, parameters.Address, parameters.Token, parameters.To, parameters.Amount, parameters.Online, parameters.Fee)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(errorBody(err))
+	} else {
+		_ = json.NewEncoder(w).Encode(res)
+	}
+}
+
+func CallContract(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	var parameters Parameters
+	_ = json.NewDecoder(r.Body).Decode(&parameters)
+	res, err := service.CallContract(ids, parameters.Threshold, parameters.Chain, parameters.Address, parameters.Contract, parameters.ABI, parameters.Method, parameters.Args, parameters.Amount, parameters.Online, parameters.Fee)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(errorBody(err))
+	} else {
+		_ = json.NewEncoder(w).Encode(res)
+	}
+}
+
+func DeployContract(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	var parameters Parameters
+	_ = json.NewDecoder(r.Body).Decode(&parameters)
+	res, err := service.DeployContract(ids, parameters.Threshold, parameters.Chain, parameters.Address, parameters.Bytecode, parameters.ABI, parameters.Args, parameters.Amount, parameters.Online, parameters.Fee)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(errorBody(err))
+	} else {
+		_ = json.NewEncoder(w).Encode(res)
+	}
+}
+
+func GetChains(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	res, err := chains.List()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		_ = json.NewEncoder(w).Encode(errorBody(err))
+		return
+	}
+	_ = json.NewEncoder(w).Encode(res)
+}
+
+func GetAddresses(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	res, err := service.GetAddresses(ids, mux.Vars(r)["address"], r.URL.Query().Get("hrp"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(errorBody(err))
+	} else {
+		_ = json.NewEncoder(w).Encode(res)
+	}
+}
+
+func GetBitcoinAccount(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	res, err := service.GetBitcoinAccount(ids, mux.Vars(r)["address"], r.URL.Query().Get("network"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(errorBody(err))
+	} else {
+		_ = json.NewEncoder(w).Encode(res)
+	}
+}
+
+func SignPSBT(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	var parameters Parameters
+	_ = json.NewDecoder(r.Body).Decode(&parameters)
+	res, err := service.SignPSBT(ids, parameters.Threshold, parameters.Address, parameters.PSBT, parameters.Network, parameters.Online)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(errorBody(err))
+	} else {
+		_ = json.NewEncoder(w).Encode(res)
+	}
+}
+
+func GetTransactions(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(service.GetTransactions())
+}
+
+func GetTransaction(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	res, err := service.GetTransaction(mux.Vars(r)["hash"])
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(errorBody(err))
+	} else {
+		_ = json.NewEncoder(w).Encode(res)
+	}
+}
+
+func SpeedUpTransaction(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	var parameters Parameters
+	_ = json.NewDecoder(r.Body).Decode(&parameters)
+	res, err := service.SpeedUpTransaction(ids, parameters.Threshold, mux.Vars(r)["hash"], parameters.Online, parameters.Fee)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(errorBody(err))
+	} else {
+		_ = json.NewEncoder(w).Encode(res)
+	}
+}
+
+func CancelTransaction(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	var parameters Parameters
+	_ = json.NewDecoder(r.Body).Decode(&parameters)
+	res, err := service.CancelTransaction(ids, parameters.Threshold, mux.Vars(r)["hash"], parameters.Online, parameters.Fee)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(errorBody(err))
+	} else {
+		_ = json.NewEncoder(w).Encode(res)
+	}
+}
+
+func GetNonces(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(nonces.GetStates())
+}
+
 func GetOnline(w http.ResponseWriter, _ *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	online := service.GetOnline(ids)
@@ -96,6 +799,37 @@ func GetConfigs(w http.ResponseWriter, _ *http.Request) {
 	_ = json.NewEncoder(w).Encode(configs)
 }
 
+func GetMetrics(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	metrics := service.GetMetrics(ids)
+	_ = json.NewEncoder(w).Encode(metrics)
+}
+
+type DebugChannels struct {
+	Goroutines int                      `json:"goroutines"`
+	Channels   models.ChannelStats      `json:"channels"`
+	Transport  messaging.TransportStats `json:"transport"`
+}
+
+func GetDebugChannels(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	debug := DebugChannels{
+		Goroutines: runtime.NumGoroutine(),
+		Channels:   models.GetChannelStats(),
+		Transport:  messaging.GetStats(),
+	}
+	_ = json.NewEncoder(w).Encode(debug)
+}
+
+func GetHealth(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	health := messaging.GetHealth()
+	if health.State != messaging.Connected {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = json.NewEncoder(w).Encode(health)
+}
+
 func initializeRouter() {
 	b := broker.NewServer()
 	r := mux.NewRouter()
@@ -106,16 +840,55 @@ func initializeRouter() {
 	r.HandleFunc("/keys/generate", GenerateKeys).Methods("POST")
 	r.HandleFunc("/keys/refresh", RefreshKeys).Methods("POST")
 	r.HandleFunc("/sign", Sign).Methods("POST")
+	r.HandleFunc("/sign/personal", SignPersonal).Methods("POST")
+	r.HandleFunc("/sign/typed", SignTyped).Methods("POST")
+	r.HandleFunc("/userop/sign", SignUserOperation).Methods("POST")
 	r.HandleFunc("/presign", PreSign).Methods("POST")
 	r.HandleFunc("/signonline", SignOnline).Methods("POST")
+	r.HandleFunc("/verify", Verify).Methods("POST")
 	r.HandleFunc("/sendeth", SendEth).Methods("POST")
+	r.HandleFunc("/tokens/transfer", TransferToken).Methods("POST")
+	r.HandleFunc("/contracts/call", CallContract).Methods("POST")
+	r.HandleFunc("/contracts/deploy", DeployContract).Methods("POST")
+	r.HandleFunc("/simulate", Simulate).Methods("POST")
+	r.HandleFunc("/transactions/{hash}/speedup", SpeedUpTransaction).Methods("POST")
+	r.HandleFunc("/transactions/{hash}/cancel", CancelTransaction).Methods("POST")
+	r.HandleFunc("/bitcoin/psbt/sign", SignPSBT).Methods("POST")
+	r.HandleFunc("/safe/transactions", ProposeSafeTransaction).Methods("POST")
+	r.HandleFunc("/safe/transactions/{hash}/sign", SignSafeTransaction).Methods("POST")
+	r.HandleFunc("/safe/transactions/{hash}/signatures", AddSafeSignature).Methods("POST")
+	r.HandleFunc("/safe/transactions/{hash}/execute", ExecuteSafeTransaction).Methods("POST")
+	r.HandleFunc("/requests", CreateRequest).Methods("POST")
+	r.HandleFunc("/requests/{id}/submit", SubmitRequest).Methods("POST")
+	r.HandleFunc("/requests/{id}/approve", decideRequest(true)).Methods("POST")
+	r.HandleFunc("/requests/{id}/reject", decideRequest(false)).Methods("POST")
+	r.HandleFunc("/requests/{id}/execute", ExecuteRequest).Methods("POST")
+	r.HandleFunc("/freeze", Freeze).Methods("POST")
+	r.HandleFunc("/unfreeze", Unfreeze).Methods("POST")
 
+	r.HandleFunc("/chains", GetChains).Methods("GET")
+	r.HandleFunc("/nonces", GetNonces).Methods("GET")
+	r.HandleFunc("/transactions", GetTransactions).Methods("GET")
+	r.HandleFunc("/transactions/{hash}", GetTransaction).Methods("GET")
+	r.HandleFunc("/safe/transactions", GetSafeTransactions).Methods("GET")
+	r.HandleFunc("/safe/transactions/{hash}", GetSafeTransaction).Methods("GET")
+	r.HandleFunc("/requests", GetRequests).Methods("GET")
+	r.HandleFunc("/requests/{id}", GetRequest).Methods("GET")
+	r.HandleFunc("/freeze", GetFreezes).Methods("GET")
+	r.HandleFunc("/audit", GetAudit).Methods("GET")
+	r.HandleFunc("/keys/{address}/addresses", GetAddresses).Methods("GET")
+	r.HandleFunc("/bitcoin/address/{address}", GetBitcoinAccount).Methods("GET")
 	r.HandleFunc("/online", GetOnline).Methods("GET")
 	r.HandleFunc("/configs", GetConfigs).Methods("GET")
+	r.HandleFunc("/metrics", GetMetrics).Methods("GET")
+	r.HandleFunc("/health", GetHealth).Methods("GET")
+	r.HandleFunc("/debug/channels", GetDebugChannels).Methods("GET")
 
 	r.HandleFunc("/sse", b.Stream).Methods("GET")
+	r.Handle("/rpc", signer.NewServer(ids)).Methods("POST")
+	r.Use(auditRequests)
 
-	headersOk := handlers.AllowedHeaders([]string{"X-Requested-With", "Content-Type"})
+	headersOk := handlers.AllowedHeaders([]string{"X-Requested-With", "Content-Type", "X-Requester", "Authorization"})
 	originsOk := handlers.AllowedOrigins([]string{"*"})
 	methodsOk := handlers.AllowedMethods([]string{"GET", "HEAD", "POST", "PUT", "OPTIONS"})
 	credentialsOk := handlers.AllowCredentials()
@@ -146,6 +919,15 @@ func main() {
 		idsArray = append(idsArray, party.ID(id))
 	}
 	ids = party.NewIDSlice(idsArray)
+	messaging.SetLocalMember(messaging.APIMember)
+	// control messages are signed with the message key of the API
+	if err := session.Init(messaging.APIMember); err != nil {
+		log.Fatalf("api: %v\n", err)
+	}
+	if err := audit.Init("api"); err != nil {
+		log.Fatalf("api: %v\n", err)
+	}
+	service.StartWatcher()
 
 	initializeRouter()
 }
@@ -0,0 +1,443 @@
+package messaging
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// APIMember is the membership ID of the API server.
+const APIMember = "api"
+
+const deliverTimeout = 10 * time.Second
+
+type (
+	Member struct {
+		ID          string `json:"id"`
+		Endpoint    string `json:"endpoint"`
+		Certificate string `json:"certificate"`
+	}
+
+	Membership struct {
+		Members []Member `json:"members"`
+	}
+)
+
+type envelope struct {
+	Name    string `json:"name"`
+	Payload []byte `json:"payload"`
+}
+
+type ack struct{}
+
+// jsonCodec lets the transport use gRPC without generated protobuf code.
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+func (jsonCodec) Name() string {
+	return "json"
+}
+
+type deliveryServer interface {
+	deliver(ctx context.Context, in *envelope) (*ack, error)
+}
+
+var deliveryServiceDesc = grpc.ServiceDesc{
+	ServiceName: "mpc.Messaging",
+	HandlerType: (*deliveryServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Deliver",
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, _ grpc.UnaryServerInterceptor) (interface{}, error) {
+				in := &envelope{}
+				if err := dec(in); err != nil {
+					return nil, err
+				}
+				return srv.(deliveryServer).deliver(ctx, in)
+			},
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "messaging",
+}
+
+type grpcPeer struct {
+	member      Member
+	certificate []byte
+	conn        *grpc.ClientConn
+}
+
+// GRPCTransport delivers every message straight to the member that reads the
+// queue. Members authenticate each other with mutual TLS against the
+// certificates pinned in the membership file.
+type GRPCTransport struct {
+	id          string
+	peers       map[string]*grpcPeer
+	certificate tls.Certificate
+	server      *grpc.Server
+
+	mtx       sync.Mutex
+	sendChans map[string]chan []byte
+	mailboxes map[string]chan []byte
+
+	healthMtx  sync.Mutex
+	lastError  string
+	lastChange time.Time
+}
+
+func NewGRPCTransport(id string, membership Membership, certificate tls.Certificate, listen string) (*GRPCTransport, error) {
+	t := &GRPCTransport{
+		id:          id,
+		peers:       make(map[string]*grpcPeer),
+		certificate: certificate,
+		sendChans:   make(map[string]chan []byte),
+		mailboxes:   make(map[string]chan []byte),
+		lastChange:  time.Now(),
+	}
+
+	for _, member := range membership.Members {
+		der, err := readCertificate(member.Certificate)
+		if err != nil {
+			return nil, err
+		}
+		t.peers[member.ID] = &grpcPeer{member: member, certificate: der}
+	}
+	self, ok := t.peers[id]
+	if !ok {
+		return nil, errors.New("member " + id + " is not in the membership")
+	}
+	if !bytes.Equal(self.certificate, certificate.Certificate[0]) {
+		return nil, errors.New("certificate of member " + id + " does not match the membership")
+	}
+	if listen == "" {
+		listen = self.member.Endpoint
+	}
+
+	serverConfig := &tls.Config{
+		MinVersion:            tls.VersionTLS12,
+		Certificates:          []tls.Certificate{certificate},
+		ClientAuth:            tls.RequireAnyClientCert,
+		VerifyPeerCertificate: t.verifyAnyMember,
+	}
+	t.server = grpc.NewServer(grpc.Creds(credentials.NewTLS(serverConfig)), grpc.ForceServerCodec(jsonCodec{}))
+	t.server.RegisterService(&deliveryServiceDesc, t)
+
+	listener, err := net.Listen("tcp", listen)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		err := t.server.Serve(listener)
+		if err != nil {
+			log.Printf("GRPCTransport: server stopped: %v\n", err)
+		}
+	}()
+
+	return t, nil
+}
+
+func readCertificate(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.New("no certificate found in " + path)
+	}
+	if _, err := x509.ParseCertificate(block.Bytes); err != nil {
+		return nil, err
+	}
+	return block.Bytes, nil
+}
+
+func (t *GRPCTransport) memberOf(certificate []byte) (string, bool) {
+	for id, p := range t.peers {
+		if bytes.Equal(p.certificate, certificate) {
+			return id, true
+		}
+	}
+	return "", false
+}
+
+func (t *GRPCTransport) verifyAnyMember(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return errors.New("no client certificate")
+	}
+	if _, ok := t.memberOf(rawCerts[0]); !ok {
+		return errors.New("client certificate is not in the membership")
+	}
+	return nil
+}
+
+func (t *GRPCTransport) conn(id string) (*grpc.ClientConn, error) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	p, ok := t.peers[id]
+	if !ok {
+		return nil, errors.New("unknown member " + id)
+	}
+	if p.conn != nil {
+		return p.conn, nil
+	}
+
+	clientConfig := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{t.certificate},
+		// The chain is not verified against a CA, instead the leaf must be
+		// exactly the certificate pinned for the member.
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 || !bytes.Equal(rawCerts[0], p.certificate) {
+				return errors.New("certificate of member " + id + " does not match the membership")
+			}
+			return nil
+		},
+	}
+	conn, err := grpc.Dial(p.member.Endpoint,
+		grpc.WithTransportCredentials(credentials.NewTLS(clientConfig)),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(jsonCodec{})),
+	)
+	if err != nil {
+		return nil, err
+	}
+	p.conn = conn
+	return conn, nil
+}
+
+// owner returns the member that reads the named queue.
+func owner(name string) string {
+	switch {
+	case name == LogMessagesChannel,
+		strings.HasPrefix(name, SessionMessagesChannel+":"),
+		strings.HasPrefix(name, InfoResponseMessagesChannel+":"):
+		return APIMember
+	}
+	return name[strings.LastIndex(name, ":")+1:]
+}
+
+// allowed reports whether the member may write to the named queue.
+func allowed(sender string, name string) bool {
+	suffix := name[strings.LastIndex(name, ":")+1:]
+	switch {
+	case name == LogMessagesChannel:
+		return true
+	case strings.HasPrefix(name, ProtocolMessagesChannel+":"),
+		strings.HasPrefix(name, InfoRequestMessagesChannel+":"):
+		return sender == APIMember
+	case strings.HasPrefix(name, InternalMessagesChannel+":"):
+		return sender != APIMember
+	case strings.HasPrefix(name, SessionMessagesChannel+":"),
+		strings.HasPrefix(name, InfoResponseMessagesChannel+":"):
+		return sender == suffix
+	}
+	return false
+}
+
+func (t *GRPCTransport) deliver(ctx context.Context, in *envelope) (*ack, error) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "no peer")
+	}
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(tlsInfo.State.PeerCertificates) == 0 {
+		return nil, status.Error(codes.Unauthenticated, "no client certificate")
+	}
+	sender, ok := t.memberOf(tlsInfo.State.PeerCertificates[0].Raw)
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "unknown member")
+	}
+	if owner(in.Name) != t.id || !allowed(sender, in.Name) {
+		return nil, status.Error(codes.PermissionDenied, sender+" may not write to "+in.Name)
+	}
+	if !t.enqueue(in.Name, in.Payload) {
+		return nil, status.Error(codes.ResourceExhausted, in.Name+" is full")
+	}
+	return &ack{}, nil
+}
+
+func (t *GRPCTransport) enqueue(name string, payload []byte) bool {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	select {
+	case t.mailbox(name) <- payload:
+		return true
+	default:
+		return false
+	}
+}
+
+// mailbox must be called with t.mtx held.
+func (t *GRPCTransport) mailbox(name string) chan []byte {
+	ch, ok := t.mailboxes[name]
+	if !ok {
+		ch = make(chan []byte, 1024)
+		t.mailboxes[name] = ch
+	}
+	return ch
+}
+
+func (t *GRPCTransport) Send(name string) chan<- []byte {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	if ch, ok := t.sendChans[name]; ok {
+		return ch
+	}
+
+	ch := make(chan []byte, 1024)
+	go func() {
+		for msg := range ch {
+			t.push(name, msg)
+		}
+	}()
+
+	t.sendChans[name] = ch
+	return ch
+}
+
+// push retries with backoff until the owner of the queue acknowledged the
+// message.
+func (t *GRPCTransport) push(name string, msg []byte) {
+	id := owner(name)
+	if id == t.id {
+		for !t.enqueue(name, msg) {
+			time.Sleep(minReconnectBackoff)
+		}
+		return
+	}
+
+	backoff := minReconnectBackoff
+	for {
+		err := t.invoke(id, &envelope{Name: name, Payload: msg})
+		if err == nil {
+			return
+		}
+		if status.Code(err) == codes.PermissionDenied || status.Code(err) == codes.Unauthenticated {
+			log.Printf("GRPCTransport: %s rejected message to %s: %v\n", id, name, err)
+			return
+		}
+		t.setError(err)
+		log.Printf("GRPCTransport: failed to deliver to %s, retrying in %v: %v\n", name, backoff, err)
+		time.Sleep(backoff)
+		backoff = nextBackoff(backoff)
+	}
+}
+
+func (t *GRPCTransport) invoke(id string, in *envelope) error {
+	conn, err := t.conn(id)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), deliverTimeout)
+	defer cancel()
+	return conn.Invoke(ctx, "/mpc.Messaging/Deliver", in, &ack{})
+}
+
+func (t *GRPCTransport) Receive(name string) <-chan []byte {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	return t.mailbox(name)
+}
+
+func (t *GRPCTransport) CloseSend(name string) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	if ch, ok := t.sendChans[name]; ok {
+		close(ch)
+		delete(t.sendChans, name)
+	}
+}
+
+func (t *GRPCTransport) CloseReceive(name string) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	if ch, ok := t.mailboxes[name]; ok {
+		close(ch)
+		delete(t.mailboxes, name)
+	}
+}
+
+func (t *GRPCTransport) Stats() TransportStats {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	return TransportStats{
+		SendChannels:    len(t.sendChans),
+		ReceiveChannels: len(t.mailboxes),
+	}
+}
+
+// Health is connected only when every peer we dialled is reachable.
+func (t *GRPCTransport) Health() TransportHealth {
+	t.mtx.Lock()
+	peers := make(map[string]ConnectionState)
+	for id, p := range t.peers {
+		if p.conn == nil {
+			continue
+		}
+		switch p.conn.GetState() {
+		case connectivity.Ready:
+			peers[id] = Connected
+		case connectivity.Idle, connectivity.Connecting:
+			peers[id] = Connecting
+		default:
+			peers[id] = Disconnected
+		}
+	}
+	t.mtx.Unlock()
+
+	t.healthMtx.Lock()
+	defer t.healthMtx.Unlock()
+
+	health := TransportHealth{
+		Mode:       GRPCTransportName,
+		State:      Connected,
+		LastError:  t.lastError,
+		LastChange: t.lastChange,
+		Peers:      peers,
+	}
+	for _, state := range peers {
+		if state == Disconnected {
+			health.State = Disconnected
+		}
+	}
+	return health
+}
+
+func (t *GRPCTransport) setError(err error) {
+	t.healthMtx.Lock()
+	defer t.healthMtx.Unlock()
+
+	t.lastError = err.Error()
+	t.lastChange = time.Now()
+}
@@ -1,17 +1,64 @@
 package messaging
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
 	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"mpc_poc/helper"
 
+	goredis "github.com/go-redis/redis/v8"
 	"github.com/joho/godotenv"
-	"github.com/matryer/vice"
-	"github.com/matryer/vice/queues/redis"
-	goredis "gopkg.in/redis.v3"
+	"github.com/nats-io/nats.go"
 )
 
-var transport vice.Transport
+type Transport interface {
+	Send(name string) chan<- []byte
+	Receive(name string) <-chan []byte
+	CloseSend(name string)
+	CloseReceive(name string)
+	Stats() TransportStats
+	Health() TransportHealth
+}
+
+type TransportStats struct {
+	SendChannels    int `json:"sendChannels"`
+	ReceiveChannels int `json:"receiveChannels"`
+}
+
+type ConnectionState string
+
+const (
+	Connecting   ConnectionState = "connecting"
+	Connected    ConnectionState = "connected"
+	Disconnected ConnectionState = "disconnected"
+)
+
+type TransportHealth struct {
+	Mode       string                     `json:"mode"`
+	State      ConnectionState            `json:"state"`
+	LastError  string                     `json:"lastError,omitempty"`
+	LastChange time.Time                  `json:"lastChange"`
+	Reconnects int                        `json:"reconnects"`
+	Peers      map[string]ConnectionState `json:"peers,omitempty"`
+}
+
+var transport Transport
+var transportOnce sync.Once
+var localMember string
+
+const (
+	RedisTransportName = "redis"
+	GRPCTransportName  = "grpc"
+	NATSTransportName  = "nats"
+)
 
 const ProtocolMessagesChannel = "protocol:messages"
 const InternalMessagesChannel = "internal:messages"
@@ -19,39 +66,218 @@ const SessionMessagesChannel = "session:messages"
 const InfoRequestMessagesChannel = "info:request:messages"
 const InfoResponseMessagesChannel = "info:response:messages"
 const LogMessagesChannel = "log:messages"
+const ControlMessagesChannel = "control:messages"
 
 const LocalAddr = "127.0.0.1:6379"
 const LocalPass = ""
 
-func getTransport() vice.Transport {
-	if transport == nil {
+const (
+	StandaloneMode = "standalone"
+	SentinelMode   = "sentinel"
+	ClusterMode    = "cluster"
+)
+
+// SetLocalMember sets the membership ID of this process. It must be called
+// before the first channel is requested when the gRPC transport is used.
+func SetLocalMember(id string) {
+	localMember = id
+}
+
+func getTransport() Transport {
+	transportOnce.Do(func() {
 		_ = godotenv.Load()
-		RedisAddr := helper.GetEnv("REDIS_ADDR", LocalAddr)
-		RedisPass := helper.GetEnv("REDIS_PASS", LocalPass)
-		client := goredis.NewClient(&goredis.Options{
-			Network:    "tcp",
-			Addr:       RedisAddr,
-			Password:   RedisPass,
-			DB:         0,
-			MaxRetries: 0,
-		})
-		transport = redis.New(redis.WithClient(client))
-	}
+		var err error
+		switch name := helper.GetEnv("MESSAGING_TRANSPORT", RedisTransportName); name {
+		case RedisTransportName:
+			mode := helper.GetEnv("REDIS_MODE", StandaloneMode)
+			var client goredis.UniversalClient
+			client, err = newRedisClient(mode)
+			if err == nil {
+				transport = NewRedisTransport(client, mode)
+			}
+		case GRPCTransportName:
+			transport, err = newGRPCTransport()
+		case NATSTransportName:
+			transport, err = newNATSTransport()
+		default:
+			err = errors.New("unknown MESSAGING_TRANSPORT: " + name)
+		}
+		if err != nil {
+			log.Fatalf("messaging: failed to configure transport: %v\n", err)
+		}
+	})
 	return transport
 }
 
-func GetOutputChannel(name string) chan<- []byte {
-	if transport == nil {
-		getTransport()
+// newGRPCTransport builds the peer-to-peer transport from the environment:
+//
+//	P2P_MEMBERSHIP  membership file, membership.json by default
+//	P2P_CERT        certificate of this member, as listed in the membership
+//	P2P_KEY         private key of this member
+//	P2P_LISTEN      listen address, defaults to the endpoint of this member
+func newGRPCTransport() (*GRPCTransport, error) {
+	if localMember == "" {
+		return nil, errors.New("local member is not set")
+	}
+	data, err := os.ReadFile(helper.GetEnv("P2P_MEMBERSHIP", "membership.json"))
+	if err != nil {
+		return nil, err
+	}
+	var membership Membership
+	if err = json.Unmarshal(data, &membership); err != nil {
+		return nil, err
+	}
+	certificate, err := tls.LoadX509KeyPair(helper.GetEnv("P2P_CERT", ""), helper.GetEnv("P2P_KEY", ""))
+	if err != nil {
+		return nil, err
+	}
+	return NewGRPCTransport(localMember, membership, certificate, helper.GetEnv("P2P_LISTEN", ""))
+}
+
+// newNATSTransport builds the NATS transport from the environment:
+//
+//	NATS_URL                  comma separated server URLs, nats://127.0.0.1:4222 by default
+//	NATS_CREDS                credentials file (JWT and NKey seed)
+//	NATS_USER, NATS_PASS      user and password
+//	NATS_REPLICAS             replicas of the JetStream streams, 1 by default
+//	NATS_TLS_CA               CA the server certificate must chain to
+//	NATS_TLS_CERT, NATS_TLS_KEY  client certificate for mutual TLS
+func newNATSTransport() (*NATSTransport, error) {
+	replicas, err := strconv.Atoi(helper.GetEnv("NATS_REPLICAS", "1"))
+	if err != nil {
+		return nil, err
 	}
+
+	options := []nats.Option{nats.Name("mpc-" + localMember)}
+	if creds := helper.GetEnv("NATS_CREDS", ""); creds != "" {
+		options = append(options, nats.UserCredentials(creds))
+	}
+	if user := helper.GetEnv("NATS_USER", ""); user != "" {
+		options = append(options, nats.UserInfo(user, helper.GetEnv("NATS_PASS", "")))
+	}
+	if ca := helper.GetEnv("NATS_TLS_CA", ""); ca != "" {
+		options = append(options, nats.RootCAs(ca))
+	}
+	if cert := helper.GetEnv("NATS_TLS_CERT", ""); cert != "" {
+		options = append(options, nats.ClientCert(cert, helper.GetEnv("NATS_TLS_KEY", "")))
+	}
+
+	return NewNATSTransport(helper.GetEnv("NATS_URL", nats.DefaultURL), replicas, options...)
+}
+
+// newRedisClient builds the Redis client from the environment:
+//
+//	REDIS_MODE             standalone (default), sentinel or cluster
+//	REDIS_ADDR             comma separated list of host:port addresses
+//	REDIS_MASTER           master name, sentinel mode only
+//	REDIS_USER, REDIS_PASS ACL user and password
+//	REDIS_SENTINEL_PASS    password of the sentinel nodes
+//	REDIS_MAX_RETRIES      retries of a failed command, 3 by default
+//	REDIS_TLS              "true" to connect over TLS
+//	REDIS_TLS_CA           CA certificate the server must chain to
+//	REDIS_TLS_CERT         client certificate for mutual TLS
+//	REDIS_TLS_KEY          client key for mutual TLS
+//	REDIS_TLS_SERVER_NAME  expected server name, defaults to the host
+func newRedisClient(mode string) (goredis.UniversalClient, error) {
+	addrs := strings.Split(helper.GetEnv("REDIS_ADDR", LocalAddr), ",")
+	maxRetries, err := strconv.Atoi(helper.GetEnv("REDIS_MAX_RETRIES", "3"))
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := newTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	options := &goredis.UniversalOptions{
+		Addrs:            addrs,
+		Username:         helper.GetEnv("REDIS_USER", ""),
+		Password:         helper.GetEnv("REDIS_PASS", LocalPass),
+		SentinelPassword: helper.GetEnv("REDIS_SENTINEL_PASS", ""),
+		DB:               0,
+		MaxRetries:       maxRetries,
+		MinRetryBackoff:  minReconnectBackoff,
+		MaxRetryBackoff:  maxReconnectBackoff,
+		PoolSize:         100,
+		TLSConfig:        tlsConfig,
+	}
+
+	switch mode {
+	case StandaloneMode:
+		return goredis.NewClient(options.Simple()), nil
+	case SentinelMode:
+		options.MasterName = helper.GetEnv("REDIS_MASTER", "")
+		if options.MasterName == "" {
+			return nil, errors.New("REDIS_MASTER is required in sentinel mode")
+		}
+		return goredis.NewFailoverClient(options.Failover()), nil
+	case ClusterMode:
+		return goredis.NewClusterClient(options.Cluster()), nil
+	}
+	return nil, errors.New("unknown REDIS_MODE: " + mode)
+}
+
+// newTLSConfig returns nil when TLS is disabled. When REDIS_TLS_CA is set only
+// that CA is trusted, the system roots are not consulted.
+func newTLSConfig() (*tls.Config, error) {
+	if helper.GetEnv("REDIS_TLS", "false") != "true" {
+		return nil, nil
+	}
+
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: helper.GetEnv("REDIS_TLS_SERVER_NAME", ""),
+	}
+
+	if caFile := helper.GetEnv("REDIS_TLS_CA", ""); caFile != "" {
+		ca, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, errors.New("no certificates found in " + caFile)
+		}
+		config.RootCAs = pool
+	}
+
+	certFile := helper.GetEnv("REDIS_TLS_CERT", "")
+	keyFile := helper.GetEnv("REDIS_TLS_KEY", "")
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+func GetOutputChannel(name string) chan<- []byte {
 	log.Printf("GetOutputChannel: %s\n", name)
-	return transport.Send(name)
+	return getTransport().Send(name)
 }
 
 func GetInputChannel(name string) <-chan []byte {
-	if transport == nil {
-		getTransport()
-	}
 	log.Printf("GetInputChannel: %s\n", name)
-	return transport.Receive(name)
+	return getTransport().Receive(name)
+}
+
+func CloseOutputChannel(name string) {
+	log.Printf("CloseOutputChannel: %s\n", name)
+	getTransport().CloseSend(name)
+}
+
+func CloseInputChannel(name string) {
+	log.Printf("CloseInputChannel: %s\n", name)
+	getTransport().CloseReceive(name)
+}
+
+func GetStats() TransportStats {
+	return getTransport().Stats()
+}
+
+func GetHealth() TransportHealth {
+	return getTransport().Health()
 }
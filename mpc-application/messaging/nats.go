@@ -0,0 +1,298 @@
+package messaging
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+const sessionStreamMaxAge = time.Hour
+
+// natsStreams maps every traffic class to the JetStream stream that stores it.
+var natsStreams = map[string]string{
+	"protocol": "MPC_PROTOCOL",
+	"internal": "MPC_INTERNAL",
+	"session":  "MPC_SESSION",
+	"info":     "MPC_INFO",
+	"log":      "MPC_LOG",
+	"control":  "MPC_CONTROL",
+}
+
+type natsSubscription struct {
+	ch   chan []byte
+	stop chan struct{}
+}
+
+// NATSTransport stores every message in a JetStream work-queue stream. Each
+// queue is read by its own durable pull consumer, so messages survive a
+// restart of the reader and are only removed once acknowledged.
+type NATSTransport struct {
+	conn *nats.Conn
+	js   nats.JetStreamContext
+
+	mtx          sync.Mutex
+	sendChans    map[string]chan []byte
+	receiveChans map[string]*natsSubscription
+
+	healthMtx  sync.Mutex
+	lastError  string
+	lastChange time.Time
+}
+
+func NewNATSTransport(url string, replicas int, options ...nats.Option) (*NATSTransport, error) {
+	t := &NATSTransport{
+		sendChans:    make(map[string]chan []byte),
+		receiveChans: make(map[string]*natsSubscription),
+		lastChange:   time.Now(),
+	}
+
+	options = append(options,
+		nats.MaxReconnects(-1),
+		nats.ReconnectWait(minReconnectBackoff),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			if err != nil {
+				t.setError(err)
+			}
+			log.Printf("NATSTransport: disconnected: %v\n", err)
+		}),
+		nats.ReconnectHandler(func(_ *nats.Conn) {
+			t.setChanged()
+			log.Printf("NATSTransport: reconnected\n")
+		}),
+	)
+	conn, err := nats.Connect(url, options...)
+	if err != nil {
+		return nil, err
+	}
+	js, err := conn.JetStream()
+	if err != nil {
+		return nil, err
+	}
+	t.conn = conn
+	t.js = js
+
+	for class, stream := range natsStreams {
+		config := &nats.StreamConfig{
+			Name:      stream,
+			Subjects:  []string{"mpc." + class + ".>"},
+			Retention: nats.WorkQueuePolicy,
+			Storage:   nats.FileStorage,
+			Replicas:  replicas,
+		}
+		if class == "session" {
+			config.MaxAge = sessionStreamMaxAge
+		}
+		if _, err = js.StreamInfo(stream); err == nil {
+			_, err = js.UpdateStream(config)
+		} else {
+			_, err = js.AddStream(config)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return t, nil
+}
+
+// natsSubject turns a channel name such as "protocol:messages:a" into the
+// subject "mpc.protocol.messages.a".
+func natsSubject(name string) string {
+	return "mpc." + strings.ReplaceAll(name, ":", ".")
+}
+
+func natsStream(name string) string {
+	return natsStreams[strings.SplitN(name, ":", 2)[0]]
+}
+
+func natsDurable(name string) string {
+	return strings.NewReplacer(":", "_", ".", "_", "*", "_", ">", "_").Replace(name)
+}
+
+func (t *NATSTransport) Send(name string) chan<- []byte {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	if ch, ok := t.sendChans[name]; ok {
+		return ch
+	}
+
+	ch := make(chan []byte, 1024)
+	go func() {
+		for msg := range ch {
+			t.push(name, msg)
+		}
+	}()
+
+	t.sendChans[name] = ch
+	return ch
+}
+
+// push retries with backoff until JetStream acknowledged that the message was
+// stored.
+func (t *NATSTransport) push(name string, msg []byte) {
+	backoff := minReconnectBackoff
+	for {
+		_, err := t.js.Publish(natsSubject(name), msg)
+		if err == nil {
+			return
+		}
+		t.setError(err)
+		log.Printf("NATSTransport: failed to publish to %s, retrying in %v: %v\n", name, backoff, err)
+		time.Sleep(backoff)
+		backoff = nextBackoff(backoff)
+	}
+}
+
+func (t *NATSTransport) Receive(name string) <-chan []byte {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	if sub, ok := t.receiveChans[name]; ok {
+		return sub.ch
+	}
+
+	sub := &natsSubscription{
+		ch:   make(chan []byte, 1024),
+		stop: make(chan struct{}),
+	}
+	go t.subscribe(name, sub)
+
+	t.receiveChans[name] = sub
+	return sub.ch
+}
+
+func (t *NATSTransport) subscribe(name string, sub *natsSubscription) {
+	defer close(sub.ch)
+
+	stream := natsStream(name)
+	durable := natsDurable(name)
+	backoff := minReconnectBackoff
+
+	var pull *nats.Subscription
+	for pull == nil {
+		var err error
+		pull, err = t.js.PullSubscribe(natsSubject(name), durable, nats.BindStream(stream), nats.AckExplicit())
+		if err != nil {
+			t.setError(err)
+			log.Printf("NATSTransport: failed to subscribe to %s, retrying in %v: %v\n", name, backoff, err)
+			select {
+			case <-sub.stop:
+				return
+			case <-time.After(backoff):
+			}
+			backoff = nextBackoff(backoff)
+		}
+	}
+	defer func() {
+		_ = pull.Unsubscribe()
+		if strings.HasPrefix(name, SessionMessagesChannel+":") {
+			_ = t.js.DeleteConsumer(stream, durable)
+		}
+	}()
+
+	backoff = minReconnectBackoff
+	for {
+		select {
+		case <-sub.stop:
+			return
+		default:
+		}
+
+		msgs, err := pull.Fetch(1, nats.MaxWait(receiveTimeout))
+		if err == nats.ErrTimeout {
+			continue
+		}
+		if err != nil {
+			t.setError(err)
+			log.Printf("NATSTransport: failed to fetch from %s, retrying in %v: %v\n", name, backoff, err)
+			select {
+			case <-sub.stop:
+				return
+			case <-time.After(backoff):
+			}
+			backoff = nextBackoff(backoff)
+			continue
+		}
+		backoff = minReconnectBackoff
+
+		for _, msg := range msgs {
+			select {
+			case sub.ch <- msg.Data:
+				_ = msg.Ack()
+			case <-sub.stop:
+				_ = msg.Nak()
+				return
+			}
+		}
+	}
+}
+
+func (t *NATSTransport) CloseSend(name string) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	if ch, ok := t.sendChans[name]; ok {
+		close(ch)
+		delete(t.sendChans, name)
+	}
+}
+
+func (t *NATSTransport) CloseReceive(name string) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	if sub, ok := t.receiveChans[name]; ok {
+		close(sub.stop)
+		delete(t.receiveChans, name)
+	}
+}
+
+func (t *NATSTransport) Stats() TransportStats {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	return TransportStats{
+		SendChannels:    len(t.sendChans),
+		ReceiveChannels: len(t.receiveChans),
+	}
+}
+
+func (t *NATSTransport) Health() TransportHealth {
+	t.healthMtx.Lock()
+	defer t.healthMtx.Unlock()
+
+	health := TransportHealth{
+		Mode:       NATSTransportName,
+		LastError:  t.lastError,
+		LastChange: t.lastChange,
+		Reconnects: int(t.conn.Stats().Reconnects),
+	}
+	switch t.conn.Status() {
+	case nats.CONNECTED:
+		health.State = Connected
+	case nats.CONNECTING, nats.RECONNECTING:
+		health.State = Connecting
+	default:
+		health.State = Disconnected
+	}
+	return health
+}
+
+func (t *NATSTransport) setError(err error) {
+	t.healthMtx.Lock()
+	defer t.healthMtx.Unlock()
+
+	t.lastError = err.Error()
+	t.lastChange = time.Now()
+}
+
+func (t *NATSTransport) setChanged() {
+	t.healthMtx.Lock()
+	defer t.healthMtx.Unlock()
+
+	t.lastChange = time.Now()
+}
@@ -0,0 +1,157 @@
+package messaging
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	natsserver "github.com/nats-io/nats-server/v2/test"
+)
+
+// runNATSServer starts an in-process NATS server with JetStream.
+func runNATSServer(t *testing.T) *server.Server {
+	t.Helper()
+	opts := natsserver.DefaultTestOptions
+	opts.Port = -1
+	opts.JetStream = true
+	opts.StoreDir = t.TempDir()
+	s := natsserver.RunServer(&opts)
+	t.Cleanup(s.Shutdown)
+	return s
+}
+
+func newTestNATSTransport(t *testing.T, s *server.Server) *NATSTransport {
+	t.Helper()
+	transport, err := NewNATSTransport(s.ClientURL(), 1)
+	if err != nil {
+		t.Fatalf("NewNATSTransport: %v", err)
+	}
+	t.Cleanup(transport.conn.Close)
+	return transport
+}
+
+func receive(t *testing.T, ch <-chan []byte) string {
+	t.Helper()
+	select {
+	case msg, ok := <-ch:
+		if !ok {
+			t.Fatal("receive channel closed")
+		}
+		return string(msg)
+	case <-time.After(10 * time.Second):
+		t.Fatal("no message received")
+	}
+	return ""
+}
+
+func TestNATSTransportCreatesStreams(t *testing.T) {
+	s := runNATSServer(t)
+	transport := newTestNATSTransport(t, s)
+	for class, stream := range natsStreams {
+		info, err := transport.js.StreamInfo(stream)
+		if err != nil {
+			t.Fatalf("stream %s of %s: %v", stream, class, err)
+		}
+		if want := "mpc." + class + ".>"; len(info.Config.Subjects) != 1 || info.Config.Subjects[0] != want {
+			t.Errorf("stream %s subjects = %v, want %s", stream, info.Config.Subjects, want)
+		}
+	}
+	// a second transport updates the existing streams
+	newTestNATSTransport(t, s)
+	if health := transport.Health(); health.State != Connected {
+		t.Errorf("state = %s, want %s", health.State, Connected)
+	}
+}
+
+func TestNATSTransportSendReceive(t *testing.T) {
+	s := runNATSServer(t)
+	transport := newTestNATSTransport(t, s)
+	name := ProtocolMessagesChannel + ":a"
+
+	transport.Send(name) <- []byte("one")
+	transport.Send(name) <- []byte("two")
+	ch := transport.Receive(name)
+	if msg := receive(t, ch); msg != "one" {
+		t.Errorf("first message = %q, want one", msg)
+	}
+	if msg := receive(t, ch); msg != "two" {
+		t.Errorf("second message = %q, want two", msg)
+	}
+	if stats := transport.Stats(); stats.SendChannels != 1 || stats.ReceiveChannels != 1 {
+		t.Errorf("stats = %+v, want one send and one receive channel", stats)
+	}
+}
+
+// Every queue of the application is stored in one of the streams.
+func TestNATSStreamsCoverChannels(t *testing.T) {
+	channels := []string{ProtocolMessagesChannel, InternalMessagesChannel, SessionMessagesChannel,
+		InfoRequestMessagesChannel, InfoResponseMessagesChannel, LogMessagesChannel, ControlMessagesChannel}
+	for _, name := range channels {
+		if _, ok := natsStreams[strings.SplitN(name, ":", 2)[0]]; !ok {
+			t.Errorf("no stream for %s", name)
+		}
+	}
+}
+
+// Messages are stored until a reader acknowledges them, so a reader that
+// starts after a restart still gets what was sent while it was away.
+func TestNATSTransportDurability(t *testing.T) {
+	s := runNATSServer(t)
+	sender := newTestNATSTransport(t, s)
+	name := InternalMessagesChannel + ":b"
+
+	first := newTestNATSTransport(t, s)
+	ch := first.Receive(name)
+	sender.Send(name) <- []byte("before")
+	if msg := receive(t, ch); msg != "before" {
+		t.Fatalf("message = %q, want before", msg)
+	}
+	first.CloseReceive(name)
+	for range ch {
+	}
+
+	sender.Send(name) <- []byte("while away")
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		info, err := sender.js.StreamInfo(natsStreams["internal"])
+		if err != nil {
+			t.Fatalf("StreamInfo: %v", err)
+		}
+		if info.State.Msgs == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("stream holds %d messages, want 1", info.State.Msgs)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	second := newTestNATSTransport(t, s)
+	if msg := receive(t, second.Receive(name)); msg != "while away" {
+		t.Errorf("message = %q, want while away", msg)
+	}
+}
+
+// Session consumers are deleted when their channel is closed, so finished
+// sessions don't pile up consumers on the server.
+func TestNATSTransportDeletesSessionConsumers(t *testing.T) {
+	s := runNATSServer(t)
+	transport := newTestNATSTransport(t, s)
+	name := SessionMessagesChannel + ":s1:a"
+
+	ch := transport.Receive(name)
+	transport.Send(name) <- []byte("result")
+	if msg := receive(t, ch); msg != "result" {
+		t.Fatalf("message = %q, want result", msg)
+	}
+	if _, err := transport.js.ConsumerInfo(natsStreams["session"], natsDurable(name)); err != nil {
+		t.Fatalf("ConsumerInfo: %v", err)
+	}
+	transport.CloseReceive(name)
+	for range ch {
+	}
+	if _, err := transport.js.ConsumerInfo(natsStreams["session"], natsDurable(name)); err == nil {
+		t.Error("session consumer still exists")
+	}
+}
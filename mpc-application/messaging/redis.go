@@ -0,0 +1,239 @@
+package messaging
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	goredis "github.com/go-redis/redis/v8"
+)
+
+// receiveTimeout bounds a single BRPOP call so subscribers can notice that
+// their channel was closed instead of blocking on Redis forever.
+const receiveTimeout = time.Second
+
+const minReconnectBackoff = 100 * time.Millisecond
+const maxReconnectBackoff = 10 * time.Second
+const healthCheckInterval = 5 * time.Second
+
+type subscription struct {
+	ch   chan []byte
+	stop chan struct{}
+}
+
+type RedisTransport struct {
+	client goredis.UniversalClient
+	mode   string
+
+	mtx          sync.Mutex
+	sendChans    map[string]chan []byte
+	receiveChans map[string]*subscription
+
+	healthMtx sync.Mutex
+	health    TransportHealth
+}
+
+func NewRedisTransport(client goredis.UniversalClient, mode string) *RedisTransport {
+	t := &RedisTransport{
+		client:       client,
+		mode:         mode,
+		sendChans:    make(map[string]chan []byte),
+		receiveChans: make(map[string]*subscription),
+		health: TransportHealth{
+			Mode:       mode,
+			State:      Connecting,
+			LastChange: time.Now(),
+		},
+	}
+	go t.watch()
+	return t
+}
+
+func (t *RedisTransport) Send(name string) chan<- []byte {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	if ch, ok := t.sendChans[name]; ok {
+		return ch
+	}
+
+	ch := make(chan []byte, 1024)
+	go func() {
+		for msg := range ch {
+			t.push(name, msg)
+		}
+	}()
+
+	t.sendChans[name] = ch
+	return ch
+}
+
+// push retries with backoff until the message is stored, so a failover only
+// delays delivery instead of dropping the message.
+func (t *RedisTransport) push(name string, msg []byte) {
+	backoff := minReconnectBackoff
+	for {
+		err := t.client.RPush(context.Background(), name, msg).Err()
+		if err == nil {
+			t.setConnected()
+			return
+		}
+		t.setDisconnected(err)
+		log.Printf("RedisTransport: failed to push to %s, retrying in %v: %v\n", name, backoff, err)
+		time.Sleep(backoff)
+		backoff = nextBackoff(backoff)
+	}
+}
+
+func (t *RedisTransport) Receive(name string) <-chan []byte {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	if sub, ok := t.receiveChans[name]; ok {
+		return sub.ch
+	}
+
+	sub := &subscription{
+		ch:   make(chan []byte, 1024),
+		stop: make(chan struct{}),
+	}
+	go t.subscribe(name, sub)
+
+	t.receiveChans[name] = sub
+	return sub.ch
+}
+
+func (t *RedisTransport) subscribe(name string, sub *subscription) {
+	defer close(sub.ch)
+
+	backoff := minReconnectBackoff
+	failed := false
+	for {
+		select {
+		case <-sub.stop:
+			return
+		default:
+		}
+
+		data, err := t.client.BRPop(context.Background(), receiveTimeout, name).Result()
+		if err != nil && err != goredis.Nil {
+			t.setDisconnected(err)
+			log.Printf("RedisTransport: failed to pop from %s, retrying in %v: %v\n", name, backoff, err)
+			failed = true
+			select {
+			case <-sub.stop:
+				return
+			case <-time.After(backoff):
+			}
+			backoff = nextBackoff(backoff)
+			continue
+		}
+
+		t.setConnected()
+		if failed {
+			log.Printf("RedisTransport: subscription to %s re-established\n", name)
+			failed = false
+			backoff = minReconnectBackoff
+		}
+		if err == goredis.Nil {
+			continue
+		}
+
+		select {
+		case sub.ch <- []byte(data[len(data)-1]):
+		case <-sub.stop:
+			return
+		}
+	}
+}
+
+// CloseSend closes the named send channel once all buffered messages have
+// been pushed to Redis.
+func (t *RedisTransport) CloseSend(name string) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	if ch, ok := t.sendChans[name]; ok {
+		close(ch)
+		delete(t.sendChans, name)
+	}
+}
+
+// CloseReceive stops the named subscription. The channel returned by Receive
+// is closed when its goroutine exits.
+func (t *RedisTransport) CloseReceive(name string) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	if sub, ok := t.receiveChans[name]; ok {
+		close(sub.stop)
+		delete(t.receiveChans, name)
+	}
+}
+
+func (t *RedisTransport) Stats() TransportStats {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	return TransportStats{
+		SendChannels:    len(t.sendChans),
+		ReceiveChannels: len(t.receiveChans),
+	}
+}
+
+func (t *RedisTransport) Health() TransportHealth {
+	t.healthMtx.Lock()
+	defer t.healthMtx.Unlock()
+
+	return t.health
+}
+
+// watch pings Redis periodically so the health state also changes when no
+// channel is active.
+func (t *RedisTransport) watch() {
+	for {
+		err := t.client.Ping(context.Background()).Err()
+		if err != nil {
+			t.setDisconnected(err)
+		} else {
+			t.setConnected()
+		}
+		time.Sleep(healthCheckInterval)
+	}
+}
+
+func (t *RedisTransport) setConnected() {
+	t.healthMtx.Lock()
+	defer t.healthMtx.Unlock()
+
+	if t.health.State == Connected {
+		return
+	}
+	if t.health.State == Disconnected {
+		t.health.Reconnects++
+		log.Printf("RedisTransport: reconnected to %s redis\n", t.mode)
+	}
+	t.health.State = Connected
+	t.health.LastChange = time.Now()
+}
+
+func (t *RedisTransport) setDisconnected(err error) {
+	t.healthMtx.Lock()
+	defer t.healthMtx.Unlock()
+
+	t.health.LastError = err.Error()
+	if t.health.State == Disconnected {
+		return
+	}
+	t.health.State = Disconnected
+	t.health.LastChange = time.Now()
+}
+
+func nextBackoff(backoff time.Duration) time.Duration {
+	backoff *= 2
+	if backoff > maxReconnectBackoff {
+		return maxReconnectBackoff
+	}
+	return backoff
+}
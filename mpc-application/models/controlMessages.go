@@ -0,0 +1,96 @@
+package models
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"mpc_poc/messaging"
+
+	"github.com/koteld/multi-party-sig/pkg/party"
+)
+
+type Command string
+
+const (
+	Freeze   Command = "control/freeze"
+	Unfreeze Command = "control/unfreeze"
+)
+
+type (
+	// FreezeState stops all protocols of Address, of every key if Address is
+	// empty. ID is what admins sign to lift it.
+	FreezeState struct {
+		ID      string    `json:"id"`
+		Address string    `json:"address,omitempty"`
+		Reason  string    `json:"reason,omitempty"`
+		By      string    `json:"by,omitempty"`
+		At      time.Time `json:"at"`
+	}
+
+	// AdminSignature is the signature of an admin of "unfreeze <id>" as
+	// personal_sign signs it.
+	AdminSignature struct {
+		Admin     string `json:"admin"`
+		Signature string `json:"signature"`
+	}
+
+	// ControlMessage is handled by participants as it arrives, also while
+	// they run a protocol. Signature is the signature of From with its
+	// message key.
+	ControlMessage struct {
+		Command    Command          `json:"command"`
+		Freeze     FreezeState      `json:"freeze"`
+		Signatures []AdminSignature `json:"signatures,omitempty"`
+		From       party.ID         `json:"from"`
+		Signature  []byte           `json:"signature"`
+	}
+)
+
+var controlMessageInputChannels = make(map[party.ID]<-chan *ControlMessage)
+var controlMessageOutputChannels = make(map[party.ID]chan<- *ControlMessage)
+
+var controlMtx sync.Mutex
+
+func GetControlMessageInputChannel(ID party.ID) <-chan *ControlMessage {
+	controlMtx.Lock()
+	defer controlMtx.Unlock()
+	if controlMessageInputChannels[ID] == nil {
+		rawInput := messaging.GetInputChannel(messaging.ControlMessagesChannel + ":" + string(ID))
+		res := make(chan *ControlMessage)
+
+		go func() {
+			for val := range rawInput {
+				bs := &ControlMessage{}
+				err := json.Unmarshal(val, bs)
+				if err == nil {
+					res <- bs
+				}
+			}
+		}()
+
+		controlMessageInputChannels[ID] = res
+	}
+	return controlMessageInputChannels[ID]
+}
+
+func GetControlMessageOutputChannel(ID party.ID) chan<- *ControlMessage {
+	controlMtx.Lock()
+	defer controlMtx.Unlock()
+	if controlMessageOutputChannels[ID] == nil {
+		rawOutput := messaging.GetOutputChannel(messaging.ControlMessagesChannel + ":" + string(ID))
+		res := make(chan *ControlMessage)
+
+		go func() {
+			for bs := range res {
+				val, err := json.Marshal(bs)
+				if err == nil {
+					rawOutput <- val
+				}
+			}
+		}()
+
+		controlMessageOutputChannels[ID] = res
+	}
+	return controlMessageOutputChannels[ID]
+}
@@ -2,6 +2,7 @@ package models
 
 import (
 	"encoding/json"
+	"sync"
 
 	"mpc_poc/messaging"
 
@@ -13,18 +14,26 @@ type Info string
 const (
 	Online  Info = "info/online"
 	Configs Info = "info/configs"
+	Metrics Info = "info/metrics"
 )
 
 type (
 	InfoRequestMessage struct {
-		Info Info `json:"info"`
+		// ID is echoed in the response, so concurrent requests get their own
+		// responses.
+		ID   string `json:"id"`
+		Info Info   `json:"info"`
 	}
 )
 
 var infoRequestMessageInputChannels = make(map[party.ID]<-chan *InfoRequestMessage)
 var infoRequestMessageOutputChannels = make(map[party.ID]chan<- *InfoRequestMessage)
 
+var infoRequestMtx sync.Mutex
+
 func GetInfoRequestMessageInputChannel(ID party.ID) <-chan *InfoRequestMessage {
+	infoRequestMtx.Lock()
+	defer infoRequestMtx.Unlock()
 	if infoRequestMessageInputChannels[ID] == nil {
 		rawInput := messaging.GetInputChannel(messaging.InfoRequestMessagesChannel + ":" + string(ID))
 		res := make(chan *InfoRequestMessage)
@@ -45,6 +54,8 @@ func GetInfoRequestMessageInputChannel(ID party.ID) <-chan *InfoRequestMessage {
 }
 
 func GetInfoRequestMessageOutputChannel(ID party.ID) chan<- *InfoRequestMessage {
+	infoRequestMtx.Lock()
+	defer infoRequestMtx.Unlock()
 	if infoRequestMessageOutputChannels[ID] == nil {
 		rawOutput := messaging.GetOutputChannel(messaging.InfoRequestMessagesChannel + ":" + string(ID))
 		res := make(chan *InfoRequestMessage)
@@ -2,6 +2,7 @@ package models
 
 import (
 	"encoding/json"
+	"sync"
 
 	"mpc_poc/messaging"
 
@@ -13,21 +14,30 @@ type (
 		Address   string        `json:"address"`
 		IDs       party.IDSlice `json:"participants"`
 		SessionID string        `json:"sessionId"`
+		PublicKey string        `json:"publicKey"`
+		Frozen    bool          `json:"frozen,omitempty"`
 	}
 )
 
 type (
 	InfoResponseMessage struct {
-		Info    Info            `json:"info"`
-		Online  bool            `json:"online"`
-		Configs []ConfigMessage `json:"configs"`
+		RequestID  string            `json:"requestId"`
+		Info       Info              `json:"info"`
+		Online     bool              `json:"online"`
+		Configs    []ConfigMessage   `json:"configs"`
+		Rejections map[string]uint64 `json:"rejections,omitempty"`
+		Frozen     []FreezeState     `json:"frozen,omitempty"`
 	}
 )
 
 var infoResponseMessageInputChannels = make(map[party.ID]<-chan *InfoResponseMessage)
 var infoResponseMessageOutputChannels = make(map[party.ID]chan<- *InfoResponseMessage)
 
+var infoResponseMtx sync.Mutex
+
 func GetInfoResponseMessageInputChannel(ID party.ID) <-chan *InfoResponseMessage {
+	infoResponseMtx.Lock()
+	defer infoResponseMtx.Unlock()
 	if infoResponseMessageInputChannels[ID] == nil {
 		rawInput := messaging.GetInputChannel(messaging.InfoResponseMessagesChannel + ":" + string(ID))
 		res := make(chan *InfoResponseMessage)
@@ -48,6 +58,8 @@ func GetInfoResponseMessageInputChannel(ID party.ID) <-chan *InfoResponseMessage
 }
 
 func GetInfoResponseMessageOutputChannel(ID party.ID) chan<- *InfoResponseMessage {
+	infoResponseMtx.Lock()
+	defer infoResponseMtx.Unlock()
 	if infoResponseMessageOutputChannels[ID] == nil {
 		rawOutput := messaging.GetOutputChannel(messaging.InfoResponseMessagesChannel + ":" + string(ID))
 		res := make(chan *InfoResponseMessage)
@@ -2,6 +2,7 @@ package models
 
 import (
 	"encoding/json"
+	"sync"
 
 	"mpc_poc/messaging"
 
@@ -11,14 +12,25 @@ import (
 
 type (
 	InternalMessage struct {
-		Message protocol.Message `json:"message"`
+		SessionID string   `json:"sessionID"`
+		From      party.ID `json:"from"`
+		Round     uint16   `json:"round"`
+		Sequence  uint64   `json:"sequence"`
+		// Abort tells that the sender left the session, Message.Data is why.
+		Abort     bool             `json:"abort,omitempty"`
+		Message   protocol.Message `json:"message"`
+		Signature []byte           `json:"signature"`
 	}
 )
 
 var internalMessageInputChannels = make(map[party.ID]<-chan *InternalMessage)
 var internalMessageOutputChannels = make(map[party.ID]chan<- *InternalMessage)
 
+var internalMtx sync.Mutex
+
 func GetInternalMessageInputChannel(ID party.ID) <-chan *InternalMessage {
+	internalMtx.Lock()
+	defer internalMtx.Unlock()
 	if internalMessageInputChannels[ID] == nil {
 		rawInput := messaging.GetInputChannel(messaging.InternalMessagesChannel + ":" + string(ID))
 		res := make(chan *InternalMessage)
@@ -39,6 +51,8 @@ func GetInternalMessageInputChannel(ID party.ID) <-chan *InternalMessage {
 }
 
 func GetInternalMessageOutputChannel(ID party.ID) chan<- *InternalMessage {
+	internalMtx.Lock()
+	defer internalMtx.Unlock()
 	if internalMessageOutputChannels[ID] == nil {
 		rawOutput := messaging.GetOutputChannel(messaging.InternalMessagesChannel + ":" + string(ID))
 		res := make(chan *InternalMessage)
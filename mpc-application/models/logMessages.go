@@ -2,6 +2,7 @@ package models
 
 import (
 	"encoding/json"
+	"sync"
 
 	"mpc_poc/messaging"
 )
@@ -18,35 +19,46 @@ type (
 	}
 )
 
+var logMessageInputChannel <-chan *LogMessage
+var logMessageOutputChannel chan<- *LogMessage
+var logMessageInputOnce sync.Once
+var logMessageOutputOnce sync.Once
+
 func GetLogMessageInputChannel() <-chan *LogMessage {
-	rawInput := messaging.GetInputChannel(messaging.LogMessagesChannel)
-	res := make(chan *LogMessage)
-
-	go func() {
-		for val := range rawInput {
-			bs := &LogMessage{}
-			err := json.Unmarshal(val, bs)
-			if err == nil {
-				res <- bs
+	logMessageInputOnce.Do(func() {
+		rawInput := messaging.GetInputChannel(messaging.LogMessagesChannel)
+		res := make(chan *LogMessage)
+
+		go func() {
+			for val := range rawInput {
+				bs := &LogMessage{}
+				err := json.Unmarshal(val, bs)
+				if err == nil {
+					res <- bs
+				}
 			}
-		}
-	}()
+		}()
 
-	return res
+		logMessageInputChannel = res
+	})
+	return logMessageInputChannel
 }
 
 func GetLogMessageOutputChannel() chan<- *LogMessage {
-	rawOutput := messaging.GetOutputChannel(messaging.LogMessagesChannel)
-	res := make(chan *LogMessage)
-
-	go func() {
-		for bs := range res {
-			val, err := json.Marshal(bs)
-			if err == nil {
-				rawOutput <- val
+	logMessageOutputOnce.Do(func() {
+		rawOutput := messaging.GetOutputChannel(messaging.LogMessagesChannel)
+		res := make(chan *LogMessage)
+
+		go func() {
+			for bs := range res {
+				val, err := json.Marshal(bs)
+				if err == nil {
+					rawOutput <- val
+				}
 			}
-		}
-	}()
+		}()
 
-	return res
+		logMessageOutputChannel = res
+	})
+	return logMessageOutputChannel
 }
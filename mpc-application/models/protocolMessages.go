@@ -2,8 +2,10 @@ package models
 
 import (
 	"encoding/json"
+	"sync"
 
 	"mpc_poc/messaging"
+	"mpc_poc/payload"
 
 	"github.com/koteld/multi-party-sig/pkg/party"
 )
@@ -16,6 +18,12 @@ const (
 	Sign       Protocol = "protocol/sign"
 	PreSign    Protocol = "protocol/presign"
 	SignOnline Protocol = "protocol/signonline"
+	// Transaction marks log messages of the transaction watcher
+	Transaction Protocol = "transaction"
+	// Approval marks log messages of approval requests
+	Approval Protocol = "approval"
+	// Control marks log messages of freezes
+	Control Protocol = "control"
 )
 
 type (
@@ -26,13 +34,20 @@ type (
 		SessionID   []byte        `json:"sessionID"`
 		MessageHash []byte        `json:"messageHash"`
 		Address     string        `json:"address"`
+		// Payload is the preimage of MessageHash, participants check it
+		// before they sign.
+		Payload *payload.Payload `json:"payload,omitempty"`
 	}
 )
 
 var protocolMessageInputChannels = make(map[party.ID]<-chan *ProtocolMessage)
 var protocolMessageOutputChannels = make(map[party.ID]chan<- *ProtocolMessage)
 
+var protocolMtx sync.Mutex
+
 func GetProtocolMessageInputChannel(ID party.ID) <-chan *ProtocolMessage {
+	protocolMtx.Lock()
+	defer protocolMtx.Unlock()
 	if protocolMessageInputChannels[ID] == nil {
 		rawInput := messaging.GetInputChannel(messaging.ProtocolMessagesChannel + ":" + string(ID))
 		res := make(chan *ProtocolMessage)
@@ -53,6 +68,8 @@ func GetProtocolMessageInputChannel(ID party.ID) <-chan *ProtocolMessage {
 }
 
 func GetProtocolMessageOutputChannel(ID party.ID) chan<- *ProtocolMessage {
+	protocolMtx.Lock()
+	defer protocolMtx.Unlock()
 	if protocolMessageOutputChannels[ID] == nil {
 		rawOutput := messaging.GetOutputChannel(messaging.ProtocolMessagesChannel + ":" + string(ID))
 		res := make(chan *ProtocolMessage)
@@ -12,51 +12,100 @@ import (
 type (
 	SessionMessage struct {
 		Result interface{} `json:"result"`
-		Error  error       `json:"error"`
+		Error  string      `json:"error,omitempty"`
+		// Refused is why a participant refused to sign, nil otherwise.
+		Refused *Refusal `json:"refused,omitempty"`
+	}
+
+	// Refusal is the rule of a participant a signing request violates.
+	Refusal struct {
+		Participant party.ID `json:"participant"`
+		Rule        string   `json:"rule"`
+		Reason      string   `json:"reason"`
 	}
 )
 
-var sessionMessageInputChannels = make(map[string]map[party.ID]<-chan *SessionMessage)
-var sessionMessageOutputChannels = make(map[string]map[party.ID]chan<- *SessionMessage)
+type (
+	ChannelStats struct {
+		Sessions              int `json:"sessions"`
+		SessionInputChannels  int `json:"sessionInputChannels"`
+		SessionOutputChannels int `json:"sessionOutputChannels"`
+	}
+)
+
+type sessionInputChannel struct {
+	ch   <-chan *SessionMessage
+	done chan struct{}
+	refs int
+}
+
+type sessionOutputChannel struct {
+	ch      chan *SessionMessage
+	drained chan struct{}
+	refs    int
+}
+
+var sessionMessageInputChannels = make(map[string]map[party.ID]*sessionInputChannel)
+var sessionMessageOutputChannels = make(map[string]map[party.ID]*sessionOutputChannel)
 
 var mtx sync.Mutex
 
+func sessionMessagesChannelName(SessionID string, ID party.ID) string {
+	return messaging.SessionMessagesChannel + ":" + SessionID + ":" + string(ID)
+}
+
+// GetSessionMessageInputChannel returns the input channel of the participant
+// in the session and takes a reference on it. Every call must be paired with
+// ReleaseSessionMessageInputChannel.
 func GetSessionMessageInputChannel(SessionID string, ID party.ID) <-chan *SessionMessage {
 	mtx.Lock()
 	defer mtx.Unlock()
 	if sessionMessageInputChannels[SessionID][ID] == nil {
 		if sessionMessageInputChannels[SessionID] == nil {
-			sessionMessageInputChannels[SessionID] = make(map[party.ID]<-chan *SessionMessage)
+			sessionMessageInputChannels[SessionID] = make(map[party.ID]*sessionInputChannel)
 		}
-		rawInput := messaging.GetInputChannel(messaging.SessionMessagesChannel + ":" + string(SessionID) + ":" + string(ID))
+		rawInput := messaging.GetInputChannel(sessionMessagesChannelName(SessionID, ID))
 		res := make(chan *SessionMessage)
+		done := make(chan struct{})
 
 		go func() {
+			defer close(res)
 			for val := range rawInput {
 				bs := &SessionMessage{}
 				err := json.Unmarshal(val, bs)
 				if err == nil {
-					res <- bs
+					select {
+					case res <- bs:
+					case <-done:
+						return
+					}
 				}
 			}
 		}()
 
-		sessionMessageInputChannels[SessionID][ID] = res
+		sessionMessageInputChannels[SessionID][ID] = &sessionInputChannel{ch: res, done: done}
 	}
-	return sessionMessageInputChannels[SessionID][ID]
+	sessionMessageInputChannels[SessionID][ID].refs++
+	return sessionMessageInputChannels[SessionID][ID].ch
 }
 
+// GetSessionMessageOutputChannel returns the output channel of the participant
+// in the session and takes a reference on it. Every call must be paired with
+// ReleaseSessionMessageOutputChannel once nothing more will be sent.
 func GetSessionMessageOutputChannel(SessionID string, ID party.ID) chan<- *SessionMessage {
 	mtx.Lock()
 	defer mtx.Unlock()
 	if sessionMessageOutputChannels[SessionID][ID] == nil {
 		if sessionMessageOutputChannels[SessionID] == nil {
-			sessionMessageOutputChannels[SessionID] = make(map[party.ID]chan<- *SessionMessage)
+			sessionMessageOutputChannels[SessionID] = make(map[party.ID]*sessionOutputChannel)
 		}
-		rawOutput := messaging.GetOutputChannel(messaging.SessionMessagesChannel + ":" + string(SessionID) + ":" + string(ID))
+		name := sessionMessagesChannelName(SessionID, ID)
+		rawOutput := messaging.GetOutputChannel(name)
 		res := make(chan *SessionMessage)
+		drained := make(chan struct{})
 
 		go func() {
+			defer close(drained)
 			for bs := range res {
 				val, err := json.Marshal(bs)
 				if err == nil {
@@ -65,7 +114,92 @@ func GetSessionMessageOutputChannel(SessionID string, ID party.ID) chan<- *Sessi
 			}
 		}()
 
-		sessionMessageOutputChannels[SessionID][ID] = res
+		sessionMessageOutputChannels[SessionID][ID] = &sessionOutputChannel{ch: res, drained: drained}
+	}
+	sessionMessageOutputChannels[SessionID][ID].refs++
+	return sessionMessageOutputChannels[SessionID][ID].ch
+}
+
+func ReleaseSessionMessageInputChannel(SessionID string, ID party.ID) {
+	mtx.Lock()
+	defer mtx.Unlock()
+	c := sessionMessageInputChannels[SessionID][ID]
+	if c == nil {
+		return
+	}
+	c.refs--
+	if c.refs <= 0 {
+		closeSessionMessageInputChannel(SessionID, ID, c)
+	}
+}
+
+func ReleaseSessionMessageOutputChannel(SessionID string, ID party.ID) {
+	mtx.Lock()
+	defer mtx.Unlock()
+	c := sessionMessageOutputChannels[SessionID][ID]
+	if c == nil {
+		return
+	}
+	c.refs--
+	if c.refs <= 0 {
+		closeSessionMessageOutputChannel(SessionID, ID, c)
+	}
+}
+
+// CloseSession tears down the channels of the session that are no longer
+// referenced. A channel somebody still holds is closed by its last release,
+// so a concurrent sender never sends on a closed channel.
+func CloseSession(SessionID string) {
+	mtx.Lock()
+	defer mtx.Unlock()
+	for ID, c := range sessionMessageInputChannels[SessionID] {
+		if c.refs <= 0 {
+			closeSessionMessageInputChannel(SessionID, ID, c)
+		}
+	}
+	for ID, c := range sessionMessageOutputChannels[SessionID] {
+		if c.refs <= 0 {
+			closeSessionMessageOutputChannel(SessionID, ID, c)
+		}
+	}
+}
+
+func GetChannelStats() ChannelStats {
+	mtx.Lock()
+	defer mtx.Unlock()
+	stats := ChannelStats{}
+	sessions := make(map[string]bool)
+	for SessionID, channels := range sessionMessageInputChannels {
+		sessions[SessionID] = true
+		stats.SessionInputChannels += len(channels)
+	}
+	for SessionID, channels := range sessionMessageOutputChannels {
+		sessions[SessionID] = true
+		stats.SessionOutputChannels += len(channels)
+	}
+	stats.Sessions = len(sessions)
+	return stats
+}
+
+func closeSessionMessageInputChannel(SessionID string, ID party.ID, c *sessionInputChannel) {
+	close(c.done)
+	messaging.CloseInputChannel(sessionMessagesChannelName(SessionID, ID))
+	delete(sessionMessageInputChannels[SessionID], ID)
+	if len(sessionMessageInputChannels[SessionID]) == 0 {
+		delete(sessionMessageInputChannels, SessionID)
+	}
+}
+
+// closeSessionMessageOutputChannel closes the transport channel once the
+// pending message is passed on and before the entry is deleted, so it never
+// closes the channel of a later GetSessionMessageOutputChannel with the same
+// name.
+func closeSessionMessageOutputChannel(SessionID string, ID party.ID, c *sessionOutputChannel) {
+	close(c.ch)
+	<-c.drained
+	messaging.CloseOutputChannel(sessionMessagesChannelName(SessionID, ID))
+	delete(sessionMessageOutputChannels[SessionID], ID)
+	if len(sessionMessageOutputChannels[SessionID]) == 0 {
+		delete(sessionMessageOutputChannels, SessionID)
 	}
-	return sessionMessageOutputChannels[SessionID][ID]
 }
@@ -0,0 +1,289 @@
+package nonces
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"math/big"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+
+	"mpc_poc/helper"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/joho/godotenv"
+)
+
+// Reader is the part of a chain backend the nonce manager needs.
+type Reader interface {
+	NonceAt(ctx context.Context, account common.Address, blockNumber *big.Int) (uint64, error)
+	PendingNonceAt(ctx context.Context, account common.Address) (uint64, error)
+	TransactionByHash(ctx context.Context, hash common.Hash) (*types.Transaction, bool, error)
+}
+
+// State is the nonce state of one address on one chain. Sent holds the
+// hashes of broadcast transactions that are not mined yet.
+type State struct {
+	ChainID  uint64            `json:"chainId"`
+	Address  string            `json:"address"`
+	Next     uint64            `json:"next"`
+	Sent     map[uint64]string `json:"sent"`
+	InFlight []uint64          `json:"inFlight,omitempty"`
+	Gaps     []uint64          `json:"gaps,omitempty"`
+}
+
+type account struct {
+	State
+
+	mtx      sync.Mutex
+	inFlight map[uint64]bool
+	gaps     map[uint64]bool
+}
+
+var accounts = make(map[string]*account)
+var accountsMtx sync.Mutex
+var fileMtx sync.Mutex
+var loadOnce sync.Once
+
+func key(chainID uint64, address common.Address) string {
+	return strconv.FormatUint(chainID, 10) + ":" + address.Hex()
+}
+
+func path() string {
+	return helper.GetEnv("NONCES_FILE", "nonces.json")
+}
+
+// load reads the state persisted in NONCES_FILE, nonces.json by default.
+func load() {
+	loadOnce.Do(func() {
+		_ = godotenv.Load()
+		data, err := os.ReadFile(path())
+		if err != nil {
+			return
+		}
+		var saved []State
+		if err = json.Unmarshal(data, &saved); err != nil {
+			log.Printf("nonces: failed to parse %s: %v\n", path(), err)
+			return
+		}
+		for _, state := range saved {
+			state.InFlight = nil
+			state.Gaps = nil
+			if state.Sent == nil {
+				state.Sent = make(map[uint64]string)
+			}
+			accounts[key(state.ChainID, common.HexToAddress(state.Address))] = &account{
+				State:    state,
+				inFlight: make(map[uint64]bool),
+				gaps:     make(map[uint64]bool),
+			}
+		}
+	})
+}
+
+func getAccount(chainID uint64, address common.Address) *account {
+	load()
+	accountsMtx.Lock()
+	defer accountsMtx.Unlock()
+	a, ok := accounts[key(chainID, address)]
+	if !ok {
+		a = &account{
+			State: State{
+				ChainID: chainID,
+				Address: address.Hex(),
+				Sent:    make(map[uint64]string),
+			},
+			inFlight: make(map[uint64]bool),
+			gaps:     make(map[uint64]bool),
+		}
+		accounts[key(chainID, address)] = a
+	}
+	return a
+}
+
+// snapshots returns copies of all states, sorted by chain and address.
+func snapshots() []State {
+	load()
+	accountsMtx.Lock()
+	list := make([]*account, 0, len(accounts))
+	for _, a := range accounts {
+		list = append(list, a)
+	}
+	accountsMtx.Unlock()
+
+	res := make([]State, 0, len(list))
+	for _, a := range list {
+		res = append(res, a.snapshot())
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].ChainID < res[j].ChainID || res[i].ChainID == res[j].ChainID && res[i].Address < res[j].Address
+	})
+	return res
+}
+
+// save writes all accounts to disk. Transactions that are still being signed
+// are not persisted, after a restart their nonces show up as gaps.
+func save() {
+	saved := snapshots()
+	for i := range saved {
+		saved[i].InFlight = nil
+		saved[i].Gaps = nil
+	}
+	data, _ := json.MarshalIndent(saved, "", "  ")
+
+	fileMtx.Lock()
+	defer fileMtx.Unlock()
+	tmp := path() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		log.Printf("nonces: failed to save %s: %v\n", path(), err)
+		return
+	}
+	if err := os.Rename(tmp, path()); err != nil {
+		log.Printf("nonces: failed to save %s: %v\n", path(), err)
+	}
+}
+
+func (a *account) snapshot() State {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	res := State{
+		ChainID:  a.ChainID,
+		Address:  a.Address,
+		Next:     a.Next,
+		Sent:     make(map[uint64]string, len(a.Sent)),
+		InFlight: sortedKeys(a.inFlight),
+		Gaps:     sortedKeys(a.gaps),
+	}
+	for nonce, hash := range a.Sent {
+		res.Sent[nonce] = hash
+	}
+	return res
+}
+
+func sortedKeys(m map[uint64]bool) []uint64 {
+	keys := make([]uint64, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys
+}
+
+// reconcile brings the state in line with the chain. Nonces between the
+// pending nonce of the chain and Next that are neither being signed nor known
+// to the node are gaps, e.g. after a failed broadcast or a dropped
+// transaction, and are handed out again first.
+func (a *account) reconcile(ctx context.Context, client Reader, address common.Address) error {
+	latest, err := client.NonceAt(ctx, address, nil)
+	if err != nil {
+		return err
+	}
+	pending, err := client.PendingNonceAt(ctx, address)
+	if err != nil {
+		return err
+	}
+
+	for nonce := range a.Sent {
+		if nonce < latest {
+			delete(a.Sent, nonce)
+		}
+	}
+	if pending > a.Next {
+		a.Next = pending
+	}
+
+	a.gaps = make(map[uint64]bool)
+	for nonce := pending; nonce < a.Next; nonce++ {
+		if a.inFlight[nonce] {
+			continue
+		}
+		if hash, ok := a.Sent[nonce]; ok {
+			_, _, err = client.TransactionByHash(ctx, common.HexToHash(hash))
+			if err == nil {
+				continue
+			}
+			if err != ethereum.NotFound {
+				return err
+			}
+			log.Printf("nonces: transaction %s with nonce %d of %s was dropped\n", hash, nonce, a.Address)
+			delete(a.Sent, nonce)
+		}
+		a.gaps[nonce] = true
+	}
+	for a.Next > pending && a.gaps[a.Next-1] {
+		delete(a.gaps, a.Next-1)
+		a.Next--
+	}
+	if len(a.gaps) > 0 {
+		log.Printf("nonces: %s on chain %d has nonce gaps %v\n", a.Address, a.ChainID, sortedKeys(a.gaps))
+	}
+	return nil
+}
+
+// Allocate reserves the next nonce of address. The lowest gap is reused
+// before a new nonce is taken. Every allocated nonce must be released with
+// Release once the transaction was broadcast or failed.
+func Allocate(ctx context.Context, client Reader, chainID uint64, address common.Address) (uint64, error) {
+	a := getAccount(chainID, address)
+	a.mtx.Lock()
+
+	if err := a.reconcile(ctx, client, address); err != nil {
+		a.mtx.Unlock()
+		return 0, err
+	}
+
+	var nonce uint64
+	if gaps := sortedKeys(a.gaps); len(gaps) > 0 {
+		nonce = gaps[0]
+		delete(a.gaps, nonce)
+	} else {
+		nonce = a.Next
+		a.Next++
+	}
+	a.inFlight[nonce] = true
+	a.mtx.Unlock()
+
+	save()
+	return nonce, nil
+}
+
+// Release records the outcome of the transaction that used nonce. A failed
+// transaction leaves a gap that the next Allocate fills.
+func Release(chainID uint64, address common.Address, nonce uint64, hash string, err error) {
+	a := getAccount(chainID, address)
+	a.mtx.Lock()
+
+	delete(a.inFlight, nonce)
+	if err == nil {
+		a.Sent[nonce] = hash
+	} else if nonce+1 == a.Next {
+		a.Next--
+	} else {
+		a.gaps[nonce] = true
+	}
+	a.mtx.Unlock()
+
+	save()
+}
+
+// Replace records hash as the transaction of a nonce that was already sent,
+// e.g. after a speed-up, so that the replaced transaction disappearing from
+// the pool is not taken for a dropped one.
+func Replace(chainID uint64, address common.Address, nonce uint64, hash string) {
+	a := getAccount(chainID, address)
+	a.mtx.Lock()
+	if _, ok := a.Sent[nonce]; ok {
+		a.Sent[nonce] = hash
+	}
+	a.mtx.Unlock()
+
+	save()
+}
+
+func GetStates() []State {
+	return snapshots()
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"mpc_poc/audit"
+	"mpc_poc/helper"
+	"mpc_poc/models"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/gorilla/mux"
+	"github.com/koteld/multi-party-sig/pkg/party"
+)
+
+// PendingRequest is a protocol request that waits for an operator of this
+// participant. ID is the session ID.
+type PendingRequest struct {
+	ID         string          `json:"id"`
+	Protocol   models.Protocol `json:"protocol"`
+	Address    string          `json:"address"`
+	IDs        party.IDSlice   `json:"ids"`
+	Preview    string          `json:"preview"`
+	ReceivedAt time.Time       `json:"receivedAt"`
+	ExpiresAt  time.Time       `json:"expiresAt"`
+
+	message  *models.ProtocolMessage
+	decision chan decision
+}
+
+type decision struct {
+	approved bool
+	approver string
+	reason   string
+}
+
+type decisionParameters struct {
+	Reason string `json:"reason"`
+}
+
+var pending = make(map[string]*PendingRequest)
+var pendingMtx sync.Mutex
+
+// decidedMessages passes held requests back to the protocol loop once an
+// operator decided, the request if approved and nil otherwise. The loop
+// takes no other protocol requests meanwhile, so protocols still run one at
+// a time and in the order they arrived.
+var decidedMessages = make(chan *models.ProtocolMessage)
+
+// needsOperator reports whether a request waits for an operator. With
+// MANUAL_APPROVAL=true every sign and refresh request does. If
+// MANUAL_APPROVAL_ABOVE is set as well, only refreshes and payloads with a
+// native value above it in wei do.
+func needsOperator(message *models.ProtocolMessage) bool {
+	if helper.GetEnv("MANUAL_APPROVAL", "false") != "true" {
+		return false
+	}
+	switch message.Protocol {
+	case models.DKF:
+		return true
+	case models.Sign, models.SignOnline:
+	default:
+		return false
+	}
+	above := helper.GetEnv("MANUAL_APPROVAL_ABOVE", "")
+	if above == "" {
+		return true
+	}
+	limit, ok := new(big.Int).SetString(above, 0)
+	if !ok {
+		log.Printf("participant %s: invalid MANUAL_APPROVAL_ABOVE %s, holding every request\n", ID, above)
+		return true
+	}
+	details, err := message.Payload.Details()
+	return err != nil || details.Value != nil && details.Value.Cmp(limit) > 0
+}
+
+func approvalTimeout() time.Duration {
+	seconds, err := strconv.Atoi(helper.GetEnv("APPROVAL_TIMEOUT", "600"))
+	if err != nil || seconds <= 0 {
+		seconds = 600
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+func preview(message *models.ProtocolMessage) string {
+	switch {
+	case message.Protocol == models.DKG:
+		return "generation of a key shared by " + strconv.Itoa(len(message.IDs)) + " participants"
+	case message.Protocol == models.DKF:
+		return "refresh of the key shares of " + message.Address
+	case message.Protocol == models.PreSign:
+		return "pre-signature of " + message.Address
+	case message.Payload == nil:
+		return "blind digest " + hexutil.Encode(message.MessageHash)
+	}
+	return message.Payload.Summary()
+}
+
+func logApproval(message *models.ProtocolMessage, text string) {
+	sessionID := string(message.SessionID)
+	log.Printf("participant %s: %s in session %s\n", ID, text, sessionID)
+	logMessages := models.GetLogMessageOutputChannel()
+	logMessage := models.LogMessage{
+		Protocol:    message.Protocol,
+		Participant: string(ID),
+		Message:     text,
+		SessionID:   sessionID,
+		Timestamp:   strconv.FormatInt(time.Now().Unix(), 10),
+		IP:          IP,
+	}
+	logMessages <- &logMessage
+}
+
+// hold queues the request until an operator decides on it or it times out.
+// Approved requests are run by the protocol loop, others are refused. Either
+// way the decision is passed to decidedMessages.
+func hold(message *models.ProtocolMessage) {
+	now := time.Now().UTC()
+	request := &PendingRequest{
+		ID:         string(message.SessionID),
+		Protocol:   message.Protocol,
+		Address:    message.Address,
+		IDs:        message.IDs,
+		Preview:    preview(message),
+		ReceivedAt: now,
+		ExpiresAt:  now.Add(approvalTimeout()),
+		message:    message,
+		decision:   make(chan decision, 1),
+	}
+	pendingMtx.Lock()
+	pending[request.ID] = request
+	pendingMtx.Unlock()
+	logApproval(message, "waiting for operator approval of "+request.Preview)
+
+	go func() {
+		var d decision
+		select {
+		case d = <-request.decision:
+		case <-time.After(time.Until(request.ExpiresAt)):
+			// a decision may have come in just now
+			pendingMtx.Lock()
+			if _, ok := pending[request.ID]; ok {
+				delete(pending, request.ID)
+				d = decision{reason: "no operator decision within " + approvalTimeout().String()}
+			} else {
+				d = <-request.decision
+			}
+			pendingMtx.Unlock()
+		}
+
+		entry := audit.Entry{
+			Event:     "approval",
+			Protocol:  string(message.Protocol),
+			Address:   message.Address,
+			SessionID: request.ID,
+			Summary:   request.Preview,
+			Approver:  d.approver,
+			Reason:    d.reason,
+		}
+		switch {
+		case d.approved:
+			entry.Result = "approved"
+		case d.approver == "":
+			entry.Result = "expired"
+		default:
+			entry.Result = "rejected"
+		}
+		audit.Append(entry)
+
+		if d.approved {
+			logApproval(message, "approved by "+d.approver)
+			decidedMessages <- message
+			return
+		}
+		refusal := models.Refusal{Participant: ID, Rule: "operator", Reason: d.reason}
+		if d.approver != "" {
+			refusal.Reason = "rejected by " + d.approver
+			if d.reason != "" {
+				refusal.Reason += ": " + d.reason
+			}
+		}
+		logApproval(message, "refused: "+refusal.Reason)
+		refuse(message, refusal)
+		decidedMessages <- nil
+	}()
+}
+
+// decide passes an operator decision to a pending request.
+func decide(id string, d decision) bool {
+	pendingMtx.Lock()
+	defer pendingMtx.Unlock()
+	request, ok := pending[id]
+	if !ok {
+		return false
+	}
+	delete(pending, id)
+	request.decision <- d
+	return true
+}
+
+func getPending() []PendingRequest {
+	pendingMtx.Lock()
+	defer pendingMtx.Unlock()
+	res := make([]PendingRequest, 0, len(pending))
+	for _, request := range pending {
+		res = append(res, *request)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].ReceivedAt.Before(res[j].ReceivedAt) })
+	return res
+}
+
+func bearerToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return ""
+	}
+	return strings.TrimPrefix(header, "Bearer ")
+}
+
+func sameToken(token string, expected string) bool {
+	return token != "" && expected != "" && subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1
+}
+
+// getOperators returns the operators in OPERATORS_FILE, operators.json by
+// default, by name with the hex SHA-256 of their token.
+func getOperators() (map[string]string, error) {
+	data, err := os.ReadFile(helper.GetEnv("OPERATORS_FILE", "operators.json"))
+	if err != nil {
+		return nil, err
+	}
+	var operators map[string]string
+	if err = json.Unmarshal(data, &operators); err != nil {
+		return nil, err
+	}
+	return operators, nil
+}
+
+// operator returns the name of the operator whose token the request
+// carries.
+func operator(r *http.Request) (string, bool) {
+	token := bearerToken(r)
+	if token == "" {
+		return "", false
+	}
+	operators, err := getOperators()
+	if err != nil {
+		return "", false
+	}
+	hash := sha256.Sum256([]byte(token))
+	for name, expected := range operators {
+		if sameToken(hex.EncodeToString(hash[:]), strings.ToLower(expected)) {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// authorized checks that the request carries ADMIN_TOKEN or the token of an
+// operator. Without ADMIN_TOKEN nothing is authorized.
+func authorized(w http.ResponseWriter, r *http.Request) bool {
+	if helper.GetEnv("ADMIN_TOKEN", "") != "" {
+		if sameToken(bearerToken(r), helper.GetEnv("ADMIN_TOKEN", "")) {
+			return true
+		}
+		if _, ok := operator(r); ok {
+			return true
+		}
+	}
+	w.WriteHeader(http.StatusUnauthorized)
+	_ = json.NewEncoder(w).Encode("invalid admin token")
+	return false
+}
+
+func GetApprovals(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !authorized(w, r) {
+		return
+	}
+	_ = json.NewEncoder(w).Encode(getPending())
+}
+
+// GetAudit exports the audit log of the participant.
+func GetAudit(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !authorized(w, r) {
+		return
+	}
+	res, err := audit.Export()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		_ = json.NewEncoder(w).Encode(err.Error())
+		return
+	}
+	_ = json.NewEncoder(w).Encode(res)
+}
+
+func decisionHandler(approved bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if !authorized(w, r) {
+			return
+		}
+		// the approver is whoever holds the token, not a name in the body
+		approver, ok := operator(r)
+		if !ok {
+			w.WriteHeader(http.StatusForbidden)
+			_ = json.NewEncoder(w).Encode("decisions need the token of an operator")
+			return
+		}
+		var parameters decisionParameters
+		_ = json.NewDecoder(r.Body).Decode(&parameters)
+		id := mux.Vars(r)["id"]
+		if !decide(id, decision{approved: approved, approver: approver, reason: parameters.Reason}) {
+			w.WriteHeader(http.StatusNotFound)
+			_ = json.NewEncoder(w).Encode("no pending request " + id)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(id)
+	}
+}
+
+// serveAdmin runs the admin API of the operators on ADMIN_LISTEN, it is off
+// if that or ADMIN_TOKEN is empty.
+func serveAdmin() {
+	listen := helper.GetEnv("ADMIN_LISTEN", "")
+	if listen == "" {
+		if helper.GetEnv("MANUAL_APPROVAL", "false") == "true" {
+			log.Printf("participant %s: MANUAL_APPROVAL is set without ADMIN_LISTEN, requests will time out\n", ID)
+		}
+		return
+	}
+	if helper.GetEnv("ADMIN_TOKEN", "") == "" {
+		log.Printf("participant %s: ADMIN_LISTEN is set without ADMIN_TOKEN, not serving the admin API\n", ID)
+		return
+	}
+	if operators, err := getOperators(); err != nil || len(operators) == 0 {
+		log.Printf("participant %s: no operators in OPERATORS_FILE, nobody can approve requests\n", ID)
+	}
+	r := mux.NewRouter()
+	r.HandleFunc("/approvals", GetApprovals).Methods("GET")
+	r.HandleFunc("/approvals/{id}/approve", decisionHandler(true)).Methods("POST")
+	r.HandleFunc("/approvals/{id}/reject", decisionHandler(false)).Methods("POST")
+	r.HandleFunc("/audit", GetAudit).Methods("GET")
+	log.Printf("participant %s: admin API on %s\n", ID, listen)
+	go func() {
+		log.Printf("participant %s: admin API stopped: %v\n", ID, http.ListenAndServe(listen, r))
+	}()
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"mpc_poc/models"
+
+	"github.com/gorilla/mux"
+	natsserver "github.com/nats-io/nats-server/v2/test"
+)
+
+// TestMain runs the messages of the tests through an embedded NATS server.
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "participant")
+	if err != nil {
+		panic(err)
+	}
+	opts := natsserver.DefaultTestOptions
+	opts.Port = -1
+	opts.JetStream = true
+	opts.StoreDir = dir
+	s := natsserver.RunServer(&opts)
+	_ = os.Setenv("MESSAGING_TRANSPORT", "nats")
+	_ = os.Setenv("NATS_URL", s.ClientURL())
+	code := m.Run()
+	s.Shutdown()
+	_ = os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func useOperators(t *testing.T) {
+	t.Helper()
+	hash := sha256.Sum256([]byte("alice-token"))
+	file := filepath.Join(t.TempDir(), "operators.json")
+	if err := os.WriteFile(file, []byte(`{"alice": "`+hex.EncodeToString(hash[:])+`"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("OPERATORS_FILE", file)
+}
+
+func adminRequest(method string, path string, token string, body string) *http.Request {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	return r
+}
+
+// Without ADMIN_TOKEN the admin API authorizes nobody.
+func TestAuthorizedNeedsAdminToken(t *testing.T) {
+	useOperators(t)
+	t.Setenv("ADMIN_TOKEN", "")
+	for _, token := range []string{"", "alice-token"} {
+		w := httptest.NewRecorder()
+		if authorized(w, adminRequest("GET", "/approvals", token, "")) || w.Code != http.StatusUnauthorized {
+			t.Errorf("token %q authorized without ADMIN_TOKEN", token)
+		}
+	}
+
+	t.Setenv("ADMIN_TOKEN", "admin-token")
+	for token, want := range map[string]bool{"admin-token": true, "alice-token": true, "other": false, "": false} {
+		if got := authorized(httptest.NewRecorder(), adminRequest("GET", "/approvals", token, "")); got != want {
+			t.Errorf("token %q authorized %v, want %v", token, got, want)
+		}
+	}
+}
+
+// The approver of a decision is the operator of the token, not the name in
+// the body.
+func TestDecisionApproverIsTokenHolder(t *testing.T) {
+	useOperators(t)
+	t.Setenv("ADMIN_TOKEN", "admin-token")
+	router := mux.NewRouter()
+	router.HandleFunc("/approvals/{id}/approve", decisionHandler(true)).Methods("POST")
+
+	request := &PendingRequest{ID: "session-1", decision: make(chan decision, 1)}
+	pendingMtx.Lock()
+	pending[request.ID] = request
+	pendingMtx.Unlock()
+	defer func() {
+		pendingMtx.Lock()
+		delete(pending, request.ID)
+		pendingMtx.Unlock()
+	}()
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, adminRequest("POST", "/approvals/session-1/approve", "admin-token", `{"approver": "alice"}`))
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("shared admin token decided with status %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, adminRequest("POST", "/approvals/session-1/approve", "alice-token", `{"approver": "mallory"}`))
+	if w.Code != http.StatusOK {
+		t.Fatalf("operator decision failed with status %d: %s", w.Code, w.Body.String())
+	}
+	d := <-request.decision
+	if !d.approved || d.approver != "alice" {
+		t.Errorf("decision %+v, want approved by alice", d)
+	}
+}
+
+// A session that arrives while another waits for an operator is started
+// after the decision, not while the held session's peers wait.
+func TestHoldDefersLaterSessions(t *testing.T) {
+	t.Setenv("MANUAL_APPROVAL", "true")
+	t.Setenv("AUDIT_FILE", filepath.Join(t.TempDir(), "audit.log"))
+	protocolMessages := make(chan *models.ProtocolMessage)
+	started := make(chan *models.ProtocolMessage, 2)
+	go serve(nil, protocolMessages, func(message *models.ProtocolMessage) { started <- message })
+	defer close(protocolMessages)
+
+	held := &models.ProtocolMessage{Protocol: models.DKF, Address: "0x00000000000000000000000000000000000000a1", SessionID: []byte("session-held")}
+	next := &models.ProtocolMessage{Protocol: models.DKG, SessionID: []byte("session-next")}
+	protocolMessages <- held
+	taken := make(chan struct{})
+	go func() {
+		protocolMessages <- next
+		close(taken)
+	}()
+
+	select {
+	case <-taken:
+		t.Fatal("session taken while another waits for an operator")
+	case message := <-started:
+		t.Fatalf("session %s started while another waits for an operator", message.SessionID)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	if !decide("session-held", decision{approved: true, approver: "alice"}) {
+		t.Fatal("session isn't held")
+	}
+	for _, want := range []string{"session-held", "session-next"} {
+		select {
+		case message := <-started:
+			if string(message.SessionID) != want {
+				t.Fatalf("started %s, want %s", message.SessionID, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s not started", want)
+		}
+	}
+}
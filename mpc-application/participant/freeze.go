@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"mpc_poc/audit"
+	"mpc_poc/helper"
+	"mpc_poc/messaging"
+	"mpc_poc/models"
+	"mpc_poc/payload"
+	"mpc_poc/session"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// admins are the identities that can lift a freeze together.
+type admins struct {
+	Threshold int               `json:"threshold"`
+	Admins    map[string]string `json:"admins"`
+}
+
+var freezes = make(map[string]models.FreezeState)
+var freezesMtx sync.Mutex
+
+func freezePath() string {
+	return helper.GetEnv("FREEZE_FILE", "freeze-"+string(ID)+".json")
+}
+
+// loadFreezes reads the freezes persisted in FREEZE_FILE,
+// freeze-<id>.json by default.
+func loadFreezes() {
+	freezesMtx.Lock()
+	defer freezesMtx.Unlock()
+	data, err := os.ReadFile(freezePath())
+	if err != nil {
+		return
+	}
+	var saved []models.FreezeState
+	if err = json.Unmarshal(data, &saved); err != nil {
+		// a node that can't tell whether it is frozen doesn't sign
+		log.Printf("participant %s: failed to parse %s, freezing all keys: %v\n", ID, freezePath(), err)
+		saved = []models.FreezeState{{ID: "unreadable-" + freezePath(), Reason: "unreadable freeze file", At: time.Now().UTC()}}
+	}
+	for _, f := range saved {
+		freezes[f.ID] = f
+	}
+}
+
+// saveFreezes persists all freezes. freezesMtx must be held.
+func saveFreezes() {
+	data, _ := json.MarshalIndent(sortedFreezes(), "", "  ")
+	tmp := freezePath() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		log.Printf("participant %s: failed to save %s: %v\n", ID, freezePath(), err)
+		return
+	}
+	if err := os.Rename(tmp, freezePath()); err != nil {
+		log.Printf("participant %s: failed to save %s: %v\n", ID, freezePath(), err)
+	}
+}
+
+// sortedFreezes returns the freezes, oldest first. freezesMtx must be held.
+func sortedFreezes() []models.FreezeState {
+	res := make([]models.FreezeState, 0, len(freezes))
+	for _, f := range freezes {
+		res = append(res, f)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].At.Before(res[j].At) })
+	return res
+}
+
+func getFreezes() []models.FreezeState {
+	freezesMtx.Lock()
+	defer freezesMtx.Unlock()
+	return sortedFreezes()
+}
+
+// frozen returns the freeze that stops protocols of address, a cluster-wide
+// one applies to every address.
+func frozen(address string) *models.FreezeState {
+	freezesMtx.Lock()
+	defer freezesMtx.Unlock()
+	for _, f := range sortedFreezes() {
+		if f.Address == "" || address != "" && common.HexToAddress(f.Address) == common.HexToAddress(address) {
+			return &f
+		}
+	}
+	return nil
+}
+
+// checkFrozen refuses the request if its key or the cluster is frozen.
+func checkFrozen(message *models.ProtocolMessage) bool {
+	f := frozen(message.Address)
+	if f == nil {
+		return true
+	}
+	reason := "all keys are frozen"
+	if f.Address != "" {
+		reason = f.Address + " is frozen"
+	}
+	if f.Reason != "" {
+		reason += ": " + f.Reason
+	}
+	logApproval(message, "refused: "+reason)
+	record(message, "refused", "frozen: "+reason)
+	refuse(message, models.Refusal{Participant: ID, Rule: "frozen", Reason: reason})
+	return false
+}
+
+// getAdmins returns the admins in ADMINS_FILE, admins.json by default.
+func getAdmins() (admins, error) {
+	data, err := os.ReadFile(helper.GetEnv("ADMINS_FILE", "admins.json"))
+	if err != nil {
+		return admins{}, err
+	}
+	var a admins
+	if err = json.Unmarshal(data, &a); err != nil {
+		return admins{}, err
+	}
+	if a.Threshold < 1 || a.Threshold > len(a.Admins) {
+		return admins{}, errors.New("admin threshold must be between 1 and the number of admins")
+	}
+	return a, nil
+}
+
+// checkUnfreeze counts the distinct admins that signed "unfreeze <id>" and
+// returns their names if they reach the threshold.
+func checkUnfreeze(id string, signatures []models.AdminSignature) ([]string, error) {
+	a, err := getAdmins()
+	if err != nil {
+		return nil, errors.New("no admins: " + err.Error())
+	}
+	hash, _ := payload.NewMessage([]byte("unfreeze " + id)).Hash()
+	signed := make(map[string]bool)
+	names := make([]string, 0)
+	for _, s := range signatures {
+		address, ok := a.Admins[s.Admin]
+		if !ok || signed[s.Admin] {
+			continue
+		}
+		sig, err := hexutil.Decode(s.Signature)
+		if err != nil || len(sig) != crypto.SignatureLength {
+			continue
+		}
+		if sig[crypto.RecoveryIDOffset] >= 27 {
+			sig[crypto.RecoveryIDOffset] -= 27
+		}
+		publicKey, err := crypto.SigToPub(hash.Bytes(), sig)
+		if err != nil || crypto.PubkeyToAddress(*publicKey) != common.HexToAddress(address) {
+			continue
+		}
+		signed[s.Admin] = true
+		names = append(names, s.Admin)
+	}
+	if len(names) < a.Threshold {
+		return nil, errors.New(strconv.Itoa(len(names)) + " valid admin signatures, " + strconv.Itoa(a.Threshold) + " needed")
+	}
+	return names, nil
+}
+
+func logControl(text string) {
+	log.Printf("participant %s: %s\n", ID, text)
+	logMessages := models.GetLogMessageOutputChannel()
+	logMessage := models.LogMessage{
+		Protocol:    models.Control,
+		Participant: string(ID),
+		Message:     text,
+		Timestamp:   strconv.FormatInt(time.Now().Unix(), 10),
+		IP:          IP,
+	}
+	logMessages <- &logMessage
+}
+
+// handleControl acts on control messages the API signed. A freeze can't be
+// changed once it is in place, only lifted by the admins.
+func handleControl(message *models.ControlMessage) {
+	if message.From != messaging.APIMember || !session.VerifyControl(message) {
+		logControl("rejected a control message that isn't signed by the API")
+		return
+	}
+	f := message.Freeze
+	switch message.Command {
+	case models.Freeze:
+		if f.ID == "" {
+			return
+		}
+		scope := "all keys"
+		if f.Address != "" {
+			scope = f.Address
+		}
+		freezesMtx.Lock()
+		if _, ok := freezes[f.ID]; ok {
+			freezesMtx.Unlock()
+			logControl("ignored freeze " + f.ID + ", it is already in place")
+			return
+		}
+		freezes[f.ID] = f
+		saveFreezes()
+		freezesMtx.Unlock()
+		audit.Append(audit.Entry{Event: "freeze", Address: f.Address, SessionID: f.ID, Approver: f.By, Reason: f.Reason, Result: "frozen"})
+		logControl("froze " + scope + " (" + f.ID + ")")
+	case models.Unfreeze:
+		freezesMtx.Lock()
+		current, ok := freezes[f.ID]
+		freezesMtx.Unlock()
+		if !ok {
+			logControl("no freeze " + f.ID + " to lift")
+			return
+		}
+		names, err := checkUnfreeze(f.ID, message.Signatures)
+		if err != nil {
+			audit.Append(audit.Entry{Event: "unfreeze", Address: current.Address, SessionID: f.ID, Result: "refused", Reason: err.Error()})
+			logControl("refused to lift freeze " + f.ID + ": " + err.Error())
+			return
+		}
+		freezesMtx.Lock()
+		delete(freezes, f.ID)
+		saveFreezes()
+		freezesMtx.Unlock()
+		audit.Append(audit.Entry{Event: "unfreeze", Address: current.Address, SessionID: f.ID, Approver: strings.Join(names, ", "), Result: "unfrozen"})
+		logControl("lifted freeze " + f.ID + " signed by " + strings.Join(names, ", "))
+	}
+}
+
+// control handles control messages apart from the protocol loop, so a
+// freeze applies to the next request even while a protocol runs.
+func control() {
+	controlMessageInput := models.GetControlMessageInputChannel(ID)
+	go func() {
+		for message := range controlMessageInput {
+			handleControl(message)
+		}
+	}()
+}
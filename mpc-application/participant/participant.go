@@ -3,14 +3,23 @@ package main
 import (
 	"context"
 	b64 "encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
 	"os"
+	"strconv"
+	"time"
 
+	"mpc_poc/audit"
 	"mpc_poc/helper"
+	"mpc_poc/messaging"
 	"mpc_poc/models"
+	"mpc_poc/policy"
 	"mpc_poc/session"
 	mpcTypes "mpc_poc/types"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/koteld/multi-party-sig/pkg/ecdsa"
 	"github.com/koteld/multi-party-sig/pkg/math/curve"
@@ -70,12 +79,45 @@ func readConfigurationsFromFiles() {
 	}
 }
 
-func startDKGProtocol(ids party.IDSlice, threshold int, sessionID []byte, pl *pool.Pool) {
-	h, _ := protocol.NewMultiHandler(cmp.Keygen(curve.Secp256k1{}, ID, ids, threshold, pl), sessionID)
-	session.Loop(ID, ids, h, string(sessionID), models.DKG, IP)
+// run runs the session of the handler and returns its result. If the
+// handler couldn't be created, the other parties are told to abort.
+func run(ctx context.Context, h *protocol.MultiHandler, err error, ids party.IDSlice, sessionID []byte, p models.Protocol) (interface{}, error) {
+	if err != nil {
+		session.Abort(ID, ids, string(sessionID), err.Error())
+		return nil, err
+	}
+	if err = session.Loop(ctx, ID, ids, h, string(sessionID), p, IP); err != nil {
+		return nil, err
+	}
+	return h.Result()
+}
 
+// sendResult answers the API with the result of the session.
+func sendResult(sessionID []byte, result interface{}, err error) {
 	sessionMessageOutput := models.GetSessionMessageOutputChannel(string(sessionID), ID)
-	r, err := h.Result()
+	sessionMessage := models.SessionMessage{Result: result}
+	if err != nil {
+		sessionMessage.Error = err.Error()
+	}
+	sessionMessageOutput <- &sessionMessage
+	models.ReleaseSessionMessageOutputChannel(string(sessionID), ID)
+}
+
+func getConfig(address string) (*cmp.Config, error) {
+	config, ok := configs[address]
+	if !ok {
+		return nil, errors.New("no key for " + address)
+	}
+	return config.Config, nil
+}
+
+func startDKGProtocol(ctx context.Context, ids party.IDSlice, threshold int, sessionID []byte, pl *pool.Pool) (string, error) {
+	h, err := protocol.NewMultiHandler(cmp.Keygen(curve.Secp256k1{}, ID, ids, threshold, pl), sessionID)
+	r, err := run(ctx, h, err, ids, sessionID, models.DKG)
+	if err != nil {
+		sendResult(sessionID, nil, err)
+		return "", err
+	}
 
 	config := r.(*cmp.Config)
 	publicKeyBytes, _ := config.PublicPoint().MarshalBinaryEth()
@@ -87,21 +129,23 @@ func startDKGProtocol(ids party.IDSlice, threshold int, sessionID []byte, pl *po
 		SessionID: string(sessionID),
 	}
 
-	sessionMessage := models.SessionMessage{
-		Result: b64.StdEncoding.EncodeToString(publicKeyBytes),
-		Error:  err,
-	}
-	sessionMessageOutput <- &sessionMessage
+	sendResult(sessionID, b64.StdEncoding.EncodeToString(publicKeyBytes), nil)
+	return address.String(), nil
 }
 
-func startDKFProtocol(address string, ids party.IDSlice, sessionID []byte, pl *pool.Pool) {
-	h, _ := protocol.NewMultiHandler(cmp.Refresh(configs[address].Config, pl), sessionID)
-	session.Loop(ID, ids, h, string(sessionID), models.DKF, IP)
+func startDKFProtocol(ctx context.Context, address string, ids party.IDSlice, sessionID []byte, pl *pool.Pool) error {
+	config, err := getConfig(address)
+	var h *protocol.MultiHandler
+	if err == nil {
+		h, err = protocol.NewMultiHandler(cmp.Refresh(config, pl), sessionID)
+	}
+	r, err := run(ctx, h, err, ids, sessionID, models.DKF)
+	if err != nil {
+		sendResult(sessionID, nil, err)
+		return err
+	}
 
-	sessionMessageOutput := models.GetSessionMessageOutputChannel(string(sessionID), ID)
-	r, err := h.Result()
-
-	config := r.(*cmp.Config)
+	config = r.(*cmp.Config)
 
 	saveConfigurationToFile(address, sessionID, config)
 	configs[address] = mpcTypes.Config{
@@ -109,100 +153,234 @@ func startDKFProtocol(address string, ids party.IDSlice, sessionID []byte, pl *p
 		SessionID: string(sessionID),
 	}
 
-	sessionMessage := models.SessionMessage{
-		Result: r,
-		Error:  err,
+	// the refreshed shares stay with the participant
+	sendResult(sessionID, nil, nil)
+	return nil
+}
+
+func startSignProtocol(ctx context.Context, address string, ids party.IDSlice, messageHash []byte, sessionID []byte, pl *pool.Pool) error {
+	config, err := getConfig(address)
+	var h *protocol.MultiHandler
+	if err == nil {
+		h, err = protocol.NewMultiHandler(cmp.Sign(config, ids, messageHash, pl), sessionID)
 	}
-	sessionMessageOutput <- &sessionMessage
+	r, err := run(ctx, h, err, ids, sessionID, models.Sign)
+	if err != nil {
+		sendResult(sessionID, nil, err)
+		return err
+	}
+	signature := r.(*ecdsa.Signature)
+	sendResult(sessionID, b64.StdEncoding.EncodeToString(signature.ToCompactEth()), nil)
+	return nil
 }
 
-func startSignProtocol(address string, ids party.IDSlice, messageHash []byte, sessionID []byte, pl *pool.Pool) {
-	h, _ := protocol.NewMultiHandler(cmp.Sign(configs[address].Config, ids, messageHash, pl), sessionID)
-	session.Loop(ID, ids, h, string(sessionID), models.Sign, IP)
+func startPreSignProtocol(ctx context.Context, address string, ids party.IDSlice, sessionID []byte, pl *pool.Pool) error {
+	config, err := getConfig(address)
+	var h *protocol.MultiHandler
+	if err == nil {
+		h, err = protocol.NewMultiHandler(cmp.Presign(config, ids, pl), sessionID)
+	}
+	r, err := run(ctx, h, err, ids, sessionID, models.PreSign)
+	if err != nil {
+		sendResult(sessionID, nil, err)
+		return err
+	}
+
+	preSignatures[address] = r.(*ecdsa.PreSignature)
 
-	sessionMessageOutput := models.GetSessionMessageOutputChannel(string(sessionID), ID)
-	r, err := h.Result()
+	// the pre-signature stays with the participant
+	sendResult(sessionID, nil, nil)
+	return nil
+}
+
+func startSignOnlineProtocol(ctx context.Context, address string, ids party.IDSlice, messageHash []byte, sessionID []byte, pl *pool.Pool) error {
+	config, err := getConfig(address)
+	preSignature := preSignatures[address]
+	if err == nil && preSignature == nil {
+		err = errors.New("no pre-signature for " + address)
+	}
+	var h *protocol.MultiHandler
+	if err == nil {
+		h, err = protocol.NewMultiHandler(cmp.PresignOnline(config, preSignature, messageHash, pl), sessionID)
+	}
+	r, err := run(ctx, h, err, ids, sessionID, models.SignOnline)
+	if err != nil {
+		sendResult(sessionID, nil, err)
+		return err
+	}
 	signature := r.(*ecdsa.Signature)
-	signatureCompact := signature.ToCompactEth()
-	sessionMessage := models.SessionMessage{
-		Result: b64.StdEncoding.EncodeToString(signatureCompact),
-		Error:  err,
+	sendResult(sessionID, b64.StdEncoding.EncodeToString(signature.ToCompactEth()), nil)
+	return nil
+}
+
+// checkPayload recomputes the message hash of a signing request from its
+// payload. Digests without preimage are only signed with
+// ALLOW_BLIND_SIGNING=true.
+func checkPayload(message *models.ProtocolMessage) error {
+	if message.Payload == nil {
+		return errors.New("no payload, the message hash can't be checked")
 	}
-	sessionMessageOutput <- &sessionMessage
+	config, ok := configs[common.HexToAddress(message.Address).String()]
+	if !ok {
+		return errors.New("no key for " + message.Address)
+	}
+	publicKey, err := config.Config.PublicPoint().MarshalBinary()
+	if err != nil {
+		return err
+	}
+	if err = message.Payload.Verify(message.MessageHash, publicKey); err != nil {
+		return err
+	}
+	if message.Payload.Blind() && helper.GetEnv("ALLOW_BLIND_SIGNING", "false") != "true" {
+		return errors.New("blind " + string(message.Payload.Kind) + ", set ALLOW_BLIND_SIGNING=true to sign digests and Keccak-256 hashes of messages")
+	}
+	return nil
 }
 
-func startPreSignProtocol(address string, ids party.IDSlice, sessionID []byte, pl *pool.Pool) {
-	h, _ := protocol.NewMultiHandler(cmp.Presign(configs[address].Config, ids, pl), sessionID)
-	session.Loop(ID, ids, h, string(sessionID), models.PreSign, IP)
+// approve checks the payload of a signing request against the payload and the
+// policy of the participant and logs what is signed. A refused request is
+// answered with the violated rule without joining the protocol. Other
+// protocols are not checked.
+func approve(message *models.ProtocolMessage) bool {
+	if message.Protocol != models.Sign && message.Protocol != models.SignOnline {
+		return true
+	}
+	sessionID := string(message.SessionID)
+	logMessages := models.GetLogMessageOutputChannel()
+	logMessage := models.LogMessage{
+		Protocol:    message.Protocol,
+		Participant: string(ID),
+		SessionID:   sessionID,
+		Timestamp:   strconv.FormatInt(time.Now().Unix(), 10),
+		IP:          IP,
+	}
 
-	sessionMessageOutput := models.GetSessionMessageOutputChannel(string(sessionID), ID)
-	r, err := h.Result()
+	err := checkPayload(message)
+	rule := "payload"
+	if err == nil {
+		err = policy.Approve(message.Address, *message.Payload, time.Now())
+		rule = "policy"
+	}
+	if err != nil {
+		refusal := models.Refusal{Participant: ID}
+		refusal.Rule, refusal.Reason = policy.Describe(err, rule)
+		log.Printf("participant %s: refused to sign in session %s: %v\n", ID, sessionID, err)
+		logMessage.Message = "refused to sign: " + err.Error()
+		logMessages <- &logMessage
+		record(message, "refused", refusal.Rule+": "+refusal.Reason)
+		refuse(message, refusal)
+		return false
+	}
 
-	preSignatures[address] = r.(*ecdsa.PreSignature)
+	summary := message.Payload.Summary()
+	log.Printf("participant %s: signing %s in session %s with %s\n", ID, summary, sessionID, message.Address)
+	logMessage.Message = "approved " + summary
+	logMessages <- &logMessage
+	return true
+}
 
-	sessionMessage := models.SessionMessage{
-		Result: r,
-		Error:  err,
+// record writes what the participant did with a request to its audit log.
+func record(message *models.ProtocolMessage, result string, reason string) {
+	entry := audit.Entry{
+		Event:     "protocol",
+		Protocol:  string(message.Protocol),
+		Address:   message.Address,
+		SessionID: string(message.SessionID),
+		Summary:   preview(message),
+		Result:    result,
+		Reason:    reason,
 	}
-	sessionMessageOutput <- &sessionMessage
+	if len(message.MessageHash) > 0 {
+		entry.Digest = hexutil.Encode(message.MessageHash)
+	}
+	if message.Payload != nil {
+		entry.Payload, _ = json.Marshal(message.Payload)
+	}
+	audit.Append(entry)
 }
 
-func startSignOnlineProtocol(address string, ids party.IDSlice, messageHash []byte, sessionID []byte, pl *pool.Pool) {
-	h, _ := protocol.NewMultiHandler(cmp.PresignOnline(configs[address].Config, preSignatures[address], messageHash, pl), sessionID)
-	session.Loop(ID, ids, h, string(sessionID), models.SignOnline, IP)
-
-	sessionMessageOutput := models.GetSessionMessageOutputChannel(string(sessionID), ID)
-	r, err := h.Result()
-	signature := r.(*ecdsa.Signature)
-	signatureCompact := signature.ToCompactEth()
-	sessionMessage := models.SessionMessage{
-		Result: b64.StdEncoding.EncodeToString(signatureCompact),
-		Error:  err,
-	}
+// refuse answers a request with the refusal instead of joining the protocol
+// and tells the other participants to abort the session.
+func refuse(message *models.ProtocolMessage, refusal models.Refusal) {
+	sessionID := string(message.SessionID)
+	session.Abort(ID, message.IDs, sessionID, "refused by "+refusal.Rule+": "+refusal.Reason)
+	sessionMessageOutput := models.GetSessionMessageOutputChannel(sessionID, ID)
+	sessionMessage := models.SessionMessage{Refused: &refusal}
 	sessionMessageOutput <- &sessionMessage
+	models.ReleaseSessionMessageOutputChannel(sessionID, ID)
+	models.CloseSession(sessionID)
 }
 
 func startProtocol(message *models.ProtocolMessage) {
+	if !checkFrozen(message) {
+		return
+	}
 	pl := pool.NewPool(0)
 	defer pl.TearDown()
+	defer models.CloseSession(string(message.SessionID))
+	ctx, cancel := context.WithTimeout(context.Background(), session.Timeout())
+	defer cancel()
 
+	var err error
 	switch message.Protocol {
 	case models.DKG:
-		startDKGProtocol(message.IDs, message.Threshold, message.SessionID, pl)
+		message.Address, err = startDKGProtocol(ctx, message.IDs, message.Threshold, message.SessionID, pl)
 	case models.DKF:
-		startDKFProtocol(message.Address, message.IDs, message.SessionID, pl)
+		err = startDKFProtocol(ctx, message.Address, message.IDs, message.SessionID, pl)
 	case models.Sign:
-		startSignProtocol(message.Address, message.IDs, message.MessageHash, message.SessionID, pl)
+		err = startSignProtocol(ctx, message.Address, message.IDs, message.MessageHash, message.SessionID, pl)
 	case models.PreSign:
-		startPreSignProtocol(message.Address, message.IDs, message.SessionID, pl)
+		err = startPreSignProtocol(ctx, message.Address, message.IDs, message.SessionID, pl)
 	case models.SignOnline:
-		startSignOnlineProtocol(message.Address, message.IDs, message.MessageHash, message.SessionID, pl)
+		err = startSignOnlineProtocol(ctx, message.Address, message.IDs, message.MessageHash, message.SessionID, pl)
+	}
+	if err != nil {
+		record(message, "failed", err.Error())
+	} else {
+		record(message, "completed", "")
 	}
 }
 
-func getOnline() {
+func getOnline(request *models.InfoRequestMessage) {
 	infoMessageOutput := models.GetInfoResponseMessageOutputChannel(ID)
 	infoMessage := models.InfoResponseMessage{
-		Info:   models.Online,
-		Online: true,
+		RequestID: request.ID,
+		Info:      models.Online,
+		Online:    true,
+		Frozen:    getFreezes(),
 	}
 	infoMessageOutput <- &infoMessage
 }
 
-func getConfigs() {
+func getConfigs(request *models.InfoRequestMessage) {
 	infoMessageOutput := models.GetInfoResponseMessageOutputChannel(ID)
 	configMessages := make([]models.ConfigMessage, 0, len(configs))
 	for address, config := range configs {
+		publicKeyBytes, _ := config.Config.PublicPoint().MarshalBinary()
 		configMessage := models.ConfigMessage{
 			Address:   address,
 			IDs:       config.Config.PartyIDs(),
 			SessionID: config.SessionID,
+			PublicKey: hexutil.Encode(publicKeyBytes),
+			Frozen:    frozen(address) != nil,
 		}
 		configMessages = append(configMessages, configMessage)
 	}
 	infoMessage := models.InfoResponseMessage{
-		Info:    models.Online,
-		Configs: configMessages,
+		RequestID: request.ID,
+		Info:      models.Configs,
+		Configs:   configMessages,
+		Frozen:    getFreezes(),
+	}
+	infoMessageOutput <- &infoMessage
+}
+
+func getMetrics(request *models.InfoRequestMessage) {
+	infoMessageOutput := models.GetInfoResponseMessageOutputChannel(ID)
+	infoMessage := models.InfoResponseMessage{
+		RequestID:  request.ID,
+		Info:       models.Metrics,
+		Rejections: session.GetRejections(),
 	}
 	infoMessageOutput <- &infoMessage
 }
@@ -213,24 +391,53 @@ func getInfo(message *models.InfoRequestMessage) {
 
 	switch message.Info {
 	case models.Online:
-		getOnline()
+		getOnline(message)
 	case models.Configs:
-		getConfigs()
+		getConfigs(message)
+	case models.Metrics:
+		getMetrics(message)
 	}
 }
 
 func activate(_ context.Context) {
 	readConfigurationsFromFiles()
+	loadFreezes()
+	control()
+	serveAdmin()
 
 	infoMessageInput := models.GetInfoRequestMessageInputChannel(ID)
 	protocolMessageInput := models.GetProtocolMessageInputChannel(ID)
+	serve(infoMessageInput, protocolMessageInput, startProtocol)
+}
 
+// serve answers info requests and runs protocol requests with start, one at
+// a time. While a request waits for an operator no other protocol request is
+// taken, they wait in protocolMessageInput. It returns once
+// protocolMessageInput is closed.
+func serve(infoMessageInput <-chan *models.InfoRequestMessage, protocolMessageInput <-chan *models.ProtocolMessage, start func(*models.ProtocolMessage)) {
+	protocolMessages := protocolMessageInput
 	for {
 		select {
 		case infoMessage := <-infoMessageInput:
 			getInfo(infoMessage)
-		case protocolMessage := <-protocolMessageInput:
-			startProtocol(protocolMessage)
+		case protocolMessage, ok := <-protocolMessages:
+			if !ok {
+				return
+			}
+			if !checkFrozen(protocolMessage) || !approve(protocolMessage) {
+				continue
+			}
+			if needsOperator(protocolMessage) {
+				hold(protocolMessage)
+				protocolMessages = nil
+				continue
+			}
+			start(protocolMessage)
+		case protocolMessage := <-decidedMessages:
+			protocolMessages = protocolMessageInput
+			if protocolMessage != nil {
+				start(protocolMessage)
+			}
 		}
 	}
 }
@@ -239,5 +446,13 @@ func main() {
 	ctx := context.Background()
 	ID = party.ID(os.Args[1])
 	IP = os.Args[2]
+	messaging.SetLocalMember(string(ID))
+	if err := session.Init(ID); err != nil {
+		log.Fatalf("participant %s: %v\n", ID, err)
+	}
+	policy.Init(string(ID))
+	if err := audit.Init(string(ID)); err != nil {
+		log.Fatalf("participant %s: %v\n", ID, err)
+	}
 	activate(ctx)
 }
@@ -0,0 +1,124 @@
+package payload
+
+import (
+	"encoding/json"
+	"math/big"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+// knownCallsABI holds the token, Safe, MultiSend and SimpleAccount methods
+// that are decoded without an ABI.
+const knownCallsABI = `[
+	{"type":"function","name":"transfer","stateMutability":"nonpayable","inputs":[{"name":"to","type":"address"},{"name":"amount","type":"uint256"}],"outputs":[{"name":"","type":"bool"}]},
+	{"type":"function","name":"approve","stateMutability":"nonpayable","inputs":[{"name":"spender","type":"address"},{"name":"amount","type":"uint256"}],"outputs":[{"name":"","type":"bool"}]},
+	{"type":"function","name":"transferFrom","stateMutability":"nonpayable","inputs":[{"name":"from","type":"address"},{"name":"to","type":"address"},{"name":"amount","type":"uint256"}],"outputs":[{"name":"","type":"bool"}]},
+	{"type":"function","name":"safeTransferFrom","stateMutability":"nonpayable","inputs":[{"name":"from","type":"address"},{"name":"to","type":"address"},{"name":"tokenId","type":"uint256"}],"outputs":[]},
+	{"type":"function","name":"execute","stateMutability":"nonpayable","inputs":[{"name":"dest","type":"address"},{"name":"value","type":"uint256"},{"name":"func","type":"bytes"}],"outputs":[]},
+	{"type":"function","name":"executeBatch","stateMutability":"nonpayable","inputs":[{"name":"dest","type":"address[]"},{"name":"func","type":"bytes[]"}],"outputs":[]},
+	{"type":"function","name":"multiSend","stateMutability":"payable","inputs":[{"name":"transactions","type":"bytes"}],"outputs":[]},
+	{"type":"function","name":"setApprovalForAll","stateMutability":"nonpayable","inputs":[{"name":"operator","type":"address"},{"name":"approved","type":"bool"}],"outputs":[]},
+	{"type":"function","name":"execTransaction","stateMutability":"payable","inputs":[
+		{"name":"to","type":"address"},{"name":"value","type":"uint256"},{"name":"data","type":"bytes"},
+		{"name":"operation","type":"uint8"},{"name":"safeTxGas","type":"uint256"},{"name":"baseGas","type":"uint256"},
+		{"name":"gasPrice","type":"uint256"},{"name":"gasToken","type":"address"},{"name":"refundReceiver","type":"address"},
+		{"name":"signatures","type":"bytes"}],"outputs":[{"name":"success","type":"bool"}]}
+]`
+
+var knownCalls, _ = abi.JSON(strings.NewReader(knownCallsABI))
+
+type DecodedArgument struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type DecodedCall struct {
+	Method    string            `json:"method"`
+	Arguments []DecodedArgument `json:"arguments"`
+}
+
+// Argument returns the value of the argument name, empty if there is none.
+func (c *DecodedCall) Argument(name string) string {
+	for _, a := range c.Arguments {
+		if a.Name == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+func (c *DecodedCall) String() string {
+	args := make([]string, 0, len(c.Arguments))
+	for _, a := range c.Arguments {
+		args = append(args, a.Name+"="+a.Value)
+	}
+	return c.Method + " " + strings.Join(args, ", ")
+}
+
+// DecodeCall decodes calldata with contractABI, which may be nil, or the
+// known token and Safe methods. It returns nil for unknown methods.
+func DecodeCall(contractABI *abi.ABI, data []byte) *DecodedCall {
+	if len(data) < 4 {
+		return nil
+	}
+	abis := []*abi.ABI{&knownCalls}
+	if contractABI != nil {
+		abis = append([]*abi.ABI{contractABI}, abis...)
+	}
+	for _, a := range abis {
+		m, err := a.MethodById(data[:4])
+		if err != nil {
+			continue
+		}
+		values, err := m.Inputs.Unpack(data[4:])
+		if err != nil {
+			continue
+		}
+		call := &DecodedCall{Method: m.Sig, Arguments: make([]DecodedArgument, 0, len(values))}
+		for i, value := range values {
+			call.Arguments = append(call.Arguments, DecodedArgument{
+				Name:  m.Inputs[i].Name,
+				Type:  m.Inputs[i].Type.String(),
+				Value: formatValue(value),
+			})
+		}
+		return call
+	}
+	return nil
+}
+
+func formatValue(value interface{}) string {
+	switch v := value.(type) {
+	case common.Address:
+		return v.Hex()
+	case *big.Int:
+		return v.String()
+	case []byte:
+		return hexutil.Encode(v)
+	case string:
+		return v
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	rv := reflect.ValueOf(value)
+	switch rv.Kind() {
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(rv.Uint(), 10)
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(rv.Int(), 10)
+	case reflect.Array:
+		if rv.Type().Elem().Kind() == reflect.Uint8 {
+			b := make([]byte, rv.Len())
+			reflect.Copy(reflect.ValueOf(b), rv)
+			return hexutil.Encode(b)
+		}
+	}
+	b, _ := json.Marshal(value)
+	return string(b)
+}
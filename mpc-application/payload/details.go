@@ -0,0 +1,288 @@
+package payload
+
+import (
+	"encoding/json"
+	"errors"
+	"math/big"
+	"strconv"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/signer/core/apitypes"
+)
+
+// Details are the fields of a payload that policies check. Fields that don't
+// apply to the kind, or can't be known from the payload, are nil.
+// Recipients are the addresses that receive value or rights: the
+// destination and the decoded token recipient, spender or operator. Calls
+// are the inner calls of a batch, Value and Recipients are their total.
+// DelegateCall marks a Safe delegatecall, which runs code in the context of
+// the Safe. Only those of MultiSend have Calls.
+type Details struct {
+	Kind         Kind
+	ChainID      *big.Int
+	To           *common.Address
+	Value        *big.Int
+	Data         []byte
+	Call         *DecodedCall
+	Recipients   []common.Address
+	Calls        []Details
+	DelegateCall bool
+}
+
+// recipientArguments are the arguments of known calls that receive tokens or
+// approvals.
+var recipientArguments = []string{"to", "spender", "operator", "dest"}
+
+func (d *Details) setCall(to common.Address, value *big.Int, data []byte) {
+	d.To = &to
+	d.Value = value
+	d.Data = data
+	d.Recipients = append(d.Recipients, to)
+	d.Call = DecodeCall(nil, data)
+	if d.Call == nil {
+		return
+	}
+	for _, a := range d.Call.Arguments {
+		for _, name := range recipientArguments {
+			if a.Name == name && a.Type == "address" {
+				d.Recipients = append(d.Recipients, common.HexToAddress(a.Value))
+			}
+		}
+	}
+}
+
+// Details decodes the payload. Calls of Safe transactions and SimpleAccount
+// user operations are unwrapped, To and Value are those of the inner call.
+// The value and recipients of other user operations and of typed data other
+// than SafeTx and permits are unknown.
+func (p Payload) Details() (Details, error) {
+	d := Details{Kind: p.Kind}
+	switch p.Kind {
+	case Transaction:
+		tx, chainID, err := p.transaction()
+		if err != nil {
+			return Details{}, err
+		}
+		d.ChainID = chainID
+		if tx.To() == nil {
+			d.Value, d.Data = tx.Value(), tx.Data()
+			return d, nil
+		}
+		d.setCall(*tx.To(), tx.Value(), tx.Data())
+	case TypedData:
+		var typedData apitypes.TypedData
+		if err := json.Unmarshal(p.Data, &typedData); err != nil {
+			return Details{}, errors.New("invalid typed data payload: " + err.Error())
+		}
+		if typedData.Domain.ChainId != nil {
+			d.ChainID = (*big.Int)(typedData.Domain.ChainId)
+		}
+		if typedData.PrimaryType == "SafeTx" {
+			if err := d.setSafeTx(typedData.Message); err != nil {
+				return Details{}, err
+			}
+		} else if err := d.setTypedData(typedData); err != nil {
+			return Details{}, err
+		}
+	case UserOp:
+		var data userOperationData
+		if err := json.Unmarshal(p.Data, &data); err != nil || data.ChainID == nil {
+			return Details{}, errors.New("invalid user operation payload")
+		}
+		d.ChainID = data.ChainID.ToInt()
+		callData := data.UserOperation.CallData
+		call := DecodeCall(nil, callData)
+		switch {
+		case call != nil && call.Method == "execute(address,uint256,bytes)":
+			value, _ := new(big.Int).SetString(call.Argument("value"), 10)
+			inner, err := hexutil.Decode(call.Argument("func"))
+			if err != nil {
+				return Details{}, errors.New("invalid execute call: " + err.Error())
+			}
+			d.setCall(common.HexToAddress(call.Argument("dest")), value, inner)
+		case call != nil && call.Method == "executeBatch(address[],bytes[])":
+			if err := d.setBatch(callData); err != nil {
+				return Details{}, err
+			}
+		default:
+			sender := data.UserOperation.Sender
+			d.To, d.Data, d.Call = &sender, callData, call
+		}
+	}
+	return d, nil
+}
+
+// setBatch sets the inner calls of a SimpleAccount executeBatch, which
+// don't transfer value.
+func (d *Details) setBatch(callData []byte) error {
+	values, err := knownCalls.Methods["executeBatch"].Inputs.Unpack(callData[4:])
+	if err != nil {
+		return errors.New("invalid executeBatch call: " + err.Error())
+	}
+	dests, _ := values[0].([]common.Address)
+	funcs, _ := values[1].([][]byte)
+	if len(dests) != len(funcs) {
+		return errors.New("invalid executeBatch call: " + strconv.Itoa(len(dests)) + " destinations and " + strconv.Itoa(len(funcs)) + " calls")
+	}
+	d.Value = new(big.Int)
+	d.Data = callData
+	for i := range dests {
+		call := Details{Kind: d.Kind, ChainID: d.ChainID}
+		call.setCall(dests[i], new(big.Int), funcs[i])
+		d.Calls = append(d.Calls, call)
+		d.Recipients = append(d.Recipients, call.Recipients...)
+	}
+	return nil
+}
+
+// messageNumber reads a uint field of a typed data message, which is a
+// decimal or hex string, or a JSON number.
+func messageNumber(message apitypes.TypedDataMessage, name string) (*big.Int, bool) {
+	switch v := message[name].(type) {
+	case string:
+		return new(big.Int).SetString(v, 0)
+	case float64:
+		n, accuracy := big.NewFloat(v).Int(nil)
+		return n, accuracy == big.Exact && n.Sign() >= 0
+	case json.Number:
+		return new(big.Int).SetString(v.String(), 10)
+	}
+	return nil, false
+}
+
+// setSafeTx sets the call of a SafeTx. A delegatecall is only unwrapped if it
+// calls multiSend. A non-zero refundReceiver is a recipient. The gas refund
+// depends on the gas used, so a SafeTx with a gasPrice or gasToken has no
+// known value.
+func (d *Details) setSafeTx(message apitypes.TypedDataMessage) error {
+	invalid := errors.New("invalid SafeTx message")
+	to, _ := message["to"].(string)
+	data, _ := message["data"].(string)
+	gasToken, _ := message["gasToken"].(string)
+	refundReceiver, _ := message["refundReceiver"].(string)
+	value, ok := messageNumber(message, "value")
+	if !ok || !common.IsHexAddress(to) || !common.IsHexAddress(gasToken) || !common.IsHexAddress(refundReceiver) {
+		return invalid
+	}
+	operation, ok := messageNumber(message, "operation")
+	if !ok || operation.Cmp(big.NewInt(1)) > 0 {
+		return invalid
+	}
+	gasPrice, ok := messageNumber(message, "gasPrice")
+	if !ok {
+		return invalid
+	}
+	calldata, err := hexutil.Decode(data)
+	if err != nil {
+		return invalid
+	}
+
+	if operation.Sign() == 0 {
+		d.setCall(common.HexToAddress(to), value, calldata)
+	} else if err = d.setDelegateCall(common.HexToAddress(to), calldata); err != nil {
+		return err
+	}
+	if receiver := common.HexToAddress(refundReceiver); receiver != (common.Address{}) {
+		d.Recipients = append(d.Recipients, receiver)
+	}
+	if gasPrice.Sign() != 0 || common.HexToAddress(gasToken) != (common.Address{}) {
+		d.Value = nil
+	}
+	return nil
+}
+
+// setDelegateCall sets a Safe delegatecall. The transactions of multiSend
+// are its calls, the code of other delegatecalls can do anything with the
+// Safe, so they have no known value or recipients.
+func (d *Details) setDelegateCall(to common.Address, calldata []byte) error {
+	d.DelegateCall = true
+	d.To = &to
+	d.Data = calldata
+	d.Call = DecodeCall(nil, calldata)
+	if d.Call == nil || d.Call.Method != "multiSend(bytes)" {
+		return nil
+	}
+	values, err := knownCalls.Methods["multiSend"].Inputs.Unpack(calldata[4:])
+	if err != nil {
+		return errors.New("invalid multiSend call: " + err.Error())
+	}
+	transactions, _ := values[0].([]byte)
+	// a delegatecall doesn't send the value of the SafeTx
+	d.Value = new(big.Int)
+	d.Recipients = append(d.Recipients, to)
+	d.Calls = make([]Details, 0)
+	// each transaction is operation (1 byte), to (20), value (32), data
+	// length (32) and data
+	for i := 0; i < len(transactions); {
+		if len(transactions)-i < 85 {
+			return errors.New("invalid multiSend transactions")
+		}
+		operation := transactions[i]
+		callTo := common.BytesToAddress(transactions[i+1 : i+21])
+		callValue := new(big.Int).SetBytes(transactions[i+21 : i+53])
+		length := new(big.Int).SetBytes(transactions[i+53 : i+85])
+		i += 85
+		if !length.IsInt64() || length.Int64() > int64(len(transactions)-i) {
+			return errors.New("invalid multiSend transactions")
+		}
+		callData := transactions[i : i+int(length.Int64())]
+		i += int(length.Int64())
+
+		call := Details{Kind: d.Kind, ChainID: d.ChainID}
+		if operation == 0 {
+			call.setCall(callTo, callValue, callData)
+			d.Value.Add(d.Value, callValue)
+			d.Recipients = append(d.Recipients, call.Recipients...)
+		} else {
+			// nested delegatecalls aren't unwrapped
+			call.DelegateCall = true
+			call.To, call.Data, call.Call = &callTo, callData, DecodeCall(nil, callData)
+		}
+		d.Calls = append(d.Calls, call)
+	}
+	return nil
+}
+
+// permitTypes are the typed data messages that grant a spender the tokens
+// of the signer: EIP-2612 permits and Permit2 allowances and transfers.
+var permitTypes = map[string]bool{
+	"Permit":                  true,
+	"PermitSingle":            true,
+	"PermitBatch":             true,
+	"PermitTransferFrom":      true,
+	"PermitBatchTransferFrom": true,
+}
+
+// setTypedData sets the verifying contract as To. The recipients of permits
+// are the verifying contract and the spender, permits move tokens and have
+// no native value. Other typed data can grant anything, it has no known
+// recipients or value.
+func (d *Details) setTypedData(typedData apitypes.TypedData) error {
+	if common.IsHexAddress(typedData.Domain.VerifyingContract) {
+		to := common.HexToAddress(typedData.Domain.VerifyingContract)
+		d.To = &to
+	}
+	if !permitTypes[typedData.PrimaryType] {
+		return nil
+	}
+	if d.To == nil {
+		return errors.New("invalid " + typedData.PrimaryType + " message: no verifying contract")
+	}
+	found := false
+	d.Recipients = append(d.Recipients, *d.To)
+	for _, name := range recipientArguments {
+		if address, ok := typedData.Message[name].(string); ok {
+			if !common.IsHexAddress(address) {
+				return errors.New("invalid " + typedData.PrimaryType + " message: invalid " + name)
+			}
+			d.Recipients = append(d.Recipients, common.HexToAddress(address))
+			found = true
+		}
+	}
+	if !found {
+		return errors.New("invalid " + typedData.PrimaryType + " message: no spender")
+	}
+	d.Value = new(big.Int)
+	return nil
+}
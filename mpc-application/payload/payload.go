@@ -0,0 +1,327 @@
+package payload
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/signer/core/apitypes"
+)
+
+type Kind string
+
+const (
+	// Transaction is an unsigned Ethereum transaction, signed with the
+	// London signer of its chain.
+	Transaction Kind = "transaction"
+	// Message is signed with the EIP-191 prefix, as personal_sign does.
+	Message Kind = "message"
+	// Keccak is a message signed by its Keccak-256 hash, as /sign does. The
+	// message can be the preimage of any hash, e.g. an encoded transaction or
+	// typed data, so it is as blind as a digest.
+	Keccak Kind = "keccak"
+	// TypedData is EIP-712 typed data.
+	TypedData Kind = "typedData"
+	// UserOp is an ERC-4337 user operation of EntryPoint v0.6.
+	UserOp Kind = "userOperation"
+	// PSBTInput is a P2WPKH input of a PSBT, signed with its BIP-143 sighash.
+	PSBTInput Kind = "psbtInput"
+	// Digest is a digest without preimage. Participants can't check it.
+	Digest Kind = "digest"
+)
+
+// maxSummary is the length summaries of messages and typed data are cut at.
+const maxSummary = 500
+
+// Payload is the preimage of the hash a participant is asked to sign. Each
+// participant recomputes the hash from it instead of trusting the initiator.
+type Payload struct {
+	Kind Kind            `json:"kind"`
+	Data json.RawMessage `json:"data"`
+}
+
+type transactionData struct {
+	ChainID *hexutil.Big  `json:"chainId"`
+	Tx      hexutil.Bytes `json:"tx"`
+}
+
+type userOperationData struct {
+	UserOperation UserOperation  `json:"userOperation"`
+	EntryPoint    common.Address `json:"entryPoint"`
+	ChainID       *hexutil.Big   `json:"chainId"`
+	Raw           bool           `json:"raw"`
+}
+
+type psbtInputData struct {
+	PSBT      string        `json:"psbt"`
+	Input     int           `json:"input"`
+	PublicKey hexutil.Bytes `json:"publicKey"`
+}
+
+func newPayload(kind Kind, data interface{}) (Payload, error) {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return Payload{}, err
+	}
+	return Payload{Kind: kind, Data: raw}, nil
+}
+
+// NewTransaction is the payload of an unsigned transaction for chainID.
+func NewTransaction(chainID *big.Int, tx *types.Transaction) (Payload, error) {
+	raw, err := tx.MarshalBinary()
+	if err != nil {
+		return Payload{}, err
+	}
+	return newPayload(Transaction, transactionData{ChainID: (*hexutil.Big)(chainID), Tx: raw})
+}
+
+func NewMessage(message []byte) Payload {
+	p, _ := newPayload(Message, hexutil.Bytes(message))
+	return p
+}
+
+func NewKeccak(message []byte) Payload {
+	p, _ := newPayload(Keccak, hexutil.Bytes(message))
+	return p
+}
+
+func NewTypedData(typedData apitypes.TypedData) (Payload, error) {
+	return newPayload(TypedData, typedData)
+}
+
+// NewUserOperation is the payload of the userOpHash of op, with the EIP-191
+// prefix unless raw is set.
+func NewUserOperation(op UserOperation, entryPoint common.Address, chainID *big.Int, raw bool) (Payload, error) {
+	return newPayload(UserOp, userOperationData{
+		UserOperation: op,
+		EntryPoint:    entryPoint,
+		ChainID:       (*hexutil.Big)(chainID),
+		Raw:           raw,
+	})
+}
+
+// NewPSBTInput is the payload of input of the base64 PSBT, which spends the
+// P2WPKH output of publicKey.
+func NewPSBTInput(encoded string, input int, publicKey []byte) (Payload, error) {
+	return newPayload(PSBTInput, psbtInputData{PSBT: encoded, Input: input, PublicKey: publicKey})
+}
+
+func NewDigest(digest common.Hash) Payload {
+	p, _ := newPayload(Digest, digest)
+	return p
+}
+
+// Blind reports whether the payload has no preimage to check, or one that
+// doesn't tell what is signed.
+func (p Payload) Blind() bool {
+	return p.Kind == Digest || p.Kind == Keccak
+}
+
+// Hash computes the digest to sign from the preimage.
+func (p Payload) Hash() (common.Hash, error) {
+	switch p.Kind {
+	case Transaction:
+		tx, chainID, err := p.transaction()
+		if err != nil {
+			return common.Hash{}, err
+		}
+		return types.NewLondonSigner(chainID).Hash(tx), nil
+	case Message, Keccak:
+		var message hexutil.Bytes
+		if err := json.Unmarshal(p.Data, &message); err != nil {
+			return common.Hash{}, errors.New("invalid message payload: " + err.Error())
+		}
+		if p.Kind == Keccak {
+			return crypto.Keccak256Hash(message), nil
+		}
+		return common.BytesToHash(accounts.TextHash(message)), nil
+	case TypedData:
+		var typedData apitypes.TypedData
+		if err := json.Unmarshal(p.Data, &typedData); err != nil {
+			return common.Hash{}, errors.New("invalid typed data payload: " + err.Error())
+		}
+		hash, _, err := apitypes.TypedDataAndHash(typedData)
+		if err != nil {
+			return common.Hash{}, err
+		}
+		return common.BytesToHash(hash), nil
+	case UserOp:
+		var data userOperationData
+		if err := json.Unmarshal(p.Data, &data); err != nil || data.ChainID == nil {
+			return common.Hash{}, errors.New("invalid user operation payload")
+		}
+		hash, err := UserOperationHash(data.UserOperation, data.EntryPoint, data.ChainID.ToInt())
+		if err != nil || data.Raw {
+			return hash, err
+		}
+		return common.BytesToHash(accounts.TextHash(hash.Bytes())), nil
+	case PSBTInput:
+		var data psbtInputData
+		if err := json.Unmarshal(p.Data, &data); err != nil {
+			return common.Hash{}, errors.New("invalid PSBT payload: " + err.Error())
+		}
+		packet, err := parsePSBT(data.PSBT)
+		if err != nil {
+			return common.Hash{}, err
+		}
+		hash, _, err := WitnessSigHash(packet, data.Input, data.PublicKey)
+		return hash, err
+	case Digest:
+		var digest common.Hash
+		if err := json.Unmarshal(p.Data, &digest); err != nil {
+			return common.Hash{}, errors.New("invalid digest payload: " + err.Error())
+		}
+		return digest, nil
+	}
+	return common.Hash{}, errors.New("unknown payload kind: " + string(p.Kind))
+}
+
+// Verify recomputes the hash and checks it is messageHash. publicKey is the
+// compressed key of the signer, a PSBT input has to spend it.
+func (p Payload) Verify(messageHash []byte, publicKey []byte) error {
+	if p.Kind == PSBTInput {
+		var data psbtInputData
+		if err := json.Unmarshal(p.Data, &data); err != nil {
+			return errors.New("invalid PSBT payload: " + err.Error())
+		}
+		if !bytes.Equal(data.PublicKey, publicKey) {
+			return errors.New("PSBT input is not signed with this key")
+		}
+	}
+	hash, err := p.Hash()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(hash.Bytes(), messageHash) {
+		return errors.New("message hash " + hexutil.Encode(messageHash) + " does not match the payload hash " + hash.Hex())
+	}
+	return nil
+}
+
+func (p Payload) transaction() (*types.Transaction, *big.Int, error) {
+	var data transactionData
+	if err := json.Unmarshal(p.Data, &data); err != nil || data.ChainID == nil {
+		return nil, nil, errors.New("invalid transaction payload")
+	}
+	tx := new(types.Transaction)
+	if err := tx.UnmarshalBinary(data.Tx); err != nil {
+		return nil, nil, errors.New("invalid transaction payload: " + err.Error())
+	}
+	return tx, data.ChainID.ToInt(), nil
+}
+
+func cut(s string) string {
+	if len(s) > maxSummary {
+		return s[:maxSummary] + "..."
+	}
+	return s
+}
+
+// text quotes data if it is UTF-8 and hex encodes it otherwise.
+func text(data []byte) string {
+	if utf8.Valid(data) {
+		return cut(strconv.Quote(string(data)))
+	}
+	return cut(hexutil.Encode(data))
+}
+
+// Summary describes what is signed for the participant's log.
+func (p Payload) Summary() string {
+	switch p.Kind {
+	case Transaction:
+		tx, chainID, err := p.transaction()
+		if err != nil {
+			return err.Error()
+		}
+		s := "transaction on chain " + chainID.String() + ", nonce " + strconv.FormatUint(tx.Nonce(), 10)
+		if tx.To() == nil {
+			s += ": deploy " + strconv.Itoa(len(tx.Data())) + " bytes"
+		} else {
+			s += ": to " + tx.To().Hex()
+		}
+		s += ", value " + tx.Value().String() + " wei"
+		if call := DecodeCall(nil, tx.Data()); call != nil {
+			s += ", call " + call.String()
+		} else if tx.To() != nil && len(tx.Data()) > 0 {
+			s += ", " + strconv.Itoa(len(tx.Data())) + " bytes of data"
+		}
+		return s + ", gas " + strconv.FormatUint(tx.Gas(), 10) + ", max fee per gas " + tx.GasFeeCap().String()
+	case Message:
+		var message hexutil.Bytes
+		_ = json.Unmarshal(p.Data, &message)
+		return "personal message " + text(message)
+	case Keccak:
+		var message hexutil.Bytes
+		_ = json.Unmarshal(p.Data, &message)
+		return "blind Keccak-256 of " + text(message)
+	case TypedData:
+		var typedData apitypes.TypedData
+		if err := json.Unmarshal(p.Data, &typedData); err != nil {
+			return err.Error()
+		}
+		message, _ := json.Marshal(typedData.Message)
+		s := "typed data " + typedData.PrimaryType
+		if typedData.Domain.Name != "" {
+			s += " of " + typedData.Domain.Name
+		}
+		if typedData.Domain.ChainId != nil {
+			s += " on chain " + (*big.Int)(typedData.Domain.ChainId).String()
+		}
+		if typedData.Domain.VerifyingContract != "" {
+			s += " for " + typedData.Domain.VerifyingContract
+		}
+		return s + ": " + cut(string(message))
+	case UserOp:
+		var data userOperationData
+		if err := json.Unmarshal(p.Data, &data); err != nil || data.ChainID == nil {
+			return "invalid user operation payload"
+		}
+		op := data.UserOperation
+		s := "user operation of " + op.Sender.Hex() + " on chain " + data.ChainID.ToInt().String() + " via entry point " + data.EntryPoint.Hex()
+		if op.Nonce != nil {
+			s += ", nonce " + op.Nonce.ToInt().String()
+		}
+		if len(op.InitCode) > 0 {
+			s += ", deploys the account"
+		}
+		if len(op.PaymasterAndData) >= common.AddressLength {
+			s += ", paymaster " + common.BytesToAddress(op.PaymasterAndData[:common.AddressLength]).Hex()
+		}
+		return s + ", " + strconv.Itoa(len(op.CallData)) + " bytes of call data"
+	case PSBTInput:
+		var data psbtInputData
+		if err := json.Unmarshal(p.Data, &data); err != nil {
+			return "invalid PSBT payload"
+		}
+		packet, err := parsePSBT(data.PSBT)
+		if err != nil {
+			return err.Error()
+		}
+		tx := packet.UnsignedTx
+		s := "bitcoin input " + strconv.Itoa(data.Input) + " of transaction " + tx.TxHash().String()
+		for _, out := range tx.TxOut {
+			s += ", " + strconv.FormatInt(out.Value, 10) + " sat to script " + hexutil.Encode(out.PkScript)
+		}
+		if fee, err := packet.GetTxFee(); err == nil {
+			s += ", fee " + strconv.FormatInt(int64(fee), 10) + " sat"
+		}
+		if _, hashType, err := WitnessSigHash(packet, data.Input, data.PublicKey); err == nil && hashType != txscript.SigHashAll {
+			s += ", sighash type " + strconv.Itoa(int(hashType))
+		}
+		return s
+	case Digest:
+		var digest common.Hash
+		_ = json.Unmarshal(p.Data, &digest)
+		return "blind digest " + digest.Hex()
+	}
+	return "unknown payload kind " + string(p.Kind)
+}
@@ -0,0 +1,40 @@
+package payload
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// The Keccak-256 hash of an encoded transaction is its sighash, so the
+// message of a Keccak payload doesn't tell what is signed.
+func TestKeccakIsBlind(t *testing.T) {
+	to := common.HexToAddress("0x00000000000000000000000000000000000000b2")
+	tx := types.NewTx(&types.DynamicFeeTx{ChainID: big.NewInt(1), Nonce: 1, To: &to, Value: big.NewInt(1e18), Gas: 21000})
+	signer := types.NewLondonSigner(big.NewInt(1))
+	fields, err := rlp.EncodeToBytes([]interface{}{
+		big.NewInt(1), tx.Nonce(), tx.GasTipCap(), tx.GasFeeCap(), tx.Gas(), tx.To(), tx.Value(), tx.Data(), tx.AccessList(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	preimage := append([]byte{types.DynamicFeeTxType}, fields...)
+
+	p := NewKeccak(preimage)
+	hash, err := p.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash != signer.Hash(tx) {
+		t.Fatal("Keccak-256 of the encoded transaction isn't its sighash")
+	}
+	if !p.Blind() {
+		t.Error("Keccak payload isn't blind")
+	}
+	if NewMessage(preimage).Blind() {
+		t.Error("personal message is blind")
+	}
+}
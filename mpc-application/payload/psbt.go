@@ -0,0 +1,117 @@
+package payload
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"strings"
+
+	"mpc_poc/helper"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/btcutil/psbt"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// PreviousOutput returns the output input i spends, from the witness UTXO or
+// the full previous transaction. If the packet has both they must agree, the
+// previous transaction is the one its txid commits to.
+func PreviousOutput(packet *psbt.Packet, i int) (*wire.TxOut, error) {
+	input := packet.Inputs[i]
+	outPoint := packet.UnsignedTx.TxIn[i].PreviousOutPoint
+	var prevOut *wire.TxOut
+	if input.NonWitnessUtxo != nil {
+		if input.NonWitnessUtxo.TxHash() != outPoint.Hash || int(outPoint.Index) >= len(input.NonWitnessUtxo.TxOut) {
+			return nil, errors.New("previous transaction of input " + strconv.Itoa(i) + " doesn't have the output it spends")
+		}
+		prevOut = input.NonWitnessUtxo.TxOut[outPoint.Index]
+	}
+	if input.WitnessUtxo == nil {
+		if prevOut == nil {
+			return nil, errors.New("input " + strconv.Itoa(i) + " has no UTXO information")
+		}
+		return prevOut, nil
+	}
+	if prevOut != nil && (prevOut.Value != input.WitnessUtxo.Value || !bytes.Equal(prevOut.PkScript, input.WitnessUtxo.PkScript)) {
+		return nil, errors.New("witness UTXO of input " + strconv.Itoa(i) + " doesn't match its previous transaction")
+	}
+	return input.WitnessUtxo, nil
+}
+
+// sigHashTypes are the names of the sighash types PSBT_SIGHASH_TYPES can
+// allow.
+var sigHashTypes = map[string]txscript.SigHashType{
+	"ALL":                 txscript.SigHashAll,
+	"NONE":                txscript.SigHashNone,
+	"SINGLE":              txscript.SigHashSingle,
+	"ALL|ANYONECANPAY":    txscript.SigHashAll | txscript.SigHashAnyOneCanPay,
+	"NONE|ANYONECANPAY":   txscript.SigHashNone | txscript.SigHashAnyOneCanPay,
+	"SINGLE|ANYONECANPAY": txscript.SigHashSingle | txscript.SigHashAnyOneCanPay,
+}
+
+// allowedSigHashType reports whether hashType is in the comma separated
+// PSBT_SIGHASH_TYPES, only ALL by default. Other types leave inputs or
+// outputs unsigned, which the signer can't see in the payload.
+func allowedSigHashType(hashType txscript.SigHashType) bool {
+	for _, name := range strings.Split(helper.GetEnv("PSBT_SIGHASH_TYPES", "ALL"), ",") {
+		if allowed, ok := sigHashTypes[strings.ToUpper(strings.TrimSpace(name))]; ok && allowed == hashType {
+			return true
+		}
+	}
+	return false
+}
+
+// P2WPKHScript is the output script paying to the compressed public key.
+func P2WPKHScript(publicKey []byte) ([]byte, error) {
+	return txscript.NewScriptBuilder().AddOp(txscript.OP_0).AddData(btcutil.Hash160(publicKey)).Script()
+}
+
+// WitnessSigHash returns the BIP-143 sighash of input i of the packet, which
+// has to spend the P2WPKH output of publicKey, and its sighash type. The
+// type must be allowed by PSBT_SIGHASH_TYPES.
+func WitnessSigHash(packet *psbt.Packet, i int, publicKey []byte) (common.Hash, txscript.SigHashType, error) {
+	tx := packet.UnsignedTx
+	if i < 0 || i >= len(tx.TxIn) {
+		return common.Hash{}, 0, errors.New("input " + strconv.Itoa(i) + " does not exist")
+	}
+	script, err := P2WPKHScript(publicKey)
+	if err != nil {
+		return common.Hash{}, 0, err
+	}
+	prevOuts := make(map[wire.OutPoint]*wire.TxOut, len(tx.TxIn))
+	for j, txIn := range tx.TxIn {
+		prevOut, err := PreviousOutput(packet, j)
+		if err != nil {
+			return common.Hash{}, 0, err
+		}
+		prevOuts[txIn.PreviousOutPoint] = prevOut
+	}
+	prevOut := prevOuts[tx.TxIn[i].PreviousOutPoint]
+	if !bytes.Equal(prevOut.PkScript, script) {
+		return common.Hash{}, 0, errors.New("input " + strconv.Itoa(i) + " does not spend the key")
+	}
+
+	hashType := txscript.SigHashAll
+	if packet.Inputs[i].SighashType != 0 {
+		hashType = packet.Inputs[i].SighashType
+	}
+	if !allowedSigHashType(hashType) {
+		return common.Hash{}, 0, errors.New("sighash type " + strconv.Itoa(int(hashType)) + " of input " + strconv.Itoa(i) + " is not allowed, see PSBT_SIGHASH_TYPES")
+	}
+	sigHashes := txscript.NewTxSigHashes(tx, txscript.NewMultiPrevOutFetcher(prevOuts))
+	hash, err := txscript.CalcWitnessSigHash(script, sigHashes, hashType, tx, i, prevOut.Value)
+	if err != nil {
+		return common.Hash{}, 0, err
+	}
+	return common.BytesToHash(hash), hashType, nil
+}
+
+func parsePSBT(encoded string) (*psbt.Packet, error) {
+	packet, err := psbt.NewFromRawBytes(strings.NewReader(strings.TrimSpace(encoded)), true)
+	if err != nil {
+		return nil, errors.New("invalid PSBT: " + err.Error())
+	}
+	return packet, nil
+}
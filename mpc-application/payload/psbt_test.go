@@ -0,0 +1,120 @@
+package payload
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcutil/psbt"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// The native P2WPKH example of BIP-143: input 1 spends 6 BTC of the key.
+const (
+	bip143Tx        = "0100000002fff7f7881a8099afa6940d42d1e7f6362bec38171ea3edf433541db4e4ad969f0000000000eeffffffef51e1b804cc89d182d279655c3aa89e815b1b309fe287d9b2b55d57b90ec68a0100000000ffffffff02202cb206000000001976a9148280b37df378db99f66f85c95a783a76ac7a6d5988ac9093510d000000001976a9143bde42dbee7e4dbe6a21b2d50ce2f0167faa815988ac11000000"
+	bip143Input0    = "2103c9f4836b9a4f77fc0d81f7bcb01b7f1b35916864b9476c241ce9fc198bd25432ac"
+	bip143PublicKey = "025476c2e83188368da1ff3e292e7acafcdb3566bb0ad253f62fc70f07aeee6357"
+	bip143SigHash   = "0xc37af31116d1b27caf68aae9e3ac82f1477929014d5b917657d0eb49478cb670"
+)
+
+func decodeHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func bip143Packet(t *testing.T) (*psbt.Packet, []byte) {
+	t.Helper()
+	tx := wire.NewMsgTx(1)
+	if err := tx.Deserialize(bytes.NewReader(decodeHex(t, bip143Tx))); err != nil {
+		t.Fatal(err)
+	}
+	packet, err := psbt.NewFromUnsignedTx(tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey := decodeHex(t, bip143PublicKey)
+	script, _ := P2WPKHScript(publicKey)
+	packet.Inputs[0].WitnessUtxo = wire.NewTxOut(625000000, decodeHex(t, bip143Input0))
+	packet.Inputs[1].WitnessUtxo = wire.NewTxOut(600000000, script)
+	return packet, publicKey
+}
+
+func TestWitnessSigHashVector(t *testing.T) {
+	packet, publicKey := bip143Packet(t)
+	hash, hashType, err := WitnessSigHash(packet, 1, publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash.Hex() != bip143SigHash || hashType != txscript.SigHashAll {
+		t.Errorf("sighash %s type %d, want %s type 1", hash.Hex(), hashType, bip143SigHash)
+	}
+	if _, _, err = WitnessSigHash(packet, 0, publicKey); err == nil {
+		t.Error("signed an input of another key")
+	}
+
+	encoded, err := packet.B64Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := NewPSBTInput(encoded, 1, publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash, err := p.Hash(); err != nil || hash.Hex() != bip143SigHash {
+		t.Errorf("payload hash %s, %v, want %s", hash.Hex(), err, bip143SigHash)
+	}
+}
+
+// Sighash types other than SIGHASH_ALL are only signed if allowed.
+func TestWitnessSigHashType(t *testing.T) {
+	packet, publicKey := bip143Packet(t)
+	packet.Inputs[1].SighashType = txscript.SigHashSingle | txscript.SigHashAnyOneCanPay
+	if _, _, err := WitnessSigHash(packet, 1, publicKey); err == nil || !strings.Contains(err.Error(), "not allowed") {
+		t.Fatalf("SINGLE|ANYONECANPAY signed by default: %v", err)
+	}
+	t.Setenv("PSBT_SIGHASH_TYPES", "ALL, single|anyonecanpay")
+	if _, hashType, err := WitnessSigHash(packet, 1, publicKey); err != nil || hashType != txscript.SigHashSingle|txscript.SigHashAnyOneCanPay {
+		t.Errorf("allowed SINGLE|ANYONECANPAY refused: %v", err)
+	}
+}
+
+// The amount of a witness UTXO is checked against the previous transaction.
+func TestWitnessUtxoMatchesPreviousTransaction(t *testing.T) {
+	publicKey := decodeHex(t, bip143PublicKey)
+	script, _ := P2WPKHScript(publicKey)
+	prevTx := wire.NewMsgTx(2)
+	prevTx.AddTxIn(wire.NewTxIn(&wire.OutPoint{Index: 0}, nil, nil))
+	prevTx.AddTxOut(wire.NewTxOut(100000000, script))
+	prevHash := prevTx.TxHash()
+
+	tx := wire.NewMsgTx(2)
+	tx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&prevHash, 0), nil, nil))
+	tx.AddTxOut(wire.NewTxOut(99990000, script))
+	packet, err := psbt.NewFromUnsignedTx(tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet.Inputs[0].NonWitnessUtxo = prevTx
+
+	if _, _, err = WitnessSigHash(packet, 0, publicKey); err != nil {
+		t.Fatalf("input with its previous transaction refused: %v", err)
+	}
+	packet.Inputs[0].WitnessUtxo = wire.NewTxOut(200000000, script)
+	if _, err = PreviousOutput(packet, 0); err == nil {
+		t.Error("witness UTXO with another amount than the previous transaction accepted")
+	}
+	packet.Inputs[0].WitnessUtxo = wire.NewTxOut(100000000, script)
+	if _, err = PreviousOutput(packet, 0); err != nil {
+		t.Errorf("matching witness UTXO refused: %v", err)
+	}
+	packet.Inputs[0].NonWitnessUtxo = wire.NewMsgTx(2)
+	if _, err = PreviousOutput(packet, 0); err == nil {
+		t.Error("previous transaction with another txid accepted")
+	}
+}
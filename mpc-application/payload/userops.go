@@ -0,0 +1,74 @@
+package payload
+
+import (
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// UserOperation is an ERC-4337 user operation of EntryPoint v0.6, encoded as
+// bundlers expect it.
+type UserOperation struct {
+	Sender               common.Address `json:"sender"`
+	Nonce                *hexutil.Big   `json:"nonce"`
+	InitCode             hexutil.Bytes  `json:"initCode"`
+	CallData             hexutil.Bytes  `json:"callData"`
+	CallGasLimit         *hexutil.Big   `json:"callGasLimit"`
+	VerificationGasLimit *hexutil.Big   `json:"verificationGasLimit"`
+	PreVerificationGas   *hexutil.Big   `json:"preVerificationGas"`
+	MaxFeePerGas         *hexutil.Big   `json:"maxFeePerGas"`
+	MaxPriorityFeePerGas *hexutil.Big   `json:"maxPriorityFeePerGas"`
+	PaymasterAndData     hexutil.Bytes  `json:"paymasterAndData"`
+	Signature            hexutil.Bytes  `json:"signature"`
+}
+
+var (
+	abiAddress, _ = abi.NewType("address", "", nil)
+	abiUint256, _ = abi.NewType("uint256", "", nil)
+	abiBytes32, _ = abi.NewType("bytes32", "", nil)
+)
+
+// userOpFields is the packed user operation the EntryPoint hashes, with
+// the dynamic fields replaced by their hashes.
+var userOpFields = abi.Arguments{
+	{Type: abiAddress}, {Type: abiUint256}, {Type: abiBytes32}, {Type: abiBytes32},
+	{Type: abiUint256}, {Type: abiUint256}, {Type: abiUint256}, {Type: abiUint256},
+	{Type: abiUint256}, {Type: abiBytes32},
+}
+
+var userOpHashFields = abi.Arguments{{Type: abiBytes32}, {Type: abiAddress}, {Type: abiUint256}}
+
+func bigOrZero(b *hexutil.Big) *big.Int {
+	if b == nil {
+		return new(big.Int)
+	}
+	return b.ToInt()
+}
+
+// UserOperationHash computes the userOpHash as EntryPoint.getUserOpHash
+// does: keccak256(abi.encode(keccak256(pack(op)), entryPoint, chainId)).
+func UserOperationHash(op UserOperation, entryPoint common.Address, chainID *big.Int) (common.Hash, error) {
+	packed, err := userOpFields.Pack(
+		op.Sender,
+		bigOrZero(op.Nonce),
+		crypto.Keccak256Hash(op.InitCode),
+		crypto.Keccak256Hash(op.CallData),
+		bigOrZero(op.CallGasLimit),
+		bigOrZero(op.VerificationGasLimit),
+		bigOrZero(op.PreVerificationGas),
+		bigOrZero(op.MaxFeePerGas),
+		bigOrZero(op.MaxPriorityFeePerGas),
+		crypto.Keccak256Hash(op.PaymasterAndData),
+	)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	encoded, err := userOpHashFields.Pack(crypto.Keccak256Hash(packed), entryPoint, chainID)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	return crypto.Keccak256Hash(encoded), nil
+}
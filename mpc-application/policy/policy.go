@@ -0,0 +1,468 @@
+package policy
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"mpc_poc/helper"
+	"mpc_poc/payload"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/joho/godotenv"
+)
+
+// TimeWindow allows signing on Days, every day if empty, between From and To
+// as 15:04 in Timezone, UTC if empty. A window with To before From ends on
+// the next day, one with To equal to From lasts the whole day.
+type TimeWindow struct {
+	Days     []string `json:"days,omitempty"`
+	From     string   `json:"from"`
+	To       string   `json:"to"`
+	Timezone string   `json:"timezone,omitempty"`
+}
+
+// Rules limit what a participant signs. Empty rules allow everything. Values
+// are decimal or 0x hex amounts in wei of the native currency, the daily
+// total is kept per key and chain and reset at midnight UTC. Methods are
+// signatures like transfer(address,uint256) or 4-byte selectors.
+type Rules struct {
+	AllowedKinds    []payload.Kind `json:"allowedKinds,omitempty"`
+	AllowedChainIDs []uint64       `json:"allowedChainIds,omitempty"`
+	Allowlist       []string       `json:"allowlist,omitempty"`
+	Denylist        []string       `json:"denylist,omitempty"`
+	AllowedMethods  []string       `json:"allowedMethods,omitempty"`
+	MaxValue        string         `json:"maxValue,omitempty"`
+	MaxDailyValue   string         `json:"maxDailyValue,omitempty"`
+	TimeWindows     []TimeWindow   `json:"timeWindows,omitempty"`
+}
+
+// Policy holds the rules of all keys and additional rules per key address.
+// A request has to pass both.
+type Policy struct {
+	Rules
+	Keys map[string]Rules `json:"keys,omitempty"`
+}
+
+// Denial is the rule a request violates and why.
+type Denial struct {
+	Rule   string `json:"rule"`
+	Reason string `json:"reason"`
+}
+
+func (d *Denial) Error() string {
+	return d.Rule + ": " + d.Reason
+}
+
+var node string
+var current *Policy
+var currentErr error
+var modTime time.Time
+var policyMtx sync.Mutex
+
+// spent holds the approved value per key, chain and day.
+var spent = make(map[string]*big.Int)
+var spentMtx sync.Mutex
+var ledgerOnce sync.Once
+
+// Init sets the participant whose policy and ledger are used.
+func Init(id string) {
+	_ = godotenv.Load()
+	node = id
+}
+
+func path() string {
+	return helper.GetEnv("POLICY_FILE", "policy-"+node+".json")
+}
+
+func ledgerPath() string {
+	return helper.GetEnv("POLICY_LEDGER_FILE", "policy-"+node+"-ledger.json")
+}
+
+// Load parses and validates a policy file.
+func Load(file string) (*Policy, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var p Policy
+	if err = json.Unmarshal(data, &p); err != nil {
+		return nil, err
+	}
+	if err = p.Rules.validate(); err != nil {
+		return nil, err
+	}
+	for address, rules := range p.Keys {
+		if !common.IsHexAddress(address) {
+			return nil, errors.New("invalid key address: " + address)
+		}
+		if err = rules.validate(); err != nil {
+			return nil, errors.New(address + ": " + err.Error())
+		}
+	}
+	return &p, nil
+}
+
+// get returns the policy in POLICY_FILE, reloaded when the file changes. It
+// is nil if there is no file. A policy that can't be loaded denies
+// everything, so a broken edit doesn't lift the limits.
+func get() (*Policy, error) {
+	policyMtx.Lock()
+	defer policyMtx.Unlock()
+	info, err := os.Stat(path())
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		current, currentErr, modTime = nil, nil, time.Time{}
+		return nil, nil
+	}
+	if !info.ModTime().Equal(modTime) {
+		modTime = info.ModTime()
+		current, currentErr = Load(path())
+		if currentErr != nil {
+			log.Printf("policy: failed to load %s: %v\n", path(), currentErr)
+		} else {
+			log.Printf("policy: loaded %s\n", path())
+		}
+	}
+	return current, currentErr
+}
+
+func parseAmount(s string) (*big.Int, bool) {
+	if s == "" {
+		return nil, true
+	}
+	amount, ok := new(big.Int).SetString(s, 0)
+	return amount, ok && amount.Sign() >= 0
+}
+
+func (r Rules) validate() error {
+	for _, address := range append(append([]string{}, r.Allowlist...), r.Denylist...) {
+		if !common.IsHexAddress(address) {
+			return errors.New("invalid address: " + address)
+		}
+	}
+	for _, method := range r.AllowedMethods {
+		if strings.HasPrefix(method, "0x") {
+			if b, err := hexutil.Decode(method); err != nil || len(b) != 4 {
+				return errors.New("invalid selector: " + method)
+			}
+		} else if !strings.Contains(method, "(") {
+			return errors.New("invalid method signature: " + method)
+		}
+	}
+	if _, ok := parseAmount(r.MaxValue); !ok {
+		return errors.New("invalid maxValue: " + r.MaxValue)
+	}
+	if _, ok := parseAmount(r.MaxDailyValue); !ok {
+		return errors.New("invalid maxDailyValue: " + r.MaxDailyValue)
+	}
+	for _, w := range r.TimeWindows {
+		if _, err := time.LoadLocation(w.Timezone); err != nil {
+			return errors.New("invalid timezone: " + w.Timezone)
+		}
+		if _, err := time.Parse("15:04", w.From); err != nil {
+			return errors.New("invalid time: " + w.From)
+		}
+		if _, err := time.Parse("15:04", w.To); err != nil {
+			return errors.New("invalid time: " + w.To)
+		}
+		for _, day := range w.Days {
+			if _, ok := weekdays[strings.ToLower(day)]; !ok {
+				return errors.New("invalid day: " + day)
+			}
+		}
+	}
+	return nil
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// contains reports whether now is in the window, checked against the
+// weekday the window starts on.
+func (w TimeWindow) contains(now time.Time) bool {
+	location, _ := time.LoadLocation(w.Timezone)
+	now = now.In(location)
+	from, _ := time.Parse("15:04", w.From)
+	to, _ := time.Parse("15:04", w.To)
+	minute := now.Hour()*60 + now.Minute()
+	start := from.Hour()*60 + from.Minute()
+	end := to.Hour()*60 + to.Minute()
+
+	day := now.Weekday()
+	if start < end {
+		if minute < start || minute >= end {
+			return false
+		}
+	} else if minute < end {
+		day = (day + 6) % 7
+	} else if minute < start {
+		return false
+	}
+	if len(w.Days) == 0 {
+		return true
+	}
+	for _, d := range w.Days {
+		if weekdays[strings.ToLower(d)] == day {
+			return true
+		}
+	}
+	return false
+}
+
+func containsAddress(list []string, address common.Address) bool {
+	for _, a := range list {
+		if common.HexToAddress(a) == address {
+			return true
+		}
+	}
+	return false
+}
+
+func selector(method string) string {
+	if strings.HasPrefix(method, "0x") {
+		return strings.ToLower(method)
+	}
+	return hexutil.Encode(crypto.Keccak256([]byte(strings.ReplaceAll(method, " ", "")))[:4])
+}
+
+// check returns the first rule details violate. total is the value approved
+// today for the key on the chain of the payload. Chain, recipient and value
+// rules deny payloads without the field they check, e.g. messages or
+// contract creations, and Safe delegatecalls other than MultiSend.
+func (r Rules) check(d payload.Details, total *big.Int, now time.Time) *Denial {
+	if len(r.AllowedKinds) > 0 {
+		allowed := false
+		for _, kind := range r.AllowedKinds {
+			allowed = allowed || kind == d.Kind
+		}
+		if !allowed {
+			return &Denial{"allowedKinds", string(d.Kind) + " payloads are not allowed"}
+		}
+	}
+	if len(r.TimeWindows) > 0 {
+		allowed := false
+		for _, w := range r.TimeWindows {
+			allowed = allowed || w.contains(now)
+		}
+		if !allowed {
+			return &Denial{"timeWindows", "signing is not allowed at " + now.UTC().Format(time.RFC3339)}
+		}
+	}
+	if len(r.AllowedChainIDs) > 0 {
+		if d.ChainID == nil {
+			return &Denial{"allowedChainIds", subject(d) + " has no chain to check"}
+		}
+		allowed := false
+		for _, chainID := range r.AllowedChainIDs {
+			allowed = allowed || new(big.Int).SetUint64(chainID).Cmp(d.ChainID) == 0
+		}
+		if !allowed {
+			return &Denial{"allowedChainIds", "chain " + d.ChainID.String() + " is not allowed"}
+		}
+	}
+	calls := d.Calls
+	if calls == nil {
+		calls = []payload.Details{d}
+	}
+	if rule := r.callRule(); rule != "" {
+		for _, call := range calls {
+			if call.DelegateCall && call.Calls == nil {
+				return &Denial{rule, "delegatecall to " + call.To.Hex() + " can't be checked"}
+			}
+		}
+	}
+	if len(r.Allowlist) > 0 && len(d.Recipients) == 0 {
+		return &Denial{"allowlist", subject(d) + " has no recipient to check"}
+	}
+	for _, recipient := range d.Recipients {
+		if containsAddress(r.Denylist, recipient) {
+			return &Denial{"denylist", recipient.Hex() + " is denied"}
+		}
+		if len(r.Allowlist) > 0 && !containsAddress(r.Allowlist, recipient) {
+			return &Denial{"allowlist", recipient.Hex() + " is not allowed"}
+		}
+	}
+	for _, call := range calls {
+		if denial := r.checkMethod(call); denial != nil {
+			return denial
+		}
+	}
+	if d.Value == nil {
+		if r.MaxValue != "" {
+			return &Denial{"maxValue", subject(d) + " has no value to check"}
+		}
+		if r.MaxDailyValue != "" {
+			return &Denial{"maxDailyValue", subject(d) + " has no value to check"}
+		}
+		return nil
+	}
+	if max, _ := parseAmount(r.MaxValue); max != nil && d.Value.Cmp(max) > 0 {
+		return &Denial{"maxValue", "value " + d.Value.String() + " exceeds " + max.String()}
+	}
+	if max, _ := parseAmount(r.MaxDailyValue); max != nil {
+		if sum := new(big.Int).Add(total, d.Value); sum.Cmp(max) > 0 {
+			return &Denial{"maxDailyValue", "value " + d.Value.String() + " would bring the daily total to " + sum.String() + ", the limit is " + max.String()}
+		}
+	}
+	return nil
+}
+
+func (r Rules) checkMethod(d payload.Details) *Denial {
+	if len(r.AllowedMethods) == 0 || len(d.Data) == 0 {
+		return nil
+	}
+	called := "contract creation"
+	allowed := false
+	if d.To != nil && len(d.Data) >= 4 {
+		called = hexutil.Encode(d.Data[:4])
+		if d.Call != nil {
+			called = d.Call.Method
+		}
+		for _, method := range r.AllowedMethods {
+			allowed = allowed || selector(method) == hexutil.Encode(d.Data[:4])
+		}
+	}
+	if !allowed {
+		return &Denial{"allowedMethods", called + " is not allowed"}
+	}
+	return nil
+}
+
+// subject names what details describe in denials.
+// callRule returns the first rule that checks what a call does, empty if
+// there is none.
+func (r Rules) callRule() string {
+	switch {
+	case len(r.Allowlist) > 0:
+		return "allowlist"
+	case len(r.AllowedMethods) > 0:
+		return "allowedMethods"
+	case r.MaxValue != "":
+		return "maxValue"
+	case r.MaxDailyValue != "":
+		return "maxDailyValue"
+	}
+	return ""
+}
+
+func subject(d payload.Details) string {
+	if d.Kind == payload.Transaction && d.To == nil {
+		return "contract creation"
+	}
+	return string(d.Kind) + " payload"
+}
+
+func spentKey(address common.Address, chainID *big.Int, now time.Time) string {
+	return address.Hex() + ":" + chainID.String() + ":" + now.UTC().Format("2006-01-02")
+}
+
+func loadLedger() {
+	ledgerOnce.Do(func() {
+		data, err := os.ReadFile(ledgerPath())
+		if err != nil {
+			return
+		}
+		var saved map[string]string
+		if err = json.Unmarshal(data, &saved); err != nil {
+			log.Printf("policy: failed to parse %s: %v\n", ledgerPath(), err)
+			return
+		}
+		for key, value := range saved {
+			if amount, ok := new(big.Int).SetString(value, 10); ok {
+				spent[key] = amount
+			}
+		}
+	})
+}
+
+// saveLedger writes the totals of today, older days are dropped. spentMtx
+// must be held.
+func saveLedger(now time.Time) {
+	today := ":" + now.UTC().Format("2006-01-02")
+	saved := make(map[string]string)
+	for key, amount := range spent {
+		if strings.HasSuffix(key, today) {
+			saved[key] = amount.String()
+		} else {
+			delete(spent, key)
+		}
+	}
+	data, _ := json.MarshalIndent(saved, "", "  ")
+	tmp := ledgerPath() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		log.Printf("policy: failed to save %s: %v\n", ledgerPath(), err)
+		return
+	}
+	if err := os.Rename(tmp, ledgerPath()); err != nil {
+		log.Printf("policy: failed to save %s: %v\n", ledgerPath(), err)
+	}
+}
+
+// Approve checks a signing request of the key of address against the policy
+// and adds its value to the daily total if it passes. Value limits apply to
+// payloads with a native value, which are transactions, Safe transactions
+// and SimpleAccount user operations. The value counts once it is approved,
+// even if signing fails later.
+func Approve(address string, p payload.Payload, now time.Time) error {
+	policy, err := get()
+	if err != nil {
+		return &Denial{"policy", "the policy can't be loaded: " + err.Error()}
+	}
+	if policy == nil {
+		return nil
+	}
+	d, err := p.Details()
+	if err != nil {
+		return &Denial{"payload", err.Error()}
+	}
+
+	loadLedger()
+	spentMtx.Lock()
+	defer spentMtx.Unlock()
+	key := common.HexToAddress(address)
+	total := new(big.Int)
+	if d.ChainID != nil && spent[spentKey(key, d.ChainID, now)] != nil {
+		total = spent[spentKey(key, d.ChainID, now)]
+	}
+
+	if denial := policy.Rules.check(d, total, now); denial != nil {
+		return denial
+	}
+	for keyAddress, rules := range policy.Keys {
+		if common.HexToAddress(keyAddress) != key {
+			continue
+		}
+		if denial := rules.check(d, total, now); denial != nil {
+			denial.Reason += " for " + key.Hex()
+			return denial
+		}
+	}
+
+	if d.Value != nil && d.Value.Sign() > 0 && d.ChainID != nil {
+		spent[spentKey(key, d.ChainID, now)] = new(big.Int).Add(total, d.Value)
+		saveLedger(now)
+	}
+	return nil
+}
+
+// Describe returns the rule and reason of a refusal, err is a *Denial or any
+// other error of the rule named fallback.
+func Describe(err error, fallback string) (string, string) {
+	var denial *Denial
+	if errors.As(err, &denial) {
+		return denial.Rule, denial.Reason
+	}
+	return fallback, err.Error()
+}
@@ -0,0 +1,243 @@
+package policy
+
+import (
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"mpc_poc/payload"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/common/math"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/signer/core/apitypes"
+)
+
+var (
+	treasury = common.HexToAddress("0x00000000000000000000000000000000000000a1")
+	stranger = common.HexToAddress("0x00000000000000000000000000000000000000b2")
+	account  = common.HexToAddress("0x00000000000000000000000000000000000000c3")
+)
+
+const accountABI = `[
+	{"type":"function","name":"executeBatch","inputs":[{"name":"dest","type":"address[]"},{"name":"func","type":"bytes[]"}],"outputs":[]},
+	{"type":"function","name":"transfer","inputs":[{"name":"to","type":"address"},{"name":"amount","type":"uint256"}],"outputs":[]},
+	{"type":"function","name":"multiSend","inputs":[{"name":"transactions","type":"bytes"}],"outputs":[]}
+]`
+
+var (
+	safe      = common.HexToAddress("0x00000000000000000000000000000000000000e5")
+	multiSend = common.HexToAddress("0x00000000000000000000000000000000000000f6")
+	token     = common.HexToAddress("0x00000000000000000000000000000000000000a7")
+)
+
+var eip712Domain = []apitypes.Type{{Name: "chainId", Type: "uint256"}, {Name: "verifyingContract", Type: "address"}}
+
+func details(t *testing.T, p payload.Payload) payload.Details {
+	t.Helper()
+	d, err := p.Details()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func transaction(t *testing.T, to *common.Address, value int64) payload.Payload {
+	t.Helper()
+	tx := types.NewTx(&types.DynamicFeeTx{ChainID: big.NewInt(1), To: to, Value: big.NewInt(value), Gas: 21000})
+	p, err := payload.NewTransaction(big.NewInt(1), tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func userOperation(t *testing.T, callData []byte) payload.Payload {
+	t.Helper()
+	op := payload.UserOperation{Sender: account, Nonce: (*hexutil.Big)(big.NewInt(0)), CallData: callData}
+	p, err := payload.NewUserOperation(op, common.HexToAddress("0x5FF137D4b0FDCD49DcA30c7CF57E578a026d2789"), big.NewInt(1), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func executeBatch(t *testing.T, recipient common.Address) []byte {
+	t.Helper()
+	a, err := abi.JSON(strings.NewReader(accountABI))
+	if err != nil {
+		t.Fatal(err)
+	}
+	transfer, _ := a.Pack("transfer", recipient, big.NewInt(1))
+	data, err := a.Pack("executeBatch", []common.Address{treasury, treasury}, [][]byte{{}, transfer})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func accountCall(t *testing.T, method string, args ...interface{}) []byte {
+	t.Helper()
+	a, err := abi.JSON(strings.NewReader(accountABI))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := a.Pack(method, args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func typedData(t *testing.T, primaryType string, fields []apitypes.Type, verifyingContract common.Address, message apitypes.TypedDataMessage) payload.Payload {
+	t.Helper()
+	p, err := payload.NewTypedData(apitypes.TypedData{
+		Types:       apitypes.Types{"EIP712Domain": eip712Domain, primaryType: fields},
+		PrimaryType: primaryType,
+		Domain:      apitypes.TypedDataDomain{ChainId: math.NewHexOrDecimal256(1), VerifyingContract: verifyingContract.Hex()},
+		Message:     message,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// safeTx is a SafeTx of safe that calls to, with the fields in overrides.
+func safeTx(t *testing.T, to common.Address, data []byte, overrides apitypes.TypedDataMessage) payload.Payload {
+	t.Helper()
+	message := apitypes.TypedDataMessage{
+		"to": to.Hex(), "value": "0", "data": hexutil.Encode(data), "operation": "0",
+		"safeTxGas": "0", "baseGas": "0", "gasPrice": "0",
+		"gasToken": common.Address{}.Hex(), "refundReceiver": common.Address{}.Hex(), "nonce": "0",
+	}
+	for name, value := range overrides {
+		message[name] = value
+	}
+	fields := []apitypes.Type{
+		{Name: "to", Type: "address"}, {Name: "value", Type: "uint256"}, {Name: "data", Type: "bytes"},
+		{Name: "operation", Type: "uint8"}, {Name: "safeTxGas", Type: "uint256"}, {Name: "baseGas", Type: "uint256"},
+		{Name: "gasPrice", Type: "uint256"}, {Name: "gasToken", Type: "address"}, {Name: "refundReceiver", Type: "address"},
+		{Name: "nonce", Type: "uint256"},
+	}
+	return typedData(t, "SafeTx", fields, safe, message)
+}
+
+// multiSendCall packs the transactions of multiSend: operation, to, value,
+// data length and data.
+func multiSendCall(t *testing.T, operation byte, to common.Address, value int64, data []byte) []byte {
+	t.Helper()
+	transactions := append([]byte{operation}, to.Bytes()...)
+	transactions = append(transactions, common.LeftPadBytes(big.NewInt(value).Bytes(), 32)...)
+	transactions = append(transactions, common.LeftPadBytes(big.NewInt(int64(len(data))).Bytes(), 32)...)
+	transactions = append(transactions, data...)
+	return accountCall(t, "multiSend", transactions)
+}
+
+func permit(t *testing.T, spender common.Address) payload.Payload {
+	t.Helper()
+	fields := []apitypes.Type{
+		{Name: "owner", Type: "address"}, {Name: "spender", Type: "address"}, {Name: "value", Type: "uint256"},
+		{Name: "nonce", Type: "uint256"}, {Name: "deadline", Type: "uint256"},
+	}
+	return typedData(t, "Permit", fields, token, apitypes.TypedDataMessage{
+		"owner": account.Hex(), "spender": spender.Hex(), "value": "1000", "nonce": "0", "deadline": "1000000",
+	})
+}
+
+// Rules that check a field deny payloads that don't have it.
+func TestUncheckablePayloadsDenied(t *testing.T) {
+	cases := []struct {
+		name  string
+		rules Rules
+		p     payload.Payload
+		rule  string
+	}{
+		{"message under maxValue", Rules{MaxValue: "1"}, payload.NewMessage([]byte("hello")), "maxValue"},
+		{"digest under maxDailyValue", Rules{MaxDailyValue: "1"}, payload.NewDigest(common.Hash{1}), "maxDailyValue"},
+		{"keccak under allowlist", Rules{Allowlist: []string{treasury.Hex()}}, payload.NewKeccak([]byte("hello")), "allowlist"},
+		{"message under allowedChainIds", Rules{AllowedChainIDs: []uint64{1}}, payload.NewMessage([]byte("hello")), "allowedChainIds"},
+		{"contract creation under allowlist", Rules{Allowlist: []string{treasury.Hex()}}, transaction(t, nil, 0), "allowlist"},
+		{"unknown user operation under maxValue", Rules{MaxValue: "1"}, userOperation(t, []byte{1, 2, 3, 4}), "maxValue"},
+		{"batch with a stranger", Rules{Allowlist: []string{treasury.Hex()}}, userOperation(t, executeBatch(t, stranger)), "allowlist"},
+		{"batch with a denied method", Rules{AllowedMethods: []string{"approve(address,uint256)"}}, userOperation(t, executeBatch(t, treasury)), "allowedMethods"},
+	}
+	for _, c := range cases {
+		denial := c.rules.check(details(t, c.p), new(big.Int), time.Now())
+		if denial == nil || denial.Rule != c.rule {
+			t.Errorf("%s: got %v, want a %s denial", c.name, denial, c.rule)
+		}
+	}
+}
+
+// Delegatecalls, gas refunds and the refund receiver of a SafeTx are checked.
+func TestSafeTxFieldsChecked(t *testing.T) {
+	allowlist := Rules{Allowlist: []string{treasury.Hex(), multiSend.Hex()}}
+	transferToStranger := accountCall(t, "transfer", stranger, big.NewInt(1))
+	transferToTreasury := accountCall(t, "transfer", treasury, big.NewInt(1))
+	cases := []struct {
+		name  string
+		rules Rules
+		p     payload.Payload
+		rule  string
+	}{
+		{"delegatecall", allowlist, safeTx(t, treasury, transferToTreasury, apitypes.TypedDataMessage{"operation": "1"}), "allowlist"},
+		{"delegatecall under allowedMethods", Rules{AllowedMethods: []string{"transfer(address,uint256)"}}, safeTx(t, treasury, transferToTreasury, apitypes.TypedDataMessage{"operation": "1"}), "allowedMethods"},
+		{"multiSend to a stranger", allowlist, safeTx(t, multiSend, multiSendCall(t, 0, treasury, 0, transferToStranger), apitypes.TypedDataMessage{"operation": "1"}), "allowlist"},
+		{"multiSend with a delegatecall", allowlist, safeTx(t, multiSend, multiSendCall(t, 1, treasury, 0, transferToTreasury), apitypes.TypedDataMessage{"operation": "1"}), "allowlist"},
+		{"multiSend above maxValue", Rules{MaxValue: "10"}, safeTx(t, multiSend, multiSendCall(t, 0, treasury, 11, nil), apitypes.TypedDataMessage{"operation": "1"}), "maxValue"},
+		{"refund to a stranger", allowlist, safeTx(t, treasury, nil, apitypes.TypedDataMessage{"refundReceiver": stranger.Hex()}), "allowlist"},
+		{"refund in ether under maxValue", Rules{MaxValue: "10"}, safeTx(t, treasury, nil, apitypes.TypedDataMessage{"gasPrice": "1", "safeTxGas": "100000"}), "maxValue"},
+		{"refund in a token under maxDailyValue", Rules{MaxDailyValue: "10"}, safeTx(t, treasury, nil, apitypes.TypedDataMessage{"gasToken": token.Hex(), "gasPrice": "1"}), "maxDailyValue"},
+	}
+	for _, c := range cases {
+		denial := c.rules.check(details(t, c.p), new(big.Int), time.Now())
+		if denial == nil || denial.Rule != c.rule {
+			t.Errorf("%s: got %v, want a %s denial", c.name, denial, c.rule)
+		}
+	}
+
+	allowed := safeTx(t, multiSend, multiSendCall(t, 0, treasury, 1, transferToTreasury), apitypes.TypedDataMessage{"operation": "1", "refundReceiver": treasury.Hex()})
+	if denial := (Rules{Allowlist: allowlist.Allowlist, MaxValue: "1"}).check(details(t, allowed), new(big.Int), time.Now()); denial != nil {
+		t.Errorf("multiSend to the treasury denied: %v", denial)
+	}
+}
+
+// Permits are checked against their spender, typed data that isn't
+// understood is denied by recipient and value rules.
+func TestTypedDataRecipients(t *testing.T) {
+	rules := Rules{Allowlist: []string{token.Hex(), treasury.Hex()}}
+	if denial := rules.check(details(t, permit(t, stranger)), new(big.Int), time.Now()); denial == nil || denial.Rule != "allowlist" {
+		t.Errorf("permit for a stranger: got %v, want an allowlist denial", denial)
+	}
+	if denial := rules.check(details(t, permit(t, treasury)), new(big.Int), time.Now()); denial != nil {
+		t.Errorf("permit for the treasury denied: %v", denial)
+	}
+
+	order := typedData(t, "Order", []apitypes.Type{{Name: "maker", Type: "address"}, {Name: "taker", Type: "address"}}, token,
+		apitypes.TypedDataMessage{"maker": account.Hex(), "taker": treasury.Hex()})
+	for _, r := range []Rules{rules, {MaxValue: "1"}} {
+		if denial := r.check(details(t, order), new(big.Int), time.Now()); denial == nil {
+			t.Errorf("unknown typed data allowed by %+v", r)
+		}
+	}
+	if denial := (Rules{}).check(details(t, order), new(big.Int), time.Now()); denial != nil {
+		t.Errorf("unknown typed data denied without rules: %v", denial)
+	}
+}
+
+func TestCheckablePayloadsAllowed(t *testing.T) {
+	rules := Rules{MaxValue: "10", Allowlist: []string{treasury.Hex()}, AllowedChainIDs: []uint64{1}, AllowedMethods: []string{"transfer(address,uint256)"}}
+	if denial := rules.check(details(t, transaction(t, &treasury, 10)), new(big.Int), time.Now()); denial != nil {
+		t.Errorf("transfer to the treasury denied: %v", denial)
+	}
+	if denial := rules.check(details(t, userOperation(t, executeBatch(t, treasury))), new(big.Int), time.Now()); denial != nil {
+		t.Errorf("batch to the treasury denied: %v", denial)
+	}
+	if denial := (Rules{}).check(details(t, payload.NewMessage([]byte("hello"))), new(big.Int), time.Now()); denial != nil {
+		t.Errorf("message denied without rules: %v", denial)
+	}
+}
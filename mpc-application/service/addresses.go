@@ -0,0 +1,88 @@
+package service
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"sync"
+
+	"mpc_poc/addresses"
+	"mpc_poc/chains"
+	"mpc_poc/helper"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/joho/godotenv"
+	"github.com/koteld/multi-party-sig/pkg/party"
+)
+
+type KeyAddresses struct {
+	Address   string              `json:"address"`
+	PublicKey string              `json:"publicKey"`
+	Addresses []addresses.Address `json:"addresses"`
+}
+
+var encodersOnce sync.Once
+
+// registerEncoders adds the Cosmos prefixes of COSMOS_PREFIXES and every EVM
+// chain of the chain registry to the address encoders.
+func registerEncoders() {
+	encodersOnce.Do(func() {
+		_ = godotenv.Load()
+		addresses.RegisterCosmos(helper.GetEnv("COSMOS_PREFIXES", "cosmos"))
+		evmChains, err := chains.List()
+		if err != nil {
+			log.Printf("addresses: no EVM chains from the chain registry: %v\n", err)
+			return
+		}
+		for _, chain := range evmChains {
+			addresses.Register("evm/"+chain.Name, addresses.EVM(chain.Name, chain.ChainID))
+		}
+	})
+}
+
+// GetAddresses lists the addresses of the MPC key of address on every chain:
+// the registered encoders, including the Cosmos prefixes of COSMOS_PREFIXES
+// and the EVM chains of the chain registry, and the Cosmos prefixes in
+// prefixes.
+func GetAddresses(ids party.IDSlice, address string, prefixes string) (KeyAddresses, error) {
+	registerEncoders()
+
+	if !common.IsHexAddress(address) {
+		return KeyAddresses{}, errors.New("invalid address: " + address)
+	}
+	publicKey, err := PublicKey(ids, address)
+	if err != nil {
+		return KeyAddresses{}, err
+	}
+	list, err := addresses.Derive(publicKey)
+	if err != nil {
+		return KeyAddresses{}, err
+	}
+
+	seen := make(map[string]bool)
+	for _, a := range list {
+		seen[a.Address] = true
+	}
+	for _, hrp := range strings.Split(prefixes, ",") {
+		if hrp = strings.ToLower(strings.TrimSpace(hrp)); hrp == "" {
+			continue
+		}
+		cosmos, err := addresses.Cosmos(hrp)(publicKey)
+		if err != nil {
+			return KeyAddresses{}, errors.New("cosmos prefix " + hrp + ": " + err.Error())
+		}
+		for _, a := range cosmos {
+			if !seen[a.Address] {
+				seen[a.Address] = true
+				list = append(list, a)
+			}
+		}
+	}
+
+	return KeyAddresses{
+		Address:   common.HexToAddress(address).Hex(),
+		PublicKey: hexutil.Encode(publicKey),
+		Addresses: list,
+	}, nil
+}
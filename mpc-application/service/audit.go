@@ -0,0 +1,38 @@
+package service
+
+import (
+	"encoding/json"
+
+	"mpc_poc/audit"
+	"mpc_poc/models"
+	"mpc_poc/payload"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+// recordSession writes the outcome of a session started by the API to its
+// audit log. p is nil for protocols without payload.
+func recordSession(protocol models.Protocol, address string, sessionID string, p *payload.Payload, err error) {
+	entry := audit.Entry{
+		Event:     "session",
+		Protocol:  string(protocol),
+		Address:   address,
+		SessionID: sessionID,
+		Result:    "completed",
+	}
+	if p != nil {
+		if hash, hashErr := p.Hash(); hashErr == nil {
+			entry.Digest = hexutil.Encode(hash.Bytes())
+		}
+		entry.Summary = p.Summary()
+		entry.Payload, _ = json.Marshal(p)
+	}
+	if err != nil {
+		entry.Result = "failed"
+		if _, ok := err.(*RefusedError); ok {
+			entry.Result = "refused"
+		}
+		entry.Reason = err.Error()
+	}
+	audit.Append(entry)
+}
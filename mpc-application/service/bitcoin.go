@@ -0,0 +1,217 @@
+package service
+
+import (
+	"bytes"
+	"encoding/asn1"
+	"encoding/hex"
+	"errors"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"mpc_poc/helper"
+	"mpc_poc/payload"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/btcutil/psbt"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/koteld/multi-party-sig/pkg/party"
+)
+
+var bitcoinNetworks = map[string]*chaincfg.Params{
+	"mainnet": &chaincfg.MainNetParams,
+	"testnet": &chaincfg.TestNet3Params,
+	"regtest": &chaincfg.RegressionNetParams,
+}
+
+type BitcoinAccount struct {
+	Network   string `json:"network"`
+	Address   string `json:"address"`
+	PublicKey string `json:"publicKey"`
+	Script    string `json:"script"`
+}
+
+type SignedPSBT struct {
+	PSBT     string `json:"psbt"`
+	Signed   []int  `json:"signed"`
+	Complete bool   `json:"complete"`
+	Tx       string `json:"tx,omitempty"`
+	TxID     string `json:"txid,omitempty"`
+	Fee      int64  `json:"fee"`
+}
+
+// bitcoinNetwork returns the parameters of network, BITCOIN_NETWORK or
+// testnet if empty.
+func bitcoinNetwork(network string) (string, *chaincfg.Params, error) {
+	if network == "" {
+		network = helper.GetEnv("BITCOIN_NETWORK", "testnet")
+	}
+	params, ok := bitcoinNetworks[strings.ToLower(network)]
+	if !ok {
+		return "", nil, errors.New("unknown bitcoin network: " + network)
+	}
+	return strings.ToLower(network), params, nil
+}
+
+// PublicKey returns the compressed public key of the MPC address as the
+// participants report it.
+func PublicKey(ids party.IDSlice, address string) ([]byte, error) {
+	for _, config := range GetConfigs(ids) {
+		if common.HexToAddress(config.Address) == common.HexToAddress(address) && config.PublicKey != "" {
+			return hexutil.Decode(config.PublicKey)
+		}
+	}
+	return nil, errors.New("no public key for " + address)
+}
+
+func p2wpkh(publicKey []byte, params *chaincfg.Params) (*btcutil.AddressWitnessPubKeyHash, []byte, error) {
+	address, err := btcutil.NewAddressWitnessPubKeyHash(btcutil.Hash160(publicKey), params)
+	if err != nil {
+		return nil, nil, err
+	}
+	script, err := txscript.PayToAddrScript(address)
+	if err != nil {
+		return nil, nil, err
+	}
+	return address, script, nil
+}
+
+// GetBitcoinAccount returns the P2WPKH address of the MPC key of address.
+func GetBitcoinAccount(ids party.IDSlice, address string, network string) (BitcoinAccount, error) {
+	network, params, err := bitcoinNetwork(network)
+	if err != nil {
+		return BitcoinAccount{}, err
+	}
+	publicKey, err := PublicKey(ids, address)
+	if err != nil {
+		return BitcoinAccount{}, err
+	}
+	p2wpkhAddress, script, err := p2wpkh(publicKey, params)
+	if err != nil {
+		return BitcoinAccount{}, err
+	}
+	return BitcoinAccount{
+		Network:   network,
+		Address:   p2wpkhAddress.EncodeAddress(),
+		PublicKey: hex.EncodeToString(publicKey),
+		Script:    hex.EncodeToString(script),
+	}, nil
+}
+
+// SignPSBT signs every input of a base64 PSBT that spends a P2WPKH output of
+// the MPC key of address and finalizes them. If all inputs are final the
+// network transaction is extracted as well.
+func SignPSBT(ids party.IDSlice, threshold int, address string, encoded string, network string, online bool) (SignedPSBT, error) {
+	_, params, err := bitcoinNetwork(network)
+	if err != nil {
+		return SignedPSBT{}, err
+	}
+	publicKey, err := PublicKey(ids, address)
+	if err != nil {
+		return SignedPSBT{}, err
+	}
+	packet, err := psbt.NewFromRawBytes(strings.NewReader(strings.TrimSpace(encoded)), true)
+	if err != nil {
+		return SignedPSBT{}, errors.New("invalid PSBT: " + err.Error())
+	}
+
+	signs := 0
+	return signPSBT(packet, publicKey, params, func(i int, hash []byte) ([]byte, error) {
+		// a pre-signature can only be used once
+		if online && signs > 0 {
+			return nil, errors.New("online signing can only sign one input, sign offline")
+		}
+		signs++
+		p, err := payload.NewPSBTInput(encoded, i, publicKey)
+		if err != nil {
+			return nil, err
+		}
+		return signDigest(ids, threshold, address, p, online, "")
+	})
+}
+
+// signPSBT adds the signatures of publicKey with the BIP-143 sighash of each
+// input it owns. sign returns a 65-byte signature with low S of the digest of
+// input i.
+func signPSBT(packet *psbt.Packet, publicKey []byte, params *chaincfg.Params, sign func(i int, hash []byte) ([]byte, error)) (SignedPSBT, error) {
+	_, script, err := p2wpkh(publicKey, params)
+	if err != nil {
+		return SignedPSBT{}, err
+	}
+
+	tx := packet.UnsignedTx
+	updater, err := psbt.NewUpdater(packet)
+	if err != nil {
+		return SignedPSBT{}, err
+	}
+	res := SignedPSBT{Signed: make([]int, 0)}
+	for i := range tx.TxIn {
+		prevOut, err := payload.PreviousOutput(packet, i)
+		if err != nil {
+			return SignedPSBT{}, err
+		}
+		if !bytes.Equal(prevOut.PkScript, script) || len(packet.Inputs[i].FinalScriptWitness) > 0 {
+			continue
+		}
+		if packet.Inputs[i].WitnessUtxo == nil {
+			if err = updater.AddInWitnessUtxo(prevOut, i); err != nil {
+				return SignedPSBT{}, err
+			}
+		}
+
+		hash, hashType, err := payload.WitnessSigHash(packet, i, publicKey)
+		if err != nil {
+			return SignedPSBT{}, err
+		}
+		sig, err := sign(i, hash.Bytes())
+		if err != nil {
+			return SignedPSBT{}, err
+		}
+		der, err := asn1.Marshal(derSignature{
+			R: new(big.Int).SetBytes(sig[:32]),
+			S: new(big.Int).SetBytes(sig[32:64]),
+		})
+		if err != nil {
+			return SignedPSBT{}, err
+		}
+
+		outcome, err := updater.Sign(i, append(der, byte(hashType)), publicKey, nil, nil)
+		if err != nil {
+			return SignedPSBT{}, errors.New("input " + strconv.Itoa(i) + ": " + err.Error())
+		}
+		if outcome != psbt.SignSuccesful {
+			return SignedPSBT{}, errors.New("input " + strconv.Itoa(i) + " could not be signed")
+		}
+		if err = psbt.Finalize(packet, i); err != nil {
+			return SignedPSBT{}, errors.New("input " + strconv.Itoa(i) + ": " + err.Error())
+		}
+		res.Signed = append(res.Signed, i)
+	}
+	if len(res.Signed) == 0 {
+		return SignedPSBT{}, errors.New("no input spends " + hex.EncodeToString(script))
+	}
+
+	if res.PSBT, err = packet.B64Encode(); err != nil {
+		return SignedPSBT{}, err
+	}
+	if fee, err := packet.GetTxFee(); err == nil {
+		res.Fee = int64(fee)
+	}
+	res.Complete = packet.IsComplete()
+	if res.Complete {
+		signedTx, err := psbt.Extract(packet)
+		if err != nil {
+			return SignedPSBT{}, err
+		}
+		var buf bytes.Buffer
+		if err = signedTx.Serialize(&buf); err != nil {
+			return SignedPSBT{}, err
+		}
+		res.Tx = hex.EncodeToString(buf.Bytes())
+		res.TxID = signedTx.TxHash().String()
+	}
+	return res, nil
+}
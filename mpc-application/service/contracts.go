@@ -0,0 +1,363 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"mpc_poc/chains"
+	"mpc_poc/nonces"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/koteld/multi-party-sig/pkg/party"
+)
+
+type ContractTransaction struct {
+	Hash     string `json:"hash"`
+	Contract string `json:"contract"`
+	Method   string `json:"method,omitempty"`
+	Data     string `json:"data"`
+	Nonce    uint64 `json:"nonce"`
+	Fees     Fees   `json:"fees"`
+}
+
+// ParseABI accepts a JSON ABI, a single JSON fragment, or a function signature
+// such as "approve(address,uint256)". The ABI may also be passed as a JSON
+// string containing any of these.
+func ParseABI(raw json.RawMessage) (abi.ABI, error) {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) > 0 && raw[0] == '"' {
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return abi.ABI{}, err
+		}
+		raw = bytes.TrimSpace([]byte(s))
+		if len(raw) > 0 && raw[0] != '[' && raw[0] != '{' {
+			return parseSignature(string(raw))
+		}
+	}
+	if len(raw) > 0 && raw[0] == '{' {
+		raw = append(append([]byte{'['}, raw...), ']')
+	}
+	return abi.JSON(bytes.NewReader(raw))
+}
+
+// parseSignature turns "function name(type a, type b)" into a one-method ABI.
+// Tuples have to be given as JSON.
+func parseSignature(signature string) (abi.ABI, error) {
+	signature = strings.TrimPrefix(strings.TrimSpace(signature), "function ")
+	open := strings.Index(signature, "(")
+	if open <= 0 || !strings.HasSuffix(signature, ")") {
+		return abi.ABI{}, errors.New("invalid function signature: " + signature)
+	}
+	if strings.Contains(signature[open+1:len(signature)-1], "(") {
+		return abi.ABI{}, errors.New("tuples are not supported in signatures, use a JSON ABI: " + signature)
+	}
+	type argument struct {
+		Name string `json:"name"`
+		Type string `json:"type"`
+	}
+	fragment := struct {
+		Type            string     `json:"type"`
+		Name            string     `json:"name"`
+		StateMutability string     `json:"stateMutability"`
+		Inputs          []argument `json:"inputs"`
+	}{
+		Type:            "function",
+		Name:            strings.TrimSpace(signature[:open]),
+		StateMutability: "payable",
+		Inputs:          make([]argument, 0),
+	}
+	if params := strings.TrimSpace(signature[open+1 : len(signature)-1]); params != "" {
+		for _, param := range strings.Split(params, ",") {
+			fields := strings.Fields(param)
+			if len(fields) == 0 {
+				return abi.ABI{}, errors.New("invalid function signature: " + signature)
+			}
+			arg := argument{Type: fields[0]}
+			if len(fields) > 1 {
+				arg.Name = fields[len(fields)-1]
+			}
+			fragment.Inputs = append(fragment.Inputs, arg)
+		}
+	}
+	data, err := json.Marshal([]interface{}{fragment})
+	if err != nil {
+		return abi.ABI{}, err
+	}
+	return abi.JSON(bytes.NewReader(data))
+}
+
+// convertArgs converts JSON arguments into the Go values abi.Pack expects.
+// Integers may be JSON numbers or decimal or 0x strings, bytes are hex strings
+// and tuples are JSON objects or arrays.
+func convertArgs(arguments abi.Arguments, args []json.RawMessage) ([]interface{}, error) {
+	if len(args) != len(arguments) {
+		return nil, errors.New("expected " + strconv.Itoa(len(arguments)) + " arguments, got " + strconv.Itoa(len(args)))
+	}
+	res := make([]interface{}, len(args))
+	for i, argument := range arguments {
+		v, err := convertArg(argument.Type, args[i])
+		if err != nil {
+			return nil, errors.New("argument " + argument.Name + ": " + err.Error())
+		}
+		res[i] = v.Interface()
+	}
+	return res, nil
+}
+
+func convertArg(t abi.Type, raw json.RawMessage) (reflect.Value, error) {
+	switch t.T {
+	case abi.AddressTy:
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil || !common.IsHexAddress(s) {
+			return reflect.Value{}, errors.New("invalid address " + string(raw))
+		}
+		return reflect.ValueOf(common.HexToAddress(s)), nil
+	case abi.IntTy, abi.UintTy:
+		s := strings.Trim(string(raw), "\"")
+		n, ok := new(big.Int).SetString(s, 0)
+		if !ok {
+			return reflect.Value{}, errors.New("invalid integer " + string(raw))
+		}
+		// intN holds -2^(N-1) to 2^(N-1)-1, the bit length of n+1 bounds
+		// negative values
+		bits := n.BitLen()
+		if t.T == abi.IntTy && n.Sign() < 0 {
+			bits = new(big.Int).Add(n, big.NewInt(1)).BitLen()
+		}
+		size := t.Size
+		if t.T == abi.IntTy {
+			size--
+		}
+		if t.T == abi.UintTy && n.Sign() < 0 || bits > size {
+			return reflect.Value{}, errors.New("integer out of range " + string(raw))
+		}
+		if t.GetType() == reflect.TypeOf(n) {
+			return reflect.ValueOf(n), nil
+		}
+		if t.T == abi.IntTy {
+			return reflect.ValueOf(n.Int64()).Convert(t.GetType()), nil
+		}
+		return reflect.ValueOf(n.Uint64()).Convert(t.GetType()), nil
+	case abi.BoolTy:
+		var b bool
+		if err := json.Unmarshal(raw, &b); err != nil {
+			return reflect.Value{}, err
+		}
+		return reflect.ValueOf(b), nil
+	case abi.StringTy:
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return reflect.Value{}, err
+		}
+		return reflect.ValueOf(s), nil
+	case abi.BytesTy, abi.FixedBytesTy, abi.FunctionTy:
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return reflect.Value{}, err
+		}
+		b, err := hexutil.Decode(s)
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		if t.T == abi.BytesTy {
+			return reflect.ValueOf(b), nil
+		}
+		if len(b) != t.GetType().Len() {
+			return reflect.Value{}, errors.New("expected " + strconv.Itoa(t.GetType().Len()) + " bytes " + string(raw))
+		}
+		v := reflect.New(t.GetType()).Elem()
+		reflect.Copy(v, reflect.ValueOf(b))
+		return v, nil
+	case abi.SliceTy, abi.ArrayTy:
+		var items []json.RawMessage
+		if err := json.Unmarshal(raw, &items); err != nil {
+			return reflect.Value{}, err
+		}
+		var v reflect.Value
+		if t.T == abi.SliceTy {
+			v = reflect.MakeSlice(t.GetType(), len(items), len(items))
+		} else {
+			if len(items) != t.Size {
+				return reflect.Value{}, errors.New("expected " + strconv.Itoa(t.Size) + " items " + string(raw))
+			}
+			v = reflect.New(t.GetType()).Elem()
+		}
+		for i, item := range items {
+			elem, err := convertArg(*t.Elem, item)
+			if err != nil {
+				return reflect.Value{}, err
+			}
+			v.Index(i).Set(elem)
+		}
+		return v, nil
+	case abi.TupleTy:
+		items := make([]json.RawMessage, len(t.TupleElems))
+		if err := json.Unmarshal(raw, &items); err != nil {
+			fields := make(map[string]json.RawMessage)
+			if err = json.Unmarshal(raw, &fields); err != nil {
+				return reflect.Value{}, err
+			}
+			for i, name := range t.TupleRawNames {
+				items[i] = fields[name]
+			}
+		}
+		if len(items) != len(t.TupleElems) {
+			return reflect.Value{}, errors.New("expected " + strconv.Itoa(len(t.TupleElems)) + " fields " + string(raw))
+		}
+		v := reflect.New(t.GetType()).Elem()
+		for i, elemType := range t.TupleElems {
+			elem, err := convertArg(*elemType, items[i])
+			if err != nil {
+				return reflect.Value{}, err
+			}
+			v.Field(i).Set(elem)
+		}
+		return v, nil
+	}
+	return reflect.Value{}, errors.New("unsupported type " + t.String())
+}
+
+// findMethod looks the method up by name or by signature, e.g. for overloaded
+// methods. The name may be empty if the ABI has a single method.
+func findMethod(contractABI abi.ABI, method string) (abi.Method, bool) {
+	if m, ok := contractABI.Methods[method]; ok {
+		return m, true
+	}
+	for _, m := range contractABI.Methods {
+		if m.Sig == strings.ReplaceAll(method, " ", "") || method == "" && len(contractABI.Methods) == 1 {
+			return m, true
+		}
+	}
+	return abi.Method{}, false
+}
+
+// CallContract sends a transaction calling method of contract. value is in wei
+// and may be empty.
+func CallContract(ids party.IDSlice, threshold int, chainName string, from string, contract string, abiJSON json.RawMessage, method string, args []json.RawMessage, value string, online bool, feeOptions FeeOptions) (ContractTransaction, error) {
+	if !common.IsHexAddress(contract) {
+		return ContractTransaction{}, errors.New("invalid contract address")
+	}
+	data, sig, err := EncodeCall(abiJSON, method, args)
+	if err != nil {
+		return ContractTransaction{}, err
+	}
+
+	contractAddress := common.HexToAddress(contract)
+	res, err := SendTransaction(ids, threshold, chainName, from, &contractAddress, data, value, nil, online, feeOptions)
+	if err != nil {
+		return ContractTransaction{}, err
+	}
+	res.Method = sig
+	return res, nil
+}
+
+// EncodeCall returns the calldata of method with JSON arguments and the
+// signature of the method.
+func EncodeCall(abiJSON json.RawMessage, method string, args []json.RawMessage) ([]byte, string, error) {
+	contractABI, err := ParseABI(abiJSON)
+	if err != nil {
+		return nil, "", err
+	}
+	m, ok := findMethod(contractABI, method)
+	if !ok {
+		return nil, "", errors.New("method not found in ABI: " + method)
+	}
+	values, err := convertArgs(m.Inputs, args)
+	if err != nil {
+		return nil, "", err
+	}
+	data, err := contractABI.Pack(m.Name, values...)
+	if err != nil {
+		return nil, "", err
+	}
+	return data, m.Sig, nil
+}
+
+// DeployContract deploys bytecode, the constructor arguments are encoded with
+// the constructor of the ABI, which may be empty if there are none.
+func DeployContract(ids party.IDSlice, threshold int, chainName string, from string, bytecode string, abiJSON json.RawMessage, args []json.RawMessage, value string, online bool, feeOptions FeeOptions) (ContractTransaction, error) {
+	data, err := hexutil.Decode(bytecode)
+	if err != nil {
+		return ContractTransaction{}, errors.New("invalid bytecode: " + err.Error())
+	}
+	if len(abiJSON) > 0 {
+		contractABI, err := ParseABI(abiJSON)
+		if err != nil {
+			return ContractTransaction{}, err
+		}
+		values, err := convertArgs(contractABI.Constructor.Inputs, args)
+		if err != nil {
+			return ContractTransaction{}, err
+		}
+		constructorArgs, err := contractABI.Pack("", values...)
+		if err != nil {
+			return ContractTransaction{}, err
+		}
+		data = append(data, constructorArgs...)
+	} else if len(args) > 0 {
+		return ContractTransaction{}, errors.New("constructor arguments need an ABI")
+	}
+
+	return SendTransaction(ids, threshold, chainName, from, nil, data, value, nil, online, feeOptions)
+}
+
+// SendTransaction sends a transaction with data from from. A nil to deploys a
+// contract. nonce may be given by callers that computed it themselves, it is
+// rejected if it differs from the nonce the nonce manager allocates.
+func SendTransaction(ids party.IDSlice, threshold int, chainName string, from string, to *common.Address, data []byte, value string, nonce *uint64, online bool, feeOptions FeeOptions) (ContractTransaction, error) {
+	chain, err := chains.Get(chainName)
+	if err != nil {
+		return ContractTransaction{}, err
+	}
+	client, err := chain.Backend(context.Background())
+	if err != nil {
+		return ContractTransaction{}, err
+	}
+
+	amount := big.NewInt(0)
+	if value != "" {
+		var ok bool
+		amount, ok = new(big.Int).SetString(value, 0)
+		if !ok || amount.Sign() < 0 {
+			return ContractTransaction{}, errors.New("invalid value: " + value)
+		}
+	}
+
+	fromAddress := common.HexToAddress(from)
+	tx, fees, err := newTransaction(client, chain, fromAddress, to, amount, data, feeOptions)
+	if err != nil {
+		return ContractTransaction{}, err
+	}
+	if nonce != nil && *nonce != tx.Nonce() {
+		err = errors.New("nonce " + strconv.FormatUint(*nonce, 10) + " does not match the next nonce " + strconv.FormatUint(tx.Nonce(), 10))
+		nonces.Release(chain.ChainID, fromAddress, tx.Nonce(), "", err)
+		return ContractTransaction{}, err
+	}
+
+	hash, err := signAndSend(ids, threshold, from, online, client, chain, tx, "")
+	if err != nil {
+		return ContractTransaction{}, err
+	}
+
+	contract := crypto.CreateAddress(fromAddress, tx.Nonce())
+	if to != nil {
+		contract = *to
+	}
+	return ContractTransaction{
+		Hash:     hash,
+		Contract: contract.Hex(),
+		Data:     hexutil.Encode(data),
+		Nonce:    tx.Nonce(),
+		Fees:     fees,
+	}, nil
+}
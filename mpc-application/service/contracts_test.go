@@ -0,0 +1,37 @@
+package service
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+)
+
+func TestConvertArgIntegerBounds(t *testing.T) {
+	for _, test := range []struct {
+		typ   string
+		value string
+		ok    bool
+	}{
+		{"int8", "-128", true},
+		{"int8", "-129", false},
+		{"int8", "127", true},
+		{"int8", "128", false},
+		{"uint8", "255", true},
+		{"uint8", "256", false},
+		{"uint8", "-1", false},
+		{"int256", "-57896044618658097711785492504343953926634992332820282019728792003956564819968", true},
+		{"int256", "-57896044618658097711785492504343953926634992332820282019728792003956564819969", false},
+		{"int256", "57896044618658097711785492504343953926634992332820282019728792003956564819967", true},
+		{"int256", "57896044618658097711785492504343953926634992332820282019728792003956564819968", false},
+	} {
+		typ, err := abi.NewType(test.typ, "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = convertArg(typ, json.RawMessage(`"`+test.value+`"`))
+		if ok := err == nil; ok != test.ok {
+			t.Errorf("%s %s accepted %v, want %v", test.typ, test.value, ok, test.ok)
+		}
+	}
+}
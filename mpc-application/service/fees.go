@@ -0,0 +1,318 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"math/big"
+
+	"mpc_poc/chains"
+	"mpc_poc/nonces"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+type FeeStrategy string
+
+const (
+	Slow     FeeStrategy = "slow"
+	Standard FeeStrategy = "standard"
+	Fast     FeeStrategy = "fast"
+	Explicit FeeStrategy = "explicit"
+)
+
+type TxType string
+
+const (
+	DynamicFeeTxType TxType = "eip1559"
+	AccessListTxType TxType = "eip2930"
+	LegacyTxType     TxType = "legacy"
+)
+
+// feeMultipliers are percentages applied to the suggested tip, the base fee
+// of the latest block and, for legacy transactions, the suggested gas price.
+// The base fee headroom lets a transaction survive a few full blocks.
+var feeMultipliers = map[FeeStrategy]struct {
+	tip      int64
+	baseFee  int64
+	gasPrice int64
+}{
+	Slow:     {tip: 80, baseFee: 125, gasPrice: 90},
+	Standard: {tip: 100, baseFee: 200, gasPrice: 100},
+	Fast:     {tip: 150, baseFee: 300, gasPrice: 125},
+}
+
+// FeeOptions are the fee parameters of a request. All amounts are in wei.
+// Without a type, EIP-1559 is used if the chain has a base fee and legacy
+// transactions otherwise. Transactions that revert in simulation are not
+// signed unless AllowRevert is set.
+type FeeOptions struct {
+	Strategy             FeeStrategy      `json:"strategy"`
+	Type                 TxType           `json:"type"`
+	MaxFeePerGas         string           `json:"maxFeePerGas"`
+	MaxPriorityFeePerGas string           `json:"maxPriorityFeePerGas"`
+	GasPrice             string           `json:"gasPrice"`
+	GasLimit             uint64           `json:"gasLimit"`
+	MaxFeeCap            string           `json:"maxFeeCap"`
+	AccessList           types.AccessList `json:"accessList"`
+	AllowRevert          bool             `json:"allowRevert"`
+}
+
+// Fees reports the fee parameters of a built transaction.
+type Fees struct {
+	Type                 TxType      `json:"type"`
+	Strategy             FeeStrategy `json:"strategy"`
+	GasLimit             uint64      `json:"gasLimit"`
+	BaseFee              string      `json:"baseFee,omitempty"`
+	MaxFeePerGas         string      `json:"maxFeePerGas,omitempty"`
+	MaxPriorityFeePerGas string      `json:"maxPriorityFeePerGas,omitempty"`
+	GasPrice             string      `json:"gasPrice,omitempty"`
+	MaxCost              string      `json:"maxCost"`
+}
+
+func parseWei(name string, value string) (*big.Int, error) {
+	if value == "" {
+		return nil, nil
+	}
+	n, ok := new(big.Int).SetString(value, 0)
+	if !ok || n.Sign() < 0 {
+		return nil, errors.New("invalid " + name + ": " + value)
+	}
+	return n, nil
+}
+
+func percent(n *big.Int, p int64) *big.Int {
+	res := new(big.Int).Mul(n, big.NewInt(p))
+	return res.Div(res, big.NewInt(100))
+}
+
+// feeLimit is the lower of the cap of the request and the cap of the chain.
+func feeLimit(chain *chains.Chain, options FeeOptions) (*big.Int, error) {
+	requestCap, err := parseWei("maxFeeCap", options.MaxFeeCap)
+	if err != nil {
+		return nil, err
+	}
+	chainCap, err := parseWei("maxFeePerGas of "+chain.Name, chain.MaxFeePerGas)
+	if err != nil {
+		return nil, err
+	}
+	if requestCap == nil || chainCap != nil && chainCap.Cmp(requestCap) < 0 {
+		return chainCap, nil
+	}
+	return requestCap, nil
+}
+
+// newTransaction builds a transaction from from. The gas limit is estimated
+// unless given in options. A nil to deploys a contract. The nonce is allocated
+// from the nonce manager, signAndSend releases it.
+func newTransaction(client chains.Backend, chain *chains.Chain, from common.Address, to *common.Address, value *big.Int, data []byte, options FeeOptions) (*types.Transaction, Fees, error) {
+	ctx := context.Background()
+
+	if options.Strategy == "" {
+		options.Strategy = Standard
+	}
+	if _, ok := feeMultipliers[options.Strategy]; !ok && options.Strategy != Explicit {
+		return nil, Fees{}, errors.New("unknown fee strategy: " + string(options.Strategy))
+	}
+	header, err := client.HeaderByNumber(ctx, nil)
+	if err != nil {
+		return nil, Fees{}, err
+	}
+	if options.Type == "" {
+		options.Type = DynamicFeeTxType
+		if header.BaseFee == nil {
+			options.Type = LegacyTxType
+		}
+	}
+	if options.Type == DynamicFeeTxType && header.BaseFee == nil {
+		return nil, Fees{}, errors.New(chain.Name + " does not support EIP-1559 transactions")
+	}
+	if len(options.AccessList) > 0 && options.Type != AccessListTxType {
+		return nil, Fees{}, errors.New("access lists need an eip2930 transaction")
+	}
+	maxFeeCap, err := feeLimit(chain, options)
+	if err != nil {
+		return nil, Fees{}, err
+	}
+
+	msg := ethereum.CallMsg{
+		From:       from,
+		To:         to,
+		Gas:        options.GasLimit,
+		Value:      value,
+		Data:       data,
+		AccessList: options.AccessList,
+	}
+	gasLimit := options.GasLimit
+	if gasLimit == 0 {
+		gasLimit, err = client.EstimateGas(ctx, msg)
+		if err != nil {
+			if reason, ok := revertReason(err); ok {
+				return nil, Fees{}, errors.New("transaction reverts in simulation: " + reason + ", set allowRevert and a gasLimit to sign it anyway")
+			}
+			return nil, Fees{}, err
+		}
+	} else if !options.AllowRevert {
+		if err = checkRevert(client, msg); err != nil {
+			return nil, Fees{}, err
+		}
+	}
+
+	fees := Fees{
+		Type:     options.Type,
+		Strategy: options.Strategy,
+		GasLimit: gasLimit,
+	}
+	var txData types.TxData
+	var maxPrice *big.Int
+
+	switch options.Type {
+	case DynamicFeeTxType:
+		tipCap, feeCap, err := dynamicFees(client, header.BaseFee, options, maxFeeCap)
+		if err != nil {
+			return nil, Fees{}, err
+		}
+		fees.BaseFee = header.BaseFee.String()
+		fees.MaxFeePerGas = feeCap.String()
+		fees.MaxPriorityFeePerGas = tipCap.String()
+		maxPrice = feeCap
+		txData = &types.DynamicFeeTx{
+			ChainID:   chain.ID(),
+			GasTipCap: tipCap,
+			GasFeeCap: feeCap,
+			To:        to,
+			Value:     value,
+			Gas:       gasLimit,
+			Data:      data,
+		}
+	case AccessListTxType, LegacyTxType:
+		gasPrice, err := legacyGasPrice(client, header.BaseFee, options, maxFeeCap)
+		if err != nil {
+			return nil, Fees{}, err
+		}
+		if header.BaseFee != nil {
+			if gasPrice.Cmp(header.BaseFee) < 0 {
+				return nil, Fees{}, errors.New("gasPrice " + gasPrice.String() + " is below the current base fee " + header.BaseFee.String())
+			}
+			fees.BaseFee = header.BaseFee.String()
+		}
+		fees.GasPrice = gasPrice.String()
+		maxPrice = gasPrice
+		if options.Type == AccessListTxType {
+			txData = &types.AccessListTx{
+				ChainID:    chain.ID(),
+				GasPrice:   gasPrice,
+				Gas:        gasLimit,
+				To:         to,
+				Value:      value,
+				Data:       data,
+				AccessList: options.AccessList,
+			}
+		} else {
+			txData = &types.LegacyTx{
+				GasPrice: gasPrice,
+				Gas:      gasLimit,
+				To:       to,
+				Value:    value,
+				Data:     data,
+			}
+		}
+	default:
+		return nil, Fees{}, errors.New("unknown transaction type: " + string(options.Type))
+	}
+
+	maxCost := new(big.Int).Mul(maxPrice, new(big.Int).SetUint64(gasLimit))
+	fees.MaxCost = maxCost.Add(maxCost, value).String()
+
+	// the nonce is taken last, nothing may fail after it was allocated
+	nonce, err := nonces.Allocate(ctx, client, chain.ChainID, from)
+	if err != nil {
+		return nil, Fees{}, err
+	}
+	switch tx := txData.(type) {
+	case *types.DynamicFeeTx:
+		tx.Nonce = nonce
+	case *types.AccessListTx:
+		tx.Nonce = nonce
+	case *types.LegacyTx:
+		tx.Nonce = nonce
+	}
+
+	return types.NewTx(txData), fees, nil
+}
+
+// dynamicFees returns the tip and fee cap. A fee cap above maxFeeCap is
+// lowered to it, as long as the transaction can still be included at the
+// current base fee.
+func dynamicFees(client chains.Backend, baseFee *big.Int, options FeeOptions, maxFeeCap *big.Int) (*big.Int, *big.Int, error) {
+	var tipCap, feeCap *big.Int
+	if options.Strategy == Explicit {
+		var err error
+		if tipCap, err = parseWei("maxPriorityFeePerGas", options.MaxPriorityFeePerGas); err != nil {
+			return nil, nil, err
+		}
+		if feeCap, err = parseWei("maxFeePerGas", options.MaxFeePerGas); err != nil {
+			return nil, nil, err
+		}
+		if tipCap == nil || feeCap == nil {
+			return nil, nil, errors.New("explicit fees need maxFeePerGas and maxPriorityFeePerGas")
+		}
+	} else {
+		suggested, err := client.SuggestGasTipCap(context.Background())
+		if err != nil {
+			return nil, nil, err
+		}
+		multipliers := feeMultipliers[options.Strategy]
+		tipCap = percent(suggested, multipliers.tip)
+		feeCap = new(big.Int).Add(percent(baseFee, multipliers.baseFee), tipCap)
+	}
+
+	if feeCap.Cmp(tipCap) < 0 {
+		return nil, nil, errors.New("maxFeePerGas is lower than maxPriorityFeePerGas")
+	}
+	if maxFeeCap != nil && feeCap.Cmp(maxFeeCap) > 0 {
+		if options.Strategy == Explicit {
+			return nil, nil, errors.New("maxFeePerGas " + feeCap.String() + " exceeds the cap of " + maxFeeCap.String())
+		}
+		feeCap = new(big.Int).Set(maxFeeCap)
+		if tipCap.Cmp(feeCap) > 0 {
+			tipCap = new(big.Int).Set(feeCap)
+		}
+	}
+	if feeCap.Cmp(baseFee) < 0 {
+		return nil, nil, errors.New("maxFeePerGas " + feeCap.String() + " is below the current base fee " + baseFee.String())
+	}
+	return tipCap, feeCap, nil
+}
+
+// legacyGasPrice returns the gas price of legacy and access list transactions.
+// On chains with a base fee the suggested price is raised to leave some
+// headroom above the base fee.
+func legacyGasPrice(client chains.Backend, baseFee *big.Int, options FeeOptions, maxFeeCap *big.Int) (*big.Int, error) {
+	var gasPrice *big.Int
+	if options.Strategy == Explicit {
+		var err error
+		if gasPrice, err = parseWei("gasPrice", options.GasPrice); err != nil {
+			return nil, err
+		}
+		if gasPrice == nil {
+			return nil, errors.New("explicit fees need gasPrice")
+		}
+	} else {
+		suggested, err := client.SuggestGasPrice(context.Background())
+		if err != nil {
+			return nil, err
+		}
+		gasPrice = percent(suggested, feeMultipliers[options.Strategy].gasPrice)
+		if baseFee != nil {
+			if floor := percent(baseFee, feeMultipliers[Slow].baseFee); gasPrice.Cmp(floor) < 0 {
+				gasPrice = floor
+			}
+		}
+	}
+	if maxFeeCap != nil && gasPrice.Cmp(maxFeeCap) > 0 {
+		return nil, errors.New("gasPrice " + gasPrice.String() + " exceeds the cap of " + maxFeeCap.String())
+	}
+	return gasPrice, nil
+}
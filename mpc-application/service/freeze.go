@@ -0,0 +1,125 @@
+package service
+
+import (
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"mpc_poc/audit"
+	"mpc_poc/messaging"
+	"mpc_poc/models"
+	"mpc_poc/session"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/koteld/multi-party-sig/pkg/party"
+)
+
+func publishControl(message string, id string) {
+	log.Printf("control %s: %s\n", id, message)
+	logMessages := models.GetLogMessageOutputChannel()
+	logMessage := models.LogMessage{
+		Protocol:    models.Control,
+		Participant: "initiator",
+		Message:     message,
+		SessionID:   id,
+		Timestamp:   strconv.FormatInt(time.Now().Unix(), 10),
+	}
+	logMessages <- &logMessage
+}
+
+// sendControl signs the message with the message key of the API and sends it
+// to every participant.
+func sendControl(ids party.IDSlice, message models.ControlMessage) error {
+	if err := session.SealControl(&message, messaging.APIMember); err != nil {
+		return err
+	}
+	for _, id := range ids {
+		controlMessages := models.GetControlMessageOutputChannel(id)
+		controlMessages <- &message
+	}
+	return nil
+}
+
+func admins(signatures []models.AdminSignature) string {
+	res := make([]string, 0, len(signatures))
+	for _, s := range signatures {
+		res = append(res, s.Admin)
+	}
+	return strings.Join(res, ", ")
+}
+
+// Freeze stops all protocols of address on every participant, of all keys
+// if address is empty. Participants persist the freeze and keep it until a
+// quorum of their admins signs "unfreeze <id>".
+func Freeze(ids party.IDSlice, address string, reason string, by string) (models.FreezeState, error) {
+	if address != "" {
+		if !common.IsHexAddress(address) {
+			return models.FreezeState{}, errors.New("invalid address: " + address)
+		}
+		address = common.HexToAddress(address).Hex()
+	}
+	f := models.FreezeState{
+		ID:      genShortUUID(),
+		Address: address,
+		Reason:  reason,
+		By:      by,
+		At:      time.Now().UTC(),
+	}
+	if err := sendControl(ids, models.ControlMessage{Command: models.Freeze, Freeze: f}); err != nil {
+		return models.FreezeState{}, err
+	}
+	audit.Append(audit.Entry{Event: "freeze", Address: address, SessionID: f.ID, Requester: by, Reason: reason, Result: "sent"})
+	scope := "all keys"
+	if address != "" {
+		scope = address
+	}
+	publishControl("freezing "+scope+", lift it with a quorum of signatures of \"unfreeze "+f.ID+"\"", f.ID)
+	return f, nil
+}
+
+// Unfreeze passes the admin signatures of "unfreeze <id>" to the
+// participants, which check them against their admins. GetFreezes shows
+// whether the freeze was lifted.
+func Unfreeze(ids party.IDSlice, id string, signatures []models.AdminSignature) error {
+	if id == "" {
+		return errors.New("id is required")
+	}
+	if len(signatures) == 0 {
+		return errors.New("admin signatures are required")
+	}
+	if err := sendControl(ids, models.ControlMessage{Command: models.Unfreeze, Freeze: models.FreezeState{ID: id}, Signatures: signatures}); err != nil {
+		return err
+	}
+	audit.Append(audit.Entry{Event: "unfreeze", SessionID: id, Approver: admins(signatures), Result: "sent"})
+	publishControl("lifting freeze "+id+" with "+strconv.Itoa(len(signatures))+" signatures", id)
+	return nil
+}
+
+// GetFreezes returns the freezes each participant reports in its heartbeat.
+func GetFreezes(ids party.IDSlice) map[party.ID][]models.FreezeState {
+	results := make(map[party.ID][]models.FreezeState, ids.Len())
+	var mtx sync.Mutex
+	var wg sync.WaitGroup
+	for _, id := range ids {
+		wg.Add(1)
+		go func(id party.ID) {
+			defer wg.Done()
+			result, ok := requestInfo(id, models.Online)
+			if !ok {
+				return
+			}
+			mtx.Lock()
+			results[id] = result.Frozen
+			if results[id] == nil {
+				results[id] = make([]models.FreezeState, 0)
+			}
+			mtx.Unlock()
+		}(id)
+	}
+	wg.Wait()
+
+	return results
+}
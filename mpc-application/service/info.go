@@ -0,0 +1,76 @@
+package service
+
+import (
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"mpc_poc/helper"
+	"mpc_poc/models"
+
+	"github.com/koteld/multi-party-sig/pkg/party"
+)
+
+// infoWaiters are the callers waiting for an info response, by request ID.
+var infoWaiters = make(map[string]chan *models.InfoResponseMessage)
+var infoReaders = make(map[party.ID]bool)
+var infoMtx sync.Mutex
+
+func infoTimeout() time.Duration {
+	seconds, err := strconv.Atoi(helper.GetEnv("INFO_TIMEOUT", "30"))
+	if err != nil || seconds <= 0 {
+		seconds = 30
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// readInfoResponses passes the info responses of participant id to the
+// callers waiting for them. Responses nobody waits for anymore are dropped.
+// infoMtx must be held.
+func readInfoResponses(id party.ID) {
+	if infoReaders[id] {
+		return
+	}
+	infoReaders[id] = true
+	infoResponseChannel := models.GetInfoResponseMessageInputChannel(id)
+	go func() {
+		for response := range infoResponseChannel {
+			infoMtx.Lock()
+			waiter, ok := infoWaiters[response.RequestID]
+			delete(infoWaiters, response.RequestID)
+			infoMtx.Unlock()
+			if !ok {
+				log.Printf("info: dropped response %s of participant %s\n", response.RequestID, id)
+				continue
+			}
+			waiter <- response
+		}
+	}()
+}
+
+// requestInfo asks participant id for info and waits for the response to
+// this request. A participant busy with a protocol answers once it is done,
+// so the wait is bounded by INFO_TIMEOUT seconds, 30 by default.
+func requestInfo(id party.ID, info models.Info) (*models.InfoResponseMessage, bool) {
+	requestID := genShortUUID()
+	waiter := make(chan *models.InfoResponseMessage, 1)
+	infoMtx.Lock()
+	readInfoResponses(id)
+	infoWaiters[requestID] = waiter
+	infoMtx.Unlock()
+
+	infoRequestChannel := models.GetInfoRequestMessageOutputChannel(id)
+	infoRequestChannel <- &models.InfoRequestMessage{ID: requestID, Info: info}
+
+	select {
+	case response := <-waiter:
+		return response, true
+	case <-time.After(infoTimeout()):
+		infoMtx.Lock()
+		delete(infoWaiters, requestID)
+		infoMtx.Unlock()
+		log.Printf("info: participant %s didn't answer %s within %v\n", id, info, infoTimeout())
+		return nil, false
+	}
+}
@@ -0,0 +1,90 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+
+	"mpc_poc/payload"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/signer/core/apitypes"
+	"github.com/koteld/multi-party-sig/pkg/party"
+)
+
+// MessageSignature is a signature as wallets return it, v is 27 or 28.
+type MessageSignature struct {
+	Hash      string `json:"hash"`
+	Signature string `json:"signature"`
+	R         string `json:"r"`
+	S         string `json:"s"`
+	V         uint8  `json:"v"`
+	Signer    string `json:"signer"`
+}
+
+// signMessage signs the hash of p as wallets do, with v as 27 or 28.
+func signMessage(ids party.IDSlice, threshold int, address string, p payload.Payload, online bool) (MessageSignature, error) {
+	hash, err := p.Hash()
+	if err != nil {
+		return MessageSignature{}, err
+	}
+	sig, err := signDigest(ids, threshold, address, p, online, "")
+	if err != nil {
+		return MessageSignature{}, err
+	}
+
+	sig[crypto.RecoveryIDOffset] += 27
+	return MessageSignature{
+		Hash:      hash.Hex(),
+		Signature: hexutil.Encode(sig),
+		R:         hexutil.Encode(sig[:32]),
+		S:         hexutil.Encode(sig[32:64]),
+		V:         sig[crypto.RecoveryIDOffset],
+		Signer:    common.HexToAddress(address).Hex(),
+	}, nil
+}
+
+// SignPersonal signs message with the EIP-191 prefix, as personal_sign does.
+func SignPersonal(ids party.IDSlice, threshold int, address string, message []byte, online bool) (MessageSignature, error) {
+	return signMessage(ids, threshold, address, payload.NewMessage(message), online)
+}
+
+// SignTypedData signs EIP-712 typed data, as eth_signTypedData_v4 does.
+func SignTypedData(ids party.IDSlice, threshold int, address string, typedData apitypes.TypedData, online bool) (MessageSignature, error) {
+	p, err := payload.NewTypedData(typedData)
+	if err != nil {
+		return MessageSignature{}, err
+	}
+	return signMessage(ids, threshold, address, p, online)
+}
+
+// ParseTypedData accepts typed data as a JSON object or as a JSON string
+// containing one, as wallets pass it. A numeric chainId in the domain is
+// accepted as well.
+func ParseTypedData(raw json.RawMessage) (apitypes.TypedData, error) {
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		raw = json.RawMessage(s)
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return apitypes.TypedData{}, errors.New("invalid typed data: " + err.Error())
+	}
+	var domain map[string]json.RawMessage
+	if err := json.Unmarshal(fields["domain"], &domain); err == nil {
+		if chainID, ok := domain["chainId"]; ok && len(chainID) > 0 && chainID[0] != '"' && chainID[0] != 'n' {
+			domain["chainId"] = json.RawMessage(strconv.Quote(string(chainID)))
+			fields["domain"], _ = json.Marshal(domain)
+			raw, _ = json.Marshal(fields)
+		}
+	}
+
+	var typedData apitypes.TypedData
+	if err := json.Unmarshal(raw, &typedData); err != nil {
+		return apitypes.TypedData{}, errors.New("invalid typed data: " + err.Error())
+	}
+	return typedData, nil
+}
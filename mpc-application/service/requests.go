@@ -0,0 +1,569 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"math/big"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"mpc_poc/audit"
+	"mpc_poc/helper"
+	"mpc_poc/models"
+	"mpc_poc/nonces"
+	"mpc_poc/payload"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/joho/godotenv"
+	"github.com/koteld/multi-party-sig/pkg/party"
+)
+
+type RequestState string
+
+const (
+	RequestDraft     RequestState = "draft"
+	RequestPending   RequestState = "pending"
+	RequestApproved  RequestState = "approved"
+	RequestExecuting RequestState = "executing"
+	RequestDone      RequestState = "done"
+	RequestRejected  RequestState = "rejected"
+	RequestExpired   RequestState = "expired"
+	RequestFailed    RequestState = "failed"
+)
+
+type RequestKind string
+
+const (
+	TransferRequest RequestKind = "transfer"
+	SignRequest     RequestKind = "sign"
+)
+
+// Approvers are the named business approvers and how many of them have to
+// approve a request.
+type Approvers struct {
+	Threshold int               `json:"threshold"`
+	Approvers map[string]string `json:"approvers"`
+}
+
+// Decision is the signed approval or rejection of an approver.
+type Decision struct {
+	Approver  string    `json:"approver"`
+	Signature string    `json:"signature"`
+	Reason    string    `json:"reason,omitempty"`
+	At        time.Time `json:"at"`
+}
+
+// Operation is what a request executes once approved: a native transfer
+// as SendEth or a signature of Payload as SignDigest. The transaction of a
+// transfer is built, with its nonce and fees, as the request executes.
+type Operation struct {
+	Kind      RequestKind      `json:"kind"`
+	Address   string           `json:"address"`
+	Threshold int              `json:"threshold"`
+	Online    bool             `json:"online"`
+	Chain     string           `json:"chain,omitempty"`
+	To        string           `json:"to,omitempty"`
+	Amount    string           `json:"amount,omitempty"`
+	Fee       FeeOptions       `json:"fee"`
+	Payload   *payload.Payload `json:"payload,omitempty"`
+	Format    SignatureFormat  `json:"format,omitempty"`
+}
+
+// ApprovalRequest is an operation waiting for, or executed after, the
+// approval of a quorum of approvers. Hash identifies the operation and its
+// expiry, approvers sign "approve <hash>" or "reject <hash>" as
+// personal_sign does.
+type ApprovalRequest struct {
+	ID          string          `json:"id"`
+	State       RequestState    `json:"state"`
+	Description string          `json:"description,omitempty"`
+	Requester   string          `json:"requester,omitempty"`
+	Operation   Operation       `json:"operation"`
+	Preview     string          `json:"preview"`
+	Hash        string          `json:"hash,omitempty"`
+	Threshold   int             `json:"approvalThreshold"`
+	Approvals   []Decision      `json:"approvals"`
+	Rejections  []Decision      `json:"rejections"`
+	Result      json.RawMessage `json:"result,omitempty"`
+	Error       string          `json:"error,omitempty"`
+	CreatedAt   time.Time       `json:"createdAt"`
+	UpdatedAt   time.Time       `json:"updatedAt"`
+	ExpiresAt   *time.Time      `json:"expiresAt,omitempty"`
+}
+
+var approvalRequests = make(map[string]*ApprovalRequest)
+var requestsMtx sync.Mutex
+var requestsLoadOnce sync.Once
+
+func approvalRequestsPath() string {
+	return helper.GetEnv("APPROVAL_REQUESTS_FILE", "approval_requests.json")
+}
+
+// GetApprovers returns the approvers in APPROVERS_FILE, approvers.json by
+// default. Without the file no approval is needed.
+func GetApprovers() (*Approvers, error) {
+	_ = godotenv.Load()
+	data, err := os.ReadFile(helper.GetEnv("APPROVERS_FILE", "approvers.json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var approvers Approvers
+	if err = json.Unmarshal(data, &approvers); err != nil {
+		return nil, errors.New("invalid approvers: " + err.Error())
+	}
+	for name, address := range approvers.Approvers {
+		if !common.IsHexAddress(address) {
+			return nil, errors.New("invalid address of approver " + name + ": " + address)
+		}
+	}
+	if approvers.Threshold < 1 || approvers.Threshold > len(approvers.Approvers) {
+		return nil, errors.New("approval threshold must be between 1 and the number of approvers")
+	}
+	return &approvers, nil
+}
+
+// approvalGrant allows one signature of the payload with hash Hash with the
+// key of Address.
+type approvalGrant struct {
+	Address common.Address
+	Hash    common.Hash
+}
+
+// approvalGrants are the payloads of the approved requests being executed,
+// by request ID. For a transfer it is the transaction the request built, with
+// its nonce and fees.
+var approvalGrants = make(map[string]approvalGrant)
+
+// grant allows the approval request id to sign p with the key of address.
+func grant(id string, address string, p payload.Payload) error {
+	hash, err := p.Hash()
+	if err != nil {
+		return err
+	}
+	requestsMtx.Lock()
+	defer requestsMtx.Unlock()
+	approvalGrants[id] = approvalGrant{Address: common.HexToAddress(address), Hash: hash}
+	return nil
+}
+
+// authorize returns an error if approvers are configured and p signed with
+// the key of address isn't what the approval request requestID was granted.
+// The grant is used up.
+func authorize(p payload.Payload, address string, requestID string) error {
+	approvers, err := GetApprovers()
+	if err != nil {
+		return err
+	}
+	if approvers == nil {
+		return nil
+	}
+	errApproval := errors.New("an approved request is required, create one with POST /requests")
+	if requestID == "" || !common.IsHexAddress(address) {
+		return errApproval
+	}
+	hash, err := p.Hash()
+	if err != nil {
+		return err
+	}
+	requestsMtx.Lock()
+	defer requestsMtx.Unlock()
+	g, ok := approvalGrants[requestID]
+	if !ok || g.Address != common.HexToAddress(address) || g.Hash != hash {
+		return errApproval
+	}
+	delete(approvalGrants, requestID)
+	return nil
+}
+
+// loadApprovalRequests reads the requests persisted in
+// APPROVAL_REQUESTS_FILE, approval_requests.json by default.
+func loadApprovalRequests() {
+	requestsLoadOnce.Do(func() {
+		_ = godotenv.Load()
+		data, err := os.ReadFile(approvalRequestsPath())
+		if err != nil {
+			return
+		}
+		var saved []*ApprovalRequest
+		if err = json.Unmarshal(data, &saved); err != nil {
+			log.Printf("requests: failed to parse %s: %v\n", approvalRequestsPath(), err)
+			return
+		}
+		for _, r := range saved {
+			// the result of an interrupted execution is unknown
+			if r.State == RequestExecuting {
+				r.State = RequestFailed
+				r.Error = "interrupted by a restart, check the chain before creating a new request"
+			}
+			approvalRequests[r.ID] = r
+		}
+	})
+}
+
+// saveApprovalRequests persists all requests. requestsMtx must be held.
+func saveApprovalRequests() {
+	saved := make([]*ApprovalRequest, 0, len(approvalRequests))
+	for _, r := range approvalRequests {
+		saved = append(saved, r)
+	}
+	sort.Slice(saved, func(i, j int) bool {
+		return saved[i].CreatedAt.Before(saved[j].CreatedAt)
+	})
+	data, _ := json.MarshalIndent(saved, "", "  ")
+	tmp := approvalRequestsPath() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		log.Printf("requests: failed to save %s: %v\n", approvalRequestsPath(), err)
+		return
+	}
+	if err := os.Rename(tmp, approvalRequestsPath()); err != nil {
+		log.Printf("requests: failed to save %s: %v\n", approvalRequestsPath(), err)
+	}
+}
+
+func (r *ApprovalRequest) copy() ApprovalRequest {
+	c := *r
+	c.Approvals = append([]Decision(nil), r.Approvals...)
+	c.Rejections = append([]Decision(nil), r.Rejections...)
+	return c
+}
+
+// expire moves a pending or approved request past its expiry to expired.
+// requestsMtx must be held.
+func (r *ApprovalRequest) expire(now time.Time) bool {
+	if (r.State == RequestPending || r.State == RequestApproved) && r.ExpiresAt != nil && now.After(*r.ExpiresAt) {
+		r.setState(RequestExpired, "")
+		return true
+	}
+	return false
+}
+
+// setState changes the state and publishes it on the log stream.
+// requestsMtx must be held.
+func (r *ApprovalRequest) setState(state RequestState, detail string) {
+	r.State = state
+	r.UpdatedAt = time.Now().UTC()
+	message := "request " + string(state) + ": " + r.Preview
+	if detail != "" {
+		message += ", " + detail
+	}
+	log.Printf("request %s: %s\n", r.ID, message)
+	logMessages := models.GetLogMessageOutputChannel()
+	logMessage := models.LogMessage{
+		Protocol:    models.Approval,
+		Participant: "approvals",
+		Message:     message,
+		SessionID:   r.ID,
+		Timestamp:   strconv.FormatInt(time.Now().Unix(), 10),
+	}
+	logMessages <- &logMessage
+
+	entry := audit.Entry{
+		Event:     "request",
+		Protocol:  string(r.Operation.Kind),
+		Address:   r.Operation.Address,
+		SessionID: r.ID,
+		Digest:    r.Hash,
+		Summary:   r.Preview,
+		Requester: r.Requester,
+		Approver:  names(r.Approvals),
+		Result:    string(state),
+		Reason:    detail,
+	}
+	entry.Payload, _ = json.Marshal(r.Operation)
+	audit.Append(entry)
+}
+
+func (o Operation) preview() string {
+	if o.Kind == TransferRequest {
+		return "transfer of " + o.Amount + " wei on " + o.Chain + " from " + o.Address + " to " + o.To
+	}
+	return "signature of " + o.Payload.Summary() + " with " + o.Address
+}
+
+func (o Operation) validate() error {
+	if !common.IsHexAddress(o.Address) {
+		return errors.New("invalid address: " + o.Address)
+	}
+	switch o.Kind {
+	case TransferRequest:
+		if !common.IsHexAddress(o.To) {
+			return errors.New("invalid to: " + o.To)
+		}
+		if value, ok := new(big.Int).SetString(o.Amount, 10); !ok || value.Sign() < 0 {
+			return errors.New("invalid amount: " + o.Amount)
+		}
+		if o.Chain == "" {
+			return errors.New("chain is required")
+		}
+	case SignRequest:
+		if o.Payload == nil {
+			return errors.New("payload is required")
+		}
+		if _, err := o.Payload.Hash(); err != nil {
+			return err
+		}
+	default:
+		return errors.New("unknown request kind: " + string(o.Kind))
+	}
+	return nil
+}
+
+// decisionHash is what approvers sign to approve or reject the request.
+func decisionHash(action string, hash string) common.Hash {
+	h, _ := payload.NewMessage([]byte(action + " " + hash)).Hash()
+	return h
+}
+
+func getApprovalRequest(id string) (*ApprovalRequest, error) {
+	loadApprovalRequests()
+	r, ok := approvalRequests[id]
+	if !ok {
+		return nil, errors.New("unknown request: " + id)
+	}
+	if r.expire(time.Now()) {
+		saveApprovalRequests()
+	}
+	return r, nil
+}
+
+// CreateApprovalRequest stores an operation as a draft.
+func CreateApprovalRequest(operation Operation, description string, requester string) (ApprovalRequest, error) {
+	if err := operation.validate(); err != nil {
+		return ApprovalRequest{}, err
+	}
+	operation.Address = common.HexToAddress(operation.Address).Hex()
+	if operation.To != "" {
+		operation.To = common.HexToAddress(operation.To).Hex()
+	}
+	now := time.Now().UTC()
+	r := &ApprovalRequest{
+		ID:          genShortUUID(),
+		Description: description,
+		Requester:   requester,
+		Operation:   operation,
+		Preview:     operation.preview(),
+		Approvals:   make([]Decision, 0),
+		Rejections:  make([]Decision, 0),
+		CreatedAt:   now,
+	}
+
+	loadApprovalRequests()
+	requestsMtx.Lock()
+	defer requestsMtx.Unlock()
+	approvalRequests[r.ID] = r
+	r.setState(RequestDraft, "")
+	saveApprovalRequests()
+	return r.copy(), nil
+}
+
+// SubmitApprovalRequest asks the approvers to approve a draft within
+// REQUEST_TTL seconds, a day by default.
+func SubmitApprovalRequest(id string) (ApprovalRequest, error) {
+	approvers, err := GetApprovers()
+	if err != nil {
+		return ApprovalRequest{}, err
+	}
+	if approvers == nil {
+		return ApprovalRequest{}, errors.New("no approvers configured")
+	}
+	ttl, err := strconv.Atoi(helper.GetEnv("REQUEST_TTL", "86400"))
+	if err != nil || ttl <= 0 {
+		ttl = 86400
+	}
+
+	requestsMtx.Lock()
+	defer requestsMtx.Unlock()
+	r, err := getApprovalRequest(id)
+	if err != nil {
+		return ApprovalRequest{}, err
+	}
+	if r.State != RequestDraft {
+		return ApprovalRequest{}, errors.New("request is " + string(r.State) + ", only drafts can be submitted")
+	}
+	expiresAt := time.Now().UTC().Add(time.Duration(ttl) * time.Second)
+	data, _ := json.Marshal(struct {
+		ID        string    `json:"id"`
+		Operation Operation `json:"operation"`
+		ExpiresAt time.Time `json:"expiresAt"`
+	}{r.ID, r.Operation, expiresAt})
+	r.Hash = crypto.Keccak256Hash(data).Hex()
+	r.ExpiresAt = &expiresAt
+	r.Threshold = approvers.Threshold
+	r.setState(RequestPending, "needs "+strconv.Itoa(approvers.Threshold)+" of "+strconv.Itoa(len(approvers.Approvers))+" approvals, sign \"approve "+r.Hash+"\"")
+	saveApprovalRequests()
+	return r.copy(), nil
+}
+
+// DecideApprovalRequest adds the signed decision of an approver. A request
+// is approved once the quorum approved it and rejected once it can't be
+// reached anymore.
+func DecideApprovalRequest(id string, approve bool, approver string, signature string, reason string) (ApprovalRequest, error) {
+	approvers, err := GetApprovers()
+	if err != nil {
+		return ApprovalRequest{}, err
+	}
+	if approvers == nil {
+		return ApprovalRequest{}, errors.New("no approvers configured")
+	}
+	address, ok := approvers.Approvers[approver]
+	if !ok {
+		return ApprovalRequest{}, errors.New("unknown approver: " + approver)
+	}
+	sig, err := hexutil.Decode(signature)
+	if err != nil {
+		return ApprovalRequest{}, errors.New("invalid signature: " + err.Error())
+	}
+
+	requestsMtx.Lock()
+	defer requestsMtx.Unlock()
+	r, err := getApprovalRequest(id)
+	if err != nil {
+		return ApprovalRequest{}, err
+	}
+	if r.State != RequestPending {
+		return ApprovalRequest{}, errors.New("request is " + string(r.State) + ", not pending")
+	}
+	for _, d := range append(append([]Decision{}, r.Approvals...), r.Rejections...) {
+		if d.Approver == approver {
+			return ApprovalRequest{}, errors.New(approver + " already decided")
+		}
+	}
+	action, decided := "reject", "rejected"
+	if approve {
+		action, decided = "approve", "approved"
+	}
+	verification, err := Verify(decisionHash(action, r.Hash), sig, address, "")
+	if err != nil {
+		return ApprovalRequest{}, err
+	}
+	if !verification.Valid {
+		return ApprovalRequest{}, errors.New("signature is not " + approver + "'s signature of \"" + action + " " + r.Hash + "\"")
+	}
+
+	d := Decision{Approver: approver, Signature: hexutil.Encode(sig), Reason: reason, At: time.Now().UTC()}
+	if approve {
+		r.Approvals = append(r.Approvals, d)
+	} else {
+		r.Rejections = append(r.Rejections, d)
+	}
+	switch {
+	case len(r.Approvals) >= r.Threshold:
+		r.setState(RequestApproved, "approved by "+names(r.Approvals))
+	case len(approvers.Approvers)-len(r.Rejections) < r.Threshold:
+		r.setState(RequestRejected, "rejected by "+names(r.Rejections))
+	default:
+		r.setState(RequestPending, decided+" by "+approver+", "+strconv.Itoa(len(r.Approvals))+" of "+strconv.Itoa(r.Threshold)+" approvals")
+	}
+	saveApprovalRequests()
+	return r.copy(), nil
+}
+
+func names(decisions []Decision) string {
+	res := make([]string, 0, len(decisions))
+	for _, d := range decisions {
+		res = append(res, d.Approver)
+	}
+	return strings.Join(res, ", ")
+}
+
+// ExecuteApprovalRequest runs an approved request once.
+func ExecuteApprovalRequest(ids party.IDSlice, id string) (ApprovalRequest, error) {
+	requestsMtx.Lock()
+	r, err := getApprovalRequest(id)
+	if err != nil {
+		requestsMtx.Unlock()
+		return ApprovalRequest{}, err
+	}
+	if r.State != RequestApproved {
+		requestsMtx.Unlock()
+		return ApprovalRequest{}, errors.New("request is " + string(r.State) + ", not approved")
+	}
+	r.setState(RequestExecuting, "")
+	saveApprovalRequests()
+	operation := r.Operation
+	requestsMtx.Unlock()
+
+	var result interface{}
+	if operation.Kind == TransferRequest {
+		result, err = executeTransfer(ids, r.ID, operation)
+	} else if err = grant(r.ID, operation.Address, *operation.Payload); err == nil {
+		result, err = signFormatted(ids, operation.Threshold, operation.Address, *operation.Payload, operation.Online, operation.Format, r.ID)
+	}
+
+	requestsMtx.Lock()
+	defer requestsMtx.Unlock()
+	delete(approvalGrants, r.ID)
+	if err != nil {
+		r.Error = err.Error()
+		r.setState(RequestFailed, err.Error())
+	} else {
+		r.Result, _ = json.Marshal(result)
+		r.setState(RequestDone, "")
+	}
+	saveApprovalRequests()
+	return r.copy(), err
+}
+
+// executeTransfer builds the transaction of the transfer, grants it to the
+// request id and sends it.
+func executeTransfer(ids party.IDSlice, id string, operation Operation) (EthTransfer, error) {
+	client, chain, tx, fees, err := newTransfer(operation.Chain, operation.Address, operation.To, operation.Amount, operation.Fee)
+	if err != nil {
+		return EthTransfer{}, err
+	}
+	p, err := payload.NewTransaction(chain.ID(), tx)
+	if err == nil {
+		err = grant(id, operation.Address, p)
+	}
+	if err != nil {
+		nonces.Release(chain.ChainID, common.HexToAddress(operation.Address), tx.Nonce(), "", err)
+		return EthTransfer{}, err
+	}
+	hash, err := signAndSend(ids, operation.Threshold, operation.Address, operation.Online, client, chain, tx, id)
+	if err != nil {
+		return EthTransfer{}, err
+	}
+	return EthTransfer{Hash: hash, Fees: fees}, nil
+}
+
+// GetApprovalRequests returns the requests in state, all if empty, oldest
+// first.
+func GetApprovalRequests(state RequestState) []ApprovalRequest {
+	loadApprovalRequests()
+	requestsMtx.Lock()
+	defer requestsMtx.Unlock()
+	now := time.Now()
+	expired := false
+	res := make([]ApprovalRequest, 0)
+	for _, r := range approvalRequests {
+		expired = r.expire(now) || expired
+		if state == "" || r.State == state {
+			res = append(res, r.copy())
+		}
+	}
+	if expired {
+		saveApprovalRequests()
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].CreatedAt.Before(res[j].CreatedAt) })
+	return res
+}
+
+func GetApprovalRequest(id string) (ApprovalRequest, error) {
+	requestsMtx.Lock()
+	defer requestsMtx.Unlock()
+	r, err := getApprovalRequest(id)
+	if err != nil {
+		return ApprovalRequest{}, err
+	}
+	return r.copy(), nil
+}
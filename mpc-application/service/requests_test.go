@@ -0,0 +1,60 @@
+package service
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"mpc_poc/payload"
+)
+
+// With approvers only the payload granted to the request being executed is
+// signed, and only once.
+func TestAuthorizeRequiresApprovedOperation(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "approvers.json")
+	approvers := `{"threshold": 1, "approvers": {"alice": "0x00000000000000000000000000000000000000a1"}}`
+	if err := os.WriteFile(file, []byte(approvers), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("APPROVERS_FILE", file)
+	address := "0x00000000000000000000000000000000000000b2"
+	approved := payload.NewMessage([]byte("approved"))
+
+	if err := authorize(approved, address, ""); err == nil {
+		t.Fatal("signed without an approved request")
+	}
+
+	if err := grant("r1", address, approved); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		requestsMtx.Lock()
+		delete(approvalGrants, "r1")
+		requestsMtx.Unlock()
+	}()
+	if err := authorize(approved, address, ""); err == nil {
+		t.Error("signed outside of a request with the grant of a request")
+	}
+	if err := authorize(approved, address, "r2"); err == nil {
+		t.Error("signed for another request with the grant of a request")
+	}
+	if err := authorize(payload.NewMessage([]byte("other")), address, "r1"); err == nil {
+		t.Error("signed another message with the grant of a request")
+	}
+	if err := authorize(approved, "0x00000000000000000000000000000000000000c3", "r1"); err == nil {
+		t.Error("signed with another key with the grant of a request")
+	}
+	if err := authorize(approved, address, "r1"); err != nil {
+		t.Errorf("approved operation refused: %v", err)
+	}
+	if err := authorize(approved, address, "r1"); err == nil {
+		t.Error("grant of a request used twice")
+	}
+}
+
+func TestAuthorizeWithoutApprovers(t *testing.T) {
+	t.Setenv("APPROVERS_FILE", filepath.Join(t.TempDir(), "missing.json"))
+	if err := authorize(payload.NewMessage([]byte("message")), "0x00000000000000000000000000000000000000b2", ""); err != nil {
+		t.Errorf("approval required without approvers: %v", err)
+	}
+}
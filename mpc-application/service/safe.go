@@ -0,0 +1,551 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"math/big"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"mpc_poc/chains"
+	"mpc_poc/helper"
+	"mpc_poc/payload"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/common/math"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/signer/core/apitypes"
+	"github.com/joho/godotenv"
+	"github.com/koteld/multi-party-sig/pkg/party"
+)
+
+const safeABIJSON = `[
+	{"type":"function","name":"nonce","stateMutability":"view","inputs":[],"outputs":[{"name":"","type":"uint256"}]},
+	{"type":"function","name":"getThreshold","stateMutability":"view","inputs":[],"outputs":[{"name":"","type":"uint256"}]},
+	{"type":"function","name":"getOwners","stateMutability":"view","inputs":[],"outputs":[{"name":"","type":"address[]"}]},
+	{"type":"function","name":"execTransaction","stateMutability":"payable","inputs":[
+		{"name":"to","type":"address"},{"name":"value","type":"uint256"},{"name":"data","type":"bytes"},
+		{"name":"operation","type":"uint8"},{"name":"safeTxGas","type":"uint256"},{"name":"baseGas","type":"uint256"},
+		{"name":"gasPrice","type":"uint256"},{"name":"gasToken","type":"address"},{"name":"refundReceiver","type":"address"},
+		{"name":"signatures","type":"bytes"}],"outputs":[{"name":"success","type":"bool"}]}
+]`
+
+var safeABI, _ = abi.JSON(strings.NewReader(safeABIJSON))
+
+var safeTxTypes = apitypes.Types{
+	"EIP712Domain": {
+		{Name: "chainId", Type: "uint256"},
+		{Name: "verifyingContract", Type: "address"},
+	},
+	"SafeTx": {
+		{Name: "to", Type: "address"},
+		{Name: "value", Type: "uint256"},
+		{Name: "data", Type: "bytes"},
+		{Name: "operation", Type: "uint8"},
+		{Name: "safeTxGas", Type: "uint256"},
+		{Name: "baseGas", Type: "uint256"},
+		{Name: "gasPrice", Type: "uint256"},
+		{Name: "gasToken", Type: "address"},
+		{Name: "refundReceiver", Type: "address"},
+		{Name: "nonce", Type: "uint256"},
+	},
+}
+
+// SafeSignature is the signature of one owner in Safe's encoding: r, s and
+// v 27 or 28 for a signature of the safeTxHash, v 31 or 32 for eth_sign.
+type SafeSignature struct {
+	Owner     string        `json:"owner"`
+	Signature hexutil.Bytes `json:"signature"`
+	MPC       bool          `json:"mpc"`
+}
+
+// SafeTransaction is a transaction of a Safe that collects the signatures of
+// its owners until it can be executed. Amounts are decimal strings in wei.
+type SafeTransaction struct {
+	SafeTxHash     string          `json:"safeTxHash"`
+	Chain          string          `json:"chain"`
+	ChainID        uint64          `json:"chainId"`
+	Safe           string          `json:"safe"`
+	To             string          `json:"to"`
+	Value          string          `json:"value"`
+	Data           hexutil.Bytes   `json:"data"`
+	Operation      uint8           `json:"operation"`
+	SafeTxGas      string          `json:"safeTxGas"`
+	BaseGas        string          `json:"baseGas"`
+	GasPrice       string          `json:"gasPrice"`
+	GasToken       string          `json:"gasToken"`
+	RefundReceiver string          `json:"refundReceiver"`
+	Nonce          uint64          `json:"nonce"`
+	Threshold      uint64          `json:"threshold"`
+	Owners         []string        `json:"owners"`
+	Signatures     []SafeSignature `json:"signatures"`
+	ExecutionHash  string          `json:"executionHash,omitempty"`
+	CreatedAt      time.Time       `json:"createdAt"`
+}
+
+// SafeTransactionOptions are the optional parameters of a Safe transaction.
+// Nonce defaults to the current nonce of the Safe, the gas refund parameters
+// to zero, i.e. no refund.
+type SafeTransactionOptions struct {
+	Operation      uint8   `json:"operation"`
+	Nonce          *uint64 `json:"nonce"`
+	SafeTxGas      string  `json:"safeTxGas"`
+	BaseGas        string  `json:"baseGas"`
+	GasPrice       string  `json:"gasPrice"`
+	GasToken       string  `json:"gasToken"`
+	RefundReceiver string  `json:"refundReceiver"`
+}
+
+var safeTransactions = make(map[string]*SafeTransaction)
+var safeMtx sync.Mutex
+var safeLoadOnce sync.Once
+
+func safeTransactionsPath() string {
+	return helper.GetEnv("SAFE_TRANSACTIONS_FILE", "safe_transactions.json")
+}
+
+// loadSafeTransactions reads the transactions persisted in
+// SAFE_TRANSACTIONS_FILE, safe_transactions.json by default.
+func loadSafeTransactions() {
+	safeLoadOnce.Do(func() {
+		_ = godotenv.Load()
+		data, err := os.ReadFile(safeTransactionsPath())
+		if err != nil {
+			return
+		}
+		var saved []*SafeTransaction
+		if err = json.Unmarshal(data, &saved); err != nil {
+			log.Printf("safe: failed to parse %s: %v\n", safeTransactionsPath(), err)
+			return
+		}
+		for _, t := range saved {
+			safeTransactions[t.SafeTxHash] = t
+		}
+	})
+}
+
+// saveSafeTransactions persists all transactions. safeMtx must be held.
+func saveSafeTransactions() {
+	saved := make([]*SafeTransaction, 0, len(safeTransactions))
+	for _, t := range safeTransactions {
+		saved = append(saved, t)
+	}
+	sort.Slice(saved, func(i, j int) bool {
+		return saved[i].CreatedAt.Before(saved[j].CreatedAt)
+	})
+	data, _ := json.MarshalIndent(saved, "", "  ")
+	tmp := safeTransactionsPath() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		log.Printf("safe: failed to save %s: %v\n", safeTransactionsPath(), err)
+		return
+	}
+	if err := os.Rename(tmp, safeTransactionsPath()); err != nil {
+		log.Printf("safe: failed to save %s: %v\n", safeTransactionsPath(), err)
+	}
+}
+
+func (t *SafeTransaction) copy() SafeTransaction {
+	c := *t
+	c.Owners = append([]string(nil), t.Owners...)
+	c.Signatures = append([]SafeSignature(nil), t.Signatures...)
+	return c
+}
+
+// TypedData returns the SafeTx EIP-712 message, as Safe 1.3.0 and later
+// hash it.
+func (t *SafeTransaction) TypedData() apitypes.TypedData {
+	return apitypes.TypedData{
+		Types:       safeTxTypes,
+		PrimaryType: "SafeTx",
+		Domain: apitypes.TypedDataDomain{
+			ChainId:           math.NewHexOrDecimal256(int64(t.ChainID)),
+			VerifyingContract: t.Safe,
+		},
+		Message: apitypes.TypedDataMessage{
+			"to":             t.To,
+			"value":          t.Value,
+			"data":           hexutil.Encode(t.Data),
+			"operation":      strconv.Itoa(int(t.Operation)),
+			"safeTxGas":      t.SafeTxGas,
+			"baseGas":        t.BaseGas,
+			"gasPrice":       t.GasPrice,
+			"gasToken":       t.GasToken,
+			"refundReceiver": t.RefundReceiver,
+			"nonce":          strconv.FormatUint(t.Nonce, 10),
+		},
+	}
+}
+
+func (t *SafeTransaction) hash() (common.Hash, error) {
+	hash, _, err := apitypes.TypedDataAndHash(t.TypedData())
+	if err != nil {
+		return common.Hash{}, err
+	}
+	return common.BytesToHash(hash), nil
+}
+
+func (t *SafeTransaction) isOwner(address common.Address) bool {
+	for _, owner := range t.Owners {
+		if common.HexToAddress(owner) == address {
+			return true
+		}
+	}
+	return false
+}
+
+// addSignature adds or replaces the signature of an owner.
+func (t *SafeTransaction) addSignature(signature SafeSignature) {
+	for i, s := range t.Signatures {
+		if strings.EqualFold(s.Owner, signature.Owner) {
+			t.Signatures[i] = signature
+			return
+		}
+	}
+	t.Signatures = append(t.Signatures, signature)
+}
+
+// encodedSignatures concatenates the signatures sorted by owner, as
+// checkSignatures expects them.
+func (t *SafeTransaction) encodedSignatures() []byte {
+	signatures := append([]SafeSignature(nil), t.Signatures...)
+	sort.Slice(signatures, func(i, j int) bool {
+		return bytes.Compare(common.HexToAddress(signatures[i].Owner).Bytes(), common.HexToAddress(signatures[j].Owner).Bytes()) < 0
+	})
+	res := make([]byte, 0, len(signatures)*crypto.SignatureLength)
+	for _, s := range signatures {
+		res = append(res, s.Signature...)
+	}
+	return res
+}
+
+// callSafe calls a view method of the Safe and returns its only output.
+func callSafe(client chains.Backend, safe common.Address, method string) (interface{}, error) {
+	data, err := safeABI.Pack(method)
+	if err != nil {
+		return nil, err
+	}
+	out, err := client.CallContract(context.Background(), ethereum.CallMsg{To: &safe, Data: data}, nil)
+	if err != nil {
+		return nil, errors.New("safe " + method + ": " + err.Error())
+	}
+	values, err := safeABI.Unpack(method, out)
+	if err != nil || len(values) != 1 {
+		return nil, errors.New("safe " + method + ": unexpected result, is " + safe.Hex() + " a Safe?")
+	}
+	return values[0], nil
+}
+
+// safeState reads the nonce, threshold and owners of the Safe.
+func safeState(client chains.Backend, safe common.Address) (uint64, uint64, []string, error) {
+	nonce, err := callSafe(client, safe, "nonce")
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	threshold, err := callSafe(client, safe, "getThreshold")
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	owners, err := callSafe(client, safe, "getOwners")
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	res := make([]string, 0)
+	for _, owner := range owners.([]common.Address) {
+		res = append(res, owner.Hex())
+	}
+	return nonce.(*big.Int).Uint64(), threshold.(*big.Int).Uint64(), res, nil
+}
+
+func decimalOrZero(value string, name string) (string, error) {
+	if value == "" {
+		return "0", nil
+	}
+	n, ok := new(big.Int).SetString(value, 0)
+	if !ok || n.Sign() < 0 {
+		return "", errors.New("invalid " + name + ": " + value)
+	}
+	return n.String(), nil
+}
+
+func addressOrZero(address string, name string) (string, error) {
+	if address == "" {
+		return common.Address{}.Hex(), nil
+	}
+	if !common.IsHexAddress(address) {
+		return "", errors.New("invalid " + name + ": " + address)
+	}
+	return common.HexToAddress(address).Hex(), nil
+}
+
+// ProposeSafeTransaction builds a transaction of safe and computes its
+// safeTxHash. Signatures are added with SignSafeTransaction and
+// AddSafeSignature.
+func ProposeSafeTransaction(chainName string, safe string, to string, value string, data []byte, options SafeTransactionOptions) (SafeTransaction, error) {
+	loadSafeTransactions()
+	if !common.IsHexAddress(safe) {
+		return SafeTransaction{}, errors.New("invalid safe: " + safe)
+	}
+	if !common.IsHexAddress(to) {
+		return SafeTransaction{}, errors.New("invalid to: " + to)
+	}
+	if options.Operation > 1 {
+		return SafeTransaction{}, errors.New("operation must be 0 (call) or 1 (delegatecall)")
+	}
+	chain, err := chains.Get(chainName)
+	if err != nil {
+		return SafeTransaction{}, err
+	}
+	client, err := chain.Backend(context.Background())
+	if err != nil {
+		return SafeTransaction{}, err
+	}
+	nonce, threshold, owners, err := safeState(client, common.HexToAddress(safe))
+	if err != nil {
+		return SafeTransaction{}, err
+	}
+	if options.Nonce != nil {
+		if *options.Nonce < nonce {
+			return SafeTransaction{}, errors.New("nonce " + strconv.FormatUint(*options.Nonce, 10) + " was already used, the safe is at " + strconv.FormatUint(nonce, 10))
+		}
+		nonce = *options.Nonce
+	}
+
+	t := &SafeTransaction{
+		Chain:      chain.Name,
+		ChainID:    chain.ChainID,
+		Safe:       common.HexToAddress(safe).Hex(),
+		To:         common.HexToAddress(to).Hex(),
+		Data:       data,
+		Operation:  options.Operation,
+		Nonce:      nonce,
+		Threshold:  threshold,
+		Owners:     owners,
+		Signatures: make([]SafeSignature, 0),
+		CreatedAt:  time.Now(),
+	}
+	if t.Value, err = decimalOrZero(value, "value"); err != nil {
+		return SafeTransaction{}, err
+	}
+	if t.SafeTxGas, err = decimalOrZero(options.SafeTxGas, "safeTxGas"); err != nil {
+		return SafeTransaction{}, err
+	}
+	if t.BaseGas, err = decimalOrZero(options.BaseGas, "baseGas"); err != nil {
+		return SafeTransaction{}, err
+	}
+	if t.GasPrice, err = decimalOrZero(options.GasPrice, "gasPrice"); err != nil {
+		return SafeTransaction{}, err
+	}
+	if t.GasToken, err = addressOrZero(options.GasToken, "gasToken"); err != nil {
+		return SafeTransaction{}, err
+	}
+	if t.RefundReceiver, err = addressOrZero(options.RefundReceiver, "refundReceiver"); err != nil {
+		return SafeTransaction{}, err
+	}
+	hash, err := t.hash()
+	if err != nil {
+		return SafeTransaction{}, err
+	}
+	t.SafeTxHash = hash.Hex()
+
+	safeMtx.Lock()
+	defer safeMtx.Unlock()
+	if existing, ok := safeTransactions[t.SafeTxHash]; ok {
+		return existing.copy(), nil
+	}
+	safeTransactions[t.SafeTxHash] = t
+	saveSafeTransactions()
+	return t.copy(), nil
+}
+
+func GetSafeTransactions(safe string) []SafeTransaction {
+	loadSafeTransactions()
+	safeMtx.Lock()
+	defer safeMtx.Unlock()
+	res := make([]SafeTransaction, 0)
+	for _, t := range safeTransactions {
+		if safe == "" || strings.EqualFold(t.Safe, safe) {
+			res = append(res, t.copy())
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].CreatedAt.After(res[j].CreatedAt)
+	})
+	return res
+}
+
+func GetSafeTransaction(safeTxHash string) (SafeTransaction, error) {
+	loadSafeTransactions()
+	safeMtx.Lock()
+	defer safeMtx.Unlock()
+	t, ok := safeTransactions[common.HexToHash(safeTxHash).Hex()]
+	if !ok {
+		return SafeTransaction{}, errors.New("unknown safe transaction: " + safeTxHash)
+	}
+	return t.copy(), nil
+}
+
+// SignSafeTransaction signs the safeTxHash with the MPC key of address, which
+// has to be an owner of the Safe.
+func SignSafeTransaction(ids party.IDSlice, threshold int, safeTxHash string, address string, online bool) (SafeTransaction, error) {
+	t, err := GetSafeTransaction(safeTxHash)
+	if err != nil {
+		return SafeTransaction{}, err
+	}
+	if !common.IsHexAddress(address) || !t.isOwner(common.HexToAddress(address)) {
+		return SafeTransaction{}, errors.New(address + " is not an owner of " + t.Safe)
+	}
+	if t.ExecutionHash != "" {
+		return SafeTransaction{}, errors.New("safe transaction was already executed in " + t.ExecutionHash)
+	}
+
+	p, err := payload.NewTypedData(t.TypedData())
+	if err != nil {
+		return SafeTransaction{}, err
+	}
+	sig, err := signDigest(ids, threshold, address, p, online, "")
+	if err != nil {
+		return SafeTransaction{}, err
+	}
+	sig[crypto.RecoveryIDOffset] += 27
+	return addSafeSignature(t.SafeTxHash, SafeSignature{
+		Owner:     common.HexToAddress(address).Hex(),
+		Signature: sig,
+		MPC:       true,
+	})
+}
+
+// AddSafeSignature adds the signature of another owner. It may sign the
+// safeTxHash with v 27 or 28, or with eth_sign, v 31 or 32.
+func AddSafeSignature(safeTxHash string, signature string) (SafeTransaction, error) {
+	t, err := GetSafeTransaction(safeTxHash)
+	if err != nil {
+		return SafeTransaction{}, err
+	}
+	sig, err := hexutil.Decode(signature)
+	if err != nil || len(sig) != crypto.SignatureLength {
+		return SafeTransaction{}, errors.New("signature must be 65 bytes of 0x hex")
+	}
+
+	digest := common.HexToHash(t.SafeTxHash).Bytes()
+	recoverable := append([]byte(nil), sig...)
+	switch v := sig[crypto.RecoveryIDOffset]; v {
+	case 0, 1:
+		sig[crypto.RecoveryIDOffset] += 27
+	case 27, 28:
+		recoverable[crypto.RecoveryIDOffset] -= 27
+	case 31, 32:
+		recoverable[crypto.RecoveryIDOffset] -= 31
+		digest = accounts.TextHash(digest)
+	default:
+		return SafeTransaction{}, errors.New("unsupported signature type v=" + strconv.Itoa(int(v)))
+	}
+	publicKey, err := crypto.SigToPub(digest, recoverable)
+	if err != nil {
+		return SafeTransaction{}, errors.New("invalid signature: " + err.Error())
+	}
+	owner := crypto.PubkeyToAddress(*publicKey)
+	if !t.isOwner(owner) {
+		return SafeTransaction{}, errors.New("signature recovers to " + owner.Hex() + ", which is not an owner of " + t.Safe)
+	}
+	return addSafeSignature(t.SafeTxHash, SafeSignature{Owner: owner.Hex(), Signature: sig})
+}
+
+func addSafeSignature(safeTxHash string, signature SafeSignature) (SafeTransaction, error) {
+	safeMtx.Lock()
+	defer safeMtx.Unlock()
+	t, ok := safeTransactions[safeTxHash]
+	if !ok {
+		return SafeTransaction{}, errors.New("unknown safe transaction: " + safeTxHash)
+	}
+	t.addSignature(signature)
+	saveSafeTransactions()
+	return t.copy(), nil
+}
+
+// ExecuteSafeTransaction sends execTransaction from the MPC address from once
+// the transaction has as many signatures as the Safe's threshold. The nonce,
+// owners and threshold are read again, they may have changed since the
+// transaction was proposed.
+func ExecuteSafeTransaction(ids party.IDSlice, threshold int, safeTxHash string, from string, online bool, feeOptions FeeOptions) (SafeTransaction, error) {
+	t, err := GetSafeTransaction(safeTxHash)
+	if err != nil {
+		return SafeTransaction{}, err
+	}
+	if t.ExecutionHash != "" {
+		return SafeTransaction{}, errors.New("safe transaction was already executed in " + t.ExecutionHash)
+	}
+	chain, err := chains.Get(t.Chain)
+	if err != nil {
+		return SafeTransaction{}, err
+	}
+	client, err := chain.Backend(context.Background())
+	if err != nil {
+		return SafeTransaction{}, err
+	}
+	safe := common.HexToAddress(t.Safe)
+	data, safeThreshold, err := execTransaction(client, &t)
+	if err != nil {
+		return SafeTransaction{}, err
+	}
+	sent, err := SendTransaction(ids, threshold, t.Chain, from, &safe, data, "", nil, online, feeOptions)
+	if err != nil {
+		return SafeTransaction{}, err
+	}
+
+	safeMtx.Lock()
+	defer safeMtx.Unlock()
+	stored := safeTransactions[t.SafeTxHash]
+	stored.Owners = t.Owners
+	stored.Threshold = safeThreshold
+	stored.ExecutionHash = sent.Hash
+	saveSafeTransactions()
+	return stored.copy(), nil
+}
+
+// execTransaction checks t against the current nonce, owners and threshold
+// of the Safe, drops signatures of former owners and returns the calldata of
+// execTransaction and the threshold.
+func execTransaction(client chains.Backend, t *SafeTransaction) ([]byte, uint64, error) {
+	safe := common.HexToAddress(t.Safe)
+	nonce, safeThreshold, owners, err := safeState(client, safe)
+	if err != nil {
+		return nil, 0, err
+	}
+	if nonce != t.Nonce {
+		return nil, 0, errors.New("safe is at nonce " + strconv.FormatUint(nonce, 10) + ", the transaction has nonce " + strconv.FormatUint(t.Nonce, 10))
+	}
+	t.Owners = owners
+	signatures := make([]SafeSignature, 0, len(t.Signatures))
+	for _, s := range t.Signatures {
+		if t.isOwner(common.HexToAddress(s.Owner)) {
+			signatures = append(signatures, s)
+		}
+	}
+	t.Signatures = signatures
+	if uint64(len(t.Signatures)) < safeThreshold {
+		return nil, 0, errors.New("safe transaction has " + strconv.Itoa(len(t.Signatures)) + " of " + strconv.FormatUint(safeThreshold, 10) + " signatures")
+	}
+
+	value, _ := new(big.Int).SetString(t.Value, 10)
+	safeTxGas, _ := new(big.Int).SetString(t.SafeTxGas, 10)
+	baseGas, _ := new(big.Int).SetString(t.BaseGas, 10)
+	gasPrice, _ := new(big.Int).SetString(t.GasPrice, 10)
+	data, err := safeABI.Pack("execTransaction",
+		common.HexToAddress(t.To), value, []byte(t.Data), t.Operation, safeTxGas, baseGas, gasPrice,
+		common.HexToAddress(t.GasToken), common.HexToAddress(t.RefundReceiver), t.encodedSignatures())
+	if err != nil {
+		return nil, 0, err
+	}
+	return data, safeThreshold, nil
+}
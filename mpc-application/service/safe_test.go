@@ -0,0 +1,251 @@
+package service
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"mpc_poc/chains"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind/backends"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// The methods of the Safe singleton and the proxy factory the test calls,
+// besides those in safeABIJSON. testdata holds the creation bytecode of
+// GnosisSafe 1.3.0 and of the SafeProxyFactory, as published in the
+// op-bindings of the optimism monorepo.
+const safeTestABIJSON = `[
+	{"type":"function","name":"setup","inputs":[
+		{"name":"owners","type":"address[]"},{"name":"threshold","type":"uint256"},{"name":"to","type":"address"},
+		{"name":"data","type":"bytes"},{"name":"fallbackHandler","type":"address"},{"name":"paymentToken","type":"address"},
+		{"name":"payment","type":"uint256"},{"name":"paymentReceiver","type":"address"}],"outputs":[]},
+	{"type":"function","name":"getTransactionHash","stateMutability":"view","inputs":[
+		{"name":"to","type":"address"},{"name":"value","type":"uint256"},{"name":"data","type":"bytes"},
+		{"name":"operation","type":"uint8"},{"name":"safeTxGas","type":"uint256"},{"name":"baseGas","type":"uint256"},
+		{"name":"gasPrice","type":"uint256"},{"name":"gasToken","type":"address"},{"name":"refundReceiver","type":"address"},
+		{"name":"nonce","type":"uint256"}],"outputs":[{"name":"","type":"bytes32"}]},
+	{"type":"function","name":"createProxyWithNonce","inputs":[
+		{"name":"singleton","type":"address"},{"name":"initializer","type":"bytes"},{"name":"saltNonce","type":"uint256"}],
+		"outputs":[{"name":"proxy","type":"address"}]}
+]`
+
+var safeTestABI, _ = abi.JSON(strings.NewReader(safeTestABIJSON))
+
+// simulatedSafe is a 2 of 3 Safe on a simulated chain 1337 that holds 1 ether.
+type simulatedSafe struct {
+	sim      *backends.SimulatedBackend
+	deployer *ecdsa.PrivateKey
+	owners   []*ecdsa.PrivateKey
+	address  common.Address
+}
+
+func newKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func (s *simulatedSafe) transactor(t *testing.T) *bind.TransactOpts {
+	t.Helper()
+	opts, err := bind.NewKeyedTransactorWithChainID(s.deployer, big.NewInt(1337))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return opts
+}
+
+// mine commits the block with tx and fails the test if tx reverted.
+func (s *simulatedSafe) mine(t *testing.T, tx *types.Transaction) *types.Receipt {
+	t.Helper()
+	s.sim.Commit()
+	receipt, err := s.sim.TransactionReceipt(context.Background(), tx.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if receipt.Status != types.ReceiptStatusSuccessful {
+		t.Fatalf("transaction %s reverted", tx.Hash().Hex())
+	}
+	return receipt
+}
+
+func (s *simulatedSafe) deploy(t *testing.T, file string) common.Address {
+	t.Helper()
+	code, err := os.ReadFile(filepath.Join("testdata", file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	address, tx, _, err := bind.DeployContract(s.transactor(t), abi.ABI{}, common.FromHex(strings.TrimSpace(string(code))), s.sim)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.mine(t, tx)
+	return address
+}
+
+func (s *simulatedSafe) call(t *testing.T, to common.Address, method string, args ...interface{}) []interface{} {
+	t.Helper()
+	data, err := safeTestABI.Pack(method, args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := s.sim.CallContract(context.Background(), ethereum.CallMsg{From: crypto.PubkeyToAddress(s.deployer.PublicKey), To: &to, Data: data}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values, err := safeTestABI.Unpack(method, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return values
+}
+
+func (s *simulatedSafe) send(t *testing.T, to common.Address, value *big.Int, data []byte) *types.Receipt {
+	t.Helper()
+	opts := s.transactor(t)
+	opts.Value = value
+	tx, err := bind.NewBoundContract(to, abi.ABI{}, s.sim, s.sim, s.sim).RawTransact(opts, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s.mine(t, tx)
+}
+
+func deploySafe(t *testing.T) *simulatedSafe {
+	t.Helper()
+	s := &simulatedSafe{deployer: newKey(t)}
+	s.sim = backends.NewSimulatedBackend(core.GenesisAlloc{
+		crypto.PubkeyToAddress(s.deployer.PublicKey): {Balance: new(big.Int).Mul(big.NewInt(100), big.NewInt(1e18))},
+	}, 30000000)
+	t.Cleanup(func() { s.sim.Close() })
+
+	singleton := s.deploy(t, "safe_v130.bin")
+	factory := s.deploy(t, "safe_proxy_factory.bin")
+	owners := make([]common.Address, 0, 3)
+	for i := 0; i < 3; i++ {
+		key := newKey(t)
+		s.owners = append(s.owners, key)
+		owners = append(owners, crypto.PubkeyToAddress(key.PublicKey))
+	}
+	setup, err := safeTestABI.Pack("setup", owners, big.NewInt(2), common.Address{}, []byte{}, common.Address{}, common.Address{}, big.NewInt(0), common.Address{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.address = s.call(t, factory, "createProxyWithNonce", singleton, setup, big.NewInt(0))[0].(common.Address)
+	data, _ := safeTestABI.Pack("createProxyWithNonce", singleton, setup, big.NewInt(0))
+	s.send(t, factory, nil, data)
+	s.send(t, s.address, big.NewInt(1e18), nil)
+	return s
+}
+
+// useSimulatedChain registers the simulated backend as chain "simulated" and
+// keeps the Safe transactions of the test in a temporary file.
+func useSimulatedChain(t *testing.T, sim *backends.SimulatedBackend) {
+	t.Helper()
+	dir := t.TempDir()
+	config := filepath.Join(dir, "chains.json")
+	err := os.WriteFile(config, []byte(`{"chains":[{"name":"simulated","chainId":1337,"rpcUrls":["http://127.0.0.1:8545"]}]}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CHAINS_CONFIG", config)
+	t.Setenv("SAFE_TRANSACTIONS_FILE", filepath.Join(dir, "safe_transactions.json"))
+	chain, err := chains.Get("simulated")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain.SetBackend(sim)
+}
+
+func TestSafeTransactionOnSimulatedBackend(t *testing.T) {
+	s := deploySafe(t)
+	useSimulatedChain(t, s.sim)
+	recipient := common.HexToAddress("0x00000000000000000000000000000000000000d4")
+
+	proposed, err := ProposeSafeTransaction("simulated", s.address.Hex(), recipient.Hex(), "1000", nil, SafeTransactionOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if proposed.Nonce != 0 || proposed.Threshold != 2 || len(proposed.Owners) != 3 {
+		t.Fatalf("proposed with nonce %d, threshold %d and %d owners, want 0, 2 and 3", proposed.Nonce, proposed.Threshold, len(proposed.Owners))
+	}
+	onChain := s.call(t, s.address, "getTransactionHash", recipient, big.NewInt(1000), []byte{}, uint8(0),
+		big.NewInt(0), big.NewInt(0), big.NewInt(0), common.Address{}, common.Address{}, big.NewInt(0))[0].([32]byte)
+	if proposed.SafeTxHash != common.Hash(onChain).Hex() {
+		t.Fatalf("safeTxHash %s, the Safe computes %s", proposed.SafeTxHash, common.Hash(onChain).Hex())
+	}
+
+	safeTxHash := common.HexToHash(proposed.SafeTxHash).Bytes()
+	stranger, err := crypto.Sign(safeTxHash, newKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = AddSafeSignature(proposed.SafeTxHash, hexutil.Encode(stranger)); err == nil {
+		t.Error("signature of a non-owner added")
+	}
+	signature, err := crypto.Sign(safeTxHash, s.owners[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = AddSafeSignature(proposed.SafeTxHash, hexutil.Encode(signature)); err != nil {
+		t.Fatal(err)
+	}
+
+	pending, _ := GetSafeTransaction(proposed.SafeTxHash)
+	if _, _, err = execTransaction(s.sim, &pending); err == nil || !strings.Contains(err.Error(), "1 of 2") {
+		t.Fatalf("executed with one signature: %v", err)
+	}
+
+	// The second owner signs with eth_sign.
+	ethSign, err := crypto.Sign(accounts.TextHash(safeTxHash), s.owners[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	ethSign[crypto.RecoveryIDOffset] += 31
+	if _, err = AddSafeSignature(proposed.SafeTxHash, hexutil.Encode(ethSign)); err != nil {
+		t.Fatal(err)
+	}
+
+	signed, _ := GetSafeTransaction(proposed.SafeTxHash)
+	data, threshold, err := execTransaction(s.sim, &signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if threshold != 2 {
+		t.Errorf("threshold %d, want 2", threshold)
+	}
+	s.send(t, s.address, nil, data)
+
+	balance, err := s.sim.BalanceAt(context.Background(), recipient, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance.Cmp(big.NewInt(1000)) != 0 {
+		t.Errorf("recipient has %s wei, want 1000", balance)
+	}
+	nonce, _, _, err := safeState(s.sim, s.address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nonce != 1 {
+		t.Errorf("safe nonce %d after execution, want 1", nonce)
+	}
+	if _, _, err = execTransaction(s.sim, &signed); err == nil {
+		t.Error("executed transaction accepted again")
+	}
+}
@@ -3,17 +3,23 @@ package service
 import (
 	"context"
 	b64 "encoding/base64"
+	"errors"
+	"log"
 	"math/big"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"mpc_poc/chains"
 	"mpc_poc/models"
+	"mpc_poc/nonces"
+	"mpc_poc/payload"
+	"mpc_poc/session"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/crypto"
-	"github.com/ethereum/go-ethereum/ethclient"
 
 	"github.com/koteld/multi-party-sig/pkg/party"
 	"github.com/lithammer/shortuuid"
@@ -31,6 +37,7 @@ func GenerateKeys(ids party.IDSlice, threshold int) models.ConfigMessage {
 		threshold = 1
 	}
 	results := make(map[party.ID][]byte, ids.Len())
+	var resultsMtx sync.Mutex
 	sessionID := genShortUUID()
 
 	logMessages := models.GetLogMessageOutputChannel()
@@ -56,15 +63,26 @@ func GenerateKeys(ids party.IDSlice, threshold int) models.ConfigMessage {
 				SessionID: []byte(sessionID),
 			}
 			protocolMessages <- &protocolMessage
-			sessionMessagesChannel := models.GetSessionMessageInputChannel(sessionID, id)
-			result := <-sessionMessagesChannel
-			results[id], _ = b64.StdEncoding.DecodeString(result.Result.(string))
+			result := awaitResult(sessionID, id)
+			if result.Refused != nil {
+				refused(models.DKG, sessionID, *result.Refused)
+				return
+			}
+			resultsMtx.Lock()
+			results[id] = decodeResult(result)
+			resultsMtx.Unlock()
 		}(id)
 	}
 	wg.Wait()
 
+	// a refusing participant leaves no key
+	if len(results[ids[0]]) == 0 {
+		recordSession(models.DKG, "", sessionID, nil, errors.New("no key was generated"))
+		return models.ConfigMessage{IDs: ids, SessionID: sessionID}
+	}
 	publicKeyBytes = results[ids[0]]
 	address = common.BytesToAddress(crypto.Keccak256(publicKeyBytes[1:])[12:])
+	recordSession(models.DKG, address.String(), sessionID, nil, nil)
 
 	logMessage = models.LogMessage{
 		Protocol:    models.DKG,
@@ -82,10 +100,14 @@ func GenerateKeys(ids party.IDSlice, threshold int) models.ConfigMessage {
 	}
 }
 
-func RefreshKeys(ids party.IDSlice, threshold int, address string) models.ConfigMessage {
+// RefreshKeys refreshes the key shares of address. If a participant refuses
+// the error is a *RefusedError, as for Sign.
+func RefreshKeys(ids party.IDSlice, threshold int, address string) (models.ConfigMessage, error) {
 	if threshold == 0 {
 		threshold = 1
 	}
+	refusals := make([]models.Refusal, 0)
+	var refusalsMtx sync.Mutex
 	sessionID := genShortUUID()
 
 	logMessages := models.GetLogMessageOutputChannel()
@@ -112,8 +134,12 @@ func RefreshKeys(ids party.IDSlice, threshold int, address string) models.Config
 				Address:   address,
 			}
 			protocolMessages <- &protocolMessage
-			sessionMessagesChannel := models.GetSessionMessageInputChannel(sessionID, id)
-			_ = <-sessionMessagesChannel
+			if result := awaitResult(sessionID, id); result.Refused != nil {
+				refused(models.DKF, sessionID, *result.Refused)
+				refusalsMtx.Lock()
+				refusals = append(refusals, *result.Refused)
+				refusalsMtx.Unlock()
+			}
 		}(id)
 	}
 	wg.Wait()
@@ -127,18 +153,59 @@ func RefreshKeys(ids party.IDSlice, threshold int, address string) models.Config
 	}
 	logMessages <- &logMessage
 
+	var err error
+	if len(refusals) > 0 {
+		err = &RefusedError{Refusals: refusals}
+	}
+	recordSession(models.DKF, address, sessionID, nil, err)
+	if err != nil {
+		return models.ConfigMessage{}, err
+	}
+
 	return models.ConfigMessage{
 		Address:   address,
 		IDs:       ids,
 		SessionID: sessionID,
+	}, nil
+}
+
+// RefusedError lists the participants that refused to sign and the rules the
+// request violates.
+type RefusedError struct {
+	Refusals []models.Refusal `json:"refusals"`
+}
+
+func (e *RefusedError) Error() string {
+	reasons := make([]string, 0, len(e.Refusals))
+	for _, refusal := range e.Refusals {
+		reasons = append(reasons, "participant "+string(refusal.Participant)+" refused to sign ("+refusal.Rule+"): "+refusal.Reason)
 	}
+	return strings.Join(reasons, "; ")
+}
+
+// Sign signs the hash of p with the MPC key of address. Participants
+// recompute the hash from p and check it against their policy. If one of
+// them refuses the error is a *RefusedError. With approvers only the
+// operation of an approved request is signed.
+func Sign(ids party.IDSlice, threshold int, p payload.Payload, address string) ([]byte, error) {
+	return sign(ids, threshold, p, address, "")
 }
 
-func Sign(ids party.IDSlice, threshold int, messageHash common.Hash, address string) []byte {
+// sign is Sign for the approval request requestID, empty if there is none.
+func sign(ids party.IDSlice, threshold int, p payload.Payload, address string, requestID string) ([]byte, error) {
 	if threshold == 0 {
 		threshold = 1
 	}
+	if err := authorize(p, address, requestID); err != nil {
+		return nil, err
+	}
+	messageHash, err := p.Hash()
+	if err != nil {
+		return nil, err
+	}
 	results := make(map[party.ID][]byte, ids.Len())
+	refusals := make([]models.Refusal, 0)
+	var resultsMtx sync.Mutex
 	sessionID := genShortUUID()
 
 	logMessages := models.GetLogMessageOutputChannel()
@@ -164,11 +231,20 @@ func Sign(ids party.IDSlice, threshold int, messageHash common.Hash, address str
 				MessageHash: messageHash.Bytes(),
 				SessionID:   []byte(sessionID),
 				Address:     address,
+				Payload:     &p,
 			}
 			protocolMessages <- &protocolMessage
-			sessionMessagesChannel := models.GetSessionMessageInputChannel(sessionID, id)
-			result := <-sessionMessagesChannel
-			results[id], _ = b64.StdEncoding.DecodeString(result.Result.(string))
+			result := awaitResult(sessionID, id)
+			if result.Refused != nil {
+				refused(models.Sign, sessionID, *result.Refused)
+				resultsMtx.Lock()
+				refusals = append(refusals, *result.Refused)
+				resultsMtx.Unlock()
+				return
+			}
+			resultsMtx.Lock()
+			results[id] = decodeResult(result)
+			resultsMtx.Unlock()
 		}(id)
 	}
 	wg.Wait()
@@ -182,7 +258,19 @@ func Sign(ids party.IDSlice, threshold int, messageHash common.Hash, address str
 	}
 	logMessages <- &logMessage
 
-	return results[ids[0]]
+	if len(refusals) > 0 {
+		err = &RefusedError{Refusals: refusals}
+	}
+	for _, id := range ids {
+		if err == nil && results[id] == nil {
+			err = errors.New("signing failed, see the log of the participants")
+		}
+	}
+	recordSession(models.Sign, address, sessionID, &p, err)
+	if err != nil {
+		return nil, err
+	}
+	return results[ids[0]], nil
 }
 
 func PreSign(ids party.IDSlice, address string) {
@@ -211,8 +299,7 @@ func PreSign(ids party.IDSlice, address string) {
 				Address:   address,
 			}
 			protocolMessages <- &protocolMessage
-			sessionMessagesChannel := models.GetSessionMessageInputChannel(sessionID, id)
-			_ = <-sessionMessagesChannel
+			_ = awaitResult(sessionID, id)
 		}(id)
 	}
 	wg.Wait()
@@ -227,8 +314,24 @@ func PreSign(ids party.IDSlice, address string) {
 	logMessages <- &logMessage
 }
 
-func SignOnline(ids party.IDSlice, messageHash common.Hash, address string) []byte {
+// SignOnline signs the hash of p with the pre-signature of address, see
+// Sign.
+func SignOnline(ids party.IDSlice, p payload.Payload, address string) ([]byte, error) {
+	return signOnline(ids, p, address, "")
+}
+
+// signOnline is SignOnline for the approval request requestID, see sign.
+func signOnline(ids party.IDSlice, p payload.Payload, address string, requestID string) ([]byte, error) {
+	if err := authorize(p, address, requestID); err != nil {
+		return nil, err
+	}
+	messageHash, err := p.Hash()
+	if err != nil {
+		return nil, err
+	}
 	results := make(map[party.ID][]byte, ids.Len())
+	refusals := make([]models.Refusal, 0)
+	var resultsMtx sync.Mutex
 	sessionID := genShortUUID()
 
 	logMessages := models.GetLogMessageOutputChannel()
@@ -253,11 +356,20 @@ func SignOnline(ids party.IDSlice, messageHash common.Hash, address string) []by
 				MessageHash: messageHash.Bytes(),
 				SessionID:   []byte(sessionID),
 				Address:     address,
+				Payload:     &p,
 			}
 			protocolMessages <- &protocolMessage
-			sessionMessagesChannel := models.GetSessionMessageInputChannel(sessionID, id)
-			result := <-sessionMessagesChannel
-			results[id], _ = b64.StdEncoding.DecodeString(result.Result.(string))
+			result := awaitResult(sessionID, id)
+			if result.Refused != nil {
+				refused(models.SignOnline, sessionID, *result.Refused)
+				resultsMtx.Lock()
+				refusals = append(refusals, *result.Refused)
+				resultsMtx.Unlock()
+				return
+			}
+			resultsMtx.Lock()
+			results[id] = decodeResult(result)
+			resultsMtx.Unlock()
 		}(id)
 	}
 	wg.Wait()
@@ -271,89 +383,190 @@ func SignOnline(ids party.IDSlice, messageHash common.Hash, address string) []by
 	}
 	logMessages <- &logMessage
 
-	return results[ids[0]]
+	if len(refusals) > 0 {
+		err = &RefusedError{Refusals: refusals}
+	}
+	for _, id := range ids {
+		if err == nil && results[id] == nil {
+			err = errors.New("signing failed, see the log of the participants")
+		}
+	}
+	recordSession(models.SignOnline, address, sessionID, &p, err)
+	if err != nil {
+		return nil, err
+	}
+	return results[ids[0]], nil
+}
+
+// awaitResult waits for the result of participant id in the session. A
+// participant that doesn't answer within the session timeout and a minute
+// to spare is given up.
+func awaitResult(sessionID string, id party.ID) *models.SessionMessage {
+	sessionMessagesChannel := models.GetSessionMessageInputChannel(sessionID, id)
+	defer models.ReleaseSessionMessageInputChannel(sessionID, id)
+	var result *models.SessionMessage
+	select {
+	case result = <-sessionMessagesChannel:
+	case <-time.After(session.Timeout() + time.Minute):
+	}
+	if result == nil {
+		result = &models.SessionMessage{Error: "no result within the session timeout"}
+	}
+	if result.Error != "" {
+		log.Printf("session %s: participant %s failed: %s\n", sessionID, id, result.Error)
+	}
+	return result
+}
+
+// decodeResult returns the base64 encoded result, nil if the participant
+// failed.
+func decodeResult(result *models.SessionMessage) []byte {
+	encoded, ok := result.Result.(string)
+	if !ok || result.Error != "" {
+		return nil
+	}
+	decoded, _ := b64.StdEncoding.DecodeString(encoded)
+	return decoded
+}
+
+// refused logs that a participant refused to take part in the session.
+func refused(protocol models.Protocol, sessionID string, refusal models.Refusal) {
+	id := refusal.Participant
+	reason := refusal.Rule + ": " + refusal.Reason
+	log.Printf("session %s: participant %s refused: %s\n", sessionID, id, reason)
+	logMessages := models.GetLogMessageOutputChannel()
+	logMessage := models.LogMessage{
+		Protocol:    protocol,
+		Participant: string(id),
+		Message:     "refused: " + reason,
+		SessionID:   sessionID,
+		Timestamp:   strconv.FormatInt(time.Now().Unix(), 10),
+	}
+	logMessages <- &logMessage
+}
+
+type EthTransfer struct {
+	Hash string `json:"hash"`
+	Fees Fees   `json:"fees"`
 }
 
-func SendEth(ids party.IDSlice, threshold int, from string, to string, amount string, online bool) (string, error) {
-	client, err := ethclient.Dial("https://goerli.infura.io/v3/4684d4b1567d4b78a9be3356bd3399b9")
+func SendEth(ids party.IDSlice, threshold int, chainName string, from string, to string, amount string, online bool, feeOptions FeeOptions) (EthTransfer, error) {
+	client, chain, tx, fees, err := newTransfer(chainName, from, to, amount, feeOptions)
 	if err != nil {
-		return "", err
+		return EthTransfer{}, err
 	}
 
-	fromAddress := common.HexToAddress(from)
-	nonce, err := client.PendingNonceAt(context.Background(), fromAddress)
+	hash, err := signAndSend(ids, threshold, from, online, client, chain, tx, "")
 	if err != nil {
-		return "", err
+		return EthTransfer{}, err
 	}
+	return EthTransfer{Hash: hash, Fees: fees}, nil
+}
 
-	a, err := strconv.Atoi(amount)
+// newTransfer builds the transaction of a transfer of amount wei and
+// reserves its nonce.
+func newTransfer(chainName string, from string, to string, amount string, feeOptions FeeOptions) (chains.Backend, *chains.Chain, *types.Transaction, Fees, error) {
+	chain, err := chains.Get(chainName)
 	if err != nil {
-		return "", err
+		return nil, nil, nil, Fees{}, err
 	}
-	value := big.NewInt(int64(a))
-	tipCap, _ := client.SuggestGasTipCap(context.Background())
-	feeCap, _ := client.SuggestGasPrice(context.Background())
-	gasLimit := uint64(21000)
+	client, err := chain.Backend(context.Background())
 	if err != nil {
-		return "", err
+		return nil, nil, nil, Fees{}, err
 	}
 
-	toAddress := common.HexToAddress(to)
+	fromAddress := common.HexToAddress(from)
 
-	chainID, err := client.NetworkID(context.Background())
-	if err != nil {
-		return "", err
+	value, ok := new(big.Int).SetString(amount, 10)
+	if !ok || value.Sign() < 0 {
+		return nil, nil, nil, Fees{}, errors.New("invalid amount: " + amount)
 	}
 
-	tx := types.NewTx(&types.DynamicFeeTx{
-		ChainID:   chainID,
-		GasTipCap: tipCap,
-		GasFeeCap: feeCap,
-		Nonce:     nonce,
-		To:        &toAddress,
-		Value:     value,
-		Gas:       gasLimit,
-		Data:      nil,
-	})
+	toAddress := common.HexToAddress(to)
 
-	signer := types.NewLondonSigner(chainID)
+	tx, fees, err := newTransaction(client, chain, fromAddress, &toAddress, value, nil, feeOptions)
+	if err != nil {
+		return nil, nil, nil, Fees{}, err
+	}
+	return client, chain, tx, fees, nil
+}
 
-	txHash := signer.Hash(tx)
+// signAndSend signs the transaction with the MPC key of from and broadcasts
+// it. It returns the hash of the signed transaction, releases its nonce and
+// hands the transaction to the watcher. requestID is the approval request
+// the transaction executes, empty if there is none.
+func signAndSend(ids party.IDSlice, threshold int, from string, online bool, client chains.Backend, chain *chains.Chain, tx *types.Transaction, requestID string) (hash string, err error) {
+	defer func() {
+		nonces.Release(chain.ChainID, common.HexToAddress(from), tx.Nonce(), hash, err)
+	}()
 
-	var sig []byte
-	if online == true {
-		sig = SignOnline(ids, txHash, from)
-	} else {
-		sig = Sign(ids, threshold, txHash, from)
+	signedTx, err := signTransaction(ids, threshold, from, online, chain.ID(), tx, requestID)
+	if err != nil {
+		return "", err
 	}
 
-	signedTx, _ := tx.WithSignature(signer, sig)
-
 	err = client.SendTransaction(context.Background(), signedTx)
 	if err != nil {
 		return "", err
 	}
 
-	hash := tx.Hash().Hex()
-	return hash, nil
+	track(chain, from, signedTx)
+	return signedTx.Hash().Hex(), nil
+}
+
+// SignTransaction signs tx for chainID with the MPC key of from without
+// sending it.
+func SignTransaction(ids party.IDSlice, threshold int, from string, online bool, chainID *big.Int, tx *types.Transaction) (*types.Transaction, error) {
+	return signTransaction(ids, threshold, from, online, chainID, tx, "")
+}
+
+func signTransaction(ids party.IDSlice, threshold int, from string, online bool, chainID *big.Int, tx *types.Transaction, requestID string) (*types.Transaction, error) {
+	p, err := payload.NewTransaction(chainID, tx)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := signDigest(ids, threshold, from, p, online, requestID)
+	if err != nil {
+		return nil, err
+	}
+
+	return tx.WithSignature(types.NewLondonSigner(chainID), sig)
 }
 
 func GetOnline(ids party.IDSlice) map[party.ID]bool {
 	results := make(map[party.ID]bool, ids.Len())
+	var mtx sync.Mutex
 	var wg sync.WaitGroup
 	for _, id := range ids {
 		wg.Add(1)
 		go func(id party.ID) {
 			defer wg.Done()
-			infoRequestChannel := models.GetInfoRequestMessageOutputChannel(id)
-			infoRequestMessage := models.InfoRequestMessage{
-				Info: models.Online,
-			}
-			infoRequestChannel <- &infoRequestMessage
+			result, ok := requestInfo(id, models.Online)
+			mtx.Lock()
+			results[id] = ok && result.Online
+			mtx.Unlock()
+		}(id)
+	}
+	wg.Wait()
+
+	return results
+}
 
-			infoResponseChannel := models.GetInfoResponseMessageInputChannel(id)
-			result := <-infoResponseChannel
-			results[id] = result.Online
+func GetMetrics(ids party.IDSlice) map[party.ID]map[string]uint64 {
+	results := make(map[party.ID]map[string]uint64, ids.Len())
+	var mtx sync.Mutex
+	var wg sync.WaitGroup
+	for _, id := range ids {
+		wg.Add(1)
+		go func(id party.ID) {
+			defer wg.Done()
+			result, ok := requestInfo(id, models.Metrics)
+			if !ok {
+				return
+			}
+			mtx.Lock()
+			results[id] = result.Rejections
+			mtx.Unlock()
 		}(id)
 	}
 	wg.Wait()
@@ -363,29 +576,31 @@ func GetOnline(ids party.IDSlice) map[party.ID]bool {
 
 func GetConfigs(ids party.IDSlice) []models.ConfigMessage {
 	results := make(map[party.ID][]models.ConfigMessage, ids.Len())
+	var mtx sync.Mutex
 	var wg sync.WaitGroup
 	for _, id := range ids {
 		wg.Add(1)
 		go func(id party.ID) {
 			defer wg.Done()
-			infoRequestChannel := models.GetInfoRequestMessageOutputChannel(id)
-			infoRequestMessage := models.InfoRequestMessage{
-				Info: models.Configs,
+			result, ok := requestInfo(id, models.Configs)
+			if !ok {
+				return
 			}
-			infoRequestChannel <- &infoRequestMessage
-
-			infoResponseChannel := models.GetInfoResponseMessageInputChannel(id)
-			result := <-infoResponseChannel
+			mtx.Lock()
 			results[id] = result.Configs
+			mtx.Unlock()
 		}(id)
 	}
 	wg.Wait()
 
 	configs := make(map[string]map[string]models.ConfigMessage)
 	checkup := make(map[string]map[string]map[string]bool)
+	frozen := make(map[string]bool)
 
 	for id, config := range results {
 		for _, configMessage := range config {
+			// a key is frozen if one participant holds it frozen
+			frozen[configMessage.Address] = frozen[configMessage.Address] || configMessage.Frozen
 			if configs[configMessage.Address] == nil {
 				configs[configMessage.Address] = make(map[string]models.ConfigMessage)
 				configs[configMessage.Address][configMessage.SessionID] = configMessage
@@ -415,6 +630,7 @@ func GetConfigs(ids party.IDSlice) []models.ConfigMessage {
 				}
 			}
 			if valid == true {
+				config.Frozen = frozen[address]
 				result = append(result, config)
 			}
 		}
@@ -0,0 +1,257 @@
+package service
+
+import (
+	"crypto/ecdsa"
+	"encoding/asn1"
+	"errors"
+	"math/big"
+
+	"mpc_poc/payload"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/koteld/multi-party-sig/pkg/party"
+)
+
+type SignatureFormat string
+
+const (
+	DERFormat      SignatureFormat = "der"
+	CompactFormat  SignatureFormat = "compact"
+	RSVFormat      SignatureFormat = "rsv"
+	EthereumFormat SignatureFormat = "ethereum"
+)
+
+var secp256k1N = crypto.S256().Params().N
+var secp256k1HalfN = new(big.Int).Rsh(secp256k1N, 1)
+
+// Signature is a signature of a digest. Signature holds the encoding of the
+// requested format and is empty for rsv. S is always in the lower half of
+// the curve order, v is 27 or 28.
+type Signature struct {
+	Digest     string          `json:"digest"`
+	Format     SignatureFormat `json:"format"`
+	Signature  string          `json:"signature,omitempty"`
+	R          string          `json:"r"`
+	S          string          `json:"s"`
+	V          uint8           `json:"v"`
+	RecoveryID uint8           `json:"recoveryId"`
+	Signer     string          `json:"signer"`
+}
+
+type Verification struct {
+	Valid     bool            `json:"valid"`
+	Format    SignatureFormat `json:"format"`
+	LowS      bool            `json:"lowS"`
+	Signer    string          `json:"signer,omitempty"`
+	PublicKey string          `json:"publicKey,omitempty"`
+}
+
+type derSignature struct {
+	R, S *big.Int
+}
+
+// normalizeS returns the 65-byte signature with S in the lower half of the
+// curve order. Negating S flips the recovery ID.
+func normalizeS(sig []byte) []byte {
+	res := make([]byte, crypto.SignatureLength)
+	copy(res, sig)
+	s := new(big.Int).SetBytes(res[32:64])
+	if s.Cmp(secp256k1HalfN) > 0 {
+		s.Sub(secp256k1N, s)
+		copy(res[32:64], common.LeftPadBytes(s.Bytes(), 32))
+		res[crypto.RecoveryIDOffset] ^= 1
+	}
+	return res
+}
+
+// signDigest signs the hash of p with the MPC key of address. The signature
+// is normalized to low S, which Ethereum requires for transactions, and
+// checked to recover to address. The recovery ID is 0 or 1. requestID is the
+// approval request p executes, empty if there is none.
+func signDigest(ids party.IDSlice, threshold int, address string, p payload.Payload, online bool, requestID string) ([]byte, error) {
+	if !common.IsHexAddress(address) {
+		return nil, errors.New("invalid address: " + address)
+	}
+	digest, err := p.Hash()
+	if err != nil {
+		return nil, err
+	}
+	var sig []byte
+	if online == true {
+		sig, err = signOnline(ids, p, address, requestID)
+	} else {
+		sig, err = sign(ids, threshold, p, address, requestID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(sig) != crypto.SignatureLength {
+		return nil, errors.New("signing failed, see the log of the participants")
+	}
+	sig = normalizeS(sig)
+
+	publicKey, err := crypto.SigToPub(digest.Bytes(), sig)
+	if err != nil {
+		return nil, err
+	}
+	if signer := crypto.PubkeyToAddress(*publicKey); signer != common.HexToAddress(address) {
+		return nil, errors.New("signature recovers to " + signer.Hex() + " instead of " + address)
+	}
+	return sig, nil
+}
+
+// encodeSignature encodes a 65-byte signature with recovery ID 0 or 1.
+func encodeSignature(digest common.Hash, sig []byte, format SignatureFormat) (Signature, error) {
+	if format == "" {
+		format = EthereumFormat
+	}
+	r := new(big.Int).SetBytes(sig[:32])
+	s := new(big.Int).SetBytes(sig[32:64])
+	recoveryID := sig[crypto.RecoveryIDOffset]
+
+	res := Signature{
+		Digest:     digest.Hex(),
+		Format:     format,
+		R:          hexutil.Encode(sig[:32]),
+		S:          hexutil.Encode(sig[32:64]),
+		V:          recoveryID + 27,
+		RecoveryID: recoveryID,
+	}
+	if publicKey, err := crypto.SigToPub(digest.Bytes(), sig); err == nil {
+		res.Signer = crypto.PubkeyToAddress(*publicKey).Hex()
+	}
+
+	switch format {
+	case DERFormat:
+		der, err := asn1.Marshal(derSignature{R: r, S: s})
+		if err != nil {
+			return Signature{}, err
+		}
+		res.Signature = hexutil.Encode(der)
+	case CompactFormat:
+		res.Signature = hexutil.Encode(sig[:64])
+	case RSVFormat:
+	case EthereumFormat:
+		res.Signature = hexutil.Encode(append(append([]byte{}, sig[:64]...), res.V))
+	default:
+		return Signature{}, errors.New("unknown signature format: " + string(format))
+	}
+	return res, nil
+}
+
+// SignDigest signs the digest of p and returns it in format.
+func SignDigest(ids party.IDSlice, threshold int, address string, p payload.Payload, online bool, format SignatureFormat) (Signature, error) {
+	return signFormatted(ids, threshold, address, p, online, format, "")
+}
+
+// signFormatted is SignDigest for the approval request requestID.
+func signFormatted(ids party.IDSlice, threshold int, address string, p payload.Payload, online bool, format SignatureFormat, requestID string) (Signature, error) {
+	if format == "" {
+		format = EthereumFormat
+	}
+	switch format {
+	case DERFormat, CompactFormat, RSVFormat, EthereumFormat:
+	default:
+		return Signature{}, errors.New("unknown signature format: " + string(format))
+	}
+	digest, err := p.Hash()
+	if err != nil {
+		return Signature{}, err
+	}
+	sig, err := signDigest(ids, threshold, address, p, online, requestID)
+	if err != nil {
+		return Signature{}, err
+	}
+	return encodeSignature(digest, sig, format)
+}
+
+// decodeSignature accepts DER, 64-byte compact and 65-byte signatures with v
+// as 0, 1, 27 or 28. The recovery ID is -1 if the signature has none.
+func decodeSignature(sig []byte) (r *big.Int, s *big.Int, recoveryID int, format SignatureFormat, err error) {
+	switch len(sig) {
+	case crypto.SignatureLength:
+		v := int(sig[crypto.RecoveryIDOffset])
+		if v >= 27 {
+			v -= 27
+		}
+		if v != 0 && v != 1 {
+			return nil, nil, 0, "", errors.New("invalid recovery ID")
+		}
+		return new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:64]), v, EthereumFormat, nil
+	case 64:
+		return new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:64]), -1, CompactFormat, nil
+	}
+	var der derSignature
+	rest, err := asn1.Unmarshal(sig, &der)
+	if err != nil || len(rest) > 0 || der.R == nil || der.S == nil {
+		return nil, nil, 0, "", errors.New("signature is neither DER, compact nor 65 bytes")
+	}
+	return der.R, der.S, -1, DERFormat, nil
+}
+
+func parsePublicKey(publicKey string) (*ecdsa.PublicKey, error) {
+	b, err := hexutil.Decode(publicKey)
+	if err != nil {
+		return nil, errors.New("invalid public key: " + err.Error())
+	}
+	if len(b) == 33 {
+		return crypto.DecompressPubkey(b)
+	}
+	return crypto.UnmarshalPubkey(b)
+}
+
+// Verify checks a signature of digest against an address or a public key. A
+// signature with high S is valid, but reported as not low S.
+func Verify(digest common.Hash, signature []byte, address string, publicKey string) (Verification, error) {
+	if address == "" && publicKey == "" {
+		return Verification{}, errors.New("address or publicKey is required")
+	}
+	if address != "" && !common.IsHexAddress(address) {
+		return Verification{}, errors.New("invalid address: " + address)
+	}
+	var expected *ecdsa.PublicKey
+	if publicKey != "" {
+		var err error
+		if expected, err = parsePublicKey(publicKey); err != nil {
+			return Verification{}, err
+		}
+	}
+
+	r, s, recoveryID, format, err := decodeSignature(signature)
+	if err != nil {
+		return Verification{}, err
+	}
+	res := Verification{Format: format, LowS: s.Cmp(secp256k1HalfN) <= 0}
+	if r.Sign() <= 0 || s.Sign() <= 0 || r.Cmp(secp256k1N) >= 0 || s.Cmp(secp256k1N) >= 0 {
+		return res, nil
+	}
+
+	sig := make([]byte, crypto.SignatureLength)
+	copy(sig[:32], common.LeftPadBytes(r.Bytes(), 32))
+	copy(sig[32:64], common.LeftPadBytes(s.Bytes(), 32))
+	candidates := []int{0, 1}
+	if recoveryID >= 0 {
+		candidates = []int{recoveryID}
+	}
+	for _, id := range candidates {
+		sig[crypto.RecoveryIDOffset] = byte(id)
+		recovered, err := crypto.SigToPub(digest.Bytes(), sig)
+		if err != nil {
+			continue
+		}
+		signer := crypto.PubkeyToAddress(*recovered)
+		if address != "" && signer != common.HexToAddress(address) {
+			continue
+		}
+		if expected != nil && signer != crypto.PubkeyToAddress(*expected) {
+			continue
+		}
+		res.Valid = true
+		res.Signer = signer.Hex()
+		res.PublicKey = hexutil.Encode(crypto.CompressPubkey(recovered))
+		break
+	}
+	return res, nil
+}
@@ -0,0 +1,245 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"mpc_poc/chains"
+	"mpc_poc/payload"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// BalanceDelta is the expected change of a balance of the sender, in the
+// smallest unit of the asset. Asset is native or the token address.
+type BalanceDelta struct {
+	Asset     string `json:"asset"`
+	Symbol    string `json:"symbol"`
+	Delta     string `json:"delta"`
+	Formatted string `json:"formatted"`
+}
+
+// Simulation is the outcome of a dry run of a transaction, Preview describes
+// it line by line.
+type Simulation struct {
+	Chain         string               `json:"chain"`
+	From          string               `json:"from"`
+	To            string               `json:"to,omitempty"`
+	Value         string               `json:"value"`
+	Data          hexutil.Bytes        `json:"data"`
+	Call          *payload.DecodedCall `json:"call,omitempty"`
+	Reverts       bool                 `json:"reverts"`
+	RevertReason  string               `json:"revertReason,omitempty"`
+	ReturnData    hexutil.Bytes        `json:"returnData,omitempty"`
+	GasLimit      uint64               `json:"gasLimit"`
+	GasPrice      string               `json:"gasPrice"`
+	EstimatedFee  string               `json:"estimatedFee"`
+	BalanceDeltas []BalanceDelta       `json:"balanceDeltas"`
+	Preview       []string             `json:"preview"`
+}
+
+// revertReason reports whether err is a revert of the EVM and its reason,
+// decoded from Error(string) if possible.
+func revertReason(err error) (string, bool) {
+	var dataErr rpc.DataError
+	if errors.As(err, &dataErr) {
+		if s, ok := dataErr.ErrorData().(string); ok {
+			data, _ := hexutil.Decode(s)
+			if reason, err := abi.UnpackRevert(data); err == nil {
+				return reason, true
+			}
+			if len(data) >= 4 {
+				return "custom error " + hexutil.Encode(data[:4]), true
+			}
+		}
+		return err.Error(), true
+	}
+	if strings.Contains(err.Error(), "execution reverted") {
+		return err.Error(), true
+	}
+	return "", false
+}
+
+// checkRevert runs the transaction with eth_call and returns an error if it
+// reverts.
+func checkRevert(client chains.Backend, msg ethereum.CallMsg) error {
+	_, err := client.CallContract(context.Background(), msg, nil)
+	if err == nil {
+		return nil
+	}
+	if reason, ok := revertReason(err); ok {
+		return errors.New("transaction reverts in simulation: " + reason + ", set allowRevert to sign it anyway")
+	}
+	return err
+}
+
+// tokenDelta is the change of the token balance of from by an ERC-20
+// transfer or transferFrom. Calls that are not token transfers or don't
+// touch from return nil.
+func tokenDelta(call *payload.DecodedCall, from common.Address) *big.Int {
+	var source, destination string
+	switch call.Method {
+	case "transfer(address,uint256)":
+		source, destination = from.Hex(), call.Argument("to")
+	case "transferFrom(address,address,uint256)":
+		source, destination = call.Argument("from"), call.Argument("to")
+	default:
+		return nil
+	}
+	amount, ok := new(big.Int).SetString(call.Argument("amount"), 10)
+	if !ok {
+		return nil
+	}
+	fromSource := common.HexToAddress(source) == from
+	toDestination := common.HexToAddress(destination) == from
+	switch {
+	case fromSource && !toDestination:
+		return amount.Neg(amount)
+	case toDestination && !fromSource:
+		return amount
+	}
+	return nil
+}
+
+// Simulate dry-runs a transaction from from without signing it: the calldata
+// is decoded, eth_call and gas estimation detect reverts, and the balance
+// changes of from are estimated. A nil to deploys a contract. abiJSON may be
+// empty, known methods are decoded without it.
+func Simulate(chainName string, from string, to *common.Address, value string, data []byte, abiJSON json.RawMessage) (Simulation, error) {
+	if !common.IsHexAddress(from) {
+		return Simulation{}, errors.New("invalid address: " + from)
+	}
+	chain, err := chains.Get(chainName)
+	if err != nil {
+		return Simulation{}, err
+	}
+	client, err := chain.Backend(context.Background())
+	if err != nil {
+		return Simulation{}, err
+	}
+	amount := big.NewInt(0)
+	if value != "" {
+		var ok bool
+		amount, ok = new(big.Int).SetString(value, 0)
+		if !ok || amount.Sign() < 0 {
+			return Simulation{}, errors.New("invalid value: " + value)
+		}
+	}
+	var contractABI *abi.ABI
+	if len(abiJSON) > 0 {
+		parsed, err := ParseABI(abiJSON)
+		if err != nil {
+			return Simulation{}, err
+		}
+		contractABI = &parsed
+	}
+
+	fromAddress := common.HexToAddress(from)
+	symbol := chain.NativeCurrency.Symbol
+	decimals := chain.NativeCurrency.Decimals
+	if symbol == "" {
+		symbol, decimals = "ETH", 18
+	}
+	res := Simulation{
+		Chain:         chain.Name,
+		From:          fromAddress.Hex(),
+		Value:         amount.String(),
+		Data:          data,
+		BalanceDeltas: make([]BalanceDelta, 0),
+		Preview:       []string{"On " + chain.Name + " (chain ID " + strconv.FormatUint(chain.ChainID, 10) + ") from " + fromAddress.Hex()},
+	}
+
+	switch {
+	case to == nil:
+		res.Preview = append(res.Preview, "Deploy a contract of "+strconv.Itoa(len(data))+" bytes")
+	case len(data) == 0:
+		res.To = to.Hex()
+		res.Preview = append(res.Preview, "Send "+FormatUnits(amount, decimals)+" "+symbol+" to "+to.Hex())
+	default:
+		res.To = to.Hex()
+		res.Call = payload.DecodeCall(contractABI, data)
+		if res.Call == nil {
+			res.Preview = append(res.Preview, "Call an unknown method of "+to.Hex()+" with "+strconv.Itoa(len(data))+" bytes of data")
+		} else {
+			res.Preview = append(res.Preview, "Call "+res.Call.Method+" of "+to.Hex())
+			for _, a := range res.Call.Arguments {
+				res.Preview = append(res.Preview, "  "+a.Name+" ("+a.Type+"): "+a.Value)
+			}
+		}
+		if amount.Sign() > 0 {
+			res.Preview = append(res.Preview, "Send "+FormatUnits(amount, decimals)+" "+symbol+" with the call")
+		}
+	}
+
+	msg := ethereum.CallMsg{From: fromAddress, To: to, Value: amount, Data: data}
+	returnData, err := client.CallContract(context.Background(), msg, nil)
+	if err != nil {
+		reason, ok := revertReason(err)
+		if !ok {
+			return Simulation{}, err
+		}
+		res.Reverts, res.RevertReason = true, reason
+	} else {
+		res.ReturnData = returnData
+		if res.GasLimit, err = client.EstimateGas(context.Background(), msg); err != nil {
+			reason, ok := revertReason(err)
+			if !ok {
+				return Simulation{}, err
+			}
+			res.Reverts, res.RevertReason = true, reason
+		}
+	}
+	if res.Reverts {
+		res.Preview = append(res.Preview, "REVERTS: "+res.RevertReason)
+		return res, nil
+	}
+
+	gasPrice, err := client.SuggestGasPrice(context.Background())
+	if err != nil {
+		return Simulation{}, err
+	}
+	fee := new(big.Int).Mul(gasPrice, new(big.Int).SetUint64(res.GasLimit))
+	res.GasPrice = gasPrice.String()
+	res.EstimatedFee = fee.String()
+	res.Preview = append(res.Preview, "Gas "+strconv.FormatUint(res.GasLimit, 10)+", estimated fee "+FormatUnits(fee, decimals)+" "+symbol)
+
+	native := new(big.Int).Neg(fee)
+	if to == nil || *to != fromAddress {
+		native.Sub(native, amount)
+	}
+	res.BalanceDeltas = append(res.BalanceDeltas, BalanceDelta{
+		Asset:     "native",
+		Symbol:    symbol,
+		Delta:     native.String(),
+		Formatted: FormatUnits(native, decimals) + " " + symbol,
+	})
+	if res.Call != nil {
+		if delta := tokenDelta(res.Call, fromAddress); delta != nil {
+			tokenDecimals, tokenSymbol := uint8(0), to.Hex()
+			if out, err := callToken(client, *to, "decimals"); err == nil && len(out) == 1 {
+				tokenDecimals = out[0].(uint8)
+			}
+			if out, err := callToken(client, *to, "symbol"); err == nil && len(out) == 1 {
+				tokenSymbol = out[0].(string)
+			}
+			res.BalanceDeltas = append(res.BalanceDeltas, BalanceDelta{
+				Asset:     to.Hex(),
+				Symbol:    tokenSymbol,
+				Delta:     delta.String(),
+				Formatted: FormatUnits(delta, tokenDecimals) + " " + tokenSymbol,
+			})
+		}
+	}
+	for _, delta := range res.BalanceDeltas {
+		res.Preview = append(res.Preview, "Balance change: "+delta.Formatted)
+	}
+	return res, nil
+}
@@ -0,0 +1,163 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"strings"
+
+	"mpc_poc/chains"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/koteld/multi-party-sig/pkg/party"
+)
+
+const erc20ABI = `[
+	{"type":"function","name":"transfer","stateMutability":"nonpayable","inputs":[{"name":"to","type":"address"},{"name":"amount","type":"uint256"}],"outputs":[{"name":"","type":"bool"}]},
+	{"type":"function","name":"balanceOf","stateMutability":"view","inputs":[{"name":"account","type":"address"}],"outputs":[{"name":"","type":"uint256"}]},
+	{"type":"function","name":"decimals","stateMutability":"view","inputs":[],"outputs":[{"name":"","type":"uint8"}]},
+	{"type":"function","name":"symbol","stateMutability":"view","inputs":[],"outputs":[{"name":"","type":"string"}]}
+]`
+
+var erc20, _ = abi.JSON(strings.NewReader(erc20ABI))
+
+type TokenTransfer struct {
+	Hash          string `json:"hash"`
+	Token         string `json:"token"`
+	Symbol        string `json:"symbol"`
+	Decimals      uint8  `json:"decimals"`
+	Amount        string `json:"amount"`
+	BalanceBefore string `json:"balanceBefore"`
+	BalanceAfter  string `json:"balanceAfter"`
+	Fees          Fees   `json:"fees"`
+}
+
+func callToken(client chains.Backend, token common.Address, method string, args ...interface{}) ([]interface{}, error) {
+	data, err := erc20.Pack(method, args...)
+	if err != nil {
+		return nil, err
+	}
+	res, err := client.CallContract(context.Background(), ethereum.CallMsg{To: &token, Data: data}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return erc20.Unpack(method, res)
+}
+
+// ParseUnits converts a decimal amount such as "1.5" into the smallest unit of
+// a token with the given decimals.
+func ParseUnits(amount string, decimals uint8) (*big.Int, error) {
+	parts := strings.Split(strings.TrimSpace(amount), ".")
+	if len(parts) > 2 || parts[0] == "" && (len(parts) == 1 || parts[1] == "") {
+		return nil, errors.New("invalid amount: " + amount)
+	}
+	fraction := ""
+	if len(parts) == 2 {
+		fraction = parts[1]
+	}
+	if len(fraction) > int(decimals) {
+		return nil, errors.New("amount has more than " + big.NewInt(int64(decimals)).String() + " decimals: " + amount)
+	}
+	value, ok := new(big.Int).SetString(parts[0]+fraction+strings.Repeat("0", int(decimals)-len(fraction)), 10)
+	if !ok || value.Sign() < 0 {
+		return nil, errors.New("invalid amount: " + amount)
+	}
+	return value, nil
+}
+
+// FormatUnits is the inverse of ParseUnits.
+func FormatUnits(value *big.Int, decimals uint8) string {
+	s := new(big.Int).Abs(value).String()
+	if len(s) <= int(decimals) {
+		s = strings.Repeat("0", int(decimals)-len(s)+1) + s
+	}
+	integer, fraction := s[:len(s)-int(decimals)], strings.TrimRight(s[len(s)-int(decimals):], "0")
+	if value.Sign() < 0 {
+		integer = "-" + integer
+	}
+	if fraction == "" {
+		return integer
+	}
+	return integer + "." + fraction
+}
+
+// TransferToken sends amount tokens, given in whole token units, from the MPC
+// address from. BalanceAfter is the expected balance once the transaction is
+// mined.
+func TransferToken(ids party.IDSlice, threshold int, chainName string, from string, token string, to string, amount string, online bool, feeOptions FeeOptions) (TokenTransfer, error) {
+	chain, err := chains.Get(chainName)
+	if err != nil {
+		return TokenTransfer{}, err
+	}
+	client, err := chain.Backend(context.Background())
+	if err != nil {
+		return TokenTransfer{}, err
+	}
+
+	if !common.IsHexAddress(token) || !common.IsHexAddress(to) {
+		return TokenTransfer{}, errors.New("invalid token or recipient address")
+	}
+	tokenAddress := common.HexToAddress(token)
+	fromAddress := common.HexToAddress(from)
+	toAddress := common.HexToAddress(to)
+
+	res, err := callToken(client, tokenAddress, "decimals")
+	if err != nil {
+		return TokenTransfer{}, err
+	}
+	decimals := *abi.ConvertType(res[0], new(uint8)).(*uint8)
+	res, err = callToken(client, tokenAddress, "symbol")
+	if err != nil {
+		return TokenTransfer{}, err
+	}
+	symbol := *abi.ConvertType(res[0], new(string)).(*string)
+	res, err = callToken(client, tokenAddress, "balanceOf", fromAddress)
+	if err != nil {
+		return TokenTransfer{}, err
+	}
+	balance := *abi.ConvertType(res[0], new(*big.Int)).(**big.Int)
+
+	value, err := ParseUnits(amount, decimals)
+	if err != nil {
+		return TokenTransfer{}, err
+	}
+	if value.Sign() == 0 {
+		return TokenTransfer{}, errors.New("amount must be greater than 0")
+	}
+	if value.Cmp(balance) > 0 {
+		return TokenTransfer{}, errors.New("insufficient " + symbol + " balance: " + FormatUnits(balance, decimals))
+	}
+
+	data, err := erc20.Pack("transfer", toAddress, value)
+	if err != nil {
+		return TokenTransfer{}, err
+	}
+
+	tx, fees, err := newTransaction(client, chain, fromAddress, &tokenAddress, big.NewInt(0), data, feeOptions)
+	if err != nil {
+		return TokenTransfer{}, err
+	}
+
+	hash, err := signAndSend(ids, threshold, from, online, client, chain, tx, "")
+	if err != nil {
+		return TokenTransfer{}, err
+	}
+
+	balanceAfter := new(big.Int).Sub(balance, value)
+	if fromAddress == toAddress {
+		balanceAfter = balance
+	}
+
+	return TokenTransfer{
+		Hash:          hash,
+		Token:         tokenAddress.Hex(),
+		Symbol:        symbol,
+		Decimals:      decimals,
+		Amount:        FormatUnits(value, decimals),
+		BalanceBefore: FormatUnits(balance, decimals),
+		BalanceAfter:  FormatUnits(balanceAfter, decimals),
+		Fees:          fees,
+	}, nil
+}
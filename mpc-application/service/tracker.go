@@ -0,0 +1,640 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"math/big"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"mpc_poc/chains"
+	"mpc_poc/helper"
+	"mpc_poc/models"
+	"mpc_poc/nonces"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/joho/godotenv"
+	"github.com/koteld/multi-party-sig/pkg/party"
+)
+
+type TxState string
+
+const (
+	Pending   TxState = "pending"
+	Mined     TxState = "mined"
+	Confirmed TxState = "confirmed"
+	Failed    TxState = "failed"
+	Dropped   TxState = "dropped"
+	Cancelled TxState = "cancelled"
+)
+
+type AttemptKind string
+
+const (
+	Original AttemptKind = "original"
+	SpeedUp  AttemptKind = "speedup"
+	Cancel   AttemptKind = "cancel"
+)
+
+// replacementBump is the percentage the fees of a replacement have to exceed
+// the fees of the transaction it replaces by. Geth needs 110, other clients
+// ask for more.
+const replacementBump = 120
+
+// Attempt is one signed transaction for the nonce of a tracked transaction.
+type Attempt struct {
+	Hash   string        `json:"hash"`
+	Kind   AttemptKind   `json:"kind"`
+	Fees   Fees          `json:"fees"`
+	Raw    hexutil.Bytes `json:"raw"`
+	SentAt time.Time     `json:"sentAt"`
+}
+
+// TrackedTransaction is a sent transaction and its replacements. ID is the
+// hash of the original transaction, Hash the hash of the attempt that was
+// mined or, while pending, of the latest one. Final transactions are no
+// longer watched.
+type TrackedTransaction struct {
+	ID            string    `json:"id"`
+	Chain         string    `json:"chain"`
+	ChainID       uint64    `json:"chainId"`
+	From          string    `json:"from"`
+	Nonce         uint64    `json:"nonce"`
+	State         TxState   `json:"state"`
+	Final         bool      `json:"final"`
+	Hash          string    `json:"hash"`
+	Block         uint64    `json:"block,omitempty"`
+	Confirmations uint64    `json:"confirmations"`
+	GasUsed       uint64    `json:"gasUsed,omitempty"`
+	Attempts      []Attempt `json:"attempts"`
+	CreatedAt     time.Time `json:"createdAt"`
+	UpdatedAt     time.Time `json:"updatedAt"`
+}
+
+var tracked = make(map[string]*TrackedTransaction)
+
+// replacing holds the IDs of the transactions a replacement is signed for.
+var replacing = make(map[string]bool)
+var trackedMtx sync.Mutex
+var trackedFileMtx sync.Mutex
+var trackedLoadOnce sync.Once
+var watcherOnce sync.Once
+
+func transactionsPath() string {
+	return helper.GetEnv("TRANSACTIONS_FILE", "transactions.json")
+}
+
+// loadTracked reads the transactions persisted in TRANSACTIONS_FILE,
+// transactions.json by default.
+func loadTracked() {
+	trackedLoadOnce.Do(func() {
+		_ = godotenv.Load()
+		data, err := os.ReadFile(transactionsPath())
+		if err != nil {
+			return
+		}
+		var saved []*TrackedTransaction
+		if err = json.Unmarshal(data, &saved); err != nil {
+			log.Printf("transactions: failed to parse %s: %v\n", transactionsPath(), err)
+			return
+		}
+		for _, t := range saved {
+			tracked[t.ID] = t
+		}
+	})
+}
+
+// snapshotTracked returns copies of all tracked transactions, newest first.
+func snapshotTracked() []TrackedTransaction {
+	loadTracked()
+	trackedMtx.Lock()
+	res := make([]TrackedTransaction, 0, len(tracked))
+	for _, t := range tracked {
+		c := *t
+		c.Attempts = append([]Attempt(nil), t.Attempts...)
+		res = append(res, c)
+	}
+	trackedMtx.Unlock()
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].CreatedAt.After(res[j].CreatedAt)
+	})
+	return res
+}
+
+func saveTracked() {
+	data, _ := json.MarshalIndent(snapshotTracked(), "", "  ")
+
+	trackedFileMtx.Lock()
+	defer trackedFileMtx.Unlock()
+	tmp := transactionsPath() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		log.Printf("transactions: failed to save %s: %v\n", transactionsPath(), err)
+		return
+	}
+	if err := os.Rename(tmp, transactionsPath()); err != nil {
+		log.Printf("transactions: failed to save %s: %v\n", transactionsPath(), err)
+	}
+}
+
+// findTracked returns the transaction one of whose attempts has hash.
+// trackedMtx must be held.
+func findTracked(hash string) (*TrackedTransaction, bool) {
+	if t, ok := tracked[hash]; ok {
+		return t, true
+	}
+	for _, t := range tracked {
+		for _, attempt := range t.Attempts {
+			if strings.EqualFold(attempt.Hash, hash) {
+				return t, true
+			}
+		}
+	}
+	return nil, false
+}
+
+func publishTransaction(t TrackedTransaction, message string) {
+	logMessages := models.GetLogMessageOutputChannel()
+	logMessage := models.LogMessage{
+		Protocol:    models.Transaction,
+		Participant: "watcher",
+		Message:     message,
+		SessionID:   t.ID,
+		Timestamp:   strconv.FormatInt(time.Now().Unix(), 10),
+	}
+	logMessages <- &logMessage
+}
+
+// txFees reports the fee parameters of a signed transaction.
+func txFees(tx *types.Transaction, strategy FeeStrategy) Fees {
+	fees := Fees{
+		Strategy: strategy,
+		GasLimit: tx.Gas(),
+	}
+	maxCost := new(big.Int).Mul(tx.GasFeeCap(), new(big.Int).SetUint64(tx.Gas()))
+	fees.MaxCost = maxCost.Add(maxCost, tx.Value()).String()
+	switch tx.Type() {
+	case types.DynamicFeeTxType:
+		fees.Type = DynamicFeeTxType
+		fees.MaxFeePerGas = tx.GasFeeCap().String()
+		fees.MaxPriorityFeePerGas = tx.GasTipCap().String()
+	case types.AccessListTxType:
+		fees.Type = AccessListTxType
+		fees.GasPrice = tx.GasPrice().String()
+	default:
+		fees.Type = LegacyTxType
+		fees.GasPrice = tx.GasPrice().String()
+	}
+	return fees
+}
+
+// track hands a broadcast transaction to the watcher.
+func track(chain *chains.Chain, from string, signedTx *types.Transaction) {
+	raw, err := signedTx.MarshalBinary()
+	if err != nil {
+		log.Printf("transactions: failed to encode %s: %v\n", signedTx.Hash().Hex(), err)
+		return
+	}
+	now := time.Now().UTC()
+	t := &TrackedTransaction{
+		ID:      signedTx.Hash().Hex(),
+		Chain:   chain.Name,
+		ChainID: chain.ChainID,
+		From:    from,
+		Nonce:   signedTx.Nonce(),
+		State:   Pending,
+		Hash:    signedTx.Hash().Hex(),
+		Attempts: []Attempt{{
+			Hash:   signedTx.Hash().Hex(),
+			Kind:   Original,
+			Fees:   txFees(signedTx, ""),
+			Raw:    raw,
+			SentAt: now,
+		}},
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+
+	loadTracked()
+	trackedMtx.Lock()
+	tracked[t.ID] = t
+	trackedMtx.Unlock()
+
+	saveTracked()
+	publishTransaction(*t, "transaction "+t.ID+" is pending")
+}
+
+// StartWatcher polls the receipts of all transactions that are not final
+// every TX_POLL_INTERVAL, 5s by default.
+func StartWatcher() {
+	watcherOnce.Do(func() {
+		loadTracked()
+		interval, err := time.ParseDuration(helper.GetEnv("TX_POLL_INTERVAL", "5s"))
+		if err != nil || interval <= 0 {
+			log.Printf("transactions: invalid TX_POLL_INTERVAL, using 5s\n")
+			interval = 5 * time.Second
+		}
+		go func() {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for range ticker.C {
+				pollTransactions()
+			}
+		}()
+	})
+}
+
+func dropTimeout() time.Duration {
+	timeout, err := time.ParseDuration(helper.GetEnv("TX_DROP_TIMEOUT", "10m"))
+	if err != nil || timeout <= 0 {
+		return 10 * time.Minute
+	}
+	return timeout
+}
+
+func pollTransactions() {
+	ctx := context.Background()
+	heads := make(map[string]uint64)
+
+	for _, t := range snapshotTracked() {
+		if t.Final {
+			continue
+		}
+		chain, err := chains.Get(t.Chain)
+		if err != nil {
+			log.Printf("transactions: %s: %v\n", t.ID, err)
+			continue
+		}
+		client, err := chain.Backend(ctx)
+		if err != nil {
+			log.Printf("transactions: %s: %v\n", t.ID, err)
+			continue
+		}
+		head, ok := heads[chain.Name]
+		if !ok {
+			header, err := client.HeaderByNumber(ctx, nil)
+			if err != nil {
+				log.Printf("transactions: failed to get the head of %s: %v\n", chain.Name, err)
+				continue
+			}
+			head = header.Number.Uint64()
+			heads[chain.Name] = head
+		}
+
+		previous := t.State
+		if err = t.check(ctx, client, head, chain.Confirmations); err != nil {
+			log.Printf("transactions: failed to check %s: %v\n", t.ID, err)
+			continue
+		}
+
+		trackedMtx.Lock()
+		current, ok := tracked[t.ID]
+		if ok {
+			current.State = t.State
+			current.Final = t.Final
+			current.Hash = t.Hash
+			current.Block = t.Block
+			current.Confirmations = t.Confirmations
+			current.GasUsed = t.GasUsed
+			current.UpdatedAt = time.Now().UTC()
+		}
+		trackedMtx.Unlock()
+
+		if t.State != previous || t.Final {
+			saveTracked()
+		}
+		if t.State != previous {
+			message := "transaction " + t.ID + " is " + string(t.State)
+			if t.Hash != t.ID {
+				message += " as " + t.Hash
+			}
+			publishTransaction(t, message)
+		}
+	}
+}
+
+// check updates the state from the receipts of the attempts. The nonce is
+// read first: if it is used but none of the attempts has a receipt, another
+// transaction took it. A transaction whose attempts are all unknown to the
+// node for TX_DROP_TIMEOUT is dropped, but stays watched until its nonce is
+// used as it may still be rebroadcast by a peer.
+func (t *TrackedTransaction) check(ctx context.Context, client chains.Backend, head uint64, required uint64) error {
+	nonce, err := client.NonceAt(ctx, common.HexToAddress(t.From), nil)
+	if err != nil {
+		return err
+	}
+
+	for i := len(t.Attempts) - 1; i >= 0; i-- {
+		attempt := t.Attempts[i]
+		receipt, err := client.TransactionReceipt(ctx, common.HexToHash(attempt.Hash))
+		if err == ethereum.NotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		t.Hash = attempt.Hash
+		t.Block = receipt.BlockNumber.Uint64()
+		t.GasUsed = receipt.GasUsed
+		t.Confirmations = 1
+		if head >= t.Block {
+			t.Confirmations = head - t.Block + 1
+		}
+		t.Final = t.Confirmations >= required
+		switch {
+		case receipt.Status == types.ReceiptStatusFailed:
+			t.State = Failed
+		case attempt.Kind == Cancel:
+			t.State = Cancelled
+		case t.Final:
+			t.State = Confirmed
+		default:
+			t.State = Mined
+		}
+		return nil
+	}
+
+	t.Block = 0
+	t.GasUsed = 0
+	t.Confirmations = 0
+	t.Hash = t.Attempts[len(t.Attempts)-1].Hash
+	if nonce > t.Nonce {
+		t.State = Dropped
+		t.Final = true
+		return nil
+	}
+
+	for _, attempt := range t.Attempts {
+		_, _, err = client.TransactionByHash(ctx, common.HexToHash(attempt.Hash))
+		if err == nil {
+			t.State = Pending
+			return nil
+		}
+		if err != ethereum.NotFound {
+			return err
+		}
+	}
+	if time.Since(t.Attempts[len(t.Attempts)-1].SentAt) > dropTimeout() {
+		t.State = Dropped
+	} else if t.State != Dropped {
+		t.State = Pending
+	}
+	return nil
+}
+
+func GetTransactions() []TrackedTransaction {
+	return snapshotTracked()
+}
+
+// GetTransaction returns the tracked transaction that has an attempt with
+// hash.
+func GetTransaction(hash string) (TrackedTransaction, error) {
+	loadTracked()
+	trackedMtx.Lock()
+	defer trackedMtx.Unlock()
+	t, ok := findTracked(hash)
+	if !ok {
+		return TrackedTransaction{}, errors.New("unknown transaction: " + hash)
+	}
+	res := *t
+	res.Attempts = append([]Attempt(nil), t.Attempts...)
+	return res, nil
+}
+
+// SpeedUpTransaction replaces a pending transaction with the same one at
+// higher fees.
+func SpeedUpTransaction(ids party.IDSlice, threshold int, hash string, online bool, feeOptions FeeOptions) (TrackedTransaction, error) {
+	return replaceTransaction(ids, threshold, hash, online, feeOptions, SpeedUp)
+}
+
+// CancelTransaction replaces a pending transaction with a transfer of 0 to
+// the sender at higher fees.
+func CancelTransaction(ids party.IDSlice, threshold int, hash string, online bool, feeOptions FeeOptions) (TrackedTransaction, error) {
+	return replaceTransaction(ids, threshold, hash, online, feeOptions, Cancel)
+}
+
+// beginReplacement returns the pending transaction with an attempt with hash
+// and marks it as being replaced until endReplacement, so concurrent speed
+// ups and cancels don't both sign a replacement.
+func beginReplacement(hash string) (TrackedTransaction, error) {
+	loadTracked()
+	trackedMtx.Lock()
+	defer trackedMtx.Unlock()
+	t, ok := findTracked(hash)
+	if !ok {
+		return TrackedTransaction{}, errors.New("unknown transaction: " + hash)
+	}
+	if t.State != Pending {
+		return TrackedTransaction{}, errors.New("transaction " + t.ID + " is " + string(t.State) + ", only pending transactions can be replaced")
+	}
+	if replacing[t.ID] {
+		return TrackedTransaction{}, errors.New("transaction " + t.ID + " is already being replaced")
+	}
+	replacing[t.ID] = true
+	res := *t
+	res.Attempts = append([]Attempt(nil), t.Attempts...)
+	return res, nil
+}
+
+func endReplacement(id string) {
+	trackedMtx.Lock()
+	defer trackedMtx.Unlock()
+	delete(replacing, id)
+}
+
+func replaceTransaction(ids party.IDSlice, threshold int, hash string, online bool, feeOptions FeeOptions, kind AttemptKind) (TrackedTransaction, error) {
+	t, err := beginReplacement(hash)
+	if err != nil {
+		return TrackedTransaction{}, err
+	}
+	defer endReplacement(t.ID)
+	chain, err := chains.Get(t.Chain)
+	if err != nil {
+		return TrackedTransaction{}, err
+	}
+	client, err := chain.Backend(context.Background())
+	if err != nil {
+		return TrackedTransaction{}, err
+	}
+
+	previous := new(types.Transaction)
+	if err = previous.UnmarshalBinary(t.Attempts[len(t.Attempts)-1].Raw); err != nil {
+		return TrackedTransaction{}, err
+	}
+	tx, err := replacement(client, chain, previous, common.HexToAddress(t.From), feeOptions, kind)
+	if err != nil {
+		return TrackedTransaction{}, err
+	}
+
+	signedTx, err := SignTransaction(ids, threshold, t.From, online, chain.ID(), tx)
+	if err != nil {
+		return TrackedTransaction{}, err
+	}
+	if err = client.SendTransaction(context.Background(), signedTx); err != nil {
+		return TrackedTransaction{}, err
+	}
+	raw, err := signedTx.MarshalBinary()
+	if err != nil {
+		return TrackedTransaction{}, err
+	}
+	nonces.Replace(chain.ChainID, common.HexToAddress(t.From), t.Nonce, signedTx.Hash().Hex())
+
+	if feeOptions.Strategy == "" {
+		feeOptions.Strategy = Standard
+	}
+	trackedMtx.Lock()
+	current, _ := findTracked(t.ID)
+	current.Attempts = append(current.Attempts, Attempt{
+		Hash:   signedTx.Hash().Hex(),
+		Kind:   kind,
+		Fees:   txFees(signedTx, feeOptions.Strategy),
+		Raw:    raw,
+		SentAt: time.Now().UTC(),
+	})
+	current.Hash = signedTx.Hash().Hex()
+	current.UpdatedAt = time.Now().UTC()
+	trackedMtx.Unlock()
+
+	saveTracked()
+	res, _ := GetTransaction(t.ID)
+	publishTransaction(res, "transaction "+t.ID+": sent "+string(kind)+" "+res.Hash)
+	return res, nil
+}
+
+// replacement builds the transaction replacing previous. Its fees are those of
+// the fee options, but at least replacementBump percent of the previous ones.
+// Explicit fees below that are rejected.
+func replacement(client chains.Backend, chain *chains.Chain, previous *types.Transaction, from common.Address, options FeeOptions, kind AttemptKind) (*types.Transaction, error) {
+	ctx := context.Background()
+
+	if options.Strategy == "" {
+		options.Strategy = Standard
+	}
+	if _, ok := feeMultipliers[options.Strategy]; !ok && options.Strategy != Explicit {
+		return nil, errors.New("unknown fee strategy: " + string(options.Strategy))
+	}
+	header, err := client.HeaderByNumber(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	maxFeeCap, err := feeLimit(chain, options)
+	if err != nil {
+		return nil, err
+	}
+
+	to := previous.To()
+	value := previous.Value()
+	data := previous.Data()
+	gasLimit := previous.Gas()
+	accessList := previous.AccessList()
+	if kind == Cancel {
+		to = &from
+		value = big.NewInt(0)
+		data = nil
+		gasLimit = 21000
+		accessList = nil
+	}
+
+	// bump returns the higher of the suggested value and the minimal bump of
+	// the previous one, rounded up so that tiny fees still increase.
+	bump := func(name string, suggested *big.Int, old *big.Int) (*big.Int, error) {
+		minimum := new(big.Int).Mul(old, big.NewInt(replacementBump))
+		minimum.Add(minimum, big.NewInt(99)).Div(minimum, big.NewInt(100))
+		if suggested.Cmp(minimum) >= 0 {
+			return suggested, nil
+		}
+		if options.Strategy == Explicit {
+			return nil, errors.New(name + " " + suggested.String() + " is below the required replacement fee " + minimum.String())
+		}
+		return minimum, nil
+	}
+	checkCap := func(fee *big.Int) error {
+		if maxFeeCap != nil && fee.Cmp(maxFeeCap) > 0 {
+			return errors.New("replacement fee " + fee.String() + " exceeds the cap of " + maxFeeCap.String())
+		}
+		return nil
+	}
+
+	var txData types.TxData
+	switch previous.Type() {
+	case types.DynamicFeeTxType:
+		if header.BaseFee == nil {
+			return nil, errors.New(chain.Name + " does not support EIP-1559 transactions")
+		}
+		suggestedTip, suggestedFeeCap, err := dynamicFees(client, header.BaseFee, options, nil)
+		if err != nil {
+			return nil, err
+		}
+		tipCap, err := bump("maxPriorityFeePerGas", suggestedTip, previous.GasTipCap())
+		if err != nil {
+			return nil, err
+		}
+		feeCap, err := bump("maxFeePerGas", suggestedFeeCap, previous.GasFeeCap())
+		if err != nil {
+			return nil, err
+		}
+		if feeCap.Cmp(tipCap) < 0 {
+			feeCap = tipCap
+		}
+		if err = checkCap(feeCap); err != nil {
+			return nil, err
+		}
+		txData = &types.DynamicFeeTx{
+			ChainID:    chain.ID(),
+			Nonce:      previous.Nonce(),
+			GasTipCap:  tipCap,
+			GasFeeCap:  feeCap,
+			Gas:        gasLimit,
+			To:         to,
+			Value:      value,
+			Data:       data,
+			AccessList: accessList,
+		}
+	case types.AccessListTxType, types.LegacyTxType:
+		suggested, err := legacyGasPrice(client, header.BaseFee, options, nil)
+		if err != nil {
+			return nil, err
+		}
+		gasPrice, err := bump("gasPrice", suggested, previous.GasPrice())
+		if err != nil {
+			return nil, err
+		}
+		if err = checkCap(gasPrice); err != nil {
+			return nil, err
+		}
+		if previous.Type() == types.AccessListTxType {
+			txData = &types.AccessListTx{
+				ChainID:    chain.ID(),
+				Nonce:      previous.Nonce(),
+				GasPrice:   gasPrice,
+				Gas:        gasLimit,
+				To:         to,
+				Value:      value,
+				Data:       data,
+				AccessList: accessList,
+			}
+		} else {
+			txData = &types.LegacyTx{
+				Nonce:    previous.Nonce(),
+				GasPrice: gasPrice,
+				Gas:      gasLimit,
+				To:       to,
+				Value:    value,
+				Data:     data,
+			}
+		}
+	default:
+		return nil, errors.New("unsupported transaction type")
+	}
+	return types.NewTx(txData), nil
+}
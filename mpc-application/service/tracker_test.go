@@ -0,0 +1,39 @@
+package service
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// A transaction is replaced by one speed up or cancel at a time.
+func TestConcurrentReplacementRefused(t *testing.T) {
+	t.Setenv("TRANSACTIONS_FILE", filepath.Join(t.TempDir(), "transactions.json"))
+	loadTracked()
+	trackedMtx.Lock()
+	tracked["0x01"] = &TrackedTransaction{ID: "0x01", State: Pending, Attempts: []Attempt{{Hash: "0x01", Kind: Original}}}
+	trackedMtx.Unlock()
+	defer func() {
+		trackedMtx.Lock()
+		delete(tracked, "0x01")
+		trackedMtx.Unlock()
+	}()
+
+	if _, err := beginReplacement("0x01"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := beginReplacement("0x01"); err == nil {
+		t.Fatal("second replacement started while the first is signed")
+	}
+	endReplacement("0x01")
+	if _, err := beginReplacement("0x01"); err != nil {
+		t.Errorf("replacement refused after the first ended: %v", err)
+	}
+	endReplacement("0x01")
+
+	trackedMtx.Lock()
+	tracked["0x01"].State = Mined
+	trackedMtx.Unlock()
+	if _, err := beginReplacement("0x01"); err == nil {
+		t.Error("mined transaction replaced")
+	}
+}
@@ -0,0 +1,107 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"strconv"
+
+	"mpc_poc/chains"
+	"mpc_poc/payload"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/koteld/multi-party-sig/pkg/party"
+)
+
+type SignedUserOperation struct {
+	UserOperation payload.UserOperation `json:"userOperation"`
+	UserOpHash    string                `json:"userOpHash"`
+	EntryPoint    string                `json:"entryPoint"`
+	ChainID       uint64                `json:"chainId"`
+	Signer        string                `json:"signer"`
+	Submitted     bool                  `json:"submitted"`
+}
+
+// SignUserOperation signs the userOpHash of op with the MPC key of address
+// and fills in the signature. Like SimpleAccount, the hash is signed with the
+// EIP-191 prefix unless raw is set. The chain is needed to submit the
+// operation to its bundler, chainID may be 0 to use the ID of the chain.
+func SignUserOperation(ids party.IDSlice, threshold int, address string, op payload.UserOperation, entryPoint string, chainName string, chainID uint64, raw bool, online bool, submit bool) (SignedUserOperation, error) {
+	if !common.IsHexAddress(entryPoint) {
+		return SignedUserOperation{}, errors.New("invalid entry point: " + entryPoint)
+	}
+	if op.Sender == (common.Address{}) {
+		return SignedUserOperation{}, errors.New("sender is required")
+	}
+
+	var chain *chains.Chain
+	if chainID == 0 || submit {
+		name := chainName
+		if name == "" && chainID != 0 {
+			name = strconv.FormatUint(chainID, 10)
+		}
+		var err error
+		if chain, err = chains.Get(name); err != nil {
+			return SignedUserOperation{}, err
+		}
+		if chainID == 0 {
+			chainID = chain.ChainID
+		} else if chain.ChainID != chainID {
+			return SignedUserOperation{}, errors.New("chain " + chain.Name + " does not have chain ID " + strconv.FormatUint(chainID, 10))
+		}
+	}
+
+	hash, err := payload.UserOperationHash(op, common.HexToAddress(entryPoint), new(big.Int).SetUint64(chainID))
+	if err != nil {
+		return SignedUserOperation{}, err
+	}
+	p, err := payload.NewUserOperation(op, common.HexToAddress(entryPoint), new(big.Int).SetUint64(chainID), raw)
+	if err != nil {
+		return SignedUserOperation{}, err
+	}
+	sig, err := signDigest(ids, threshold, address, p, online, "")
+	if err != nil {
+		return SignedUserOperation{}, err
+	}
+	sig[crypto.RecoveryIDOffset] += 27
+	op.Signature = sig
+
+	res := SignedUserOperation{
+		UserOperation: op,
+		UserOpHash:    hash.Hex(),
+		EntryPoint:    common.HexToAddress(entryPoint).Hex(),
+		ChainID:       chainID,
+		Signer:        common.HexToAddress(address).Hex(),
+	}
+	if submit {
+		if err = sendUserOperation(chain, op, res.EntryPoint, hash); err != nil {
+			return res, err
+		}
+		res.Submitted = true
+	}
+	return res, nil
+}
+
+// sendUserOperation submits op with eth_sendUserOperation to the bundler of
+// the chain and checks it returns the same userOpHash.
+func sendUserOperation(chain *chains.Chain, op payload.UserOperation, entryPoint string, hash common.Hash) error {
+	if chain.BundlerURL == "" {
+		return errors.New("no bundler configured for " + chain.Name)
+	}
+	client, err := rpc.DialContext(context.Background(), chain.BundlerURL)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	var returned common.Hash
+	if err = client.CallContext(context.Background(), &returned, "eth_sendUserOperation", op, entryPoint); err != nil {
+		return errors.New("bundler: " + err.Error())
+	}
+	if returned != hash {
+		return errors.New("bundler returned userOpHash " + returned.Hex() + " instead of " + hash.Hex())
+	}
+	return nil
+}
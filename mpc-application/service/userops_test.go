@@ -0,0 +1,107 @@
+package service
+
+import (
+	"bytes"
+	"errors"
+	"math/big"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"mpc_poc/chains"
+	"mpc_poc/payload"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+var entryPoint = common.HexToAddress("0x5FF137D4b0FDCD49DcA30c7CF57E578a026d2789")
+
+// bundler stands in for an ERC-4337 bundler of chain 1337. It answers
+// eth_sendUserOperation with the userOpHash of the operation, or with
+// returned if set.
+type bundler struct {
+	received []payload.UserOperation
+	returned *common.Hash
+	fail     bool
+}
+
+func (b *bundler) SendUserOperation(op payload.UserOperation, entryPoint common.Address) (common.Hash, error) {
+	if b.fail {
+		return common.Hash{}, errors.New("AA23 reverted")
+	}
+	b.received = append(b.received, op)
+	if b.returned != nil {
+		return *b.returned, nil
+	}
+	return payload.UserOperationHash(op, entryPoint, big.NewInt(1337))
+}
+
+func serveBundler(t *testing.T, b *bundler) *chains.Chain {
+	t.Helper()
+	server := rpc.NewServer()
+	if err := server.RegisterName("eth", b); err != nil {
+		t.Fatal(err)
+	}
+	s := httptest.NewServer(server)
+	t.Cleanup(func() {
+		s.Close()
+		server.Stop()
+	})
+	return &chains.Chain{Name: "dev", ChainID: 1337, BundlerURL: s.URL}
+}
+
+func signedUserOperation() payload.UserOperation {
+	return payload.UserOperation{
+		Sender:               common.HexToAddress("0x00000000000000000000000000000000000000c3"),
+		Nonce:                (*hexutil.Big)(big.NewInt(7)),
+		CallData:             hexutil.Bytes{0xb6, 0x1d, 0x27, 0xf6},
+		CallGasLimit:         (*hexutil.Big)(big.NewInt(100000)),
+		VerificationGasLimit: (*hexutil.Big)(big.NewInt(150000)),
+		PreVerificationGas:   (*hexutil.Big)(big.NewInt(50000)),
+		MaxFeePerGas:         (*hexutil.Big)(big.NewInt(2000000000)),
+		MaxPriorityFeePerGas: (*hexutil.Big)(big.NewInt(1000000000)),
+		Signature:            bytes.Repeat([]byte{1}, 65),
+	}
+}
+
+func TestSendUserOperation(t *testing.T) {
+	b := &bundler{}
+	chain := serveBundler(t, b)
+	op := signedUserOperation()
+	hash, err := payload.UserOperationHash(op, entryPoint, big.NewInt(1337))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = sendUserOperation(chain, op, entryPoint.Hex(), hash); err != nil {
+		t.Fatal(err)
+	}
+	if len(b.received) != 1 {
+		t.Fatalf("bundler got %d operations, want 1", len(b.received))
+	}
+	got := b.received[0]
+	if got.Sender != op.Sender || got.Nonce.ToInt().Cmp(op.Nonce.ToInt()) != 0 || !bytes.Equal(got.Signature, op.Signature) || !bytes.Equal(got.CallData, op.CallData) {
+		t.Errorf("bundler got %+v, want %+v", got, op)
+	}
+}
+
+func TestSendUserOperationChecksHash(t *testing.T) {
+	other := common.HexToHash("0x01")
+	chain := serveBundler(t, &bundler{returned: &other})
+	op := signedUserOperation()
+	hash, _ := payload.UserOperationHash(op, entryPoint, big.NewInt(1337))
+	if err := sendUserOperation(chain, op, entryPoint.Hex(), hash); err == nil || !strings.Contains(err.Error(), "instead of") {
+		t.Errorf("other userOpHash accepted: %v", err)
+	}
+
+	chain = serveBundler(t, &bundler{fail: true})
+	if err := sendUserOperation(chain, op, entryPoint.Hex(), hash); err == nil || !strings.Contains(err.Error(), "AA23") {
+		t.Errorf("bundler error not returned: %v", err)
+	}
+
+	if err := sendUserOperation(&chains.Chain{Name: "dev"}, op, entryPoint.Hex(), hash); err == nil {
+		t.Error("sent without a bundler")
+	}
+}
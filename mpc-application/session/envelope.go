@@ -0,0 +1,173 @@
+package session
+
+import (
+	"crypto/ecdsa"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"time"
+
+	"mpc_poc/helper"
+	"mpc_poc/models"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/joho/godotenv"
+	"github.com/koteld/multi-party-sig/pkg/party"
+)
+
+// signingKey signs the envelopes this participant sends.
+var signingKey *ecdsa.PrivateKey
+
+// peerKeys are the addresses of the keys every participant signs with.
+var peerKeys map[party.ID]common.Address
+
+// Init loads the key id signs its envelopes with from MESSAGE_KEY_FILE,
+// message-<id>.key by default, and the addresses of the keys of all
+// participants from MESSAGE_KEYS_FILE, message-keys.json by default. A
+// participant must not run without them, envelopes would be unauthenticated.
+func Init(id party.ID) error {
+	_ = godotenv.Load()
+	keyFile := helper.GetEnv("MESSAGE_KEY_FILE", "message-"+string(id)+".key")
+	key, err := crypto.LoadECDSA(keyFile)
+	if err != nil {
+		return errors.New("no message key in " + keyFile + ": " + err.Error())
+	}
+	address := crypto.PubkeyToAddress(key.PublicKey)
+	log.Printf("session: participant %s signs messages with %s\n", id, address.Hex())
+
+	keysFile := helper.GetEnv("MESSAGE_KEYS_FILE", "message-keys.json")
+	data, err := os.ReadFile(keysFile)
+	if err != nil {
+		return errors.New("no message keys of the participants: " + err.Error())
+	}
+	var keys map[party.ID]string
+	if err = json.Unmarshal(data, &keys); err != nil {
+		return errors.New("invalid " + keysFile + ": " + err.Error())
+	}
+	peers := make(map[party.ID]common.Address, len(keys))
+	for peer, key := range keys {
+		if !common.IsHexAddress(key) {
+			return errors.New("invalid message key of participant " + string(peer) + " in " + keysFile)
+		}
+		peers[peer] = common.HexToAddress(key)
+	}
+	if peers[id] != address {
+		return errors.New(keysFile + " doesn't list " + address.Hex() + " as the message key of participant " + string(id))
+	}
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	signingKey = key
+	peerKeys = peers
+	return nil
+}
+
+func writeField(h crypto.KeccakState, data []byte) {
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(data)))
+	h.Write(length[:])
+	h.Write(data)
+}
+
+// digest is the hash of everything the signature of an envelope covers.
+func digest(message *models.InternalMessage) []byte {
+	h := crypto.NewKeccakState()
+	writeField(h, []byte(message.SessionID))
+	writeField(h, []byte(message.From))
+	var header [10]byte
+	binary.BigEndian.PutUint16(header[0:2], message.Round)
+	binary.BigEndian.PutUint64(header[2:10], message.Sequence)
+	h.Write(header[:])
+	if message.Abort {
+		h.Write([]byte{1})
+	} else {
+		h.Write([]byte{0})
+	}
+	writeField(h, message.Message.Hash())
+	var res [32]byte
+	_, _ = h.Read(res[:])
+	return res[:]
+}
+
+// controlDigest is the hash of everything the signature of a control message
+// covers.
+func controlDigest(message *models.ControlMessage) []byte {
+	h := crypto.NewKeccakState()
+	writeField(h, []byte(message.Command))
+	writeField(h, []byte(message.From))
+	writeField(h, []byte(message.Freeze.ID))
+	writeField(h, []byte(message.Freeze.Address))
+	writeField(h, []byte(message.Freeze.Reason))
+	writeField(h, []byte(message.Freeze.By))
+	writeField(h, []byte(message.Freeze.At.UTC().Format(time.RFC3339Nano)))
+	for _, s := range message.Signatures {
+		writeField(h, []byte(s.Admin))
+		writeField(h, []byte(s.Signature))
+	}
+	var res [32]byte
+	_, _ = h.Read(res[:])
+	return res[:]
+}
+
+// SealControl signs a control message as from with the message key of this
+// node.
+func SealControl(message *models.ControlMessage, from party.ID) error {
+	mtx.Lock()
+	key := signingKey
+	mtx.Unlock()
+	if key == nil {
+		return errors.New("no message key to sign control messages with")
+	}
+	message.From = from
+	signature, err := crypto.Sign(controlDigest(message), key)
+	if err != nil {
+		return err
+	}
+	message.Signature = signature
+	return nil
+}
+
+// VerifyControl checks that a control message is signed by the message key
+// of its sender.
+func VerifyControl(message *models.ControlMessage) bool {
+	mtx.Lock()
+	expected, ok := peerKeys[message.From]
+	mtx.Unlock()
+	if !ok || len(message.Signature) != crypto.SignatureLength {
+		return false
+	}
+	publicKey, err := crypto.SigToPub(controlDigest(message), message.Signature)
+	return err == nil && crypto.PubkeyToAddress(*publicKey) == expected
+}
+
+func seal(message *models.InternalMessage) {
+	mtx.Lock()
+	key := signingKey
+	mtx.Unlock()
+	if key == nil {
+		log.Printf("session: no message key, sending an unsigned message in session %s\n", message.SessionID)
+		return
+	}
+	signature, err := crypto.Sign(digest(message), key)
+	if err != nil {
+		log.Printf("session: failed to sign a message in session %s: %v\n", message.SessionID, err)
+		return
+	}
+	message.Signature = signature
+}
+
+// verifySignature checks that the envelope is signed by the key of its
+// sender. Without message keys nothing is accepted.
+func verifySignature(message *models.InternalMessage) bool {
+	mtx.Lock()
+	expected, ok := peerKeys[message.From]
+	mtx.Unlock()
+	if !ok || len(message.Signature) != crypto.SignatureLength {
+		return false
+	}
+	publicKey, err := crypto.SigToPub(digest(message), message.Signature)
+	return err == nil && crypto.PubkeyToAddress(*publicKey) == expected
+}
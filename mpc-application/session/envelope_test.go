@@ -0,0 +1,136 @@
+package session
+
+import (
+	"crypto/ecdsa"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"mpc_poc/models"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/koteld/multi-party-sig/pkg/party"
+	"github.com/koteld/multi-party-sig/pkg/protocol"
+)
+
+// setupKeys provisions message keys for a and b and loads the one of id.
+func setupKeys(t *testing.T, id party.ID) map[party.ID]*ecdsa.PrivateKey {
+	t.Helper()
+	dir := t.TempDir()
+	keys := make(map[party.ID]*ecdsa.PrivateKey)
+	addresses := make(map[party.ID]string)
+	for _, peer := range []party.ID{"a", "b"} {
+		key, _ := crypto.GenerateKey()
+		keys[peer] = key
+		addresses[peer] = crypto.PubkeyToAddress(key.PublicKey).Hex()
+		if err := crypto.SaveECDSA(filepath.Join(dir, string(peer)+".key"), key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, _ := json.Marshal(addresses)
+	if err := os.WriteFile(filepath.Join(dir, "keys.json"), data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("MESSAGE_KEY_FILE", filepath.Join(dir, string(id)+".key"))
+	t.Setenv("MESSAGE_KEYS_FILE", filepath.Join(dir, "keys.json"))
+	if err := Init(id); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+	return keys
+}
+
+func envelope(from party.ID) *models.InternalMessage {
+	return &models.InternalMessage{
+		SessionID: "s1",
+		From:      from,
+		Round:     1,
+		Sequence:  1,
+		Message:   protocol.Message{SSID: []byte("s1"), From: from, Protocol: "test", RoundNumber: 1, Data: []byte("data")},
+	}
+}
+
+func TestSignedEnvelope(t *testing.T) {
+	setupKeys(t, "a")
+	message := envelope("a")
+	seal(message)
+	if !verifySignature(message) {
+		t.Fatal("own envelope rejected")
+	}
+	message.Sequence++
+	if verifySignature(message) {
+		t.Error("envelope with a changed sequence accepted")
+	}
+}
+
+// A participant can't send envelopes in the name of another one.
+func TestForgedSender(t *testing.T) {
+	keys := setupKeys(t, "a")
+	message := envelope("b")
+	message.Signature, _ = crypto.Sign(digest(message), keys["a"])
+	if verifySignature(message) {
+		t.Error("envelope of b signed by a accepted")
+	}
+	message.Signature, _ = crypto.Sign(digest(message), keys["b"])
+	if !verifySignature(message) {
+		t.Error("envelope of b signed by b rejected")
+	}
+	unknown := envelope("c")
+	unknown.Signature, _ = crypto.Sign(digest(unknown), keys["a"])
+	if verifySignature(unknown) {
+		t.Error("envelope of an unknown participant accepted")
+	}
+}
+
+func TestInitRequiresKeys(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("MESSAGE_KEY_FILE", filepath.Join(dir, "missing.key"))
+	t.Setenv("MESSAGE_KEYS_FILE", filepath.Join(dir, "keys.json"))
+	if err := Init("a"); err == nil {
+		t.Error("Init without a message key succeeded")
+	}
+
+	key, _ := crypto.GenerateKey()
+	_ = crypto.SaveECDSA(filepath.Join(dir, "a.key"), key)
+	t.Setenv("MESSAGE_KEY_FILE", filepath.Join(dir, "a.key"))
+	if err := Init("a"); err == nil {
+		t.Error("Init without the keys of the participants succeeded")
+	}
+	other, _ := crypto.GenerateKey()
+	data, _ := json.Marshal(map[string]string{"a": crypto.PubkeyToAddress(other.PublicKey).Hex()})
+	_ = os.WriteFile(filepath.Join(dir, "keys.json"), data, 0600)
+	if err := Init("a"); err == nil {
+		t.Error("Init with a key that isn't listed succeeded")
+	}
+}
+
+func TestSignedControlMessage(t *testing.T) {
+	keys := setupKeys(t, "a")
+	message := &models.ControlMessage{
+		Command: models.Freeze,
+		Freeze:  models.FreezeState{ID: "f1", Reason: "compromise", At: time.Now().UTC()},
+	}
+	if err := SealControl(message, "a"); err != nil {
+		t.Fatal(err)
+	}
+	// the signature survives the way through the transport
+	data, _ := json.Marshal(message)
+	received := &models.ControlMessage{}
+	if err := json.Unmarshal(data, received); err != nil {
+		t.Fatal(err)
+	}
+	if !VerifyControl(received) {
+		t.Fatal("signed control message rejected")
+	}
+
+	received.Freeze.Address = "0x00000000000000000000000000000000000000a1"
+	if VerifyControl(received) {
+		t.Error("control message with a narrowed freeze accepted")
+	}
+	forged := &models.ControlMessage{Command: models.Unfreeze, Freeze: models.FreezeState{ID: "f1"}, From: "a"}
+	forged.Signature, _ = crypto.Sign(controlDigest(forged), keys["b"])
+	if VerifyControl(forged) {
+		t.Error("control message of a signed by b accepted")
+	}
+}
@@ -1,27 +1,221 @@
 package session
 
 import (
+	"context"
+	"errors"
+	"log"
 	"strconv"
+	"sync"
 	"time"
 
+	"mpc_poc/helper"
 	"mpc_poc/models"
 
 	"github.com/koteld/multi-party-sig/pkg/party"
 	"github.com/koteld/multi-party-sig/pkg/protocol"
 )
 
-func SendMessage(msg *protocol.Message, ids party.IDSlice) {
+// roundWindow is how many rounds an incoming message may be away from the
+// round we last sent messages for.
+const roundWindow = 1
+
+const maxPendingSessions = 16
+const maxPendingMessages = 256
+const maxCompletedSessions = 1024
+
+type Rejection string
+
+const (
+	Malformed        Rejection = "malformed"
+	InvalidSignature Rejection = "signature"
+	UnknownSender    Rejection = "sender"
+	OutOfRound       Rejection = "round"
+	Duplicate        Rejection = "duplicate"
+	StaleSession     Rejection = "session"
+)
+
+var mtx sync.Mutex
+var rejections = make(map[Rejection]uint64)
+
+// parked are the messages of a session this participant has not started yet.
+type parked struct {
+	messages []*models.InternalMessage
+	since    time.Time
+}
+
+// pending holds messages of sessions this participant has not started yet.
+// Sessions it refuses or never runs expire after the session timeout, by
+// then their senders have left them.
+var pending = make(map[string]*parked)
+
+// completed remembers finished sessions so their messages can't be replayed.
+var completed = make(map[string]bool)
+var completedOrder = make([]string, 0, maxCompletedSessions)
+
+type seenKey struct {
+	from     party.ID
+	sequence uint64
+}
+
+type state struct {
+	id       party.ID
+	ids      party.IDSlice
+	round    uint16
+	sequence uint64
+	seen     map[seenKey]bool
+}
+
+func GetRejections() map[string]uint64 {
+	mtx.Lock()
+	defer mtx.Unlock()
+	res := make(map[string]uint64, len(rejections))
+	for reason, count := range rejections {
+		res[string(reason)] = count
+	}
+	return res
+}
+
+// Timeout is how long a participant stays in a session, SESSION_TIMEOUT
+// seconds, 900 by default. It must exceed APPROVAL_TIMEOUT if participants
+// wait for operators.
+func Timeout() time.Duration {
+	seconds, err := strconv.Atoi(helper.GetEnv("SESSION_TIMEOUT", "900"))
+	if err != nil || seconds <= 0 {
+		seconds = 900
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+func SendMessage(msg *protocol.Message, ids party.IDSlice, sessionID string, sequence uint64) {
+	internalMessage := models.InternalMessage{
+		SessionID: sessionID,
+		From:      msg.From,
+		Round:     uint16(msg.RoundNumber),
+		Sequence:  sequence,
+		Message:   *msg,
+	}
+	seal(&internalMessage)
 	for _, id := range ids {
 		if msg.IsFor(id) {
 			internalMessageOutput := models.GetInternalMessageOutputChannel(id)
-			internalMessage := models.InternalMessage{Message: *msg}
 			internalMessageOutput <- &internalMessage
 		}
 	}
 }
 
-func Loop(id party.ID, ids party.IDSlice, h protocol.Handler, sessionID string, protocol models.Protocol, ip string) {
+// park keeps a message of a session that has not started here yet. It returns
+// false if the message must be rejected instead.
+func park(message *models.InternalMessage) bool {
+	mtx.Lock()
+	defer mtx.Unlock()
+	if completed[message.SessionID] {
+		return false
+	}
+	now := time.Now()
+	for sessionID, p := range pending {
+		if now.Sub(p.since) > Timeout() {
+			delete(pending, sessionID)
+		}
+	}
+	p := pending[message.SessionID]
+	if p == nil {
+		if len(pending) >= maxPendingSessions {
+			return false
+		}
+		p = &parked{since: now}
+		pending[message.SessionID] = p
+	}
+	if len(p.messages) >= maxPendingMessages {
+		return false
+	}
+	p.messages = append(p.messages, message)
+	return true
+}
+
+// Abort tells the other parties of a session that id won't take part, so they
+// leave the session instead of waiting for its messages. A party that hasn't
+// started the session yet gets the abort once it does.
+func Abort(id party.ID, ids party.IDSlice, sessionID string, reason string) {
+	internalMessage := models.InternalMessage{
+		SessionID: sessionID,
+		From:      id,
+		Abort:     true,
+		Message:   protocol.Message{From: id, Data: []byte(reason)},
+	}
+	seal(&internalMessage)
+	for _, peer := range ids {
+		if peer != id {
+			internalMessageOutput := models.GetInternalMessageOutputChannel(peer)
+			internalMessageOutput <- &internalMessage
+		}
+	}
+	start(sessionID)
+	complete(sessionID)
+}
+
+func start(sessionID string) []*models.InternalMessage {
+	mtx.Lock()
+	defer mtx.Unlock()
+	p := pending[sessionID]
+	delete(pending, sessionID)
+	if p == nil {
+		return nil
+	}
+	return p.messages
+}
+
+func complete(sessionID string) {
+	mtx.Lock()
+	defer mtx.Unlock()
+	if completed[sessionID] {
+		return
+	}
+	if len(completedOrder) == maxCompletedSessions {
+		delete(completed, completedOrder[0])
+		completedOrder = completedOrder[1:]
+	}
+	completed[sessionID] = true
+	completedOrder = append(completedOrder, sessionID)
+}
+
+func (s *state) check(message *models.InternalMessage) (Rejection, bool) {
+	if message.From != message.Message.From || message.Round != uint16(message.Message.RoundNumber) {
+		return Malformed, false
+	}
+	if !verifySignature(message) {
+		return InvalidSignature, false
+	}
+	if message.From == s.id || !s.ids.Contains(message.From) {
+		return UnknownSender, false
+	}
+	// round 0 is an abort, which may arrive at any time
+	if message.Round != 0 {
+		expected := s.round
+		if expected < 1 {
+			expected = 1
+		}
+		if message.Round+roundWindow < expected || message.Round > expected+roundWindow {
+			return OutOfRound, false
+		}
+	}
+	key := seenKey{from: message.From, sequence: message.Sequence}
+	if s.seen[key] {
+		return Duplicate, false
+	}
+	s.seen[key] = true
+	return "", true
+}
+
+// Loop runs the session until the handler is done, another party aborts it or
+// ctx ends. An abort or the end of ctx is returned as error, the other
+// parties are told about the latter.
+func Loop(ctx context.Context, id party.ID, ids party.IDSlice, h protocol.Handler, sessionID string, protocol models.Protocol, ip string) error {
 	internalMessageInput := models.GetInternalMessageInputChannel(id)
+	s := &state{
+		id:   id,
+		ids:  ids,
+		seen: make(map[seenKey]bool),
+	}
 
 	logMessages := models.GetLogMessageOutputChannel()
 	logMessage := models.LogMessage{
@@ -34,11 +228,77 @@ func Loop(id party.ID, ids party.IDSlice, h protocol.Handler, sessionID string,
 	}
 	logMessages <- &logMessage
 
+	reject := func(internalMessage *models.InternalMessage, reason Rejection) {
+		mtx.Lock()
+		rejections[reason]++
+		mtx.Unlock()
+		log.Printf("session %s: rejected message from %s (session %s, round %d, sequence %d): %s\n",
+			sessionID, internalMessage.From, internalMessage.SessionID, internalMessage.Round, internalMessage.Sequence, reason)
+		logMessage := models.LogMessage{
+			Protocol:    protocol,
+			Participant: string(id),
+			Message:     "rejected message from: " + string(internalMessage.From) + " (" + string(reason) + ")",
+			SessionID:   sessionID,
+			Timestamp:   strconv.FormatInt(time.Now().Unix(), 10),
+			Round:       internalMessage.Round,
+			IP:          ip,
+		}
+		logMessages <- &logMessage
+	}
+
+	var aborted error
+	accept := func(internalMessage *models.InternalMessage) {
+		if reason, ok := s.check(internalMessage); !ok {
+			reject(internalMessage, reason)
+			return
+		}
+		if internalMessage.Abort {
+			aborted = errors.New("aborted by " + string(internalMessage.From) + ": " + string(internalMessage.Message.Data))
+			return
+		}
+		h.Accept(&internalMessage.Message)
+		logMessage := models.LogMessage{
+			Protocol:    protocol,
+			Participant: string(id),
+			Message:     "received message from: " + string(internalMessage.Message.From),
+			SessionID:   sessionID,
+			Timestamp:   strconv.FormatInt(time.Now().Unix(), 10),
+			Round:       uint16(internalMessage.Message.RoundNumber),
+			IP:          ip,
+		}
+		logMessages <- &logMessage
+	}
+
+	leave := func(err error) error {
+		complete(sessionID)
+		logMessage := models.LogMessage{
+			Protocol:    protocol,
+			Participant: string(id),
+			Message:     "left the session: " + err.Error(),
+			SessionID:   sessionID,
+			Timestamp:   strconv.FormatInt(time.Now().Unix(), 10),
+			IP:          ip,
+		}
+		logMessages <- &logMessage
+		return err
+	}
+
+	for _, internalMessage := range start(sessionID) {
+		accept(internalMessage)
+	}
+
 	for {
+		if aborted != nil {
+			return leave(aborted)
+		}
 		select {
+		case <-ctx.Done():
+			Abort(id, ids, sessionID, "no result within the session timeout")
+			return leave(ctx.Err())
 		// outgoing messages
 		case msg, ok := <-h.Listen():
 			if !ok {
+				complete(sessionID)
 				logMessage = models.LogMessage{
 					Protocol:    protocol,
 					Participant: string(id),
@@ -48,8 +308,12 @@ func Loop(id party.ID, ids party.IDSlice, h protocol.Handler, sessionID string,
 					IP:          ip,
 				}
 				logMessages <- &logMessage
-				return
+				return nil
 			}
+			if uint16(msg.RoundNumber) > s.round {
+				s.round = uint16(msg.RoundNumber)
+			}
+			s.sequence++
 			var to string
 			if len(string(msg.To)) > 0 {
 				to = string(msg.To)
@@ -66,20 +330,18 @@ func Loop(id party.ID, ids party.IDSlice, h protocol.Handler, sessionID string,
 				IP:          ip,
 			}
 			logMessages <- &logMessage
-			go SendMessage(msg, ids)
+			go SendMessage(msg, ids, sessionID, s.sequence)
 		// incoming messages
 		case internalMessage := <-internalMessageInput:
-			h.Accept(&internalMessage.Message)
-			logMessage = models.LogMessage{
-				Protocol:    protocol,
-				Participant: string(id),
-				Message:     "received message from: " + string(internalMessage.Message.From),
-				SessionID:   sessionID,
-				Timestamp:   strconv.FormatInt(time.Now().Unix(), 10),
-				Round:       uint16(internalMessage.Message.RoundNumber),
-				IP:          ip,
+			if internalMessage.SessionID != sessionID {
+				if !verifySignature(internalMessage) {
+					reject(internalMessage, InvalidSignature)
+				} else if !park(internalMessage) {
+					reject(internalMessage, StaleSession)
+				}
+				continue
 			}
-			logMessages <- &logMessage
+			accept(internalMessage)
 		}
 	}
 }
@@ -0,0 +1,138 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"mpc_poc/models"
+
+	"github.com/koteld/multi-party-sig/pkg/math/curve"
+	"github.com/koteld/multi-party-sig/pkg/party"
+	"github.com/koteld/multi-party-sig/pkg/pool"
+	"github.com/koteld/multi-party-sig/pkg/protocol"
+	"github.com/koteld/multi-party-sig/protocols/cmp"
+	natsserver "github.com/nats-io/nats-server/v2/test"
+)
+
+// TestMain runs the messages of the tests through an embedded NATS server.
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "session")
+	if err != nil {
+		panic(err)
+	}
+	opts := natsserver.DefaultTestOptions
+	opts.Port = -1
+	opts.JetStream = true
+	opts.StoreDir = dir
+	s := natsserver.RunServer(&opts)
+	_ = os.Setenv("MESSAGING_TRANSPORT", "nats")
+	_ = os.Setenv("NATS_URL", s.ClientURL())
+	code := m.Run()
+	s.Shutdown()
+	_ = os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func keygen(t *testing.T, id party.ID, ids party.IDSlice, sessionID string) *protocol.MultiHandler {
+	t.Helper()
+	pl := pool.NewPool(1)
+	t.Cleanup(pl.TearDown)
+	h, err := protocol.NewMultiHandler(cmp.Keygen(curve.Secp256k1{}, id, ids, 1, pl), []byte(sessionID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+// A party that refuses a session aborts it, so the others don't wait for its
+// messages.
+func TestLoopAbortedByRefusingParty(t *testing.T) {
+	keys := setupKeys(t, "b")
+	ids := party.NewIDSlice([]party.ID{"a", "b"})
+	h := keygen(t, "b", ids, "refused")
+
+	done := make(chan error, 1)
+	go func() {
+		done <- Loop(context.Background(), "b", ids, h, "refused", models.DKG, "")
+	}()
+	// a refuses, the test process signs its abort with the key of a
+	mtx.Lock()
+	signingKey = keys["a"]
+	mtx.Unlock()
+	Abort("a", ids, "refused", "refused by policy: value too high")
+
+	select {
+	case err := <-done:
+		if err == nil || !strings.Contains(err.Error(), "aborted by a: refused by policy") {
+			t.Errorf("Loop returned %v, want the abort of a", err)
+		}
+	case <-time.After(30 * time.Second):
+		t.Fatal("Loop didn't return after the abort")
+	}
+	if park(&models.InternalMessage{SessionID: "refused"}) {
+		t.Error("message of an aborted session parked")
+	}
+}
+
+// A session that gets no messages ends with its deadline, and the other
+// parties are told.
+func TestLoopDeadline(t *testing.T) {
+	setupKeys(t, "b")
+	ids := party.NewIDSlice([]party.ID{"a", "b"})
+	h := keygen(t, "b", ids, "deadline")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err := Loop(ctx, "b", ids, h, "deadline", models.DKG, "")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Loop returned %v, want the deadline", err)
+	}
+
+	input := models.GetInternalMessageInputChannel("a")
+	timeout := time.After(30 * time.Second)
+	for {
+		select {
+		case message := <-input:
+			if message.SessionID == "deadline" && message.Abort {
+				if !verifySignature(message) {
+					t.Error("abort isn't signed by b")
+				}
+				return
+			}
+		case <-timeout:
+			t.Fatal("a got no abort")
+		}
+	}
+}
+
+// Sessions that never start here don't keep their parking slot.
+func TestParkedSessionsExpire(t *testing.T) {
+	t.Setenv("SESSION_TIMEOUT", "1")
+	mtx.Lock()
+	pending = make(map[string]*parked)
+	mtx.Unlock()
+	for i := 0; i < maxPendingSessions; i++ {
+		if !park(&models.InternalMessage{SessionID: "never-" + strconv.Itoa(i)}) {
+			t.Fatalf("session %d not parked", i)
+		}
+	}
+	if park(&models.InternalMessage{SessionID: "next"}) {
+		t.Fatal("parked more than maxPendingSessions sessions")
+	}
+	mtx.Lock()
+	for _, p := range pending {
+		p.since = p.since.Add(-2 * time.Second)
+	}
+	mtx.Unlock()
+	if !park(&models.InternalMessage{SessionID: "next"}) {
+		t.Fatal("expired sessions still block new ones")
+	}
+	if messages := start("next"); len(messages) != 1 {
+		t.Errorf("started with %d parked messages, want 1", len(messages))
+	}
+}
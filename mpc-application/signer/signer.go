@@ -0,0 +1,434 @@
+package signer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"mpc_poc/chains"
+	"mpc_poc/helper"
+	"mpc_poc/service"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/ethereum/go-ethereum/signer/core/apitypes"
+	"github.com/koteld/multi-party-sig/pkg/party"
+)
+
+// version is the external API version of Clef the server implements.
+const version = "6.0.0"
+
+const (
+	invalidRequest = -32600
+	invalidParams  = -32602
+	internalError  = -32603
+	signerError    = -32000
+)
+
+type request struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+type response struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *Error          `json:"error,omitempty"`
+}
+
+type Error struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// SignTransactionResult is the result of account_signTransaction.
+type SignTransactionResult struct {
+	Raw hexutil.Bytes      `json:"raw"`
+	Tx  *types.Transaction `json:"tx"`
+}
+
+// Server is a JSON-RPC endpoint compatible with Clef, the external signer of
+// geth. Signing methods use the MPC keys of the participants, every other
+// method is forwarded to the node of SIGNER_CHAIN, the default chain if
+// empty.
+type Server struct {
+	ids party.IDSlice
+}
+
+func NewServer(ids party.IDSlice) *Server {
+	return &Server{ids: ids}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var body json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		_ = json.NewEncoder(w).Encode(response{JSONRPC: "2.0", ID: json.RawMessage("null"), Error: &Error{Code: invalidRequest, Message: err.Error()}})
+		return
+	}
+
+	f := &forwarder{}
+	defer f.close()
+
+	body = bytes.TrimSpace(body)
+	if len(body) > 0 && body[0] == '[' {
+		var requests []request
+		if err := json.Unmarshal(body, &requests); err != nil {
+			_ = json.NewEncoder(w).Encode(response{JSONRPC: "2.0", ID: json.RawMessage("null"), Error: &Error{Code: invalidRequest, Message: err.Error()}})
+			return
+		}
+		responses := make([]response, 0, len(requests))
+		for _, req := range requests {
+			if res, ok := s.handle(r.Context(), f, req); ok {
+				responses = append(responses, res)
+			}
+		}
+		_ = json.NewEncoder(w).Encode(responses)
+		return
+	}
+
+	var req request
+	if err := json.Unmarshal(body, &req); err != nil {
+		_ = json.NewEncoder(w).Encode(response{JSONRPC: "2.0", ID: json.RawMessage("null"), Error: &Error{Code: invalidRequest, Message: err.Error()}})
+		return
+	}
+	if res, ok := s.handle(r.Context(), f, req); ok {
+		_ = json.NewEncoder(w).Encode(res)
+	}
+}
+
+// handle answers a single request. Notifications, requests without ID, get no
+// response.
+func (s *Server) handle(ctx context.Context, f *forwarder, req request) (response, bool) {
+	res := response{JSONRPC: "2.0", ID: req.ID}
+
+	var params []json.RawMessage
+	if len(req.Params) > 0 && string(req.Params) != "null" {
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			res.Error = &Error{Code: invalidParams, Message: "params must be an array"}
+			return res, req.ID != nil
+		}
+	}
+
+	var result interface{}
+	var err error
+	switch req.Method {
+	case "account_version":
+		result = version
+	case "account_list", "eth_accounts":
+		result, err = s.accounts()
+	case "account_signTransaction":
+		result, err = s.signTransaction(params)
+	case "account_signData":
+		result, err = s.signData(params)
+	case "eth_sendTransaction":
+		result, err = s.sendTransaction(params)
+	case "eth_sign":
+		result, err = s.sign(params)
+	case "eth_signTypedData_v4":
+		result, err = s.signTypedData(params)
+	default:
+		var raw json.RawMessage
+		raw, err = f.forward(ctx, req.Method, params)
+		result = raw
+	}
+
+	if err != nil {
+		var rpcErr *Error
+		if !errors.As(err, &rpcErr) {
+			rpcErr = &Error{Code: signerError, Message: err.Error()}
+		}
+		log.Printf("signer: %s failed: %v\n", req.Method, err)
+		res.Error = rpcErr
+		return res, req.ID != nil
+	}
+	res.Result, err = json.Marshal(result)
+	if err != nil {
+		res.Error = &Error{Code: internalError, Message: err.Error()}
+	}
+	return res, req.ID != nil
+}
+
+func argument(params []json.RawMessage, i int, v interface{}) error {
+	if i >= len(params) {
+		return &Error{Code: invalidParams, Message: "missing value for required argument " + strconv.Itoa(i)}
+	}
+	if err := json.Unmarshal(params[i], v); err != nil {
+		return &Error{Code: invalidParams, Message: "invalid argument " + strconv.Itoa(i) + ": " + err.Error()}
+	}
+	return nil
+}
+
+// accounts returns the addresses all participants have a key for.
+func (s *Server) accounts() ([]common.Address, error) {
+	res := make([]common.Address, 0)
+	seen := make(map[common.Address]bool)
+	for _, config := range service.GetConfigs(s.ids) {
+		address := common.HexToAddress(config.Address)
+		if !seen[address] {
+			seen[address] = true
+			res = append(res, address)
+		}
+	}
+	return res, nil
+}
+
+// account returns the address as the participants know it.
+func (s *Server) account(address common.Address) (string, error) {
+	for _, config := range service.GetConfigs(s.ids) {
+		if common.HexToAddress(config.Address) == address {
+			return config.Address, nil
+		}
+	}
+	return "", &Error{Code: signerError, Message: "unknown account " + address.Hex()}
+}
+
+// signPersonal signs data with the EIP-191 prefix with the key of address.
+func (s *Server) signPersonal(address common.Address, data []byte) (hexutil.Bytes, error) {
+	from, err := s.account(address)
+	if err != nil {
+		return nil, err
+	}
+	res, err := service.SignPersonal(s.ids, 0, from, data, false)
+	if err != nil {
+		return nil, err
+	}
+	return hexutil.Decode(res.Signature)
+}
+
+func defaultChain() (*chains.Chain, error) {
+	return chains.Get(helper.GetEnv("SIGNER_CHAIN", ""))
+}
+
+// signTransaction signs a complete transaction as account_signTransaction
+// of Clef. The chain ID defaults to SIGNER_CHAIN.
+func (s *Server) signTransaction(params []json.RawMessage) (*SignTransactionResult, error) {
+	var args apitypes.SendTxArgs
+	if err := argument(params, 0, &args); err != nil {
+		return nil, err
+	}
+	if args.Gas == 0 || args.GasPrice == nil && args.MaxFeePerGas == nil {
+		return nil, &Error{Code: invalidParams, Message: "gas and gasPrice or maxFeePerGas are required"}
+	}
+	if args.ChainID == nil {
+		chain, err := defaultChain()
+		if err != nil {
+			return nil, err
+		}
+		args.ChainID = (*hexutil.Big)(chain.ID())
+	}
+	from, err := s.account(args.From.Address())
+	if err != nil {
+		return nil, err
+	}
+
+	signedTx, err := service.SignTransaction(s.ids, 0, from, false, args.ChainID.ToInt(), args.ToTransaction())
+	if err != nil {
+		return nil, err
+	}
+	raw, err := signedTx.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return &SignTransactionResult{Raw: raw, Tx: signedTx}, nil
+}
+
+// sendTransaction fills in the gas and fees like /contracts/call, signs and
+// sends the transaction and returns its hash. A given nonce must match the
+// nonce the API allocates.
+func (s *Server) sendTransaction(params []json.RawMessage) (common.Hash, error) {
+	var args apitypes.SendTxArgs
+	if err := argument(params, 0, &args); err != nil {
+		return common.Hash{}, err
+	}
+	var fields map[string]json.RawMessage
+	_ = json.Unmarshal(params[0], &fields)
+
+	chainName := helper.GetEnv("SIGNER_CHAIN", "")
+	if args.ChainID != nil {
+		chainName = args.ChainID.ToInt().String()
+	}
+	from, err := s.account(args.From.Address())
+	if err != nil {
+		return common.Hash{}, err
+	}
+
+	options := service.FeeOptions{GasLimit: uint64(args.Gas)}
+	if args.AccessList != nil {
+		options.Type = service.AccessListTxType
+		options.AccessList = *args.AccessList
+	}
+	if args.MaxFeePerGas != nil || args.MaxPriorityFeePerGas != nil {
+		options.Strategy = service.Explicit
+		options.Type = service.DynamicFeeTxType
+		if args.MaxFeePerGas != nil {
+			options.MaxFeePerGas = args.MaxFeePerGas.ToInt().String()
+		}
+		if args.MaxPriorityFeePerGas != nil {
+			options.MaxPriorityFeePerGas = args.MaxPriorityFeePerGas.ToInt().String()
+		}
+	} else if args.GasPrice != nil {
+		options.Strategy = service.Explicit
+		if options.Type == "" {
+			options.Type = service.LegacyTxType
+		}
+		options.GasPrice = args.GasPrice.ToInt().String()
+	}
+
+	var to *common.Address
+	if args.To != nil {
+		address := args.To.Address()
+		to = &address
+	}
+	var data []byte
+	if args.Input != nil {
+		data = *args.Input
+	} else if args.Data != nil {
+		data = *args.Data
+	}
+	var nonce *uint64
+	if _, ok := fields["nonce"]; ok {
+		n := uint64(args.Nonce)
+		nonce = &n
+	}
+
+	res, err := service.SendTransaction(s.ids, 0, chainName, from, to, data, args.Value.ToInt().String(), nonce, false, options)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	return common.HexToHash(res.Hash), nil
+}
+
+// sign implements eth_sign, the data is signed with the EIP-191 prefix.
+func (s *Server) sign(params []json.RawMessage) (hexutil.Bytes, error) {
+	var address common.Address
+	var data hexutil.Bytes
+	if err := argument(params, 0, &address); err != nil {
+		return nil, err
+	}
+	if err := argument(params, 1, &data); err != nil {
+		return nil, err
+	}
+	return s.signPersonal(address, data)
+}
+
+func (s *Server) signTypedData(params []json.RawMessage) (hexutil.Bytes, error) {
+	var address common.Address
+	if err := argument(params, 0, &address); err != nil {
+		return nil, err
+	}
+	if len(params) < 2 {
+		return nil, &Error{Code: invalidParams, Message: "missing value for required argument 1"}
+	}
+	typedData, err := service.ParseTypedData(params[1])
+	if err != nil {
+		return nil, &Error{Code: invalidParams, Message: err.Error()}
+	}
+	from, err := s.account(address)
+	if err != nil {
+		return nil, err
+	}
+	res, err := service.SignTypedData(s.ids, 0, from, typedData, false)
+	if err != nil {
+		return nil, err
+	}
+	return hexutil.Decode(res.Signature)
+}
+
+// signData implements account_signData for text/plain and data/typed.
+func (s *Server) signData(params []json.RawMessage) (hexutil.Bytes, error) {
+	var contentType string
+	var address common.MixedcaseAddress
+	if err := argument(params, 0, &contentType); err != nil {
+		return nil, err
+	}
+	if err := argument(params, 1, &address); err != nil {
+		return nil, err
+	}
+
+	switch contentType {
+	case apitypes.TextPlain.Mime:
+		var text string
+		if err := argument(params, 2, &text); err != nil {
+			return nil, err
+		}
+		data := []byte(text)
+		if strings.HasPrefix(text, "0x") {
+			decoded, err := hexutil.Decode(text)
+			if err != nil {
+				return nil, &Error{Code: invalidParams, Message: err.Error()}
+			}
+			data = decoded
+		}
+		return s.signPersonal(address.Address(), data)
+	case apitypes.DataTyped.Mime:
+		if len(params) < 3 {
+			return nil, &Error{Code: invalidParams, Message: "missing value for required argument 2"}
+		}
+		return s.signTypedData(params[1:3])
+	}
+	return nil, &Error{Code: invalidParams, Message: "unsupported content type " + contentType}
+}
+
+// forwarder dials the upstream node once per HTTP request, on first use.
+type forwarder struct {
+	client *rpc.Client
+}
+
+func (f *forwarder) forward(ctx context.Context, method string, params []json.RawMessage) (json.RawMessage, error) {
+	if f.client == nil {
+		chain, err := defaultChain()
+		if err != nil {
+			return nil, err
+		}
+		f.client, err = chain.Dial(ctx)
+		if err != nil {
+			return nil, &Error{Code: internalError, Message: "upstream node is not available: " + err.Error()}
+		}
+	}
+
+	args := make([]interface{}, len(params))
+	for i, param := range params {
+		args[i] = param
+	}
+	var result json.RawMessage
+	err := f.client.CallContext(ctx, &result, method, args...)
+	if err != nil {
+		res := &Error{Code: internalError, Message: err.Error()}
+		var rpcErr rpc.Error
+		if errors.As(err, &rpcErr) {
+			res.Code = rpcErr.ErrorCode()
+		}
+		var dataErr rpc.DataError
+		if errors.As(err, &dataErr) {
+			res.Data = dataErr.ErrorData()
+		}
+		return nil, res
+	}
+	if result == nil {
+		result = json.RawMessage("null")
+	}
+	return result, nil
+}
+
+func (f *forwarder) close() {
+	if f.client != nil {
+		f.client.Close()
+	}
+}
@@ -184,7 +184,7 @@ function App() {
     
     sendETH(configAddress, address, amount).then((res) => {
       if (!res.error) {
-        setTxLink(`https://goerli.etherscan.io/tx/${res.data}`)
+        setTxLink(`https://goerli.etherscan.io/tx/${res.data.hash}`)
         
         setSnackbarSeverity(SEVERITIES.SUCCESS)
         setSnackbarMessage("ETH amount was successfully sent")